@@ -1,4 +1,4 @@
-// +build !linux
+// +build !linux !cgo
 
 package capture
 
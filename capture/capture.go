@@ -2,16 +2,17 @@ package capture
 
 import (
 	"context"
-	"errors"
 	"expvar"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"os"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -21,7 +22,6 @@ import (
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 )
 
 var stats *expvar.Map
@@ -35,7 +35,7 @@ func init() {
 type PacketHandler func(*tcp.Packet)
 
 type PcapStatProvider interface {
-	Stats() (*pcap.Stats, error)
+	Stats() (*Stats, error)
 }
 
 // PcapOptions options that can be set on a pcap capture handle,
@@ -48,15 +48,21 @@ type PcapOptions struct {
 	Promiscuous   bool          `json:"input-raw-promisc"`
 	Monitor       bool          `json:"input-raw-monitor"`
 	Snaplen       bool          `json:"input-raw-override-snaplen"`
+
+	// pcap_file engine replays packets at their recorded timing, these options control the pacing
+	PcapFileLoop    bool          `json:"input-raw-pcap-loop"`
+	PcapFileMaxWait time.Duration `json:"input-raw-pcap-max-wait"`
+	PcapFilePace    bool          `json:"input-raw-pcap-pace"`
 }
 
 // Listener handle traffic capture, this is its representation.
 type Listener struct {
+	speedFactor uint64 // math.Float64bits of pcap file replay speed, first for atomic alignment
 	sync.Mutex
 	Transport  string       // transport layer default to tcp
 	Activate   func() error // function is used to activate the engine. it must be called before reading packets
 	Handles    map[string]packetHandle
-	Interfaces []pcap.Interface
+	Interfaces []Interface
 	loopIndex  int
 	Reading    chan bool // this channel is closed when the listener has started reading packets
 	PcapOptions
@@ -68,7 +74,13 @@ type Listener struct {
 	messages        chan *tcp.Message
 	protocol        tcp.TCPProtocol
 
-	host string // pcap file name or interface (name, hardware addr, index or ip address)
+	host      string         // pcap file name or interface (name, hardware addr, index or ip address)
+	tlsKeyLog *tcp.TLSKeyLog // TLS connections are decrypted when set
+	framer    Framer         // delimits messages instead of the protocol hints when set
+
+	portProtocols map[uint16]tcp.TCPProtocol // protocols of the ports which differ from the listener protocol
+
+	connectionHandler tcp.ConnectionHandler
 
 	closeDone chan struct{}
 	quit      chan struct{}
@@ -148,6 +160,7 @@ func NewListener(host string, ports []uint16, transport string, engine EngineTyp
 	l.allowIncomplete = allowIncomplete
 	l.protocol = protocol
 	l.messages = make(chan *tcp.Message, 10000)
+	l.SetSpeedFactor(1)
 
 	switch engine {
 	default:
@@ -178,6 +191,46 @@ func (l *Listener) SetPcapOptions(opts PcapOptions) {
 	l.PcapOptions = opts
 }
 
+// SetSpeedFactor sets the speed of replaying pcap files relative to the recorded timing,
+// for example 2 replays packets twice as fast. It can be called while the listener is reading.
+func (l *Listener) SetSpeedFactor(factor float64) {
+	atomic.StoreUint64(&l.speedFactor, math.Float64bits(factor))
+}
+
+// SetPortProtocols sets protocols of the server ports, connections of other ports use the listener protocol.
+// It must be set before reading packets
+func (l *Listener) SetPortProtocols(protocols map[uint16]tcp.TCPProtocol) {
+	l.portProtocols = protocols
+}
+
+// PortProtocol returns the protocol of the connection of the packet
+func (l *Listener) PortProtocol(pckt *tcp.Packet) tcp.TCPProtocol {
+	// the server port is the destination of requests, and the source of responses
+	if protocol, ok := l.portProtocols[pckt.DstPort]; ok {
+		return protocol
+	}
+	if protocol, ok := l.portProtocols[pckt.SrcPort]; ok {
+		return protocol
+	}
+	return l.protocol
+}
+
+// SetFramer sets the framer which delimits messages instead of the protocol, it must be set before reading packets
+func (l *Listener) SetFramer(framer Framer) {
+	l.framer = framer
+}
+
+// SetTLSKeyLog sets the key log used to decrypt TLS connections, it must be set before reading packets
+func (l *Listener) SetTLSKeyLog(keyLog *tcp.TLSKeyLog) {
+	l.tlsKeyLog = keyLog
+}
+
+// SetConnectionHandler sets the handler which is called with stats of closed TCP connections,
+// it must be set before reading packets
+func (l *Listener) SetConnectionHandler(handler tcp.ConnectionHandler) {
+	l.connectionHandler = handler
+}
+
 // Listen listens for packets from the handles, and call handler on every packet received
 // until the context done signal is sent or there is unrecoverable error on all handles.
 // this function must be called after activating pcap handles
@@ -208,7 +261,7 @@ func (l *Listener) ListenBackground(ctx context.Context) chan error {
 
 // Filter returns automatic filter applied by goreplay
 // to a pcap handle of a specific interface
-func (l *Listener) Filter(ifi pcap.Interface) (filter string) {
+func (l *Listener) Filter(ifi Interface) (filter string) {
 	// https://www.tcpdump.org/manpages/pcap-filter.7.html
 
 	hosts := []string{l.host}
@@ -241,88 +294,8 @@ func (l *Listener) Filter(ifi pcap.Interface) (filter string) {
 	return
 }
 
-// PcapHandle returns new pcap Handle from dev on success.
-// this function should be called after setting all necessary options for this listener
-func (l *Listener) PcapHandle(ifi pcap.Interface) (handle *pcap.Handle, err error) {
-	var inactive *pcap.InactiveHandle
-	inactive, err = pcap.NewInactiveHandle(ifi.Name)
-	if err != nil {
-		return nil, fmt.Errorf("inactive handle error: %q, interface: %q", err, ifi.Name)
-	}
-	defer inactive.CleanUp()
-
-	if l.TimestampType != "" && l.TimestampType != "go" {
-		var ts pcap.TimestampSource
-		ts, err = pcap.TimestampSourceFromString(l.TimestampType)
-		fmt.Println("Setting custom Timestamp Source. Supported values: `go`, ", inactive.SupportedTimestamps())
-		err = inactive.SetTimestampSource(ts)
-		if err != nil {
-			return nil, fmt.Errorf("%q: supported timestamps: %q, interface: %q", err, inactive.SupportedTimestamps(), ifi.Name)
-		}
-	}
-	if l.Promiscuous {
-		if err = inactive.SetPromisc(l.Promiscuous); err != nil {
-			return nil, fmt.Errorf("promiscuous mode error: %q, interface: %q", err, ifi.Name)
-		}
-	}
-	if l.Monitor {
-		if err = inactive.SetRFMon(l.Monitor); err != nil && !errors.Is(err, pcap.CannotSetRFMon) {
-			return nil, fmt.Errorf("monitor mode error: %q, interface: %q", err, ifi.Name)
-		}
-	}
-
-	var snap int
-
-	if !l.Snaplen {
-		infs, _ := net.Interfaces()
-		for _, i := range infs {
-			if i.Name == ifi.Name {
-				snap = i.MTU + 200
-			}
-		}
-	}
-
-	if snap == 0 {
-		snap = 64<<10 + 200
-	}
-
-	err = inactive.SetSnapLen(snap)
-	if err != nil {
-		return nil, fmt.Errorf("snapshot length error: %q, interface: %q", err, ifi.Name)
-	}
-	if l.BufferSize > 0 {
-		err = inactive.SetBufferSize(int(l.BufferSize))
-		if err != nil {
-			return nil, fmt.Errorf("handle buffer size error: %q, interface: %q", err, ifi.Name)
-		}
-	}
-	if l.BufferTimeout == 0 {
-		l.BufferTimeout = 2000 * time.Millisecond
-	}
-	err = inactive.SetTimeout(l.BufferTimeout)
-	if err != nil {
-		return nil, fmt.Errorf("handle buffer timeout error: %q, interface: %q", err, ifi.Name)
-	}
-	handle, err = inactive.Activate()
-	if err != nil {
-		return nil, fmt.Errorf("PCAP Activate device error: %q, interface: %q", err, ifi.Name)
-	}
-
-	bpfFilter := l.BPFFilter
-	if bpfFilter == "" {
-		bpfFilter = l.Filter(ifi)
-	}
-	fmt.Println("Interface:", ifi.Name, ". BPF Filter:", bpfFilter)
-	err = handle.SetBPFFilter(bpfFilter)
-	if err != nil {
-		handle.Close()
-		return nil, fmt.Errorf("BPF filter error: %q%s, interface: %q", err, bpfFilter, ifi.Name)
-	}
-	return
-}
-
 // SocketHandle returns new unix ethernet handle associated with this listener settings
-func (l *Listener) SocketHandle(ifi pcap.Interface) (handle Socket, err error) {
+func (l *Listener) SocketHandle(ifi Interface) (handle Socket, err error) {
 	handle, err = NewSocket(ifi)
 	if err != nil {
 		return nil, fmt.Errorf("sock raw error: %q, interface: %q", err, ifi.Name)
@@ -363,6 +336,114 @@ func http1EndHint(m *tcp.Message) bool {
 	return proto.HasFullPayload(m, m.PacketData()...)
 }
 
+func http1SplitHint(m *tcp.Message) int {
+	// continuation of a message captured without its beginning is not split
+	if !proto.HasTitle(m.Packets()[0].Payload) {
+		return -1
+	}
+
+	return proto.MessageLength(m, m.PacketData()...)
+}
+
+// http1UpgradeHint switches the connection to WebSocket after the response which accepts the upgrade,
+// or after the request when responses are not captured
+func (l *Listener) http1UpgradeHint(m *tcp.Message) bool {
+	data := m.Packets()[0].Payload
+	if !proto.IsWebSocketUpgrade(data) {
+		return false
+	}
+	return proto.HasResponseTitle(data) || !l.trackResponse
+}
+
+func websocketFrameHint(m *tcp.Message) int {
+	return proto.WebSocketFrameLength(m.PacketData()...)
+}
+
+// serverPortStartHint tells requests from responses by the port of the server, it is used by protocols
+// which messages of both directions can start with the same bytes, like redis, postgres and mysql
+func (l *Listener) serverPortStartHint(pckt *tcp.Packet) (isRequest, isResponse bool) {
+	return serverPortStart(l.ports, pckt)
+}
+
+func serverPortStart(ports []uint16, pckt *tcp.Packet) (isRequest, isResponse bool) {
+	if len(pckt.Payload) == 0 {
+		return false, false
+	}
+	for _, port := range ports {
+		if port == 0 {
+			break
+		}
+		if pckt.DstPort == port {
+			return true, false
+		}
+		if pckt.SrcPort == port {
+			return false, true
+		}
+	}
+	// without known ports, the server is expected to listen on the lower port
+	return pckt.DstPort < pckt.SrcPort, pckt.SrcPort < pckt.DstPort
+}
+
+func redisEndHint(m *tcp.Message) bool {
+	if m.MissingChunk() {
+		return false
+	}
+
+	return redisLength(m) == m.Length
+}
+
+// redisLength returns the length of the first RESP value of the message, pipelined commands are split by it
+func redisLength(m *tcp.Message) int {
+	// only clients can send inline commands, otherwise the message is captured without its beginning
+	data := m.Packets()[0].Payload
+	if m.Direction != tcp.DirIncoming && (len(data) == 0 || !proto.IsRESPType(data[0])) {
+		return -1
+	}
+
+	return proto.RESPLength(m.PacketData()...)
+}
+
+func postgresEndHint(m *tcp.Message) bool {
+	if m.MissingChunk() {
+		return false
+	}
+
+	return postgresLength(m) == m.Length
+}
+
+// postgresLength returns the length of the first request or response of the message, pipelined ones are split by it
+func postgresLength(m *tcp.Message) int {
+	return proto.PostgresLength(m, m.Direction == tcp.DirIncoming, m.PacketData()...)
+}
+
+func mysqlEndHint(m *tcp.Message) bool {
+	if m.MissingChunk() {
+		return false
+	}
+
+	return mysqlLength(m) == m.Length
+}
+
+// mysqlLength returns the length of the first command or response of the message, pipelined ones are split by it
+func mysqlLength(m *tcp.Message) int {
+	return proto.MySQLLength(m, m.Direction == tcp.DirIncoming, m.PacketData()...)
+}
+
+// protocolHints returns the message parser hints of the protocol, binary protocol has no hints
+func (l *Listener) protocolHints(protocol tcp.TCPProtocol) (hints tcp.Hints) {
+	switch protocol {
+	case tcp.ProtocolHTTP:
+		hints = tcp.Hints{Start: http1StartHint, End: http1EndHint, Split: http1SplitHint, Upgrade: l.http1UpgradeHint, Frame: websocketFrameHint}
+	case tcp.ProtocolRedis:
+		hints = tcp.Hints{Start: l.serverPortStartHint, End: redisEndHint, Split: redisLength}
+	case tcp.ProtocolPostgres:
+		hints = tcp.Hints{Start: l.serverPortStartHint, End: postgresEndHint, Split: postgresLength}
+	case tcp.ProtocolMySQL:
+		hints = tcp.Hints{Start: l.serverPortStartHint, End: mysqlEndHint, Split: mysqlLength}
+	}
+	return
+}
+
 func (l *Listener) read() {
 	l.Lock()
 	defer l.Unlock()
@@ -373,8 +454,8 @@ func (l *Listener) read() {
 			defer l.closeHandles(key)
 			linkSize := 14
 			linkType := int(layers.LinkTypeEthernet)
-			if _, ok := hndl.handler.(*pcap.Handle); ok {
-				linkType = int(hndl.handler.(*pcap.Handle).LinkType())
+			if h, ok := hndl.handler.(interface{ LinkType() layers.LinkType }); ok {
+				linkType = int(h.LinkType())
 				linkSize, ok = pcapLinkTypeLength(linkType)
 				if !ok {
 					if os.Getenv("GORDEBUG") != "0" {
@@ -385,10 +466,23 @@ func (l *Listener) read() {
 			}
 
 			messageParser := tcp.NewMessageParser(l.messages, l.ports, hndl.ips, l.expiry, l.allowIncomplete)
+			if l.tlsKeyLog != nil {
+				messageParser.TLS = tcp.NewTLSDecryptor(l.tlsKeyLog)
+			}
+			messageParser.ConnectionClosed = l.connectionHandler
 
-			if l.protocol == tcp.ProtocolHTTP {
-				messageParser.Start = http1StartHint
-				messageParser.End = http1EndHint
+			hints := l.protocolHints(l.protocol)
+			if l.framer != nil {
+				hints = tcp.Hints{Start: l.framer.Start, End: l.framer.End, Split: l.framer.Split}
+			}
+			messageParser.Start, messageParser.End, messageParser.Split = hints.Start, hints.End, hints.Split
+			messageParser.Upgrade, messageParser.Frame = hints.Upgrade, hints.Frame
+			if len(l.portProtocols) > 0 {
+				messageParser.PortHints = make(map[uint16]*tcp.Hints)
+				for port, protocol := range l.portProtocols {
+					hints := l.protocolHints(protocol)
+					messageParser.PortHints[port] = &hints
+				}
 			}
 
 			timer := time.NewTicker(1 * time.Second)
@@ -407,6 +501,11 @@ func (l *Listener) read() {
 				default:
 					data, ci, err := hndl.handler.ReadPacketData()
 					if err == nil {
+						// pcapng file can have interfaces with different link types
+						if h, ok := hndl.handler.(*pcapFileHandle); ok && int(h.LinkType()) != linkType {
+							linkType = int(h.LinkType())
+							linkSize, _ = pcapLinkTypeLength(linkType)
+						}
 						if l.TimestampType == "go" {
 							ci.Timestamp = time.Now()
 						}
@@ -419,7 +518,7 @@ func (l *Listener) read() {
 						})
 						continue
 					}
-					if enext, ok := err.(pcap.NextError); ok && enext == pcap.NextErrorTimeoutExpired {
+					if isTimeoutError(err) {
 						continue
 					}
 					if eno, ok := err.(syscall.Errno); ok && eno.Temporary() {
@@ -461,27 +560,6 @@ func (l *Listener) closeHandles(key string) {
 	}
 }
 
-func (l *Listener) activatePcap() error {
-	var e error
-	var msg string
-	for _, ifi := range l.Interfaces {
-		var handle *pcap.Handle
-		handle, e = l.PcapHandle(ifi)
-		if e != nil {
-			msg += ("\n" + e.Error())
-			continue
-		}
-		l.Handles[ifi.Name] = packetHandle{
-			handler: handle,
-			ips:     interfaceIPs(ifi),
-		}
-	}
-	if len(l.Handles) == 0 {
-		return fmt.Errorf("pcap handles error:%s", msg)
-	}
-	return nil
-}
-
 func (l *Listener) activateRawSocket() error {
 	if runtime.GOOS != "linux" {
 		return fmt.Errorf("sock_raw is not stabilized on OS other than linux")
@@ -506,24 +584,31 @@ func (l *Listener) activateRawSocket() error {
 	return nil
 }
 
+// activatePcapFile opens pcap or pcapng file without libpcap, packets are filtered
+// in Go using the same rules as BPF filter
 func (l *Listener) activatePcapFile() (err error) {
-	var handle *pcap.Handle
+	var handle *PcapFile
 	var e error
-	if handle, e = pcap.OpenOffline(l.host); e != nil {
+	if handle, e = OpenPcapFile(l.host); e != nil {
 		return fmt.Errorf("open pcap file error: %q", e)
 	}
 
 	tmp := l.host
 	l.host = ""
-	l.BPFFilter = l.Filter(pcap.Interface{})
+	l.BPFFilter = l.Filter(Interface{})
 	l.host = tmp
 
-	if e = handle.SetBPFFilter(l.BPFFilter); e != nil {
-		handle.Close()
-		return fmt.Errorf("BPF filter error: %q, filter: %s", e, l.BPFFilter)
-	}
 	l.Handles["pcap_file"] = packetHandle{
-		handler: handle,
+		handler: &pcapFileHandle{
+			PcapFile: handle,
+			filter:   newPacketFilter(l.Transport, l.ports, nil, l.trackResponse),
+			path:     l.host,
+			loop:     l.PcapFileLoop,
+			pace:     l.PcapFilePace,
+			maxWait:  l.PcapFileMaxWait,
+			speed:    &l.speedFactor,
+			quit:     l.quit,
+		},
 	}
 	return
 }
@@ -536,7 +621,7 @@ func (l *Listener) activateAFPacket() error {
 
 	var msg string
 	for _, ifi := range l.Interfaces {
-		handle, err := newAfpacketHandle(ifi.Name, szFrame, szBlock, numBlocks, false, pcap.BlockForever)
+		handle, err := newAfpacketHandle(ifi.Name, szFrame, szBlock, numBlocks, false, blockForever)
 
 		if err != nil {
 			msg += ("\n" + err.Error())
@@ -563,8 +648,8 @@ func (l *Listener) activateAFPacket() error {
 }
 
 func (l *Listener) setInterfaces() (err error) {
-	var pifis []pcap.Interface
-	pifis, err = pcap.FindAllDevs()
+	var pifis []Interface
+	pifis, err = findAllDevs()
 	ifis, _ := net.Interfaces()
 	if err != nil {
 		return
@@ -594,7 +679,7 @@ func (l *Listener) setInterfaces() (err error) {
 		}
 
 		if isDevice(l.host, pi) {
-			l.Interfaces = []pcap.Interface{pi}
+			l.Interfaces = []Interface{pi}
 			return
 		}
 
@@ -603,7 +688,7 @@ func (l *Listener) setInterfaces() (err error) {
 	return
 }
 
-func isDevice(addr string, ifi pcap.Interface) bool {
+func isDevice(addr string, ifi Interface) bool {
 	if addr == ifi.Name {
 		return true
 	}
@@ -617,7 +702,7 @@ func isDevice(addr string, ifi pcap.Interface) bool {
 	return false
 }
 
-func interfaceAddresses(ifi pcap.Interface) []string {
+func interfaceAddresses(ifi Interface) []string {
 	var hosts []string
 	for _, addr := range ifi.Addresses {
 		hosts = append(hosts, addr.IP.String())
@@ -625,7 +710,7 @@ func interfaceAddresses(ifi pcap.Interface) []string {
 	return hosts
 }
 
-func interfaceIPs(ifi pcap.Interface) []net.IP {
+func interfaceIPs(ifi Interface) []net.IP {
 	var ips []net.IP
 	for _, addr := range ifi.Addresses {
 		ips = append(ips, addr.IP)
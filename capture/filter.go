@@ -0,0 +1,93 @@
+package capture
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// packetFilter matches packets using the same rules as BPF filter returned by Listener.Filter:
+// packets to the ports and hosts, and packets from them if responses are tracked.
+// It is used when packets are read without libpcap, which compiles BPF filters.
+type packetFilter struct {
+	transport     byte            // IP protocol number
+	ports         map[uint16]bool // empty matches all ports
+	hosts         []net.IP        // empty matches all hosts
+	trackResponse bool
+}
+
+func newPacketFilter(transport string, ports []uint16, hosts []string, trackResponse bool) *packetFilter {
+	f := &packetFilter{transport: 6, ports: make(map[uint16]bool), trackResponse: trackResponse}
+	if transport == "udp" {
+		f.transport = 17
+	}
+	if len(ports) > 0 && ports[0] != 0 {
+		for _, port := range ports {
+			f.ports[port] = true
+		}
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			f.hosts = append(f.hosts, ip)
+		}
+	}
+	return f
+}
+
+// match reports if the packet passes the filter, linkSize is the length of link layer header
+func (f *packetFilter) match(data []byte, linkSize int) bool {
+	if len(data) <= linkSize {
+		return false
+	}
+	data = data[linkSize:]
+
+	var proto byte
+	var src, dst net.IP
+	var ihl int
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return false
+		}
+		ihl = int(data[0]&0x0f) * 4
+		// like libpcap, ports are checked only in the first fragment
+		if binary.BigEndian.Uint16(data[6:8])&0x1fff != 0 {
+			return false
+		}
+		proto, src, dst = data[9], data[12:16], data[16:20]
+	case 6:
+		if len(data) < 40 {
+			return false
+		}
+		// like libpcap, extension headers are not followed
+		ihl = 40
+		proto, src, dst = data[6], data[8:24], data[24:40]
+	default:
+		return false
+	}
+	if proto != f.transport || len(data) < ihl+4 {
+		return false
+	}
+	srcPort := binary.BigEndian.Uint16(data[ihl : ihl+2])
+	dstPort := binary.BigEndian.Uint16(data[ihl+2 : ihl+4])
+
+	if f.matchPort(dstPort) && f.matchHost(dst) {
+		return true
+	}
+	return f.trackResponse && f.matchPort(srcPort) && f.matchHost(src)
+}
+
+func (f *packetFilter) matchPort(port uint16) bool {
+	return len(f.ports) == 0 || f.ports[port]
+}
+
+func (f *packetFilter) matchHost(ip net.IP) bool {
+	if len(f.hosts) == 0 {
+		return true
+	}
+	for _, host := range f.hosts {
+		if host.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
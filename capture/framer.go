@@ -0,0 +1,189 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/buger/goreplay/proto"
+	"github.com/buger/goreplay/tcp"
+)
+
+// Framer delimits messages of an application protocol, its methods are used as hints of tcp.MessageParser.
+// When set with Listener.SetFramer, it replaces the hints of the listener protocol.
+type Framer interface {
+	// Start tells requests from responses, see tcp.HintStart
+	Start(*tcp.Packet) (isRequest, isResponse bool)
+	// End reports whether the message is complete, see tcp.HintEnd
+	End(*tcp.Message) bool
+	// Split returns the length of the first of pipelined messages, or -1 if it is not known yet, see tcp.HintSplit
+	Split(*tcp.Message) int
+}
+
+// FramerConfig configures the generic framers
+type FramerConfig struct {
+	// Delimiter ends each message of delimiter framer, escape sequences like \r\n are supported
+	Delimiter string `json:"input-raw-framer-delimiter"`
+	// LengthOffset is the position of the length field of length framer
+	LengthOffset int `json:"input-raw-framer-length-offset"`
+	// LengthSize is the size of the length field in bytes: 1, 2, 4 or 8
+	LengthSize int `json:"input-raw-framer-length-size"`
+	// LengthAdjust is added to the length value, the message ends at LengthOffset + LengthSize + length + LengthAdjust
+	LengthAdjust int `json:"input-raw-framer-length-adjust"`
+	// LittleEndian length field, it is big endian by default
+	LittleEndian bool `json:"input-raw-framer-length-little-endian"`
+}
+
+// FramerFunc returns a framer for the ports of the server
+type FramerFunc func(ports []uint16, config FramerConfig) (Framer, error)
+
+var (
+	framers  = make(map[string]FramerFunc)
+	framersL sync.RWMutex
+)
+
+func init() {
+	RegisterFramer("memcached", newMemcachedFramer)
+	RegisterFramer("delimiter", newDelimiterFramer)
+	RegisterFramer("length", newLengthFramer)
+}
+
+// RegisterFramer makes the framer available by the name, a framer registered with the same name is replaced
+func RegisterFramer(name string, f FramerFunc) {
+	framersL.Lock()
+	defer framersL.Unlock()
+	framers[name] = f
+}
+
+// Framers returns the names of registered framers
+func Framers() (names []string) {
+	framersL.RLock()
+	defer framersL.RUnlock()
+	for name := range framers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// NewFramer returns the framer registered with the name
+func NewFramer(name string, ports []uint16, config FramerConfig) (Framer, error) {
+	framersL.RLock()
+	f, ok := framers[name]
+	framersL.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown framer %q, available framers: %v", name, Framers())
+	}
+	return f(ports, config)
+}
+
+// LengthFramer is a framer of protocols which messages can be measured, requests and responses are told apart
+// by the port of the server, see Listener.serverPortStartHint
+type LengthFramer struct {
+	Ports []uint16
+	// Length returns the length of the first message, or -1 if it is not complete
+	Length func(*tcp.Message) int
+}
+
+// Start tells requests from responses by the port of the server
+func (f *LengthFramer) Start(pckt *tcp.Packet) (isRequest, isResponse bool) {
+	return serverPortStart(f.Ports, pckt)
+}
+
+// End reports whether the first message has the whole data of the message
+func (f *LengthFramer) End(m *tcp.Message) bool {
+	if m.MissingChunk() {
+		return false
+	}
+
+	return f.Length(m) == m.Length
+}
+
+// Split returns the length of the first message
+func (f *LengthFramer) Split(m *tcp.Message) int {
+	return f.Length(m)
+}
+
+// newMemcachedFramer frames text and binary memcached protocols
+func newMemcachedFramer(ports []uint16, _ FramerConfig) (Framer, error) {
+	return &LengthFramer{Ports: ports, Length: func(m *tcp.Message) int {
+		return proto.MemcachedLength(m, m.Direction == tcp.DirIncoming, m.PacketData()...)
+	}}, nil
+}
+
+type delimiterState struct {
+	pos int // position to continue the search from
+}
+
+// newDelimiterFramer frames messages which end with the delimiter, like lines of text protocols
+func newDelimiterFramer(ports []uint16, config FramerConfig) (Framer, error) {
+	delimiter, err := strconv.Unquote(`"` + config.Delimiter + `"`)
+	if err != nil || delimiter == "" {
+		return nil, fmt.Errorf("invalid delimiter %q", config.Delimiter)
+	}
+	return &LengthFramer{Ports: ports, Length: func(m *tcp.Message) int {
+		state, _ := m.ProtocolState().(*delimiterState)
+		if state == nil {
+			state = new(delimiterState)
+			m.SetProtocolState(state)
+		}
+		data := bytes.Join(m.PacketData(), nil)
+		if i := bytes.Index(data[state.pos:], []byte(delimiter)); i >= 0 {
+			return state.pos + i + len(delimiter)
+		}
+		// the delimiter can start at the end of the data
+		if state.pos = len(data) - len(delimiter) + 1; state.pos < 0 {
+			state.pos = 0
+		}
+		return -1
+	}}, nil
+}
+
+// newLengthFramer frames messages which have their length in a field at a fixed position
+func newLengthFramer(ports []uint16, config FramerConfig) (Framer, error) {
+	switch config.LengthSize {
+	case 1, 2, 4, 8:
+	default:
+		return nil, fmt.Errorf("length size should be 1, 2, 4 or 8, got %d", config.LengthSize)
+	}
+	if config.LengthOffset < 0 {
+		return nil, fmt.Errorf("invalid length offset %d", config.LengthOffset)
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if config.LittleEndian {
+		order = binary.LittleEndian
+	}
+	header := config.LengthOffset + config.LengthSize
+	return &LengthFramer{Ports: ports, Length: func(m *tcp.Message) int {
+		var data []byte
+		for _, payload := range m.PacketData() {
+			data = append(data, payload...)
+			if len(data) >= header {
+				break
+			}
+		}
+		if len(data) < header {
+			return -1
+		}
+		var length uint64
+		field := data[config.LengthOffset:header]
+		switch config.LengthSize {
+		case 1:
+			length = uint64(field[0])
+		case 2:
+			length = uint64(order.Uint16(field))
+		case 4:
+			length = uint64(order.Uint32(field))
+		case 8:
+			length = order.Uint64(field)
+		}
+		n := int64(header) + int64(length) + int64(config.LengthAdjust)
+		if length > 1<<31 || n < int64(header) {
+			return -1
+		}
+		return int(n)
+	}}, nil
+}
@@ -0,0 +1,86 @@
+package capture
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+// frame captures the request and the response with the framer, and checks the emitted messages
+func frame(t *testing.T, name string, config FramerConfig, request, response string, expected []string) {
+	path := writePcapFile(t,
+		tcpPacket(t, "10.0.0.1", "10.0.0.2", 50000, 9000, request),
+		tcpPacket(t, "10.0.0.2", "10.0.0.1", 9000, 50000, response),
+	)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	framer, err := NewFramer(name, []uint16{9000}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// messages are emitted by the framer long before they expire
+	l, err := NewListener(path, []uint16{9000}, "", EnginePcapFile, tcp.ProtocolBinary, true, time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetFramer(framer)
+	if err = l.Activate(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l.ListenBackground(ctx)
+
+	for i, data := range expected {
+		select {
+		case m := <-l.Messages():
+			if string(m.Data()) != data {
+				t.Errorf("%s: expected %q to equal %q", name, m.Data(), data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: message %d is not captured", name, i)
+		}
+	}
+}
+
+func TestMemcachedFramer(t *testing.T) {
+	requests := []string{"get a b\r\n", "set a 0 0 5 noreply\r\nhello\r\nset b 0 0 2\r\nhi\r\n", "incr n 1\r\n"}
+	responses := []string{"VALUE a 0 5\r\nhello\r\nVALUE b 0 2\r\nhi\r\nEND\r\n", "STORED\r\n", "2\r\n"}
+	frame(t, "memcached", FramerConfig{}, requests[0]+requests[1]+requests[2], responses[0]+responses[1]+responses[2],
+		append(requests, responses...))
+}
+
+func TestDelimiterFramer(t *testing.T) {
+	frame(t, "delimiter", FramerConfig{Delimiter: `\r\n`}, "PING\r\nECHO a\r\nX\r\n", "PONG\r\na\r\n",
+		[]string{"PING\r\n", "ECHO a\r\n", "X\r\n", "PONG\r\n", "a\r\n"})
+}
+
+func TestLengthFramer(t *testing.T) {
+	// two bytes of type and two bytes of length, which includes the header
+	config := FramerConfig{LengthOffset: 2, LengthSize: 2, LengthAdjust: -4}
+	frame(t, "length", config, "\x01\x00\x00\x05a\x02\x00\x00\x06bc", "\x03\x00\x00\x04\x03\x00\x00\x04",
+		[]string{"\x01\x00\x00\x05a", "\x02\x00\x00\x06bc", "\x03\x00\x00\x04", "\x03\x00\x00\x04"})
+}
+
+func TestNewFramer(t *testing.T) {
+	if _, err := NewFramer("unknown", nil, FramerConfig{}); err == nil {
+		t.Error("unknown framer should be an error")
+	}
+	if _, err := NewFramer("length", nil, FramerConfig{LengthSize: 3}); err == nil {
+		t.Error("length size 3 should be an error")
+	}
+	if _, err := NewFramer("delimiter", nil, FramerConfig{}); err == nil {
+		t.Error("empty delimiter should be an error")
+	}
+
+	RegisterFramer("custom", func(ports []uint16, config FramerConfig) (Framer, error) {
+		return &LengthFramer{Ports: ports, Length: func(m *tcp.Message) int { return 1 }}, nil
+	})
+	if _, err := NewFramer("custom", nil, FramerConfig{}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,63 @@
+// +build !cgo
+
+package capture
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Interface is a network interface, it mirrors pcap.Interface
+type Interface struct {
+	Name        string
+	Description string
+	Flags       uint32
+	Addresses   []InterfaceAddress
+}
+
+// InterfaceAddress is an address of a network interface, it mirrors pcap.InterfaceAddress
+type InterfaceAddress struct {
+	IP        net.IP
+	Netmask   net.IPMask
+	Broadaddr net.IP
+	P2P       net.IP
+}
+
+// Stats holds statistics of a capture handle, it mirrors pcap.Stats
+type Stats struct {
+	PacketsReceived  int
+	PacketsDropped   int
+	PacketsIfDropped int
+}
+
+const blockForever = -time.Millisecond * 10
+
+var errNoCgo = errors.New("libpcap engine is not available in binaries built without cgo, use pcap_file engine")
+
+// findAllDevs returns interfaces known to the OS, libpcap is not used
+func findAllDevs() (ifis []Interface, err error) {
+	netIfis, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, ni := range netIfis {
+		ifi := Interface{Name: ni.Name, Flags: uint32(ni.Flags)}
+		addrs, _ := ni.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				ifi.Addresses = append(ifi.Addresses, InterfaceAddress{IP: ipnet.IP, Netmask: ipnet.Mask})
+			}
+		}
+		ifis = append(ifis, ifi)
+	}
+	return ifis, nil
+}
+
+func isTimeoutError(err error) bool {
+	return false
+}
+
+func (l *Listener) activatePcap() error {
+	return errNoCgo
+}
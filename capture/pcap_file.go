@@ -0,0 +1,408 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// pcap and pcapng magic numbers
+const (
+	pcapMagicMicro    = 0xa1b2c3d4
+	pcapMagicNano     = 0xa1b23c4d
+	pcapngSectionType = 0x0a0d0d0a
+	pcapngByteOrder   = 0x1a2b3c4d
+)
+
+// pcapng block types
+const (
+	pcapngInterfaceBlock      = 0x00000001
+	pcapngObsoletePacketBlock = 0x00000002
+	pcapngSimplePacketBlock   = 0x00000003
+	pcapngEnhancedPacketBlock = 0x00000006
+)
+
+// maxPcapBlockSize limits size of a packet or a block, to not allocate memory for corrupted lengths
+const maxPcapBlockSize = 16 << 20
+
+// ErrPcapFormat is returned when file is neither pcap nor pcapng, or is corrupted
+var ErrPcapFormat = errors.New("invalid pcap file format")
+
+type pcapngInterface struct {
+	linkType   layers.LinkType
+	snaplen    uint32
+	resolution time.Duration // duration of timestamp unit, 0 if unit is smaller than a nanosecond
+	unitsPerNs float64       // used if resolution is 0
+	offset     time.Duration
+}
+
+// PcapFile reads packets from pcap or pcapng file without libpcap.
+// Both byte orders and microsecond or nanosecond timestamps are supported.
+type PcapFile struct {
+	r        *bufio.Reader
+	closer   io.Closer
+	order    binary.ByteOrder
+	ng       bool
+	nano     bool
+	snaplen  uint32
+	linkType layers.LinkType
+
+	interfaces []pcapngInterface
+}
+
+// OpenPcapFile opens pcap or pcapng file
+func OpenPcapFile(path string) (*PcapFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := NewPcapReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	p.closer = f
+	return p, nil
+}
+
+// NewPcapReader reads pcap or pcapng headers from r, format is detected by the magic number
+func NewPcapReader(r io.Reader) (*PcapFile, error) {
+	p := &PcapFile{r: bufio.NewReaderSize(r, 64<<10)}
+	magic, err := p.r.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", ErrPcapFormat, err)
+	}
+	if binary.LittleEndian.Uint32(magic) == pcapngSectionType {
+		p.ng = true
+		// blocks up to the first interface description are read to know the link type
+		if err = p.readNextBlocks(); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	return p, p.readPcapHeader()
+}
+
+func (p *PcapFile) readPcapHeader() error {
+	var hdr [24]byte
+	if _, err := io.ReadFull(p.r, hdr[:]); err != nil {
+		return fmt.Errorf("%v: %v", ErrPcapFormat, err)
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(hdr[0:4]) {
+		case pcapMagicMicro:
+			p.order = order
+		case pcapMagicNano:
+			p.order, p.nano = order, true
+		default:
+			continue
+		}
+		p.snaplen = p.order.Uint32(hdr[16:20])
+		// upper bits of the link type field hold FCS length
+		p.linkType = layers.LinkType(p.order.Uint32(hdr[20:24]) & 0xffff)
+		return nil
+	}
+	return ErrPcapFormat
+}
+
+// readNextBlocks reads pcapng blocks until section and interface description blocks are read,
+// the first packet block is left unread
+func (p *PcapFile) readNextBlocks() error {
+	for len(p.interfaces) == 0 {
+		if _, _, err := p.readBlock(); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("%v: no interfaces", ErrPcapFormat)
+			}
+			return err
+		}
+	}
+	p.linkType = p.interfaces[0].linkType
+	return nil
+}
+
+// LinkType returns link type of the last read packet
+func (p *PcapFile) LinkType() layers.LinkType {
+	return p.linkType
+}
+
+// ReadPacketData returns next packet, io.EOF is returned at the end of file
+func (p *PcapFile) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	if !p.ng {
+		return p.readPcapPacket()
+	}
+	for {
+		data, ci, err = p.readBlock()
+		if err != nil || data != nil {
+			return
+		}
+	}
+}
+
+// Close closes the file
+func (p *PcapFile) Close() error {
+	if p.closer != nil {
+		return p.closer.Close()
+	}
+	return nil
+}
+
+func (p *PcapFile) readPcapPacket() (data []byte, ci gopacket.CaptureInfo, err error) {
+	var hdr [16]byte
+	if _, err = io.ReadFull(p.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("%v: truncated packet header", ErrPcapFormat)
+		}
+		return
+	}
+	sec := int64(p.order.Uint32(hdr[0:4]))
+	frac := int64(p.order.Uint32(hdr[4:8]))
+	if !p.nano {
+		frac *= 1000
+	}
+	ci.Timestamp = time.Unix(sec, frac).UTC()
+	ci.CaptureLength = int(p.order.Uint32(hdr[8:12]))
+	ci.Length = int(p.order.Uint32(hdr[12:16]))
+	if ci.CaptureLength > maxPcapBlockSize {
+		err = fmt.Errorf("%v: packet length %d", ErrPcapFormat, ci.CaptureLength)
+		return
+	}
+	data = make([]byte, ci.CaptureLength)
+	if _, err = io.ReadFull(p.r, data); err != nil {
+		err = fmt.Errorf("%v: truncated packet: %v", ErrPcapFormat, err)
+		return nil, ci, err
+	}
+	return
+}
+
+// readBlock reads a pcapng block, returns packet data if it is a packet block, nil otherwise
+func (p *PcapFile) readBlock() (data []byte, ci gopacket.CaptureInfo, err error) {
+	var hdr [8]byte
+	if _, err = io.ReadFull(p.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("%v: truncated block header", ErrPcapFormat)
+		}
+		return
+	}
+
+	if binary.LittleEndian.Uint32(hdr[0:4]) == pcapngSectionType {
+		// byte order of the section is defined by its byte order magic
+		bom, e := p.r.Peek(4)
+		if e != nil {
+			return nil, ci, fmt.Errorf("%v: truncated section header", ErrPcapFormat)
+		}
+		switch {
+		case binary.LittleEndian.Uint32(bom) == pcapngByteOrder:
+			p.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(bom) == pcapngByteOrder:
+			p.order = binary.BigEndian
+		default:
+			return nil, ci, fmt.Errorf("%v: invalid byte order magic", ErrPcapFormat)
+		}
+		// interfaces are defined per section
+		p.interfaces = p.interfaces[:0]
+	}
+	if p.order == nil {
+		return nil, ci, fmt.Errorf("%v: block outside of section", ErrPcapFormat)
+	}
+
+	blockType := p.order.Uint32(hdr[0:4])
+	length := p.order.Uint32(hdr[4:8])
+	if length < 12 || length%4 != 0 || length > maxPcapBlockSize {
+		return nil, ci, fmt.Errorf("%v: block length %d", ErrPcapFormat, length)
+	}
+	body := make([]byte, length-8)
+	if _, err = io.ReadFull(p.r, body); err != nil {
+		return nil, ci, fmt.Errorf("%v: truncated block: %v", ErrPcapFormat, err)
+	}
+	body = body[:len(body)-4] // trailing block length
+
+	switch blockType {
+	case pcapngInterfaceBlock:
+		err = p.readInterface(body)
+	case pcapngEnhancedPacketBlock:
+		if len(body) < 20 {
+			return nil, ci, fmt.Errorf("%v: enhanced packet block length %d", ErrPcapFormat, length)
+		}
+		return p.packet(p.order.Uint32(body[0:4]), body[4:12], body[12:16], body[16:20], body[20:])
+	case pcapngObsoletePacketBlock:
+		if len(body) < 20 {
+			return nil, ci, fmt.Errorf("%v: packet block length %d", ErrPcapFormat, length)
+		}
+		return p.packet(uint32(p.order.Uint16(body[0:2])), body[4:12], body[12:16], body[16:20], body[20:])
+	case pcapngSimplePacketBlock:
+		if len(body) < 4 || len(p.interfaces) == 0 {
+			return nil, ci, fmt.Errorf("%v: simple packet block", ErrPcapFormat)
+		}
+		origLen := p.order.Uint32(body[0:4])
+		capLen := origLen
+		if iface := p.interfaces[0]; iface.snaplen > 0 && capLen > iface.snaplen {
+			capLen = iface.snaplen
+		}
+		if int(capLen) > len(body)-4 {
+			capLen = uint32(len(body) - 4)
+		}
+		p.linkType = p.interfaces[0].linkType
+		ci.CaptureLength, ci.Length = int(capLen), int(origLen)
+		return body[4 : 4+capLen], ci, nil
+	}
+	return nil, ci, err
+}
+
+func (p *PcapFile) packet(ifaceID uint32, ts, capLen, origLen, payload []byte) (data []byte, ci gopacket.CaptureInfo, err error) {
+	if int(ifaceID) >= len(p.interfaces) {
+		return nil, ci, fmt.Errorf("%v: unknown interface %d", ErrPcapFormat, ifaceID)
+	}
+	iface := p.interfaces[ifaceID]
+	ci.CaptureLength = int(p.order.Uint32(capLen))
+	ci.Length = int(p.order.Uint32(origLen))
+	ci.InterfaceIndex = int(ifaceID)
+	if ci.CaptureLength > len(payload) {
+		return nil, ci, fmt.Errorf("%v: packet length %d", ErrPcapFormat, ci.CaptureLength)
+	}
+	units := uint64(p.order.Uint32(ts[0:4]))<<32 | uint64(p.order.Uint32(ts[4:8]))
+	if iface.resolution > 0 {
+		ci.Timestamp = time.Unix(0, 0).Add(time.Duration(units) * iface.resolution)
+	} else {
+		ci.Timestamp = time.Unix(0, int64(float64(units)/iface.unitsPerNs))
+	}
+	ci.Timestamp = ci.Timestamp.Add(iface.offset).UTC()
+	p.linkType = iface.linkType
+	return payload[:ci.CaptureLength], ci, nil
+}
+
+func (p *PcapFile) readInterface(body []byte) error {
+	if len(body) < 8 {
+		return fmt.Errorf("%v: interface description block", ErrPcapFormat)
+	}
+	iface := pcapngInterface{
+		linkType:   layers.LinkType(p.order.Uint16(body[0:2])),
+		snaplen:    p.order.Uint32(body[4:8]),
+		resolution: time.Microsecond,
+	}
+	// options
+	for opts := body[8:]; len(opts) >= 4; {
+		code, length := p.order.Uint16(opts[0:2]), int(p.order.Uint16(opts[2:4]))
+		if code == 0 || 4+length > len(opts) {
+			break
+		}
+		value := opts[4 : 4+length]
+		switch {
+		case code == 9 && length == 1: // if_tsresol
+			exp := float64(value[0] & 0x7f)
+			unitsPerSecond := math.Pow(10, exp)
+			if value[0]&0x80 != 0 {
+				unitsPerSecond = math.Pow(2, exp)
+			}
+			if unitsPerSecond <= 1e9 && math.Mod(1e9, unitsPerSecond) == 0 {
+				iface.resolution = time.Duration(1e9 / unitsPerSecond)
+			} else {
+				iface.resolution = 0
+				iface.unitsPerNs = unitsPerSecond / 1e9
+			}
+		case code == 14 && length == 8: // if_tsoffset, in seconds
+			iface.offset = time.Duration(int64(p.order.Uint64(value))) * time.Second
+		}
+		next := 4 + (length+3)&^3
+		if next > len(opts) {
+			break
+		}
+		opts = opts[next:]
+	}
+	p.interfaces = append(p.interfaces, iface)
+	return nil
+}
+
+// pcapFileHandle skips packets of the file which do not pass the filter, and replays
+// packets at their recorded timing if pace is set
+type pcapFileHandle struct {
+	*PcapFile
+	filter  *packetFilter
+	path    string
+	loop    bool
+	pace    bool
+	maxWait time.Duration
+	speed   *uint64 // math.Float64bits of the speed factor, updated atomically
+	quit    chan struct{}
+
+	lastTs time.Time // recorded timestamp of the previous packet
+	next   time.Time // time when the previous packet was due to be replayed
+}
+
+// ReadPacketData returns the next packet which passes the filter
+func (h *pcapFileHandle) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	for {
+		data, ci, err = h.PcapFile.ReadPacketData()
+		if err == io.EOF && h.loop {
+			if err = h.reopen(); err != nil {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+		linkSize, ok := pcapLinkTypeLength(int(h.LinkType()))
+		if ok && h.filter.match(data, linkSize) {
+			ci.Timestamp, err = h.wait(ci.Timestamp)
+			return
+		}
+	}
+}
+
+// reopen starts reading the file from the beginning, the first packet is replayed without delay
+func (h *pcapFileHandle) reopen() error {
+	f, err := OpenPcapFile(h.path)
+	if err != nil {
+		return err
+	}
+	h.PcapFile.Close()
+	h.PcapFile = f
+	h.lastTs = time.Time{}
+	return nil
+}
+
+// wait sleeps until the packet with the recorded timestamp is due, according to the time passed
+// since the previous packet and the speed factor. Delays are accumulated from the previous due time,
+// so the time spent on processing packets does not slow down the replay.
+// Packets keep the recorded timestamp in either mode.
+func (h *pcapFileHandle) wait(recorded time.Time) (time.Time, error) {
+	speed := 1.0
+	if h.speed != nil {
+		speed = math.Float64frombits(atomic.LoadUint64(h.speed))
+	}
+	if !h.pace || speed <= 0 {
+		return recorded, nil
+	}
+
+	now := time.Now()
+	if h.lastTs.IsZero() {
+		h.next = now
+	} else if diff := recorded.Sub(h.lastTs); diff > 0 {
+		diff = time.Duration(float64(diff) / speed)
+		if h.maxWait > 0 && diff > h.maxWait {
+			diff = h.maxWait
+		}
+		h.next = h.next.Add(diff)
+	}
+	h.lastTs = recorded
+
+	if d := h.next.Sub(now); d > 0 {
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-h.quit:
+			timer.Stop()
+			return recorded, io.ErrClosedPipe
+		}
+	}
+	return recorded, nil
+}
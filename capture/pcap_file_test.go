@@ -0,0 +1,484 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func tcpPacket(t *testing.T, src, dst string, srcPort, dstPort uint16, payload string) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+	network := gopacket.SerializableLayer(ip)
+	if ip.SrcIP.To4() == nil {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		network = &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: ip.SrcIP, DstIP: ip.DstIP}
+	}
+	tcpLayer := &layers.TCP{SrcPort: layers.TCPPort(srcPort), DstPort: layers.TCPPort(dstPort), Seq: 1, ACK: true, PSH: true, Window: 1024}
+
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, eth, network, tcpLayer, gopacket.Payload(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func writePcapFile(t *testing.T, packets ...[]byte) string {
+	return writePcapFileGap(t, time.Nanosecond, packets...)
+}
+
+// writePcapFileGap writes packets recorded with the gap between them
+func writePcapFileGap(t *testing.T, gap time.Duration, packets ...[]byte) string {
+	dir, err := ioutil.TempDir("", "pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "test.pcap")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w := NewWriterNanos(f)
+	w.WriteFileHeader(65536, layers.LinkTypeEthernet)
+	for i, data := range packets {
+		ci := gopacket.CaptureInfo{Timestamp: time.Unix(1600000000, 0).Add(time.Duration(i) * gap), CaptureLength: len(data), Length: len(data)}
+		if err = w.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestPcapFileReader(t *testing.T) {
+	first := tcpPacket(t, "10.0.0.1", "10.0.0.2", 5000, 80, "GET / HTTP/1.1\r\n\r\n")
+	second := tcpPacket(t, "10.0.0.2", "10.0.0.1", 80, 5000, "HTTP/1.1 200 OK\r\n\r\n")
+	path := writePcapFile(t, first, second)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	f, err := OpenPcapFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.LinkType() != layers.LinkTypeEthernet {
+		t.Errorf("wrong link type %s", f.LinkType())
+	}
+	for i, expected := range [][]byte{first, second} {
+		data, ci, err := f.ReadPacketData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, expected) || ci.CaptureLength != len(expected) {
+			t.Errorf("%d: wrong packet data", i)
+		}
+		if !ci.Timestamp.Equal(time.Unix(1600000000, int64(i))) {
+			t.Errorf("%d: wrong timestamp %s", i, ci.Timestamp)
+		}
+	}
+	if _, _, err = f.ReadPacketData(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	if _, err = NewPcapReader(bytes.NewReader([]byte("not a pcap file at all"))); err == nil {
+		t.Error("expected format error")
+	}
+}
+
+// pcapngBlock returns big endian pcapng block
+func pcapngBlock(blockType uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	block := make([]byte, 8, 12+len(body))
+	binary.BigEndian.PutUint32(block[0:4], blockType)
+	binary.BigEndian.PutUint32(block[4:8], uint32(12+len(body)))
+	block = append(block, body...)
+	return append(block, block[4:8]...)
+}
+
+func TestPcapngFileReader(t *testing.T) {
+	packet := tcpPacket(t, "10.0.0.1", "10.0.0.2", 5000, 80, "GET / HTTP/1.1\r\n\r\n")
+	var file []byte
+
+	shb := make([]byte, 16)
+	binary.BigEndian.PutUint32(shb[0:4], pcapngByteOrder)
+	binary.BigEndian.PutUint16(shb[4:6], 1)
+	binary.BigEndian.PutUint64(shb[8:16], ^uint64(0))
+	file = append(file, pcapngBlock(pcapngSectionType, shb)...)
+
+	// interface with nanosecond resolution: if_tsresol option 9, followed by end of options
+	idb := []byte{0, byte(layers.LinkTypeEthernet), 0, 0, 0, 0, 0, 0, 0, 9, 0, 1, 9, 0, 0, 0, 0, 0, 0, 0}
+	file = append(file, pcapngBlock(pcapngInterfaceBlock, idb)...)
+	// name resolution block is skipped
+	file = append(file, pcapngBlock(4, []byte{0, 0, 0, 0})...)
+
+	ts := uint64(1600000000123456789)
+	epb := make([]byte, 20, 20+len(packet))
+	binary.BigEndian.PutUint32(epb[4:8], uint32(ts>>32))
+	binary.BigEndian.PutUint32(epb[8:12], uint32(ts))
+	binary.BigEndian.PutUint32(epb[12:16], uint32(len(packet)))
+	binary.BigEndian.PutUint32(epb[16:20], uint32(len(packet)))
+	file = append(file, pcapngBlock(pcapngEnhancedPacketBlock, append(epb, packet...))...)
+
+	spb := make([]byte, 4, 4+len(packet))
+	binary.BigEndian.PutUint32(spb[0:4], uint32(len(packet)))
+	file = append(file, pcapngBlock(pcapngSimplePacketBlock, append(spb, packet...))...)
+
+	f, err := NewPcapReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.LinkType() != layers.LinkTypeEthernet {
+		t.Errorf("wrong link type %s", f.LinkType())
+	}
+
+	data, ci, err := f.ReadPacketData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, packet) {
+		t.Error("wrong enhanced packet data")
+	}
+	if ci.Timestamp.UnixNano() != int64(ts) {
+		t.Errorf("wrong timestamp %d", ci.Timestamp.UnixNano())
+	}
+
+	data, _, err = f.ReadPacketData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, packet) {
+		t.Error("wrong simple packet data")
+	}
+	if _, _, err = f.ReadPacketData(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestPacketFilter(t *testing.T) {
+	request := tcpPacket(t, "10.0.0.1", "10.0.0.2", 5000, 80, "req")
+	response := tcpPacket(t, "10.0.0.2", "10.0.0.1", 80, 5000, "resp")
+	other := tcpPacket(t, "10.0.0.1", "10.0.0.2", 5000, 8080, "other")
+	request6 := tcpPacket(t, "fe80::1", "fe80::2", 5000, 80, "req")
+
+	f := newPacketFilter("tcp", []uint16{80}, nil, false)
+	if !f.match(request, 14) || !f.match(request6, 14) {
+		t.Error("requests to the port should match")
+	}
+	if f.match(response, 14) || f.match(other, 14) {
+		t.Error("responses and other ports should not match")
+	}
+
+	f = newPacketFilter("tcp", []uint16{80}, []string{"10.0.0.2"}, true)
+	if !f.match(request, 14) || !f.match(response, 14) {
+		t.Error("requests and responses should match")
+	}
+	if f.match(request6, 14) {
+		t.Error("other hosts should not match")
+	}
+
+	f = newPacketFilter("tcp", []uint16{0}, nil, false)
+	if !f.match(other, 14) {
+		t.Error("all ports should match")
+	}
+	if newPacketFilter("udp", nil, nil, false).match(request, 14) {
+		t.Error("tcp packet should not match udp filter")
+	}
+}
+
+func TestListenerPcapFile(t *testing.T) {
+	path := writePcapFile(t,
+		tcpPacket(t, "10.0.0.1", "10.0.0.2", 5000, 9000, "GET /skipped HTTP/1.1\r\n\r\n"),
+		tcpPacket(t, "10.0.0.1", "10.0.0.2", 5000, 8000, "GET /captured HTTP/1.1\r\n\r\n"),
+	)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	l, err := NewListener(path, []uint16{8000}, "", EnginePcapFile, tcp.ProtocolHTTP, false, time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Activate(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l.ListenBackground(ctx)
+
+	select {
+	case m := <-l.Messages():
+		if !bytes.HasPrefix(m.Data(), []byte("GET /captured")) {
+			t.Errorf("wrong message %q", m.Data())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message is not captured")
+	}
+	select {
+	case m := <-l.Messages():
+		t.Errorf("unexpected message %q", m.Data())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestListenerRedis(t *testing.T) {
+	commands := []string{"*2\r\n$3\r\nGET\r\n$1\r\na\r\n", "PING\r\n"}
+	replies := []string{"*2\r\n$1\r\n1\r\n$-1\r\n", "+PONG\r\n"}
+	// pipelined commands and their replies are sent in one packet
+	path := writePcapFile(t,
+		tcpPacket(t, "10.0.0.1", "10.0.0.2", 50000, 6379, strings.Join(commands, "")),
+		tcpPacket(t, "10.0.0.2", "10.0.0.1", 6379, 50000, strings.Join(replies, "")),
+	)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	l, err := NewListener(path, []uint16{6379}, "", EnginePcapFile, tcp.ProtocolRedis, true, time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Activate(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l.ListenBackground(ctx)
+
+	var ids [][]byte
+	for i, expected := range append(commands, replies...) {
+		select {
+		case m := <-l.Messages():
+			if string(m.Data()) != expected {
+				t.Errorf("expected %q to equal %q", m.Data(), expected)
+			}
+			if (m.Direction == tcp.DirIncoming) != (i < len(commands)) {
+				t.Errorf("wrong direction of %q", m.Data())
+			}
+			if i < len(commands) {
+				ids = append(ids, m.UUID())
+			} else if !bytes.Equal(ids[i-len(commands)], m.UUID()) {
+				t.Errorf("reply %q should have id of its command", m.Data())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d is not captured", i)
+		}
+	}
+}
+
+func TestListenerPostgres(t *testing.T) {
+	message := func(typ byte, data string) string {
+		m := proto.PostgresMessage{Type: typ, Data: []byte(data)}
+		return string(m.Encode())
+	}
+	requests := []string{
+		message('Q', "SELECT 1\x00"),
+		message('P', "\x00SELECT 2\x00\x00\x00") + message('B', "\x00\x00\x00\x00\x00\x00\x00\x00") + message('E', "\x00\x00\x00\x00\x00") + message('S', ""),
+	}
+	responses := []string{
+		message('T', "\x00\x00") + message('D', "\x00\x00") + message('C', "SELECT 1\x00") + message('Z', "I"),
+		message('1', "") + message('2', "") + message('D', "\x00\x00") + message('C', "SELECT 1\x00") + message('Z', "I"),
+	}
+	// pipelined requests and their responses are sent in one packet
+	path := writePcapFile(t,
+		tcpPacket(t, "10.0.0.1", "10.0.0.2", 50000, 5432, strings.Join(requests, "")),
+		tcpPacket(t, "10.0.0.2", "10.0.0.1", 5432, 50000, strings.Join(responses, "")),
+	)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	l, err := NewListener(path, []uint16{5432}, "", EnginePcapFile, tcp.ProtocolPostgres, true, time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Activate(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l.ListenBackground(ctx)
+
+	var ids [][]byte
+	for i, expected := range append(requests, responses...) {
+		select {
+		case m := <-l.Messages():
+			if string(m.Data()) != expected {
+				t.Errorf("expected %q to equal %q", m.Data(), expected)
+			}
+			if i < len(requests) {
+				ids = append(ids, m.UUID())
+			} else if !bytes.Equal(ids[i-len(requests)], m.UUID()) {
+				t.Errorf("response %q should have id of its request", m.Data())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d is not captured", i)
+		}
+	}
+}
+
+func TestListenerMySQL(t *testing.T) {
+	packet := func(seq byte, payload string) string {
+		n := len(payload)
+		return string([]byte{byte(n), byte(n >> 8), byte(n >> 16), seq}) + payload
+	}
+	eof := "\xfe\x00\x00\x02\x00"
+	requests := []string{
+		packet(0, "\x03SELECT a FROM t"),
+		// COM_STMT_CLOSE has no response, it is joined with the next command
+		packet(0, "\x19\x01\x00\x00\x00") + packet(0, "\x03DELETE FROM t"),
+	}
+	responses := []string{
+		packet(1, "\x01") + packet(2, "\x03def\x00\x00\x00\x01a\x00\x0c") + packet(3, eof) + packet(4, "\x011") + packet(5, eof),
+		packet(1, "\x00\x01\x00\x02\x00\x00\x00"),
+	}
+	path := writePcapFile(t,
+		tcpPacket(t, "10.0.0.1", "10.0.0.2", 50000, 3306, strings.Join(requests, "")),
+		tcpPacket(t, "10.0.0.2", "10.0.0.1", 3306, 50000, strings.Join(responses, "")),
+	)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	l, err := NewListener(path, []uint16{3306}, "", EnginePcapFile, tcp.ProtocolMySQL, true, time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Activate(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l.ListenBackground(ctx)
+
+	var ids [][]byte
+	for i, expected := range append(requests, responses...) {
+		select {
+		case m := <-l.Messages():
+			if string(m.Data()) != expected {
+				t.Errorf("expected %q to equal %q", m.Data(), expected)
+			}
+			if i < len(requests) {
+				ids = append(ids, m.UUID())
+			} else if !bytes.Equal(ids[i-len(requests)], m.UUID()) {
+				t.Errorf("response %q should have id of its request", m.Data())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d is not captured", i)
+		}
+	}
+}
+
+func TestListenerPortProtocols(t *testing.T) {
+	path := writePcapFile(t,
+		tcpPacket(t, "10.0.0.1", "10.0.0.2", 50000, 8080, "GET / HTTP/1.1\r\n\r\n"),
+		tcpPacket(t, "10.0.0.1", "10.0.0.2", 50001, 6379, "*1\r\n$4\r\nPING\r\n*1\r\n$4\r\nPING\r\n"),
+	)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	l, err := NewListener(path, []uint16{8080, 6379}, "", EnginePcapFile, tcp.ProtocolHTTP, true, time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetPortProtocols(map[uint16]tcp.TCPProtocol{6379: tcp.ProtocolRedis})
+	if err = l.Activate(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l.ListenBackground(ctx)
+
+	expected := []struct {
+		data     string
+		protocol tcp.TCPProtocol
+	}{
+		{"GET / HTTP/1.1\r\n\r\n", tcp.ProtocolHTTP},
+		{"*1\r\n$4\r\nPING\r\n", tcp.ProtocolRedis},
+		{"*1\r\n$4\r\nPING\r\n", tcp.ProtocolRedis},
+	}
+	for i, e := range expected {
+		select {
+		case m := <-l.Messages():
+			if string(m.Data()) != e.data {
+				t.Errorf("expected %q to equal %q", m.Data(), e.data)
+			}
+			if protocol := l.PortProtocol(m.Packets()[0]); protocol != e.protocol {
+				t.Errorf("expected protocol %s of %q, got %s", e.protocol.String(), m.Data(), protocol.String())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d is not captured", i)
+		}
+	}
+}
+
+func TestPcapFileHandlePacing(t *testing.T) {
+	packet := tcpPacket(t, "10.0.0.1", "10.0.0.2", 5000, 80, "GET / HTTP/1.1\r\n\r\n")
+	path := writePcapFileGap(t, 100*time.Millisecond, packet, packet, packet)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	replay := func(h *pcapFileHandle, n int) (elapsed time.Duration, timestamps []time.Time) {
+		f, err := OpenPcapFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.PcapFile, h.path, h.filter = f, path, newPacketFilter("tcp", nil, nil, false)
+		defer h.Close()
+
+		start := time.Now()
+		for i := 0; i < n; i++ {
+			_, ci, err := h.ReadPacketData()
+			if err != nil {
+				t.Fatal(err)
+			}
+			timestamps = append(timestamps, ci.Timestamp)
+		}
+		return time.Since(start), timestamps
+	}
+
+	recorded := time.Unix(1600000000, 0).Add(200 * time.Millisecond)
+	if elapsed, ts := replay(&pcapFileHandle{pace: true}, 3); elapsed < 200*time.Millisecond || !ts[2].Equal(recorded) {
+		t.Errorf("packets should be replayed at recorded timing, keeping recorded timestamps: %s %v", elapsed, ts)
+	}
+
+	speed := math.Float64bits(4)
+	if elapsed, _ := replay(&pcapFileHandle{pace: true, speed: &speed}, 3); elapsed < 50*time.Millisecond || elapsed > 150*time.Millisecond {
+		t.Errorf("packets should be replayed 4 times faster: %s", elapsed)
+	}
+
+	if elapsed, _ := replay(&pcapFileHandle{pace: true, maxWait: 10 * time.Millisecond}, 3); elapsed > 100*time.Millisecond {
+		t.Errorf("wait between packets should be limited: %s", elapsed)
+	}
+
+	elapsed, ts := replay(&pcapFileHandle{}, 3)
+	if elapsed > 100*time.Millisecond || !ts[2].Equal(recorded) {
+		t.Errorf("file should be read as fast as possible by default: %s %v", elapsed, ts)
+	}
+
+	// the first packet of the next iteration is replayed without delay
+	if elapsed, _ := replay(&pcapFileHandle{pace: true, loop: true}, 7); elapsed < 400*time.Millisecond || elapsed > 550*time.Millisecond {
+		t.Errorf("file should be looped: %s", elapsed)
+	}
+
+	quit := make(chan struct{})
+	h := &pcapFileHandle{pace: true, quit: quit}
+	h.PcapFile, _ = OpenPcapFile(path)
+	h.filter = newPacketFilter("tcp", nil, nil, false)
+	defer h.Close()
+	h.ReadPacketData()
+	close(quit)
+	if _, _, err := h.ReadPacketData(); err != io.ErrClosedPipe {
+		t.Errorf("expected closed pipe error, got %v", err)
+	}
+}
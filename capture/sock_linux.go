@@ -1,4 +1,4 @@
-// +build linux
+// +build linux,cgo
 
 package capture
 
@@ -46,7 +46,7 @@ type SockRaw struct {
 }
 
 // NewSocket returns new M'maped sock_raw on packet version 2.
-func NewSocket(pifi pcap.Interface) (*SockRaw, error) {
+func NewSocket(pifi Interface) (*SockRaw, error) {
 	var ifi net.Interface
 
 	infs, _ := net.Interfaces()
@@ -1,14 +1,10 @@
-// +build !linux
+// +build !linux !cgo
 
 package capture
 
-import (
-	"errors"
-
-	"github.com/google/gopacket/pcap"
-)
+import "errors"
 
 // NewSocket returns new M'maped sock_raw on packet version 2.
-func NewSocket(_ pcap.Interface) (Socket, error) {
-	return nil, errors.New("afpacket socket is only available on linux")
+func NewSocket(_ Interface) (Socket, error) {
+	return nil, errors.New("afpacket socket is only available on linux, in binaries built with cgo")
 }
@@ -30,6 +30,7 @@ type ESPlugin struct {
 
 type ESRequestResponse struct {
 	ReqURL               string `json:"Req_URL"`
+	ReqEndpoint          string `json:"Req_Endpoint"`
 	ReqMethod            string `json:"Req_Method"`
 	ReqUserAgent         string `json:"Req_User-Agent"`
 	ReqAcceptLanguage    string `json:"Req_Accept-Language,omitempty"`
@@ -135,6 +136,7 @@ func (p *ESPlugin) ResponseAnalyze(req, resp []byte, start, stop time.Time) {
 
 	esResp := ESRequestResponse{
 		ReqURL:               string(proto.Path(req)),
+		ReqEndpoint:          Settings.PathTemplates.Normalize(proto.Path(req)),
 		ReqMethod:            string(proto.Method(req)),
 		ReqUserAgent:         string(proto.Header(req, []byte("User-Agent"))),
 		ReqAcceptLanguage:    string(proto.Header(req, []byte("Accept-Language"))),
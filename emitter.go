@@ -5,10 +5,15 @@ import (
 	"hash/fnv"
 	"io"
 	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/buger/goreplay/byteutils"
+	"github.com/buger/goreplay/proto"
 )
 
 // Emitter represents an abject to manage plugins communication
@@ -29,10 +34,18 @@ func (e *Emitter) Start(plugins *InOutPlugins, middlewareCmd string) {
 	}
 	e.plugins = plugins
 
+	inputs := plugins.Inputs
+	if templates := NewHTTPTemplates(&Settings.TemplateConfig); templates != nil {
+		inputs = make([]PluginReader, len(plugins.Inputs))
+		for i, in := range plugins.Inputs {
+			inputs[i] = templates.Reader(in)
+		}
+	}
+
 	if middlewareCmd != "" {
 		middleware := NewMiddleware(middlewareCmd)
 
-		for _, in := range plugins.Inputs {
+		for _, in := range inputs {
 			middleware.ReadFrom(in)
 		}
 
@@ -46,7 +59,7 @@ func (e *Emitter) Start(plugins *InOutPlugins, middlewareCmd string) {
 			}
 		}()
 	} else {
-		for _, in := range plugins.Inputs {
+		for _, in := range inputs {
 			e.Add(1)
 			go func(in PluginReader) {
 				defer e.Done()
@@ -72,9 +85,146 @@ func (e *Emitter) Close() {
 	e.plugins.All = nil // avoid Close to make changes again
 }
 
+// OutputWeights holds relative weights of outputs used by --split-output
+type OutputWeights []int
+
+func (w *OutputWeights) String() string {
+	return fmt.Sprint(*w)
+}
+
+// Set method to implement flags.Value, accepts comma separated list of weights
+func (w *OutputWeights) Set(value string) error {
+	var weights OutputWeights
+	for _, v := range strings.Split(value, ",") {
+		weight, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(v), "%")))
+		if err != nil || weight < 0 {
+			return fmt.Errorf("invalid output weight %q, expected comma separated list of non-negative numbers (ex. 90,10)", v)
+		}
+		weights = append(weights, weight)
+	}
+	*w = weights
+	return nil
+}
+
+// splitAssignment remembers output of a request, so its responses can follow it
+type splitAssignment struct {
+	index   int
+	created int64
+}
+
+// outputSplitter picks an output for each message when --split-output is set.
+// By default it is a simple round robin. With weights or a sticky header/cookie requests are
+// assigned to outputs proportionally to weights, consistently for the same sticky key,
+// and their responses are written to the same output as the request.
+type outputSplitter struct {
+	outputs    int
+	weights    []int // cumulative weights
+	header     []byte
+	cookie     []byte
+	index      int // round robin index
+	assigned   map[string]splitAssignment
+	lastCleanT int64
+}
+
+func newOutputSplitter(outputs int) *outputSplitter {
+	s := &outputSplitter{outputs: outputs}
+	if Settings.SplitOutputStickyHeader != "" {
+		s.header = []byte(Settings.SplitOutputStickyHeader)
+	}
+	if Settings.SplitOutputStickyCookie != "" {
+		s.cookie = []byte(Settings.SplitOutputStickyCookie)
+	}
+	if Settings.SplitOutput && len(Settings.SplitOutputWeights) > 0 {
+		if len(Settings.SplitOutputWeights) != outputs {
+			log.Fatalf("--split-output-weights expects %d weights, one per output, got %d", outputs, len(Settings.SplitOutputWeights))
+		}
+		total := 0
+		for _, w := range Settings.SplitOutputWeights {
+			total += w
+			s.weights = append(s.weights, total)
+		}
+		if total == 0 {
+			s.weights = nil
+		}
+	}
+	if s.weights != nil || s.header != nil || s.cookie != nil {
+		s.assigned = make(map[string]splitAssignment)
+		s.lastCleanT = time.Now().UnixNano()
+	}
+	return s
+}
+
+// writerIndex returns index of the output the message should be written to
+func (s *outputSplitter) writerIndex(msg *Message, requestID string) int {
+	if s.assigned == nil {
+		// Simple round robin
+		i := s.index
+		s.index = (s.index + 1) % s.outputs
+		return i
+	}
+
+	if !isRequestPayload(msg.Meta) {
+		if a, ok := s.assigned[requestID]; ok {
+			delete(s.assigned, requestID)
+			return a.index
+		}
+	}
+
+	var key []byte
+	if s.header != nil {
+		key = proto.Header(msg.Data, s.header)
+	}
+	if len(key) == 0 && s.cookie != nil {
+		key = proto.Cookie(msg.Data, s.cookie)
+	}
+
+	var i int
+	switch {
+	case len(key) > 0:
+		hasher := fnv.New32a()
+		hasher.Write(key)
+		i = s.pick(int(hasher.Sum32() & math.MaxInt32))
+	case s.weights != nil:
+		i = s.pick(rand.Intn(s.weights[len(s.weights)-1]))
+	default:
+		i = s.index
+		s.index = (s.index + 1) % s.outputs
+	}
+
+	if isRequestPayload(msg.Meta) {
+		now := time.Now().UnixNano()
+		s.assigned[requestID] = splitAssignment{i, now}
+		// Clean up requests for which we didn't get a response
+		if len(s.assigned)%1000 == 0 && now-s.lastCleanT > int64(60*time.Second) {
+			for k, v := range s.assigned {
+				if now-v.created > int64(60*time.Second) {
+					delete(s.assigned, k)
+				}
+			}
+			s.lastCleanT = now
+		}
+	}
+	return i
+}
+
+// pick maps a point to an output, according to weights if they are set
+func (s *outputSplitter) pick(point int) int {
+	if s.weights == nil {
+		return point % s.outputs
+	}
+	point %= s.weights[len(s.weights)-1]
+	for i, w := range s.weights {
+		if point < w {
+			return i
+		}
+	}
+	return len(s.weights) - 1
+}
+
 // CopyMulty copies from 1 reader to multiple writers
 func CopyMulty(src PluginReader, writers ...PluginWriter) error {
 	wIndex := 0
+	splitter := newOutputSplitter(len(writers))
 	modifier := NewHTTPModifier(&Settings.ModifierConfig)
 	filteredRequests := make(map[string]int64)
 	filteredRequestsLastCleanTime := time.Now().UnixNano()
@@ -112,6 +262,10 @@ func CopyMulty(src PluginReader, writers ...PluginWriter) error {
 						filteredCount++
 						continue
 					}
+					if len(modifier.config.TimeShift) > 0 {
+						ts, _ := strconv.ParseInt(byteutils.SliceToString(meta[2]), 10, 64)
+						msg.Data = modifier.ShiftTime(msg.Data, ts)
+					}
 					Debug(3, "[EMITTER] Rewritten input:", requestID, "from:", src)
 
 				} else {
@@ -143,12 +297,10 @@ func CopyMulty(src PluginReader, writers ...PluginWriter) error {
 						return err
 					}
 				} else {
-					// Simple round robin
+					wIndex = splitter.writerIndex(msg, requestID)
 					if _, err := writers[wIndex].PluginWrite(msg); err != nil {
 						return err
 					}
-
-					wIndex = (wIndex + 1) % len(writers)
 				}
 			} else {
 				for _, dst := range writers {
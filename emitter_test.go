@@ -7,6 +7,8 @@ import (
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/buger/goreplay/proto"
 )
 
 func TestMain(m *testing.M) {
@@ -233,6 +235,136 @@ func TestEmitterSplitSession(t *testing.T) {
 	emitter.Close()
 }
 
+func TestEmitterSplitWeighted(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	input := NewTestInput()
+
+	var counter1, counter2 int32
+
+	output1 := NewTestOutput(func(*Message) {
+		atomic.AddInt32(&counter1, 1)
+		wg.Done()
+	})
+
+	output2 := NewTestOutput(func(*Message) {
+		atomic.AddInt32(&counter2, 1)
+		wg.Done()
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input},
+		Outputs: []PluginWriter{output1, output2},
+	}
+
+	Settings.SplitOutput = true
+	Settings.SplitOutputWeights.Set("90,10")
+
+	emitter := NewEmitter()
+	go emitter.Start(plugins, Settings.Middleware)
+
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		input.EmitGET()
+	}
+
+	wg.Wait()
+	emitter.Close()
+
+	if counter2 < 50 || counter2 > 150 {
+		t.Errorf("Expected around 10%% of traffic to go to second output: %d vs %d", counter1, counter2)
+	}
+
+	Settings.SplitOutput = false
+	Settings.SplitOutputWeights = nil
+}
+
+func TestEmitterSplitSticky(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	input := NewTestInput()
+	input.skipHeader = true
+
+	var mu sync.Mutex
+	users := make(map[string]int)
+	requests := make(map[string]int)
+	check := func(output int) func(*Message) {
+		return func(msg *Message) {
+			mu.Lock()
+			defer mu.Unlock()
+			defer wg.Done()
+			id := string(payloadID(msg.Meta))
+			if !isRequestPayload(msg.Meta) {
+				if requests[id] != output {
+					t.Errorf("response %s should go to the output of its request %d, got %d", id, requests[id], output)
+				}
+				return
+			}
+			requests[id] = output
+			user := string(proto.Header(msg.Data, []byte("X-User-ID")))
+			if user == "" {
+				user = string(proto.Cookie(msg.Data, []byte("session")))
+			}
+			if o, ok := users[user]; ok && o != output {
+				t.Errorf("user %s should always go to output %d, got %d", user, o, output)
+			}
+			users[user] = output
+		}
+	}
+
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input},
+		Outputs: []PluginWriter{NewTestOutput(check(0)), NewTestOutput(check(1)), NewTestOutput(check(2))},
+	}
+
+	Settings.SplitOutput = true
+	Settings.SplitOutputWeights.Set("1,1,1")
+	Settings.SplitOutputStickyHeader = "X-User-ID"
+	Settings.SplitOutputStickyCookie = "session"
+
+	emitter := NewEmitter()
+	go emitter.Start(plugins, Settings.Middleware)
+
+	for i := 0; i < 300; i++ {
+		wg.Add(2)
+		id := uuid()
+		if i%2 == 0 {
+			input.EmitBytes([]byte(fmt.Sprintf("1 %s 1 1\nGET / HTTP/1.1\r\nX-User-ID: user%d\r\n\r\n", id, i%10)))
+		} else {
+			input.EmitBytes([]byte(fmt.Sprintf("1 %s 1 1\nGET / HTTP/1.1\r\nCookie: a=b; session=s%d\r\n\r\n", id, i%10)))
+		}
+		input.EmitBytes([]byte(fmt.Sprintf("2 %s 1 1\nHTTP/1.1 200 OK\r\n\r\n", id)))
+	}
+
+	wg.Wait()
+	emitter.Close()
+
+	if len(users) != 10 {
+		t.Errorf("expected 10 users, got %d", len(users))
+	}
+
+	Settings.SplitOutput = false
+	Settings.SplitOutputWeights = nil
+	Settings.SplitOutputStickyHeader = ""
+	Settings.SplitOutputStickyCookie = ""
+}
+
+func TestOutputWeights(t *testing.T) {
+	var w OutputWeights
+	if err := w.Set("90%, 10%"); err != nil || len(w) != 2 || w[0] != 90 || w[1] != 10 {
+		t.Errorf("unexpected weights %v, err %v", w, err)
+	}
+	if err := w.Set("90,a"); err == nil {
+		t.Error("expected error for invalid weight")
+	}
+	if err := w.Set("100,0"); err != nil || w[1] != 0 {
+		t.Errorf("zero weight should be accepted, got %v, err %v", w, err)
+	}
+	if err := w.Set("100,-1"); err == nil {
+		t.Error("expected error for negative weight")
+	}
+}
+
 func BenchmarkEmitter(b *testing.B) {
 	wg := new(sync.WaitGroup)
 
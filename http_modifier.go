@@ -17,6 +17,8 @@ func NewHTTPModifier(config *HTTPModifierConfig) *HTTPModifier {
 	// Optimization to skip modifier completely if we do not need it
 	if len(config.URLRegexp) == 0 &&
 		len(config.URLNegativeRegexp) == 0 &&
+		len(config.EndpointRegexp) == 0 &&
+		len(config.EndpointNegativeRegexp) == 0 &&
 		len(config.URLRewrite) == 0 &&
 		len(config.HeaderRewrite) == 0 &&
 		len(config.HeaderFilters) == 0 &&
@@ -24,9 +26,11 @@ func NewHTTPModifier(config *HTTPModifierConfig) *HTTPModifier {
 		len(config.HeaderBasicAuthFilters) == 0 &&
 		len(config.HeaderHashFilters) == 0 &&
 		len(config.ParamHashFilters) == 0 &&
+		len(config.Sampling) == 0 &&
 		len(config.Params) == 0 &&
 		len(config.Headers) == 0 &&
-		len(config.Methods) == 0 {
+		len(config.Methods) == 0 &&
+		len(config.TimeShift) == 0 {
 		return nil
 	}
 
@@ -94,6 +98,31 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 		}
 	}
 
+	if len(m.config.EndpointRegexp) > 0 || len(m.config.EndpointNegativeRegexp) > 0 {
+		endpoint := []byte(endpointTemplate(payload))
+
+		if len(m.config.EndpointRegexp) > 0 {
+			matched := false
+
+			for _, f := range m.config.EndpointRegexp {
+				if f.regexp.Match(endpoint) {
+					matched = true
+					break
+				}
+			}
+
+			if !matched {
+				return
+			}
+		}
+
+		for _, f := range m.config.EndpointNegativeRegexp {
+			if f.regexp.Match(endpoint) {
+				return
+			}
+		}
+	}
+
 	if len(m.config.HeaderFilters) > 0 {
 		for _, f := range m.config.HeaderFilters {
 			value := proto.Header(payload, f.name)
@@ -165,6 +194,10 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 		}
 	}
 
+	if len(m.config.Sampling) > 0 && !m.config.Sampling.sampled(payload) {
+		return
+	}
+
 	if len(m.config.URLRewrite) > 0 {
 		path := proto.Path(payload)
 
@@ -12,6 +12,8 @@ import (
 type HTTPModifierConfig struct {
 	URLNegativeRegexp      HTTPURLRegexp              `json:"http-disallow-url"`
 	URLRegexp              HTTPURLRegexp              `json:"http-allow-url"`
+	EndpointNegativeRegexp HTTPURLRegexp              `json:"http-disallow-endpoint"`
+	EndpointRegexp         HTTPURLRegexp              `json:"http-allow-endpoint"`
 	URLRewrite             URLRewriteMap              `json:"http-rewrite-url"`
 	HeaderRewrite          HeaderRewriteMap           `json:"http-rewrite-header"`
 	HeaderFilters          HTTPHeaderFilters          `json:"http-allow-header"`
@@ -19,9 +21,11 @@ type HTTPModifierConfig struct {
 	HeaderBasicAuthFilters HTTPHeaderBasicAuthFilters `json:"http-basic-auth-filter"`
 	HeaderHashFilters      HTTPHashFilters            `json:"http-header-limiter"`
 	ParamHashFilters       HTTPHashFilters            `json:"http-param-limiter"`
+	Sampling               HTTPSamplingRules          `json:"http-sample"`
 	Params                 HTTPParams                 `json:"http-set-param"`
 	Headers                HTTPHeaders                `json:"http-set-header"`
 	Methods                HTTPMethods                `json:"http-allow-method"`
+	TimeShift              HTTPTimeShiftFields        `json:"http-time-shift"`
 }
 
 //
@@ -287,6 +287,34 @@ func TestHTTPModifierURLNegativeRegexp(t *testing.T) {
 	}
 }
 
+func TestHTTPModifierEndpointRegexp(t *testing.T) {
+	allow := HTTPURLRegexp{}
+	allow.Set("^GET /users/:id")
+	disallow := HTTPURLRegexp{}
+	disallow.Set("/orders$")
+
+	modifier := NewHTTPModifier(&HTTPModifierConfig{
+		EndpointRegexp:         allow,
+		EndpointNegativeRegexp: disallow,
+	})
+
+	payload := func(method, url string) []byte {
+		return []byte(method + " " + url + " HTTP/1.1\r\nHost: www.w3.org\r\n\r\n")
+	}
+
+	if len(modifier.Rewrite(payload("GET", "/users/12?full=1"))) == 0 {
+		t.Error("Should pass endpoint")
+	}
+
+	if len(modifier.Rewrite(payload("POST", "/users/12"))) > 0 {
+		t.Error("Should not pass method")
+	}
+
+	if len(modifier.Rewrite(payload("GET", "/users/12/orders"))) > 0 {
+		t.Error("Should not pass disallowed endpoint")
+	}
+}
+
 func TestHTTPModifierSetHeader(t *testing.T) {
 	filters := HTTPHeaders{}
 	filters.Set("User-Agent:Gor")
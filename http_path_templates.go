@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/buger/goreplay/byteutils"
+	"github.com/buger/goreplay/proto"
+)
+
+// pathTemplate is a path with named segments, like /users/:id/orders/:order.
+// `*` as the last segment matches the rest of the path: /static/*
+type pathTemplate struct {
+	segments []string
+	raw      string
+}
+
+func (t *pathTemplate) match(segments []string) bool {
+	for i, s := range t.segments {
+		if s == "*" && i == len(t.segments)-1 {
+			return len(segments) > i
+		}
+		if i >= len(segments) {
+			return false
+		}
+		if strings.HasPrefix(s, ":") {
+			if segments[i] == "" {
+				return false
+			}
+		} else if s != segments[i] {
+			return false
+		}
+	}
+	return len(segments) == len(t.segments)
+}
+
+// HTTPPathTemplates holds list of path templates set by --http-path-template.
+// Paths are normalized into templates, to group requests of the same endpoint in stats,
+// filters and limiters.
+type HTTPPathTemplates []*pathTemplate
+
+func (t *HTTPPathTemplates) String() string {
+	var templates []string
+	for _, template := range *t {
+		templates = append(templates, template.raw)
+	}
+	return fmt.Sprint(templates)
+}
+
+// Set method to implement flags.Value
+func (t *HTTPPathTemplates) Set(value string) error {
+	if !strings.HasPrefix(value, "/") {
+		return fmt.Errorf("path template should start with /, ex. /users/:id")
+	}
+	segments := strings.Split(value[1:], "/")
+	for i, s := range segments {
+		if s == ":" || s == "*" && i != len(segments)-1 {
+			return fmt.Errorf("invalid path template %q, `:` should be followed by name and `*` can be only the last segment", value)
+		}
+		if s == "" && i != len(segments)-1 {
+			return fmt.Errorf("invalid path template %q, empty segment", value)
+		}
+	}
+	*t = append(*t, &pathTemplate{segments: segments, raw: value})
+	return nil
+}
+
+// Normalize returns template of the path. The first matching template set by --http-path-template
+// is used, otherwise numeric, UUID and long hex segments are replaced with :id, :uuid and :hex.
+// Query string is dropped.
+func (t HTTPPathTemplates) Normalize(path []byte) string {
+	if i := strings.IndexByte(byteutils.SliceToString(path), '?'); i != -1 {
+		path = path[:i]
+	}
+	if len(path) == 0 || path[0] != '/' {
+		return string(path)
+	}
+	segments := strings.Split(string(path[1:]), "/")
+	for _, template := range t {
+		if template.match(segments) {
+			return template.raw
+		}
+	}
+
+	for i, s := range segments {
+		switch {
+		case isNumericSegment(s):
+			segments[i] = ":id"
+		case isUUIDSegment(s):
+			segments[i] = ":uuid"
+		case isHexSegment(s):
+			segments[i] = ":hex"
+		}
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+func isNumericSegment(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isHexByte(b byte) bool {
+	return b >= '0' && b <= '9' || b >= 'a' && b <= 'f' || b >= 'A' && b <= 'F'
+}
+
+// isUUIDSegment matches 8-4-4-4-12 hex digits
+func isUUIDSegment(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch i {
+		case 8, 13, 18, 23:
+			if s[i] != '-' {
+				return false
+			}
+		default:
+			if !isHexByte(s[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isHexSegment matches hashes and object ids: at least 16 hex digits, with both digits and letters,
+// so regular words are not matched
+func isHexSegment(s string) bool {
+	if len(s) < 16 {
+		return false
+	}
+	digits, letters := false, false
+	for i := 0; i < len(s); i++ {
+		if !isHexByte(s[i]) {
+			return false
+		}
+		if s[i] <= '9' {
+			digits = true
+		} else {
+			letters = true
+		}
+	}
+	return digits && letters
+}
+
+// endpointTemplate returns method and normalized path of the request, like "GET /users/:id"
+func endpointTemplate(payload []byte) string {
+	return string(proto.Method(payload)) + " " + Settings.PathTemplates.Normalize(proto.Path(payload))
+}
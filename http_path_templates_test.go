@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHTTPPathTemplatesNormalize(t *testing.T) {
+	var templates HTTPPathTemplates
+	for _, template := range []string{"/users/:login/repos", "/static/*", "/health"} {
+		if err := templates.Set(template); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path     string
+		template string
+	}{
+		{"/users/buger/repos", "/users/:login/repos"},
+		{"/users/buger/repos?page=2", "/users/:login/repos"},
+		{"/users/buger", "/users/buger"},
+		{"/users//repos", "/users//repos"},
+		{"/static/js/app.js", "/static/*"},
+		{"/static", "/static"},
+		{"/health", "/health"},
+		{"/users/123/orders/456", "/users/:id/orders/:id"},
+		{"/files/0b3cf9a8-69a4-4a6e-9f0b-5d8f2a1c3e7d", "/files/:uuid"},
+		{"/commits/3f786850e387550fdab836ed7e6dc881de23001b", "/commits/:hex"},
+		{"/objects/507f1f77bcf86cd799439011/", "/objects/:hex/"},
+		{"/blog/deadbeef", "/blog/deadbeef"},
+		{"/", "/"},
+		{"*", "*"},
+	}
+	for _, tt := range tests {
+		if template := templates.Normalize([]byte(tt.path)); template != tt.template {
+			t.Errorf("%q: expected %q, got %q", tt.path, tt.template, template)
+		}
+	}
+}
+
+func TestHTTPPathTemplatesSet(t *testing.T) {
+	for _, template := range []string{"users/:id", "/users/:", "/static/*/js", "/users//id"} {
+		var templates HTTPPathTemplates
+		if err := templates.Set(template); err == nil {
+			t.Errorf("%q: expected error", template)
+		}
+	}
+}
+
+func TestEndpointTemplate(t *testing.T) {
+	if e := endpointTemplate([]byte("POST /users/123/orders?expand=1 HTTP/1.1\r\n\r\n")); e != "POST /users/:id/orders" {
+		t.Errorf("wrong endpoint %q", e)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/buger/goreplay/byteutils"
+	"github.com/buger/goreplay/proto"
+)
+
+//
+// Handling of --http-sample option
+//
+type samplingRule struct {
+	method  []byte        // nil matches any method
+	path    *pathTemplate // nil matches any path
+	percent float64
+	raw     string
+}
+
+// HTTPSamplingRules holds list of per endpoint sampling rates, the first matching rule is applied
+type HTTPSamplingRules []*samplingRule
+
+func (r *HTTPSamplingRules) String() string {
+	var rules []string
+	for _, rule := range *r {
+		rules = append(rules, rule.raw)
+	}
+	return fmt.Sprint(rules)
+}
+
+// Set method to implement flags.Value, accepts `[METHOD] [PATH]=PERCENT%` value, where PATH is
+// a path template like /users/:id or /static/*, and * matches any method or path
+func (r *HTTPSamplingRules) Set(value string) error {
+	i := strings.LastIndexByte(value, '=')
+	if i < 1 || !strings.HasSuffix(value, "%") {
+		return fmt.Errorf("expected [METHOD] [PATH]=PERCENT%% format, ex. 'GET /health=1%%'")
+	}
+	rule := &samplingRule{raw: value}
+	percent, err := strconv.ParseFloat(strings.TrimSpace(value[i+1:len(value)-1]), 64)
+	if err != nil || percent < 0 || percent > 100 {
+		return fmt.Errorf("invalid sampling percent in %q, expected value from 0 to 100", value)
+	}
+	rule.percent = percent
+
+	for _, part := range strings.Fields(value[:i]) {
+		switch {
+		case part == "*":
+		case strings.HasPrefix(part, "/"):
+			if rule.path != nil {
+				return fmt.Errorf("several paths in sampling rule %q", value)
+			}
+			var templates HTTPPathTemplates
+			if err := templates.Set(part); err != nil {
+				return err
+			}
+			rule.path = templates[0]
+		default:
+			if rule.method != nil {
+				return fmt.Errorf("several methods in sampling rule %q", value)
+			}
+			rule.method = []byte(strings.ToUpper(part))
+		}
+	}
+
+	*r = append(*r, rule)
+	return nil
+}
+
+func (rule *samplingRule) match(method, path []byte) bool {
+	if rule.method != nil && !bytes.Equal(rule.method, method) {
+		return false
+	}
+	if rule.path == nil {
+		return true
+	}
+	if i := bytes.IndexByte(path, '?'); i != -1 {
+		path = path[:i]
+	}
+	if len(path) == 0 || path[0] != '/' {
+		return false
+	}
+	return rule.path.match(strings.Split(byteutils.SliceToString(path[1:]), "/"))
+}
+
+// sampled reports if request is kept by the first matching rule, requests matching no rule are kept
+func (r HTTPSamplingRules) sampled(payload []byte) bool {
+	method, path := proto.Method(payload), proto.Path(payload)
+	for _, rule := range r {
+		if rule.match(method, path) {
+			return rule.percent >= 100 || rand.Float64()*100 < rule.percent
+		}
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHTTPSamplingRulesSet(t *testing.T) {
+	var rules HTTPSamplingRules
+	for _, rule := range []string{"POST /checkout=100%", "get /health=1%", "/users/:id/*=0.5%", "DELETE=0%", "*=10%"} {
+		if err := rules.Set(rule); err != nil {
+			t.Fatalf("%q: %v", rule, err)
+		}
+	}
+	if string(rules[1].method) != "GET" || rules[1].path.raw != "/health" || rules[1].percent != 1 {
+		t.Errorf("wrong rule %+v", rules[1])
+	}
+	if rules[2].method != nil || rules[2].percent != 0.5 {
+		t.Errorf("wrong rule %+v", rules[2])
+	}
+	if rules[3].path != nil || rules[4].method != nil || rules[4].path != nil {
+		t.Errorf("wrong rules %+v %+v", rules[3], rules[4])
+	}
+
+	for _, rule := range []string{"/health", "/health=1", "/health=101%", "GET POST /=1%", "/a /b=1%", "users=1%x"} {
+		if err := rules.Set(rule); err == nil {
+			t.Errorf("%q: expected error", rule)
+		}
+	}
+}
+
+func TestHTTPModifierSampling(t *testing.T) {
+	var rules HTTPSamplingRules
+	rules.Set("POST /checkout=100%")
+	rules.Set("GET /health=0%")
+	rules.Set("/users/:id=10%")
+
+	modifier := NewHTTPModifier(&HTTPModifierConfig{Sampling: rules})
+
+	payload := func(method, path string) []byte {
+		return []byte(method + " " + path + " HTTP/1.1\r\nHost: www.w3.org\r\n\r\n")
+	}
+
+	passed := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		for _, req := range [][2]string{{"POST", "/checkout"}, {"GET", "/health"}, {"POST", "/health"}, {"GET", "/users/1?a=b"}} {
+			if len(modifier.Rewrite(payload(req[0], req[1]))) > 0 {
+				passed[req[0]+" "+req[1]]++
+			}
+		}
+	}
+
+	if passed["POST /checkout"] != 1000 {
+		t.Errorf("all checkouts should pass: %d", passed["POST /checkout"])
+	}
+	if passed["GET /health"] != 0 {
+		t.Errorf("health checks should be dropped: %d", passed["GET /health"])
+	}
+	if passed["POST /health"] != 1000 {
+		t.Errorf("requests matching no rule should pass: %d", passed["POST /health"])
+	}
+	if n := passed["GET /users/1?a=b"]; n < 50 || n > 150 {
+		t.Errorf("about 10%% of users should pass: %d", n)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/byteutils"
+	"github.com/buger/goreplay/proto"
+)
+
+// HTTPTemplateConfig holds rules for substituting values, captured from responses, into later requests
+type HTTPTemplateConfig struct {
+	Rules HTTPTemplateRules `json:"http-template"`
+	Limit int               `json:"http-template-limit"`
+}
+
+// httpTemplateRule captures a value from a response
+type httpTemplateRule struct {
+	source string // header, cookie, json or regex
+	name   []byte
+	path   []string
+	regexp *regexp.Regexp
+	raw    string
+}
+
+// HTTPTemplateRules holds list of rules set by --http-template
+type HTTPTemplateRules []*httpTemplateRule
+
+func (r *HTTPTemplateRules) String() string {
+	var rules []string
+	for _, rule := range *r {
+		rules = append(rules, rule.raw)
+	}
+	return fmt.Sprint(rules)
+}
+
+// Set method to implement flags.Value, accepts <source>:<name> value, where source is one of header, cookie, json or regex
+func (r *HTTPTemplateRules) Set(value string) error {
+	i := strings.IndexByte(value, ':')
+	if i < 1 || i == len(value)-1 {
+		return errors.New("expected <source>:<name> format, ex. header:X-CSRF-Token")
+	}
+	rule := &httpTemplateRule{source: value[:i], raw: value}
+	name := value[i+1:]
+
+	switch rule.source {
+	case "header", "cookie":
+		rule.name = []byte(name)
+	case "json":
+		rule.path = strings.Split(name, ".")
+	case "regex":
+		var err error
+		if rule.regexp, err = regexp.Compile(name); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown template source %q, expected one of header, cookie, json, regex", rule.source)
+	}
+
+	*r = append(*r, rule)
+	return nil
+}
+
+// extract returns captured value, or nil if response has no such value
+func (r *httpTemplateRule) extract(response []byte) []byte {
+	switch r.source {
+	case "header":
+		return proto.Header(response, r.name)
+	case "cookie":
+		for _, cookie := range proto.ParseHeaders(response)["Set-Cookie"] {
+			pair := cookie
+			if i := strings.IndexByte(cookie, ';'); i != -1 {
+				pair = cookie[:i]
+			}
+			if i := strings.IndexByte(pair, '='); i != -1 && strings.TrimSpace(pair[:i]) == string(r.name) {
+				return []byte(strings.TrimSpace(pair[i+1:]))
+			}
+		}
+	case "json":
+		return jsonPathValue(responseBody(response), r.path)
+	case "regex":
+		m := r.regexp.FindSubmatch(response)
+		if len(m) > 1 {
+			return m[1]
+		}
+		if len(m) == 1 {
+			return m[0]
+		}
+	}
+	return nil
+}
+
+// responseBody returns decoded response body, handling chunked transfer encoding
+func responseBody(response []byte) []byte {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(response)), nil)
+	if err != nil {
+		return proto.Body(response)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return body
+}
+
+// jsonPathValue returns value of the dot separated path, array elements are referenced by index: items.0.id
+func jsonPathValue(body []byte, path []string) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var v interface{}
+	if decoder.Decode(&v) != nil {
+		return nil
+	}
+
+	for _, key := range path {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil
+			}
+			v = node[i]
+		default:
+			return nil
+		}
+	}
+
+	switch value := v.(type) {
+	case string:
+		return []byte(value)
+	case json.Number:
+		return []byte(value)
+	case bool:
+		return []byte(strconv.FormatBool(value))
+	}
+	return nil
+}
+
+// templatePair holds values captured from original and replayed responses of the same request
+type templatePair struct {
+	original [][]byte
+	replayed [][]byte
+	created  int64
+}
+
+// HTTPTemplates captures values from original and replayed responses of the same request
+// using rules, and replaces original values with replayed ones in the following requests.
+// Original responses require --input-raw-track-response and replayed ones --output-http-track-response.
+type HTTPTemplates struct {
+	rules HTTPTemplateRules
+	limit int
+
+	mu         sync.Mutex
+	pending    map[string]*templatePair
+	lastCleanT int64
+	aliases    map[string]*list.Element // original value -> element with templateAlias
+	aliasOrder *list.List
+	lengths    map[int]int // lengths of original values -> number of aliases with such length
+}
+
+type templateAlias struct {
+	original string
+	replayed []byte
+}
+
+// NewHTTPTemplates returns nil if there are no rules
+func NewHTTPTemplates(config *HTTPTemplateConfig) *HTTPTemplates {
+	if len(config.Rules) == 0 {
+		return nil
+	}
+	if config.Limit <= 0 {
+		config.Limit = 100000
+	}
+	return &HTTPTemplates{
+		rules:      config.Rules,
+		limit:      config.Limit,
+		pending:    make(map[string]*templatePair),
+		lastCleanT: time.Now().UnixNano(),
+		aliases:    make(map[string]*list.Element),
+		aliasOrder: list.New(),
+		lengths:    make(map[int]int),
+	}
+}
+
+// Process captures values from responses and rewrites requests, message data is replaced in place
+func (t *HTTPTemplates) Process(msg *Message) {
+	switch msg.Meta[0] {
+	case RequestPayload:
+		msg.Data = t.rewrite(msg.Data)
+	case ResponsePayload, ReplayedResponsePayload:
+		t.capture(msg)
+	}
+}
+
+func (t *HTTPTemplates) capture(msg *Message) {
+	values := make([][]byte, len(t.rules))
+	found := false
+	for i, rule := range t.rules {
+		if values[i] = rule.extract(msg.Data); len(values[i]) > 0 {
+			found = true
+		}
+	}
+
+	id := string(payloadID(msg.Meta))
+	now := time.Now().UnixNano()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pair, ok := t.pending[id]
+	if !ok {
+		if !found {
+			return
+		}
+		pair = &templatePair{created: now}
+		t.pending[id] = pair
+	}
+	if msg.Meta[0] == ResponsePayload {
+		pair.original = values
+	} else {
+		pair.replayed = values
+	}
+
+	if pair.original != nil && pair.replayed != nil {
+		delete(t.pending, id)
+		for i := range t.rules {
+			original, replayed := pair.original[i], pair.replayed[i]
+			if len(original) > 0 && len(replayed) > 0 && !bytes.Equal(original, replayed) {
+				t.addAlias(string(original), replayed)
+			}
+		}
+	}
+
+	// Clean up requests for which we didn't get both responses
+	if len(t.pending)%1000 == 0 && now-t.lastCleanT > int64(60*time.Second) {
+		for k, v := range t.pending {
+			if now-v.created > int64(60*time.Second) {
+				delete(t.pending, k)
+			}
+		}
+		t.lastCleanT = now
+	}
+}
+
+// addAlias must be called with mu held
+func (t *HTTPTemplates) addAlias(original string, replayed []byte) {
+	if el, ok := t.aliases[original]; ok {
+		el.Value.(*templateAlias).replayed = replayed
+		t.aliasOrder.MoveToBack(el)
+		return
+	}
+	if t.aliasOrder.Len() >= t.limit {
+		oldest := t.aliasOrder.Remove(t.aliasOrder.Front()).(*templateAlias)
+		delete(t.aliases, oldest.original)
+		if t.lengths[len(oldest.original)]--; t.lengths[len(oldest.original)] == 0 {
+			delete(t.lengths, len(oldest.original))
+		}
+	}
+	t.aliases[original] = t.aliasOrder.PushBack(&templateAlias{original, replayed})
+	t.lengths[len(original)]++
+}
+
+// rewrite replaces original values with replayed ones. Values are matched only as whole words,
+// not surrounded by letters or digits, so short IDs do not match inside of other values.
+func (t *HTTPTemplates) rewrite(payload []byte) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.aliases) == 0 {
+		return payload
+	}
+
+	var out []byte
+	last := 0
+	for i := 0; i < len(payload); i++ {
+		if i > 0 && isTemplateWordByte(payload[i-1]) {
+			continue
+		}
+		for l := range t.lengths {
+			end := i + l
+			if end > len(payload) || (end < len(payload) && isTemplateWordByte(payload[end])) {
+				continue
+			}
+			el, ok := t.aliases[byteutils.SliceToString(payload[i:end])]
+			if !ok {
+				continue
+			}
+			if out == nil {
+				out = make([]byte, 0, len(payload))
+			}
+			out = append(out, payload[last:i]...)
+			out = append(out, el.Value.(*templateAlias).replayed...)
+			last = end
+			i = end - 1
+			break
+		}
+	}
+	if out == nil {
+		return payload
+	}
+	out = append(out, payload[last:]...)
+
+	// payload could be truncated, so Content-Length is adjusted, not calculated
+	if delta := len(proto.Body(out)) - len(proto.Body(payload)); delta != 0 {
+		if cl, err := strconv.Atoi(string(proto.Header(out, []byte("Content-Length")))); err == nil {
+			out = proto.SetHeader(out, []byte("Content-Length"), []byte(strconv.Itoa(cl+delta)))
+		}
+	}
+	return out
+}
+
+func isTemplateWordByte(b byte) bool {
+	return b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+// templateReader applies templates to messages read from the plugin
+type templateReader struct {
+	PluginReader
+	templates *HTTPTemplates
+}
+
+// Reader wraps plugin, so messages read from it are processed by templates
+func (t *HTTPTemplates) Reader(plugin PluginReader) PluginReader {
+	return &templateReader{plugin, t}
+}
+
+// PluginRead reads message from the wrapped plugin and processes it
+func (r *templateReader) PluginRead() (*Message, error) {
+	msg, err := r.PluginReader.PluginRead()
+	if err == nil && msg != nil && len(msg.Meta) > 0 {
+		r.templates.Process(msg)
+	}
+	return msg, err
+}
+
+func (r *templateReader) String() string {
+	return fmt.Sprint(r.PluginReader)
+}
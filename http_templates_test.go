@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func templateMessage(payloadType byte, id string, data string) *Message {
+	return &Message{Meta: payloadHeader(payloadType, []byte(id), 1, -1), Data: []byte(data)}
+}
+
+func TestHTTPTemplateRuleExtract(t *testing.T) {
+	body := `{"data": {"id": 12, "items": [{"id": "x"}]}}`
+	response := "HTTP/1.1 200 OK\r\nX-CSRF-Token: abc\r\nSet-Cookie: lang=en; Path=/\r\nSet-Cookie: session_id=s1; HttpOnly\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", len(body), body)
+
+	cases := []struct {
+		rule, value string
+	}{
+		{"header:X-CSRF-Token", "abc"},
+		{"cookie:session_id", "s1"},
+		{"json:data.id", "12"},
+		{"json:data.items.0.id", "x"},
+		{"json:data.missing", ""},
+		{`regex:"id": "(\w+)"`, "x"},
+		{"regex:HTTP/1.1", "HTTP/1.1"},
+	}
+	for _, c := range cases {
+		var rules HTTPTemplateRules
+		if err := rules.Set(c.rule); err != nil {
+			t.Fatal(c.rule, err)
+		}
+		if value := rules[0].extract([]byte(response)); string(value) != c.value {
+			t.Errorf("%s: expected %q, got %q", c.rule, c.value, value)
+		}
+	}
+
+	var rules HTTPTemplateRules
+	for _, rule := range []string{"header", "body:id", "regex:(", "json:"} {
+		if err := rules.Set(rule); err == nil {
+			t.Errorf("rule %q should be invalid", rule)
+		}
+	}
+}
+
+func TestHTTPTemplates(t *testing.T) {
+	var rules HTTPTemplateRules
+	rules.Set("header:X-CSRF-Token")
+	rules.Set("json:id")
+	templates := NewHTTPTemplates(&HTTPTemplateConfig{Rules: rules})
+
+	templates.Process(templateMessage(ReplayedResponsePayload, "a", "HTTP/1.1 200 OK\r\nX-CSRF-Token: replayed-token\r\nContent-Length: 9\r\n\r\n{\"id\": 7}"))
+	templates.Process(templateMessage(ResponsePayload, "a", "HTTP/1.1 200 OK\r\nX-CSRF-Token: token\r\nContent-Length: 10\r\n\r\n{\"id\": 12}"))
+	// the same values in both responses are not substituted
+	templates.Process(templateMessage(ResponsePayload, "b", "HTTP/1.1 200 OK\r\nX-CSRF-Token: same\r\n\r\n"))
+	templates.Process(templateMessage(ReplayedResponsePayload, "b", "HTTP/1.1 200 OK\r\nX-CSRF-Token: same\r\n\r\n"))
+
+	if len(templates.pending) != 0 || len(templates.aliases) != 2 {
+		t.Fatalf("expected 2 aliases and no pending responses, got %d and %d", len(templates.aliases), len(templates.pending))
+	}
+
+	msg := templateMessage(RequestPayload, "c", "POST /items/12?ref=123 HTTP/1.1\r\nX-CSRF-Token: token\r\nX-Other: tokens\r\nContent-Length: 22\r\n\r\ncsrf=token&item=12&x=1")
+	templates.Process(msg)
+	expected := "POST /items/7?ref=123 HTTP/1.1\r\nX-CSRF-Token: replayed-token\r\nX-Other: tokens\r\nContent-Length: 30\r\n\r\ncsrf=replayed-token&item=7&x=1"
+	if string(msg.Data) != expected {
+		t.Errorf("expected\n%q, got\n%q", expected, msg.Data)
+	}
+
+	msg = templateMessage(RequestPayload, "d", "GET /items/123 HTTP/1.1\r\n\r\n")
+	templates.Process(msg)
+	if string(msg.Data) != "GET /items/123 HTTP/1.1\r\n\r\n" {
+		t.Errorf("values should match only whole words, got %q", msg.Data)
+	}
+}
+
+func TestHTTPTemplatesLimit(t *testing.T) {
+	var rules HTTPTemplateRules
+	rules.Set("header:X-Id")
+	templates := NewHTTPTemplates(&HTTPTemplateConfig{Rules: rules, Limit: 2})
+
+	for i, id := range []string{"a", "bb", "ccc"} {
+		templates.Process(templateMessage(ResponsePayload, id, "HTTP/1.1 200 OK\r\nX-Id: "+id+"\r\n\r\n"))
+		templates.Process(templateMessage(ReplayedResponsePayload, id, "HTTP/1.1 200 OK\r\nX-Id: "+string(rune('x'+i))+"\r\n\r\n"))
+	}
+
+	msg := templateMessage(RequestPayload, "r", "GET /a/bb/ccc HTTP/1.1\r\n\r\n")
+	templates.Process(msg)
+	if string(msg.Data) != "GET /a/y/z HTTP/1.1\r\n\r\n" {
+		t.Errorf("the oldest value should be forgotten, got %q", msg.Data)
+	}
+	if _, ok := templates.lengths[1]; ok || len(templates.lengths) != 2 {
+		t.Errorf("lengths of forgotten values should be removed: %v", templates.lengths)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buger/goreplay/byteutils"
+	"github.com/buger/goreplay/proto"
+)
+
+//
+// Handling of --http-time-shift option
+//
+type timeShiftField struct {
+	source string // header, param or json
+	name   []byte
+	path   []string
+	raw    string
+}
+
+// HTTPTimeShiftFields holds list of request fields with dates, which are moved by the time passed since recording
+type HTTPTimeShiftFields []timeShiftField
+
+func (h *HTTPTimeShiftFields) String() string {
+	var fields []string
+	for _, f := range *h {
+		fields = append(fields, f.raw)
+	}
+	return fmt.Sprint(fields)
+}
+
+// Set method to implement flags.Value, accepts header:<name>, param:<name> or json:<path> value
+func (h *HTTPTimeShiftFields) Set(value string) error {
+	i := strings.IndexByte(value, ':')
+	if i < 1 || i == len(value)-1 {
+		return fmt.Errorf("expected <source>:<name> format, ex. header:If-Modified-Since")
+	}
+	field := timeShiftField{source: value[:i], raw: value}
+	switch field.source {
+	case "header", "param":
+		field.name = []byte(value[i+1:])
+	case "json":
+		field.path = strings.Split(value[i+1:], ".")
+	default:
+		return fmt.Errorf("unknown time shift source %q, expected one of header, param, json", field.source)
+	}
+	*h = append(*h, field)
+	return nil
+}
+
+// timeLayouts are date formats recognized in time shifted fields, unix timestamps in seconds
+// and milliseconds are recognized as well
+var timeLayouts = []string{
+	http.TimeFormat,
+	time.RFC1123Z,
+	time.RFC3339,
+	"2006-01-02T15:04:05.000Z07:00",
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// shiftTime moves date by offset keeping its format, returns nil if value is not a date
+func shiftTime(value []byte, offset time.Duration) []byte {
+	s := string(value)
+
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		switch len(s) {
+		case 10:
+			return []byte(strconv.FormatInt(n+int64(offset/time.Second), 10))
+		case 13:
+			return []byte(strconv.FormatInt(n+int64(offset/time.Millisecond), 10))
+		}
+		return nil
+	}
+
+	for _, layout := range timeLayouts {
+		t, err := time.Parse(layout, s)
+		// layout should match exactly to keep the original format
+		if err != nil || t.Format(layout) != s {
+			continue
+		}
+		return []byte(t.Add(offset).Format(layout))
+	}
+	return nil
+}
+
+// ShiftTime moves dates in configured fields of request by time passed since it was recorded.
+// recorded is request timestamp from payload meta in nanoseconds.
+func (m *HTTPModifier) ShiftTime(payload []byte, recorded int64) []byte {
+	if recorded <= 0 {
+		return payload
+	}
+	offset := time.Duration(time.Now().UnixNano() - recorded)
+	// Round to seconds, most of formats do not have better precision
+	offset = offset.Round(time.Second)
+	if offset == 0 {
+		return payload
+	}
+
+	for _, f := range m.config.TimeShift {
+		switch f.source {
+		case "header":
+			if value := proto.Header(payload, f.name); len(value) > 0 {
+				if shifted := shiftTime(value, offset); shifted != nil {
+					payload = proto.SetHeader(payload, f.name, shifted)
+				}
+			}
+		case "param":
+			value, start, _ := proto.PathParam(payload, f.name)
+			if start == -1 {
+				continue
+			}
+			unescaped, err := url.QueryUnescape(string(value))
+			if err != nil {
+				continue
+			}
+			if shifted := shiftTime([]byte(unescaped), offset); shifted != nil {
+				if unescaped != string(value) {
+					shifted = []byte(url.QueryEscape(string(shifted)))
+				}
+				payload = proto.SetPathParam(payload, f.name, shifted)
+			}
+		case "json":
+			payload = shiftJSONTime(payload, f.path, offset)
+		}
+	}
+	return payload
+}
+
+func shiftJSONTime(payload []byte, path []string, offset time.Duration) []byte {
+	bodyStart := proto.MIMEHeadersEndPos(payload)
+	if bodyStart == -1 || bodyStart >= len(payload) {
+		return payload
+	}
+	body := payload[bodyStart:]
+
+	start, end := jsonValueOffsets(body, path)
+	if start == -1 {
+		return payload
+	}
+	value := body[start:end]
+	quoted := len(value) > 1 && value[0] == '"'
+	if quoted {
+		value = value[1 : len(value)-1]
+	}
+	shifted := shiftTime(value, offset)
+	if shifted == nil {
+		return payload
+	}
+	if quoted {
+		shifted = append(append([]byte{'"'}, shifted...), '"')
+	}
+
+	delta := len(shifted) - (end - start)
+	payload = byteutils.Replace(payload, bodyStart+start, bodyStart+end, shifted)
+	if delta != 0 {
+		if cl, err := strconv.Atoi(string(proto.Header(payload, []byte("Content-Length")))); err == nil {
+			payload = proto.SetHeader(payload, []byte("Content-Length"), []byte(strconv.Itoa(cl+delta)))
+		}
+	}
+	return payload
+}
+
+// jsonValueOffsets returns position of the raw scalar value (quotes included) with
+// dot separated path, array elements are referenced by index. Returns -1 if not found.
+func jsonValueOffsets(body []byte, path []string) (start, end int) {
+	type frame struct {
+		object  bool
+		keyNext bool
+		key     string
+		index   int
+	}
+	var stack []*frame
+
+	matches := func() bool {
+		if len(stack) != len(path) {
+			return false
+		}
+		for i, f := range stack {
+			if f.object && f.key != path[i] || !f.object && strconv.Itoa(f.index) != path[i] {
+				return false
+			}
+		}
+		return true
+	}
+	valueDone := func() {
+		if len(stack) > 0 && stack[len(stack)-1].object {
+			stack[len(stack)-1].keyNext = true
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return -1, -1
+		}
+		delim, isDelim := token.(json.Delim)
+
+		if len(stack) > 0 {
+			top := stack[len(stack)-1]
+			if top.object && top.keyNext {
+				if isDelim { // closing '}'
+					stack = stack[:len(stack)-1]
+					valueDone()
+					continue
+				}
+				top.key, top.keyNext = token.(string), false
+				continue
+			}
+			if isDelim && (delim == ']' || delim == '}') {
+				stack = stack[:len(stack)-1]
+				valueDone()
+				continue
+			}
+			if !top.object {
+				top.index++
+			}
+		}
+
+		if isDelim {
+			stack = append(stack, &frame{object: delim == '{', keyNext: delim == '{', index: -1})
+			continue
+		}
+
+		if matches() {
+			end = int(decoder.InputOffset())
+			switch v := token.(type) {
+			case string:
+				start = bytes.LastIndexByte(body[:end-1], '"')
+				// escaped strings are not dates
+				if start == -1 || string(body[start+1:end-1]) != v {
+					return -1, -1
+				}
+			case json.Number:
+				start = end - len(v)
+			default:
+				return -1, -1
+			}
+			return start, end
+		}
+		valueDone()
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShiftTime(t *testing.T) {
+	offset := 49*time.Hour + 30*time.Minute
+	cases := map[string]string{
+		"Mon, 01 Mar 2021 10:00:00 GMT":   "Wed, 03 Mar 2021 11:30:00 GMT",
+		"Mon, 01 Mar 2021 10:00:00 +0300": "Wed, 03 Mar 2021 11:30:00 +0300",
+		"2021-03-01T10:00:00Z":            "2021-03-03T11:30:00Z",
+		"2021-03-01T10:00:00+03:00":       "2021-03-03T11:30:00+03:00",
+		"2021-03-01T10:00:00.000Z":        "2021-03-03T11:30:00.000Z",
+		"2021-03-01T10:00:00.123456Z":     "2021-03-03T11:30:00.123456Z",
+		"2021-03-01 10:00:00":             "2021-03-03 11:30:00",
+		"2021-03-01":                      "2021-03-03",
+		"1614592800":                      "1614771000",
+		"1614592800000":                   "1614771000000",
+		"12345":                           "",
+		"hello":                           "",
+	}
+	for value, expected := range cases {
+		if shifted := shiftTime([]byte(value), offset); string(shifted) != expected {
+			t.Errorf("%s: expected %q, got %q", value, expected, shifted)
+		}
+	}
+}
+
+func TestHTTPModifierShiftTime(t *testing.T) {
+	var fields HTTPTimeShiftFields
+	for _, f := range []string{"header:If-Modified-Since", "param:from", "param:to", "json:filter.range.1", "json:missing"} {
+		if err := fields.Set(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	modifier := NewHTTPModifier(&HTTPModifierConfig{TimeShift: fields})
+
+	body := `{"filter": {"range": ["2021-03-01", "2021-03-02"], "to": "2021-03-02"}}`
+	payload := "POST /search?from=2021-03-01T10%3A00%3A00Z&to=1614592800&q=2021-03-01 HTTP/1.1\r\n" +
+		"If-Modified-Since: Mon, 01 Mar 2021 10:00:00 GMT\r\nContent-Length: 72\r\n\r\n" + body
+	recorded := time.Now().Add(-48 * time.Hour).UnixNano()
+
+	shifted := string(modifier.ShiftTime([]byte(payload), recorded))
+	expected := "POST /search?from=2021-03-03T10%3A00%3A00Z&to=1614765600&q=2021-03-01 HTTP/1.1\r\n" +
+		"If-Modified-Since: Wed, 03 Mar 2021 10:00:00 GMT\r\nContent-Length: 72\r\n\r\n" +
+		strings.Replace(body, `"2021-03-02"]`, `"2021-03-04"]`, 1)
+	if shifted != expected {
+		t.Errorf("expected\n%q, got\n%q", expected, shifted)
+	}
+
+	if shifted := modifier.ShiftTime([]byte(payload), time.Now().UnixNano()); string(shifted) != payload {
+		t.Error("just recorded request should not change")
+	}
+}
+
+func TestJSONValueOffsets(t *testing.T) {
+	body := []byte(`{"a": [1, {"b": "x"}, [2, 3]], "c": {"d": {}, "e": 10}, "f": "say \"hi\""}`)
+	cases := map[string]string{
+		"a.0":   "1",
+		"a.1.b": `"x"`,
+		"a.2.1": "3",
+		"c.e":   "10",
+		"c.d":   "",
+		"a.3":   "",
+		"f":     "",
+	}
+	for path, expected := range cases {
+		start, end := jsonValueOffsets(body, strings.Split(path, "."))
+		value := ""
+		if start != -1 {
+			value = string(body[start:end])
+		}
+		if value != expected {
+			t.Errorf("%s: expected %q, got %q", path, expected, value)
+		}
+	}
+}
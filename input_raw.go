@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -27,7 +28,10 @@ type RAWInputConfig struct {
 	RealIPHeader    string             `json:"input-raw-realip-header"`
 	Stats           bool               `json:"input-raw-stats"`
 	AllowIncomplete bool               `json:"input-raw-allow-incomplete"`
-	quit            chan bool          // Channel used only to indicate goroutine should shutdown
+	TLSKeyLog       string             `json:"input-raw-tls-keylog"`
+	Framer          string             `json:"input-raw-framer"`
+	FramerConfig    capture.FramerConfig
+	quit            chan bool // Channel used only to indicate goroutine should shutdown
 	host            string
 	ports           []uint16
 }
@@ -37,10 +41,13 @@ type RAWInput struct {
 	sync.Mutex
 	RAWInputConfig
 	messageStats   []tcp.Stats
+	connStats      []tcp.ConnectionStats
 	listener       *capture.Listener
 	messageParser  *tcp.MessageParser
 	cancelListener context.CancelFunc
 	closed         bool
+	mysql          *mysqlTracker
+	portProtocols  map[uint16]tcp.TCPProtocol
 }
 
 // NewRAWInput constructor for RAWInput. Accepts raw input config as arguments.
@@ -49,9 +56,26 @@ func NewRAWInput(address string, config RAWInputConfig) (i *RAWInput) {
 	i.RAWInputConfig = config
 	i.quit = make(chan bool)
 
-	host, _ports, err := net.SplitHostPort(address)
+	var host, _ports string
+	var err error
+	if strings.Contains(address, "=") {
+		host, _ports, i.portProtocols, err = parsePortProtocols(address)
+	} else {
+		host, _ports, err = net.SplitHostPort(address)
+	}
 	if err != nil {
-		log.Fatalf("input-raw: error while parsing address: %s", err)
+		// pcap file can be given without ports, to read traffic of all ports
+		if info, e := os.Stat(address); e == nil && !info.IsDir() {
+			if i.Engine != capture.EnginePcapFile {
+				log.Fatalf("input-raw: %s is a file, use --input-raw-engine pcap_file to read it", address)
+			}
+			host, _ports = address, ""
+		} else {
+			log.Fatalf("input-raw: error while parsing address: %s", err)
+		}
+	}
+	if err = i.checkFramer(); err != nil {
+		log.Fatalf("input-raw: %s", err)
 	}
 
 	var ports []uint16
@@ -70,31 +94,112 @@ func NewRAWInput(address string, config RAWInputConfig) (i *RAWInput) {
 
 	i.host = host
 	i.ports = ports
+	if i.Protocol == tcp.ProtocolMySQL || i.hasPortProtocol(tcp.ProtocolMySQL) {
+		i.mysql = newMySQLTracker(i.TrackResponse)
+	}
 
 	i.listen(address)
 
 	return
 }
 
+// parsePortProtocols parses address of ports with their protocols, like :8080=http,:9000=binary, and returns
+// the host and the ports separated by comma. Ports without protocol use --input-raw-protocol.
+func parsePortProtocols(address string) (host, ports string, protocols map[uint16]tcp.TCPProtocol, err error) {
+	protocols = make(map[uint16]tcp.TCPProtocol)
+	var list []string
+	for _, entry := range strings.Split(address, ",") {
+		addr, name := strings.TrimSpace(entry), ""
+		if i := strings.LastIndexByte(addr, '='); i >= 0 {
+			addr, name = addr[:i], addr[i+1:]
+		}
+		if !strings.Contains(addr, ":") {
+			addr = ":" + addr
+		}
+		h, p, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", "", nil, err
+		}
+		if h != "" && host != "" && h != host {
+			return "", "", nil, fmt.Errorf("ports of different hosts %s and %s", host, h)
+		}
+		if h != "" {
+			host = h
+		}
+		port, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("invalid port %q", p)
+		}
+		if name != "" {
+			var protocol tcp.TCPProtocol
+			if err = protocol.Set(name); err != nil {
+				return "", "", nil, err
+			}
+			protocols[uint16(port)] = protocol
+		}
+		list = append(list, p)
+	}
+	return host, strings.Join(list, ","), protocols, nil
+}
+
+// hasPortProtocol reports whether the protocol is used by any port
+func (i *RAWInput) hasPortProtocol(protocol tcp.TCPProtocol) bool {
+	for _, p := range i.portProtocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFramer returns an error if the framer is combined with protocols of ports,
+// hints of their protocols would be used instead of the framer
+func (i *RAWInput) checkFramer() error {
+	if i.Framer != "" && len(i.portProtocols) > 0 {
+		return fmt.Errorf("--input-raw-framer %s can't be used with protocols of ports, capture these ports with separate inputs", i.Framer)
+	}
+	return nil
+}
+
 // PluginRead reads meassage from this plugin
 func (i *RAWInput) PluginRead() (*Message, error) {
 	var msgTCP *tcp.Message
 	var msg Message
-	select {
-	case <-i.quit:
-		return nil, ErrorStopped
-	case msgTCP = <-i.listener.Messages():
-		msg.Data = msgTCP.Data()
+	protocol := i.Protocol
+	for {
+		select {
+		case <-i.quit:
+			return nil, ErrorStopped
+		case msgTCP = <-i.listener.Messages():
+			msg.Data = msgTCP.Data()
+		}
+		if i.portProtocols != nil {
+			protocol = i.listener.PortProtocol(msgTCP.Packets()[0])
+		}
+		if protocol != tcp.ProtocolMySQL {
+			break
+		}
+		// commands are converted to SQL text, other messages are skipped
+		var ok bool
+		if msg.Data, ok = i.mysql.message(msgTCP, msg.Data); ok {
+			break
+		}
 	}
 
 	var msgType byte = ResponsePayload
-	if msgTCP.Direction == tcp.DirIncoming {
+	if msgTCP.Upgraded {
+		msgType = WebSocketPayload
+	} else if msgTCP.Direction == tcp.DirIncoming {
 		msgType = RequestPayload
-		if i.RealIPHeader != "" {
+		if i.RealIPHeader != "" && protocol == tcp.ProtocolHTTP {
 			msg.Data = proto.SetHeader(msg.Data, []byte(i.RealIPHeader), []byte(msgTCP.SrcAddr))
 		}
 	}
 	msg.Meta = payloadHeader(msgType, msgTCP.UUID(), msgTCP.Start.UnixNano(), msgTCP.End.UnixNano()-msgTCP.Start.UnixNano())
+	if i.portProtocols != nil {
+		// messages of different protocols are told apart by the protocol after the latency
+		msg.Meta = append(msg.Meta[:len(msg.Meta)-1], " "+protocol.String()+"\n"...)
+	}
 
 	// to be removed....
 	if msgTCP.Truncated {
@@ -119,6 +224,24 @@ func (i *RAWInput) listen(address string) {
 		log.Fatal(err)
 	}
 	i.listener.SetPcapOptions(i.PcapOptions)
+	i.listener.SetConnectionHandler(i.connectionClosed)
+	if i.TLSKeyLog != "" {
+		keyLog, err := tcp.NewTLSKeyLog(i.TLSKeyLog)
+		if err != nil {
+			log.Fatalf("input-raw: error while reading TLS key log: %s", err)
+		}
+		i.listener.SetTLSKeyLog(keyLog)
+	}
+	if i.Framer != "" {
+		framer, err := capture.NewFramer(i.Framer, i.ports, i.FramerConfig)
+		if err != nil {
+			log.Fatalf("input-raw: %s", err)
+		}
+		i.listener.SetFramer(framer)
+	}
+	if i.portProtocols != nil {
+		i.listener.SetPortProtocols(i.portProtocols)
+	}
 	err = i.listener.Activate()
 	if err != nil {
 		log.Fatal(err)
@@ -135,6 +258,16 @@ func (i *RAWInput) listen(address string) {
 	}()
 }
 
+// SetSpeedFactor sets the replay speed of pcap file, see capture.Listener.SetSpeedFactor
+func (i *RAWInput) SetSpeedFactor(factor float64) {
+	i.listener.SetSpeedFactor(factor)
+}
+
+// replaysPcapFile reports if the input replays pcap file at its recorded timing
+func (i *RAWInput) replaysPcapFile() bool {
+	return i.Engine == capture.EnginePcapFile && i.PcapFilePace
+}
+
 func (i *RAWInput) String() string {
 	return fmt.Sprintf("Intercepting traffic from: %s:%s", i.host, strings.Join(strings.Fields(fmt.Sprint(i.ports)), ","))
 }
@@ -162,6 +295,31 @@ func (i *RAWInput) Close() error {
 	return nil
 }
 
+// GetConnectionStats returns stats of closed connections so far and reset the stats
+func (i *RAWInput) GetConnectionStats() []tcp.ConnectionStats {
+	i.Lock()
+	defer func() {
+		i.connStats = []tcp.ConnectionStats{}
+		i.Unlock()
+	}()
+	return i.connStats
+}
+
+func (i *RAWInput) connectionClosed(cStats tcp.ConnectionStats) {
+	if cStats.LostBytes > 0 || cStats.Retransmitted > 0 {
+		Debug(2, "[INPUT-RAW] connection", cStats.String())
+	}
+	if !i.Stats {
+		return
+	}
+	i.Lock()
+	if len(i.connStats) >= 10000 {
+		i.connStats = []tcp.ConnectionStats{}
+	}
+	i.connStats = append(i.connStats, cStats)
+	i.Unlock()
+}
+
 func (i *RAWInput) addStats(mStats tcp.Stats) {
 	i.Lock()
 	if len(i.messageStats) >= 10000 {
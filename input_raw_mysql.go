@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+
+	"github.com/buger/goreplay/proto"
+	"github.com/buger/goreplay/tcp"
+)
+
+// maxMySQLConnections limits the number of tracked connections, connections closed without COM_QUIT are not removed
+const maxMySQLConnections = 10000
+
+// mysqlTracker converts captured MySQL commands to their SQL text, so filters and outputs work on queries.
+// Executions of prepared statements are converted to the statement query with the parameters substituted.
+// Commands which are not queries are skipped, with their responses.
+type mysqlTracker struct {
+	sync.Mutex
+	trackResponse bool
+	conns         map[string]*mysqlConn
+}
+
+// mysqlConn is the state of a client connection
+type mysqlConn struct {
+	attributes bool // client sends query attributes, CLIENT_QUERY_ATTRIBUTES
+	statements map[uint32]*mysqlStatement
+	prepared   []*mysqlStatement // statements waiting for COM_STMT_PREPARE response
+	lastID     uint32
+	skipped    map[string]bool // ids of skipped commands, their responses are skipped too
+}
+
+type mysqlStatement struct {
+	query    []byte
+	params   int
+	types    []byte         // parameter types sent by the first execution
+	longData map[int][]byte // parameters sent by COM_STMT_SEND_LONG_DATA
+}
+
+func newMySQLTracker(trackResponse bool) *mysqlTracker {
+	return &mysqlTracker{trackResponse: trackResponse, conns: make(map[string]*mysqlConn)}
+}
+
+// message returns the body of the message, SQL text for commands, it returns false if the message is skipped
+func (t *mysqlTracker) message(m *tcp.Message, data []byte) ([]byte, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	pckt := m.Packets()[0]
+	incoming := m.Direction == tcp.DirIncoming
+	key := pckt.Src() + "-" + pckt.Dst()
+	if !incoming {
+		key = pckt.Dst() + "-" + pckt.Src()
+	}
+	c := t.conns[key]
+	if c == nil {
+		if len(t.conns) >= maxMySQLConnections {
+			t.conns = make(map[string]*mysqlConn)
+		}
+		c = &mysqlConn{statements: make(map[uint32]*mysqlStatement), skipped: make(map[string]bool)}
+		t.conns[key] = c
+	}
+
+	packets, _ := proto.ParseMySQLPackets(data)
+	if !incoming {
+		return data, c.response(packets, string(m.UUID()))
+	}
+
+	query, quit := c.request(packets, t.trackResponse)
+	if quit {
+		delete(t.conns, key)
+	}
+	if query == nil {
+		if t.trackResponse {
+			if len(c.skipped) >= maxMySQLConnections {
+				c.skipped = make(map[string]bool)
+			}
+			c.skipped[string(m.UUID())] = true
+		}
+		return nil, false
+	}
+	return query, true
+}
+
+// request follows prepared statements, and returns SQL text of the query or the statement execution.
+// It reports if the client closes the connection.
+func (c *mysqlConn) request(packets []proto.MySQLPacket, trackResponse bool) (query []byte, quit bool) {
+	for _, p := range packets {
+		if p.Seq != 0 || len(p.Payload) == 0 {
+			// handshake response has capabilities of the client
+			if p.Seq == 1 && len(p.Payload) >= 4 {
+				if capabilities := binary.LittleEndian.Uint32(p.Payload); capabilities&proto.MySQLClientProtocol41 != 0 {
+					c.attributes = capabilities&proto.MySQLClientQueryAttributes != 0
+				}
+			}
+			continue
+		}
+
+		var st *mysqlStatement
+		if len(p.Payload) >= 5 {
+			st = c.statements[binary.LittleEndian.Uint32(p.Payload[1:])]
+		}
+		switch p.Payload[0] {
+		case proto.MySQLComQuery:
+			query, _ = proto.MySQLQuery(p.Payload, c.attributes)
+		case proto.MySQLComInitDB:
+			name := bytes.Replace(p.Payload[1:], []byte("`"), []byte("``"), -1)
+			query = append(append([]byte("USE `"), name...), '`')
+		case proto.MySQLComStmtPrepare:
+			st = &mysqlStatement{query: append([]byte(nil), p.Payload[1:]...)}
+			st.params = proto.MySQLPlaceholders(st.query)
+			if trackResponse {
+				// the id is known from the response
+				c.prepared = append(c.prepared, st)
+			} else {
+				// servers give statements sequential ids
+				c.lastID++
+				c.statements[c.lastID] = st
+			}
+		case proto.MySQLComStmtExecute:
+			if st == nil {
+				Debug(2, "[INPUT-RAW] execution of unknown MySQL statement")
+				continue
+			}
+			sql, types, ok := proto.MySQLExecuteQuery(st.query, st.params, p.Payload, st.types, st.longData, c.attributes)
+			if !ok {
+				Debug(2, "[INPUT-RAW] invalid MySQL statement execution")
+				continue
+			}
+			query, st.types, st.longData = sql, types, nil
+		case proto.MySQLComStmtSendLongData:
+			if st != nil && len(p.Payload) >= 7 {
+				if st.longData == nil {
+					st.longData = make(map[int][]byte)
+				}
+				param := int(binary.LittleEndian.Uint16(p.Payload[5:]))
+				st.longData[param] = append(st.longData[param], p.Payload[7:]...)
+			}
+		case proto.MySQLComStmtReset:
+			if st != nil {
+				st.longData = nil
+			}
+		case proto.MySQLComStmtClose:
+			if len(p.Payload) >= 5 {
+				delete(c.statements, binary.LittleEndian.Uint32(p.Payload[1:]))
+			}
+		case proto.MySQLComQuit:
+			quit = true
+		}
+	}
+	return
+}
+
+// response assigns the id of prepared statement, it returns false if the response is skipped
+func (c *mysqlConn) response(packets []proto.MySQLPacket, uuid string) bool {
+	if len(packets) == 0 {
+		return true
+	}
+	p := packets[0]
+	// the client waits for the response to COM_STMT_PREPARE before other commands
+	if len(c.prepared) > 0 {
+		st := c.prepared[0]
+		c.prepared = c.prepared[1:]
+		if id, params, ok := proto.MySQLPrepareOK(p.Payload); ok {
+			st.params = params
+			c.statements[id] = st
+			c.lastID = id
+		}
+	}
+	if c.skipped[uuid] {
+		delete(c.skipped, uuid)
+		return false
+	}
+	// server greeting
+	return !(p.Seq == 0 && len(p.Payload) > 0 && p.Payload[0] == 0x0a)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func mysqlTestPacket(seq byte, payload string) string {
+	n := len(payload)
+	return string([]byte{byte(n), byte(n >> 8), byte(n >> 16), seq}) + payload
+}
+
+func TestMySQLConnRequest(t *testing.T) {
+	packets := func(data string) []proto.MySQLPacket {
+		p, _ := proto.ParseMySQLPackets([]byte(data))
+		return p
+	}
+	execute := "\x17\x01\x00\x00\x00\x00\x01\x00\x00\x00"
+
+	for _, trackResponse := range []bool{false, true} {
+		c := &mysqlConn{statements: make(map[uint32]*mysqlStatement), skipped: make(map[string]bool)}
+		steps := []struct {
+			request  string
+			response string
+			query    string
+		}{
+			{mysqlTestPacket(0, "\x03SELECT 1"), "", "SELECT 1"},
+			{mysqlTestPacket(0, "\x02app"), "", "USE `app`"},
+			{mysqlTestPacket(0, "\x16SELECT * FROM t WHERE id = ?"), mysqlTestPacket(1, "\x00\x01\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00"), ""},
+			{mysqlTestPacket(0, execute+"\x00\x01\x03\x00\x05\x00\x00\x00"), "", "SELECT * FROM t WHERE id = 5"},
+			// the types of the first execution are used
+			{mysqlTestPacket(0, execute+"\x00\x00\x06\x00\x00\x00"), "", "SELECT * FROM t WHERE id = 6"},
+			{mysqlTestPacket(0, "\x18\x01\x00\x00\x00\x00\x00ab") + mysqlTestPacket(0, execute+"\x00\x00"), "", "SELECT * FROM t WHERE id = 'ab'"},
+			{mysqlTestPacket(0, "\x19\x01\x00\x00\x00") + mysqlTestPacket(0, "\x0e"), "", ""},
+			{mysqlTestPacket(0, execute+"\x00\x00\x06\x00\x00\x00"), "", ""},
+		}
+		for i, step := range steps {
+			query, quit := c.request(packets(step.request), trackResponse)
+			if string(query) != step.query || quit {
+				t.Errorf("%d: expected query %q, got %q", i, step.query, query)
+			}
+			if step.response != "" && trackResponse {
+				c.response(packets(step.response), "")
+			}
+		}
+		if _, quit := c.request(packets(mysqlTestPacket(0, "\x01")), trackResponse); !quit {
+			t.Error("COM_QUIT should close the connection")
+		}
+	}
+}
+
+func TestMySQLConnResponse(t *testing.T) {
+	c := &mysqlConn{statements: make(map[uint32]*mysqlStatement), skipped: map[string]bool{"1": true}}
+	ok, _ := proto.ParseMySQLPackets([]byte(mysqlTestPacket(1, "\x00\x00\x00\x02\x00\x00\x00")))
+	greeting, _ := proto.ParseMySQLPackets([]byte(mysqlTestPacket(0, "\x0a8.0.33\x00")))
+	if c.response(ok, "1") {
+		t.Error("response of skipped command should be skipped")
+	}
+	if !c.response(ok, "1") {
+		t.Error("response should not be skipped twice")
+	}
+	if c.response(greeting, "2") {
+		t.Error("server greeting should be skipped")
+	}
+}
@@ -278,6 +278,47 @@ func TestInputRAWChunkedEncoding(t *testing.T) {
 	wg.Wait()
 }
 
+func TestParsePortProtocols(t *testing.T) {
+	host, ports, protocols, err := parsePortProtocols("127.0.0.1:8080=http,:9000=binary,6379=redis,8081")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "127.0.0.1" || ports != "8080,9000,6379,8081" {
+		t.Errorf("wrong host %q or ports %q", host, ports)
+	}
+	expected := map[uint16]tcp.TCPProtocol{8080: tcp.ProtocolHTTP, 9000: tcp.ProtocolBinary, 6379: tcp.ProtocolRedis}
+	if len(protocols) != len(expected) {
+		t.Errorf("expected %d protocols, got %v", len(expected), protocols)
+	}
+	for port, protocol := range expected {
+		if got := protocols[port]; got != protocol {
+			t.Errorf("expected protocol %s of port %d, got %s", protocol.String(), port, got.String())
+		}
+	}
+
+	for _, address := range []string{"127.0.0.1:8080=http,10.0.0.1:9000=binary", ":8080=ftp", ":http=http"} {
+		if _, _, _, err = parsePortProtocols(address); err == nil {
+			t.Errorf("expected error for %q", address)
+		}
+	}
+}
+
+func TestCheckFramer(t *testing.T) {
+	_, _, protocols, err := parsePortProtocols(":11211=binary,:8080=http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &RAWInput{RAWInputConfig: RAWInputConfig{Framer: "memcached"}, portProtocols: protocols}
+	if err = i.checkFramer(); err == nil {
+		t.Error("framer should be rejected with protocols of ports")
+	}
+
+	i.portProtocols = nil
+	if err = i.checkFramer(); err != nil {
+		t.Errorf("framer should be accepted without protocols of ports: %s", err)
+	}
+}
+
 func BenchmarkRAWInputWithReplay(b *testing.B) {
 	var respCounter, reqCounter, replayCounter uint32
 	wg := &sync.WaitGroup{}
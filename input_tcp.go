@@ -24,6 +24,7 @@ type TCPInputConfig struct {
 	Secure          bool   `json:"input-tcp-secure"`
 	CertificatePath string `json:"input-tcp-certificate"`
 	KeyPath         string `json:"input-tcp-certificate-key"`
+	ClientCACert    string `json:"input-tcp-client-ca-cert"`
 }
 
 // NewTCPInput constructor for TCPInput, accepts address with port
@@ -65,6 +66,13 @@ func (i *TCPInput) listen(address string) {
 		}
 
 		config := &tls.Config{Certificates: []tls.Certificate{cer}}
+		if i.config.ClientCACert != "" {
+			config.ClientCAs, err = loadCertPool(i.config.ClientCACert)
+			if err != nil {
+				log.Fatalln("error while loading --input-tcp-client-ca-cert:", err)
+			}
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
 		listener, err := tls.Listen("tcp", address, config)
 		if err != nil {
 			log.Fatalln("[INPUT-TCP] failed to start INPUT-TCP listener:", err)
@@ -140,3 +140,61 @@ func TestTCPInputSecure(t *testing.T) {
 	wg.Wait()
 	emitter.Close()
 }
+
+func TestTCPInputClientCertificate(t *testing.T) {
+	dir, caFile, certFile, keyFile := writeTestCertificates(t)
+	defer os.RemoveAll(dir)
+
+	received := make(chan *Message, 10)
+	input := NewTCPInput("127.0.0.1:0", &TCPInputConfig{
+		Secure:          true,
+		CertificatePath: certFile,
+		KeyPath:         keyFile,
+		ClientCACert:    caFile,
+	})
+	defer input.Close()
+	go func() {
+		for {
+			msg, err := input.PluginRead()
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}()
+
+	// connection without client certificate is rejected
+	conn, err := tls.Dial("tcp", input.listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		conn.Write([]byte("1 1 1\nGET / HTTP/1.1\r\n\r\n" + payloadSeparator))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err = conn.Read(make([]byte, 1)); err == nil {
+			t.Error("connection without client certificate should be closed")
+		}
+		conn.Close()
+	}
+
+	output := NewTCPOutput(input.listener.Addr().String(), &TCPOutputConfig{
+		Secure:    true,
+		Workers:   1,
+		TLSCert:   certFile,
+		TLSKey:    keyFile,
+		TLSCACert: caFile,
+	})
+	defer output.(*TCPOutput).Close()
+	output.PluginWrite(&Message{Meta: []byte("1 2 3\n"), Data: []byte("GET / HTTP/1.1\r\n\r\n")})
+
+	select {
+	case msg := <-received:
+		if !bytes.HasPrefix(msg.Data, []byte("GET / HTTP/1.1\r\n\r\n")) {
+			t.Errorf("wrong message %q", msg.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message with client certificate was not received")
+	}
+	select {
+	case msg := <-received:
+		t.Errorf("message without client certificate was received: %q", msg.Data)
+	default:
+	}
+}
@@ -2,11 +2,7 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
-	"crypto/x509"
-	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 
 	"github.com/Shopify/sarama"
@@ -42,44 +38,14 @@ type KafkaTLSConfig struct {
 // KafkaMessage should contains catched request information that should be
 // passed as Json to Apache Kafka.
 type KafkaMessage struct {
-	ReqURL     string            `json:"Req_URL"`
-	ReqType    string            `json:"Req_Type"`
-	ReqID      string            `json:"Req_ID"`
-	ReqTs      string            `json:"Req_Ts"`
-	ReqMethod  string            `json:"Req_Method"`
-	ReqBody    string            `json:"Req_Body,omitempty"`
-	ReqHeaders map[string]string `json:"Req_Headers,omitempty"`
-}
-
-// NewTLSConfig loads TLS certificates
-func NewTLSConfig(clientCertFile, clientKeyFile, caCertFile string) (*tls.Config, error) {
-	tlsConfig := tls.Config{}
-
-	if clientCertFile != "" && clientKeyFile == "" {
-		return &tlsConfig, errors.New("Missing key of client certificate in kafka")
-	}
-	if clientCertFile == "" && clientKeyFile != "" {
-		return &tlsConfig, errors.New("missing TLS client certificate in kafka")
-	}
-	// Load client cert
-	if (clientCertFile != "") && (clientKeyFile != "") {
-		cert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
-		if err != nil {
-			return &tlsConfig, err
-		}
-		tlsConfig.Certificates = []tls.Certificate{cert}
-	}
-	// Load CA cert
-	if caCertFile != "" {
-		caCert, err := ioutil.ReadFile(caCertFile)
-		if err != nil {
-			return &tlsConfig, err
-		}
-		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(caCert)
-		tlsConfig.RootCAs = caCertPool
-	}
-	return &tlsConfig, nil
+	ReqURL      string            `json:"Req_URL"`
+	ReqEndpoint string            `json:"Req_Endpoint,omitempty"`
+	ReqType     string            `json:"Req_Type"`
+	ReqID       string            `json:"Req_ID"`
+	ReqTs       string            `json:"Req_Ts"`
+	ReqMethod   string            `json:"Req_Method"`
+	ReqBody     string            `json:"Req_Body,omitempty"`
+	ReqHeaders  map[string]string `json:"Req_Headers,omitempty"`
 }
 
 // NewKafkaConfig returns Kafka config with or without TLS
@@ -3,18 +3,34 @@ package main
 import (
 	"fmt"
 	"io"
+	"log"
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// maxLimiterEndpoints limits the number of endpoints counted separately, endpoints beyond it share one limit
+const maxLimiterEndpoints = 10000
+
 // Limiter is a wrapper for input or output plugin which adds rate limiting
 type Limiter struct {
-	plugin    interface{}
-	limit     int
-	isPercent bool
+	plugin      interface{}
+	limit       int
+	isPercent   bool
+	perEndpoint bool
+
+	currentRPS  int
+	currentTime int64
 
+	mu        sync.Mutex
+	endpoints map[string]*endpointRate
+	overflow  endpointRate // rate of endpoints which don't fit maxLimiterEndpoints
+}
+
+// endpointRate counts requests of an endpoint in the current second
+type endpointRate struct {
 	currentRPS  int
 	currentTime int64
 }
@@ -31,11 +47,31 @@ func parseLimitOptions(options string) (limit int, isPercent bool) {
 	return
 }
 
+// parseEndpointLimitOptions parses limit with optional `/endpoint` suffix, which is allowed for absolute limits only
+func parseEndpointLimitOptions(options string) (limit int, isPercent, perEndpoint bool, err error) {
+	if strings.HasSuffix(options, "/endpoint") {
+		options = strings.TrimSuffix(options, "/endpoint")
+		perEndpoint = true
+	}
+	limit, isPercent = parseLimitOptions(options)
+	if perEndpoint && isPercent {
+		return 0, false, false, fmt.Errorf("limit %q: /endpoint can't be used with percentage", options+"/endpoint")
+	}
+	return
+}
+
 // NewLimiter constructor for Limiter, accepts plugin and options
-// `options` allow to sprcify relatve or absolute limiting
+// `options` allow to sprcify relatve or absolute limiting,
+// absolute limit with `/endpoint` suffix is applied to each endpoint separately
 func NewLimiter(plugin interface{}, options string) PluginReadWriter {
 	l := new(Limiter)
-	l.limit, l.isPercent = parseLimitOptions(options)
+	var err error
+	if l.limit, l.isPercent, l.perEndpoint, err = parseEndpointLimitOptions(options); err != nil {
+		log.Fatal("[LIMITER] ", err)
+	}
+	if l.perEndpoint {
+		l.endpoints = make(map[string]*endpointRate)
+	}
 	l.plugin = plugin
 	l.currentTime = time.Now().UnixNano()
 
@@ -43,6 +79,10 @@ func NewLimiter(plugin interface{}, options string) PluginReadWriter {
 	if fi, ok := l.plugin.(*FileInput); ok && l.isPercent {
 		fi.speedFactor = float64(l.limit) / float64(100)
 	}
+	// The same applies to pcap files replayed at their recorded timing
+	if ri, ok := l.plugin.(*RAWInput); ok && l.isPercent && ri.replaysPcapFile() {
+		ri.SetSpeedFactor(float64(l.limit) / float64(100))
+	}
 
 	return l
 }
@@ -52,6 +92,9 @@ func (l *Limiter) isLimited() bool {
 	if _, ok := l.plugin.(*FileInput); ok && l.isPercent {
 		return false
 	}
+	if ri, ok := l.plugin.(*RAWInput); ok && l.isPercent && ri.replaysPcapFile() {
+		return false
+	}
 
 	if l.isPercent {
 		return l.limit <= rand.Intn(100)
@@ -71,9 +114,60 @@ func (l *Limiter) isLimited() bool {
 	return false
 }
 
+// isEndpointLimited applies absolute limit to each endpoint separately,
+// only requests are counted and limited
+func (l *Limiter) isEndpointLimited(msg *Message) bool {
+	if msg == nil || !isRequestPayload(msg.Meta) {
+		return false
+	}
+	endpoint := endpointTemplate(msg.Data)
+	now := time.Now().UnixNano()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rate, ok := l.endpoints[endpoint]
+	if !ok {
+		if len(l.endpoints) >= maxLimiterEndpoints {
+			l.evictEndpoints(now)
+		}
+		if len(l.endpoints) < maxLimiterEndpoints {
+			rate = &endpointRate{currentTime: now}
+			l.endpoints[endpoint] = rate
+		} else {
+			rate = &l.overflow
+		}
+	}
+	if now-rate.currentTime > time.Second.Nanoseconds() {
+		rate.currentTime = now
+		rate.currentRPS = 0
+	}
+	if rate.currentRPS >= l.limit {
+		return true
+	}
+	rate.currentRPS++
+	return false
+}
+
+// evictEndpoints removes endpoints without requests in the current second, their counters would be reset anyway
+func (l *Limiter) evictEndpoints(now int64) {
+	for endpoint, rate := range l.endpoints {
+		if now-rate.currentTime > time.Second.Nanoseconds() {
+			delete(l.endpoints, endpoint)
+		}
+	}
+}
+
+func (l *Limiter) isMessageLimited(msg *Message) bool {
+	if l.perEndpoint {
+		return l.isEndpointLimited(msg)
+	}
+	return l.isLimited()
+}
+
 // PluginWrite writes message to this plugin
 func (l *Limiter) PluginWrite(msg *Message) (n int, err error) {
-	if l.isLimited() {
+	if l.isMessageLimited(msg) {
 		return 0, nil
 	}
 	if w, ok := l.plugin.(PluginWriter); ok {
@@ -92,7 +186,7 @@ func (l *Limiter) PluginRead() (msg *Message, err error) {
 		return nil, io.ErrClosedPipe
 	}
 
-	if l.isLimited() {
+	if l.isMessageLimited(msg) {
 		return nil, nil
 	}
 
@@ -100,7 +194,7 @@ func (l *Limiter) PluginRead() (msg *Message, err error) {
 }
 
 func (l *Limiter) String() string {
-	return fmt.Sprintf("Limiting %s to: %d (isPercent: %v)", l.plugin, l.limit, l.isPercent)
+	return fmt.Sprintf("Limiting %s to: %d (isPercent: %v, perEndpoint: %v)", l.plugin, l.limit, l.isPercent, l.perEndpoint)
 }
 
 // Close closes the resources.
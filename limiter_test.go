@@ -5,6 +5,7 @@ package main
 import (
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestOutputLimiter(t *testing.T) {
@@ -109,3 +110,73 @@ func TestPercentLimiter2(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestEndpointLimiter(t *testing.T) {
+	limiter := NewLimiter(NewTestOutput(func(*Message) {}), "2/endpoint").(*Limiter)
+	if !limiter.perEndpoint || limiter.limit != 2 {
+		t.Fatalf("wrong limiter options: %s", limiter)
+	}
+
+	request := func(path string) *Message {
+		return &Message{Meta: payloadHeader(RequestPayload, uuid(), 1, 0), Data: []byte("GET " + path + " HTTP/1.1\r\n\r\n")}
+	}
+	passed := make(map[string]int)
+	for i := 0; i < 5; i++ {
+		for _, path := range []string{"/users/1", "/users/2", "/items"} {
+			if !limiter.isMessageLimited(request(path)) {
+				passed[path]++
+			}
+		}
+	}
+	if passed["/users/1"]+passed["/users/2"] != 2 || passed["/items"] != 2 {
+		t.Errorf("each endpoint should be limited separately: %v", passed)
+	}
+
+	response := &Message{Meta: payloadHeader(ResponsePayload, uuid(), 1, 0), Data: []byte("HTTP/1.1 200 OK\r\n\r\n")}
+	if limiter.isMessageLimited(response) {
+		t.Error("responses should not be limited")
+	}
+}
+
+func TestEndpointLimiterOptions(t *testing.T) {
+	if _, _, _, err := parseEndpointLimitOptions("10%/endpoint"); err == nil {
+		t.Error("percentage limit per endpoint should be an error")
+	}
+	limit, isPercent, perEndpoint, err := parseEndpointLimitOptions("10/endpoint")
+	if err != nil || limit != 10 || isPercent || !perEndpoint {
+		t.Errorf("wrong options %d %v %v %v", limit, isPercent, perEndpoint, err)
+	}
+}
+
+func TestEndpointLimiterEviction(t *testing.T) {
+	limiter := NewLimiter(NewTestOutput(func(*Message) {}), "1/endpoint").(*Limiter)
+	request := func(path string) *Message {
+		return &Message{Meta: payloadHeader(RequestPayload, uuid(), 1, 0), Data: []byte("GET " + path + " HTTP/1.1\r\n\r\n")}
+	}
+	// path templates replace numbers, so paths are made of letters
+	for i := 0; i < maxLimiterEndpoints; i++ {
+		path := "/"
+		for n := i; n > 0 || path == "/"; n /= 26 {
+			path += string(rune('a' + n%26))
+		}
+		limiter.isMessageLimited(request(path))
+	}
+	if len(limiter.endpoints) != maxLimiterEndpoints {
+		t.Fatalf("expected %d endpoints, got %d", maxLimiterEndpoints, len(limiter.endpoints))
+	}
+	// endpoints beyond the cap share one limit
+	if limiter.isMessageLimited(request("/new1")) || !limiter.isMessageLimited(request("/new2")) {
+		t.Error("new endpoints should share the overflow limit")
+	}
+	if len(limiter.endpoints) != maxLimiterEndpoints {
+		t.Errorf("endpoints should be capped, got %d", len(limiter.endpoints))
+	}
+
+	// endpoints without requests in the current second are evicted
+	for _, rate := range limiter.endpoints {
+		rate.currentTime -= 2 * time.Second.Nanoseconds()
+	}
+	if limiter.isMessageLimited(request("/new3")) || len(limiter.endpoints) != 1 {
+		t.Errorf("stale endpoints should be evicted, got %d endpoints", len(limiter.endpoints))
+	}
+}
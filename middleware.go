@@ -4,15 +4,27 @@ import (
 	"bufio"
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"os/exec"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
+const (
+	middlewareDialTimeout  = 5 * time.Second
+	middlewareWriteTimeout = 5 * time.Second
+	middlewareMinBackoff   = 100 * time.Millisecond
+	middlewareMaxBackoff   = 10 * time.Second
+)
+
+var errMiddlewareDisconnected = errors.New("middleware service disconnected")
+
 // Middleware represents a middleware object
 type Middleware struct {
 	command       string
@@ -23,16 +35,31 @@ type Middleware struct {
 	stop          chan bool // Channel used only to indicate goroutine should shutdown
 	closed        bool
 	mu            sync.RWMutex
+	conn          middlewareConn // middleware service connection
+	connClosed    bool
+	connMu        sync.Mutex
 }
 
-// NewMiddleware returns new middleware
+// NewMiddleware returns new middleware.
+// command is either an executable with its arguments, or the address of a
+// long-running middleware service in the form `unix:///path/to.sock`, `tcp://host:port` or `grpc://host:port`.
+// Unix and TCP services speak the same line based hex protocol as executables, gRPC services
+// receive and send raw payloads in a bidirectional stream, see grpcMiddlewareMethod.
 func NewMiddleware(command string) *Middleware {
 	m := new(Middleware)
 	m.command = command
 	m.data = make(chan *Message, 1000)
 	m.stop = make(chan bool)
 
-	commands := strings.Split(command, " ")
+	if network, address, ok := middlewareAddress(command); ok {
+		m.dial(network, address)
+		return m
+	}
+
+	commands, err := splitCommand(command)
+	if err != nil {
+		log.Fatalf("[MIDDLEWARE] command[%q] parse error: %q", command, err)
+	}
 	ctx, cancl := context.WithCancel(context.Background())
 	m.commandCancel = cancl
 	cmd := exec.CommandContext(ctx, commands[0], commands[1:]...)
@@ -64,6 +91,152 @@ func NewMiddleware(command string) *Middleware {
 	return m
 }
 
+// dial connects to a middleware service. The connection is used for both
+// directions of the protocol, if it gets lost middleware reconnects with backoff.
+func (m *Middleware) dial(network, address string) {
+	conn, err := dialMiddleware(network, address)
+	if err != nil {
+		log.Fatalf("[MIDDLEWARE] service[%q] connection error: %q", m.command, err)
+	}
+	m.setConn(conn)
+	m.Stdin = writerFunc(m.writeConn)
+	m.commandCancel = func() {
+		m.connMu.Lock()
+		m.connClosed = true
+		m.connMu.Unlock()
+		m.setConn(nil)
+	}
+
+	go m.serve(network, address, conn)
+}
+
+func (m *Middleware) serve(network, address string, conn middlewareConn) {
+	backoff := middlewareMinBackoff
+	for {
+		if conn != nil {
+			backoff = middlewareMinBackoff
+			m.read(conn)
+			if m.isClosed() {
+				return
+			}
+			m.setConn(nil)
+			Debug(0, fmt.Sprintf("[MIDDLEWARE] service[%q] disconnected, reconnecting", m.command))
+		}
+
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(backoff):
+		}
+
+		var err error
+		if conn, err = dialMiddleware(network, address); err != nil {
+			Debug(0, fmt.Sprintf("[MIDDLEWARE] service[%q] connection error: %q, retrying in %s", m.command, err, backoff))
+			conn = nil
+			if backoff *= 2; backoff > middlewareMaxBackoff {
+				backoff = middlewareMaxBackoff
+			}
+			continue
+		}
+		if !m.setConn(conn) {
+			return
+		}
+		Debug(1, fmt.Sprintf("[MIDDLEWARE] service[%q] reconnected", m.command))
+	}
+}
+
+// setConn replaces current service connection closing the previous one,
+// it returns false if middleware is already closed
+func (m *Middleware) setConn(conn middlewareConn) bool {
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+	if m.conn != nil {
+		m.conn.Close()
+	}
+	if conn != nil && m.connClosed {
+		conn.Close()
+		conn = nil
+	}
+	m.conn = conn
+	return conn != nil
+}
+
+// writeConn writes to current service connection, so stalled service can't block the pipeline forever
+func (m *Middleware) writeConn(p []byte) (int, error) {
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+	if m.conn == nil {
+		return 0, errMiddlewareDisconnected
+	}
+	m.conn.SetWriteDeadline(time.Now().Add(middlewareWriteTimeout))
+	return m.conn.Write(p)
+}
+
+// writerFunc is an adapter to allow the use of ordinary functions as io.Writer
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// middlewareAddress detects if middleware should connect to a service instead of running a command
+func middlewareAddress(command string) (network, address string, ok bool) {
+	for _, scheme := range []string{"unix", "tcp", "grpc"} {
+		if strings.HasPrefix(command, scheme+"://") {
+			return scheme, strings.TrimPrefix(command, scheme+"://"), true
+		}
+	}
+	return "", "", false
+}
+
+// splitCommand splits command line into arguments, respecting single and
+// double quotes and backslash escapes the same way a shell would do
+func splitCommand(command string) (args []string, err error) {
+	var arg strings.Builder
+	var quote rune
+	var escaped, inArg bool
+
+	for _, r := range command {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if escaped || quote != 0 {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
+
 // ReadFrom start a worker to read from this plugin
 func (m *Middleware) ReadFrom(plugin PluginReader) {
 	Debug(2, fmt.Sprintf("[MIDDLEWARE] command[%q] Starting reading from %q", m.command, plugin))
@@ -101,6 +274,7 @@ func (m *Middleware) copy(to io.Writer, from PluginReader) {
 		if m.isClosed() {
 			return
 		}
+		Debug(1, fmt.Sprintf("[MIDDLEWARE] command[%q] write error: %q", m.command, err))
 	}
 }
 
@@ -109,11 +283,9 @@ func (m *Middleware) read(from io.Reader) {
 	var line []byte
 	var e error
 	for {
+		// the command closed its stdout or service connection is lost
 		if line, e = reader.ReadBytes('\n'); e != nil {
-			if m.isClosed() {
-				return
-			}
-			continue
+			return
 		}
 		buf := make([]byte, (len(line)-1)/2)
 		if _, err := hex.Decode(buf, line[:len(line)-1]); err != nil {
@@ -143,6 +315,9 @@ func (m *Middleware) PluginRead() (msg *Message, err error) {
 }
 
 func (m *Middleware) String() string {
+	if _, _, ok := middlewareAddress(m.command); ok {
+		return fmt.Sprintf("Modifying traffic using %q service", m.command)
+	}
 	return fmt.Sprintf("Modifying traffic using %q command", m.command)
 }
 
@@ -159,6 +334,9 @@ func (m *Middleware) Close() error {
 	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
 	m.commandCancel()
 	close(m.stop)
 	m.closed = true
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// grpcMiddlewareMethod is the default method of gRPC middleware services:
+//
+//	service Middleware {
+//	  rpc Process(stream Payload) returns (stream Payload);
+//	}
+//	message Payload {
+//	  bytes data = 1;
+//	}
+const grpcMiddlewareMethod = "/goreplay.Middleware/Process"
+
+// grpcMaxMessageSize limits the size of messages received from the service
+const grpcMaxMessageSize = 64 << 20
+
+// middlewareConn is a connection to middleware service, it carries lines of the hex protocol
+type middlewareConn interface {
+	io.ReadWriteCloser
+	SetWriteDeadline(time.Time) error
+}
+
+// dialMiddleware connects to the middleware service, network is unix, tcp or grpc
+func dialMiddleware(network, address string) (middlewareConn, error) {
+	if network == "grpc" {
+		conn, err := dialGRPC(address)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	return net.DialTimeout(network, address, middlewareDialTimeout)
+}
+
+type grpcResponse struct {
+	resp *http.Response
+	err  error
+}
+
+// grpcConn is a bidirectional gRPC stream over plain text HTTP/2.
+// Each line of the hex protocol written to it is sent as a message with the decoded payload,
+// and each received message is read as a line, so the service gets raw payloads.
+type grpcConn struct {
+	conn     net.Conn
+	body     *io.PipeWriter
+	cancel   context.CancelFunc
+	response chan grpcResponse
+	resp     *http.Response
+	line     []byte // rest of the received message encoded as a line
+	deadline time.Time
+	close    sync.Once
+}
+
+// dialGRPC starts the stream, address is host:port with an optional method path, like
+// middleware.local:9000/package.Service/Method
+func dialGRPC(address string) (*grpcConn, error) {
+	method := grpcMiddlewareMethod
+	if i := strings.IndexByte(address, '/'); i >= 0 {
+		address, method = address[:i], address[i:]
+	}
+	conn, err := net.DialTimeout("tcp", address, middlewareDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := (&http2.Transport{AllowHTTP: true}).NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	body, w := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest(http.MethodPost, "http://"+address+method, body)
+	if err != nil {
+		cancel()
+		conn.Close()
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	c := &grpcConn{conn: conn, body: w, cancel: cancel, response: make(chan grpcResponse, 1)}
+	// servers may send response headers only with the first message
+	go func() {
+		resp, err := cc.RoundTrip(req)
+		c.response <- grpcResponse{resp, err}
+	}()
+	return c, nil
+}
+
+// Write sends the line as a message, the line is written by a single call
+func (c *grpcConn) Write(p []byte) (int, error) {
+	line := bytes.TrimSuffix(p, []byte("\n"))
+	payload := make([]byte, hex.DecodedLen(len(line)))
+	if _, err := hex.Decode(payload, line); err != nil {
+		return 0, err
+	}
+	if !c.deadline.IsZero() {
+		// the stream is broken if the message is written partially
+		timer := time.AfterFunc(time.Until(c.deadline), func() { c.Close() })
+		defer timer.Stop()
+	}
+	if _, err := c.body.Write(grpcMessage(payload)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read returns received messages as lines
+func (c *grpcConn) Read(p []byte) (int, error) {
+	if len(c.line) == 0 {
+		payload, err := c.recv()
+		if err != nil {
+			return 0, err
+		}
+		c.line = make([]byte, hex.EncodedLen(len(payload))+1)
+		hex.Encode(c.line, payload)
+		c.line[len(c.line)-1] = '\n'
+	}
+	n := copy(p, c.line)
+	c.line = c.line[n:]
+	return n, nil
+}
+
+func (c *grpcConn) recv() ([]byte, error) {
+	if c.resp == nil {
+		r := <-c.response
+		if r.err != nil {
+			return nil, r.err
+		}
+		c.resp = r.resp
+		if c.resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected HTTP status %s", c.resp.Status)
+		}
+		// responses without messages have the status in the headers
+		if err := grpcStatus(c.resp.Header); err != nil {
+			return nil, err
+		}
+	}
+
+	var header [5]byte
+	if _, err := io.ReadFull(c.resp.Body, header[:]); err != nil {
+		if err == io.EOF {
+			if err = grpcStatus(c.resp.Trailer); err == nil {
+				err = io.EOF
+			}
+		}
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, errors.New("compressed gRPC messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > grpcMaxMessageSize {
+		return nil, fmt.Errorf("gRPC message of %d bytes is too large", size)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(c.resp.Body, msg); err != nil {
+		return nil, err
+	}
+	return grpcPayload(msg)
+}
+
+// SetWriteDeadline sets the deadline of the following writes
+func (c *grpcConn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+// Close ends the stream and the connection
+func (c *grpcConn) Close() error {
+	c.close.Do(func() {
+		c.cancel()
+		c.body.CloseWithError(errMiddlewareDisconnected)
+		c.conn.Close()
+	})
+	return nil
+}
+
+// grpcStatus returns the error of non OK grpc-status
+func grpcStatus(header http.Header) error {
+	status := header.Get("Grpc-Status")
+	if status == "" || status == "0" {
+		return nil
+	}
+	return fmt.Errorf("gRPC status %s: %s", status, header.Get("Grpc-Message"))
+}
+
+// grpcMessage encodes the payload as a length prefixed Payload message
+func grpcMessage(payload []byte) []byte {
+	var size [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(size[:], uint64(len(payload)))
+	length := 1 + n + len(payload)
+
+	msg := make([]byte, 5, 5+length)
+	binary.BigEndian.PutUint32(msg[1:], uint32(length))
+	// field 1, length delimited
+	msg = append(msg, 0x0a)
+	msg = append(msg, size[:n]...)
+	return append(msg, payload...)
+}
+
+// grpcPayload decodes the data of Payload message, unknown fields are skipped
+func grpcPayload(msg []byte) (payload []byte, err error) {
+	errInvalid := errors.New("invalid gRPC Payload message")
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return nil, errInvalid
+		}
+		msg = msg[n:]
+		var value []byte
+		switch key & 7 {
+		case 0: // varint
+			if _, n = binary.Uvarint(msg); n <= 0 {
+				return nil, errInvalid
+			}
+		case 1: // 64-bit
+			n = 8
+		case 2: // length delimited
+			size, m := binary.Uvarint(msg)
+			if m <= 0 || size > uint64(len(msg)-m) {
+				return nil, errInvalid
+			}
+			value = msg[m : m+int(size)]
+			n = m + int(size)
+		case 5: // 32-bit
+			n = 4
+		default:
+			return nil, errInvalid
+		}
+		if n > len(msg) {
+			return nil, errInvalid
+		}
+		msg = msg[n:]
+		if key == 0x0a {
+			payload = value
+		}
+	}
+	return payload, nil
+}
@@ -3,14 +3,24 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/buger/goreplay/proto"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 const echoSh = "./examples/middleware/echo.sh"
@@ -152,3 +162,243 @@ func TestMiddlewareWithPrettify(t *testing.T) {
 	midd.Close()
 	Settings.PrettifyHTTP = false
 }
+
+func TestMiddlewareSplitCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		args    []string
+	}{
+		{"./echo.sh", []string{"./echo.sh"}},
+		{"go run  ./token_modifier.go", []string{"go", "run", "./token_modifier.go"}},
+		{`python -c "print('a b')"`, []string{"python", "-c", "print('a b')"}},
+		{`node 'my script.js' --flag`, []string{"node", "my script.js", "--flag"}},
+		{`/opt/my\ middleware ""`, []string{"/opt/my middleware", ""}},
+	}
+	for _, tt := range tests {
+		args, err := splitCommand(tt.command)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", tt.command, err)
+			continue
+		}
+		if strings.Join(args, "|") != strings.Join(tt.args, "|") || len(args) != len(tt.args) {
+			t.Errorf("expected %q to be split into %q, got %q", tt.command, tt.args, args)
+		}
+	}
+
+	for _, command := range []string{"", "echo 'a", `echo \`} {
+		if _, err := splitCommand(command); err == nil {
+			t.Errorf("expected error for %q", command)
+		}
+	}
+}
+
+// echoMiddleware emits messages through middleware and checks they come back unchanged
+func echoMiddleware(t *testing.T, midd *Middleware, in *TestInput, n int) {
+	quit := make(chan struct{})
+	var body = []byte("GET / HTTP/1.1\r\nHost: example.org\r\n\r\n")
+	count := uint32(0)
+	out := NewTestOutput(func(msg *Message) {
+		if !bytes.Equal(body, msg.Data) {
+			t.Errorf("expected %q to equal %q", body, msg.Data)
+		}
+		if atomic.AddUint32(&count, 1) == uint32(n) {
+			quit <- struct{}{}
+		}
+	})
+	pl := &InOutPlugins{}
+	pl.Inputs = []PluginReader{midd, in}
+	pl.Outputs = []PluginWriter{out}
+	pl.All = []interface{}{midd, out, in}
+	e := NewEmitter()
+	go e.Start(pl, "")
+	for i := 0; i < n; i++ {
+		in.EmitBytes(body)
+	}
+	select {
+	case <-quit:
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected %d messages, got %d", n, atomic.LoadUint32(&count))
+	}
+	e.Close()
+}
+
+// echoService accepts connections and returns every line as is
+func echoService(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+// echoGRPCService serves gRPC middleware streams returning every message as is
+func echoGRPCService(listener net.Listener) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != grpcMiddlewareMethod {
+			w.Header().Set("Grpc-Status", "12")
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		var header [5]byte
+		for {
+			if _, err := io.ReadFull(r.Body, header[:]); err != nil {
+				break
+			}
+			msg := make([]byte, binary.BigEndian.Uint32(header[1:]))
+			if _, err := io.ReadFull(r.Body, msg); err != nil {
+				break
+			}
+			w.Write(header[:])
+			w.Write(msg)
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("Grpc-Status", "0")
+	})
+	(&http.Server{Handler: h2c.NewHandler(handler, &http2.Server{})}).Serve(listener)
+}
+
+func TestMiddlewareService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gor_middleware")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, network := range []string{"unix", "tcp", "grpc"} {
+		t.Run(network, func(t *testing.T) {
+			var listener net.Listener
+			if network == "unix" {
+				listener, err = net.Listen("unix", filepath.Join(dir, "middleware.sock"))
+			} else {
+				listener, err = net.Listen("tcp", "127.0.0.1:0")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			if network == "grpc" {
+				go echoGRPCService(listener)
+			} else {
+				go echoService(listener)
+			}
+
+			address := network + "://" + listener.Addr().String()
+			in := NewTestInput()
+			midd := NewMiddleware(address)
+			midd.ReadFrom(in)
+			echoMiddleware(t, midd, in, 3)
+			midd.Close()
+
+			if midd.String() != fmt.Sprintf("Modifying traffic using %q service", address) {
+				t.Errorf("unexpected middleware description %q", midd)
+			}
+		})
+	}
+}
+
+func TestMiddlewareGRPCStatus(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go echoGRPCService(listener)
+
+	conn, err := dialGRPC(listener.Addr().String() + "/goreplay.Middleware/Unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Read(make([]byte, 10)); err == nil || !strings.Contains(err.Error(), "gRPC status 12") {
+		t.Errorf("expected gRPC status error, got %v", err)
+	}
+}
+
+func TestMiddlewareGRPCPayload(t *testing.T) {
+	msg := grpcMessage([]byte("1 2 3\nGET /"))
+	// unknown varint, fixed and bytes fields are skipped
+	data := append([]byte{0x10, 0x96, 0x01, 0x1d, 1, 2, 3, 4, 0x22, 1, 'x'}, msg[5:]...)
+	payload, err := grpcPayload(data)
+	if err != nil || string(payload) != "1 2 3\nGET /" {
+		t.Errorf("wrong payload %q, %v", payload, err)
+	}
+	if _, err = grpcPayload([]byte{0x0a, 10, 'x'}); err == nil {
+		t.Error("expected error for truncated message")
+	}
+}
+
+func TestMiddlewareServiceReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}()
+
+	midd := NewMiddleware("tcp://" + listener.Addr().String())
+	// service restarts and drops the first connection
+	(<-accepted).Close()
+	go echoService(listener)
+
+	// wait for middleware to reconnect
+	for i := 0; ; i++ {
+		midd.connMu.Lock()
+		connected := midd.conn != nil
+		midd.connMu.Unlock()
+		if connected && i > 0 {
+			break
+		}
+		if i > 100 {
+			t.Fatal("middleware didn't reconnect to the service")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if midd.isClosed() {
+		t.Fatal("middleware should not close when service disconnects")
+	}
+
+	in := NewTestInput()
+	midd.ReadFrom(in)
+	echoMiddleware(t, midd, in, 3)
+}
+
+func TestMiddlewareQuotedCommand(t *testing.T) {
+	in := NewTestInput()
+	midd := NewMiddleware(`sh -c 'cat'`)
+	midd.ReadFrom(in)
+	echoMiddleware(t, midd, in, 3)
+}
+
+func TestMiddlewareCommandExit(t *testing.T) {
+	midd := NewMiddleware("true")
+	done := make(chan error)
+	go func() {
+		_, err := midd.PluginRead()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != ErrorStopped {
+			t.Errorf("expected %q, got %q", ErrorStopped, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("middleware should stop when the command exits")
+	}
+	midd.Close()
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// MySQL capability flags of the client
+const (
+	mysqlClientLongPassword     = 0x00000001
+	mysqlClientLongFlag         = 0x00000004
+	mysqlClientConnectWithDB    = 0x00000008
+	mysqlClientProtocol41       = 0x00000200
+	mysqlClientTransactions     = 0x00002000
+	mysqlClientSecureConnection = 0x00008000
+	mysqlClientMultiStatements  = 0x00010000
+	mysqlClientMultiResults     = 0x00020000
+	mysqlClientPluginAuth       = 0x00080000
+	mysqlClientPluginAuthLenEnc = 0x00200000
+)
+
+// MySQL authentication plugins
+const (
+	mysqlNativePassword      = "mysql_native_password"
+	mysqlCachingSHA2Password = "caching_sha2_password"
+	// caching_sha2_password data sent by the server, and the request of the public key
+	mysqlCachingSHA2FastAuthOK = 0x03
+	mysqlCachingSHA2FullAuth   = 0x04
+	mysqlCachingSHA2RequestKey = 0x02
+)
+
+const (
+	mysqlHandshakeProtocolNumber = 0x0a
+	mysqlHandshakeMaxPacketSize  = 1 << 24
+	mysqlDefaultCollation        = 45 // utf8mb4_general_ci
+)
+
+// MySQLClientConfig connection settings of MySQLClient
+type MySQLClientConfig struct {
+	Address  string
+	User     string
+	Password string
+	Database string
+	Timeout  time.Duration
+}
+
+// MySQLClient is a connection to MySQL server, which sends queries in wire format
+type MySQLClient struct {
+	config *MySQLClientConfig
+	conn   net.Conn
+	reader *bufio.Reader
+	seq    byte
+}
+
+// NewMySQLClient returns a client, it connects on the first query
+func NewMySQLClient(config *MySQLClientConfig) *MySQLClient {
+	return &MySQLClient{config: config}
+}
+
+// Connect opens a connection and authenticates the user
+func (c *MySQLClient) Connect() (err error) {
+	c.Disconnect()
+
+	if c.conn, err = net.DialTimeout("tcp", c.config.Address, c.config.Timeout); err != nil {
+		return
+	}
+	c.conn.SetDeadline(time.Now().Add(c.config.Timeout))
+	c.reader = bufio.NewReader(c.conn)
+
+	if err = c.handshake(); err != nil {
+		c.Disconnect()
+	}
+	return
+}
+
+// handshake answers the server greeting, and makes authentication with mysql_native_password or
+// caching_sha2_password. Without TLS, caching_sha2_password full authentication encrypts the password
+// with the public key of the server.
+func (c *MySQLClient) handshake() error {
+	greeting, err := c.read()
+	if err != nil {
+		return err
+	}
+	if len(greeting) > 0 && greeting[0] == 0xff {
+		return mysqlError(greeting)
+	}
+	plugin, salt, err := mysqlGreeting(greeting)
+	if err != nil {
+		return err
+	}
+
+	capabilities := uint32(mysqlClientLongPassword | mysqlClientLongFlag | mysqlClientProtocol41 | mysqlClientTransactions |
+		mysqlClientSecureConnection | mysqlClientMultiStatements | mysqlClientMultiResults | mysqlClientPluginAuth |
+		mysqlClientPluginAuthLenEnc)
+	if c.config.Database != "" {
+		capabilities |= mysqlClientConnectWithDB
+	}
+	auth := mysqlScramble(plugin, c.config.Password, salt)
+
+	data := make([]byte, 32)
+	binary.LittleEndian.PutUint32(data, capabilities)
+	binary.LittleEndian.PutUint32(data[4:], mysqlHandshakeMaxPacketSize)
+	data[8] = mysqlDefaultCollation
+	data = append(append(data, c.config.User...), 0)
+	data = append(append(data, byte(len(auth))), auth...)
+	if c.config.Database != "" {
+		data = append(append(data, c.config.Database...), 0)
+	}
+	data = append(append(data, plugin...), 0)
+	if err = c.write(data); err != nil {
+		return err
+	}
+
+	for {
+		resp, err := c.read()
+		if err != nil {
+			return err
+		}
+		if len(resp) == 0 {
+			return errors.New("empty authentication response")
+		}
+		switch resp[0] {
+		case 0x00:
+			return nil
+		case 0xff:
+			return mysqlError(resp)
+		case 0xfe:
+			// authentication switch request
+			name, rest, ok := mysqlNullString(resp[1:])
+			if !ok {
+				return errors.New("invalid authentication switch request")
+			}
+			plugin, salt = string(name), bytes.TrimSuffix(rest, []byte{0})
+			if err = c.write(mysqlScramble(plugin, c.config.Password, salt)); err != nil {
+				return err
+			}
+		case 0x01:
+			if plugin != mysqlCachingSHA2Password || len(resp) < 2 {
+				return errors.New("unexpected authentication data")
+			}
+			switch resp[1] {
+			case mysqlCachingSHA2FastAuthOK:
+				// OK packet follows
+			case mysqlCachingSHA2FullAuth:
+				err = c.write([]byte{mysqlCachingSHA2RequestKey})
+			default:
+				// public key of the server
+				err = c.writeEncryptedPassword(resp[1:], salt)
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected authentication response %#x", resp[0])
+		}
+	}
+}
+
+// writeEncryptedPassword sends the password encrypted with the public key in PEM format
+func (c *MySQLClient) writeEncryptedPassword(key []byte, salt []byte) error {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return errors.New("invalid public key of the server")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	rsaKey, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("public key of the server is not RSA key")
+	}
+	password := append([]byte(c.config.Password), 0)
+	for i := range password {
+		password[i] ^= salt[i%len(salt)]
+	}
+	encrypted, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, rsaKey, password, nil)
+	if err != nil {
+		return err
+	}
+	return c.write(encrypted)
+}
+
+// Query sends COM_QUERY, and returns the response packets
+func (c *MySQLClient) Query(query []byte) (response []byte, err error) {
+	if c.conn == nil {
+		if err = c.Connect(); err != nil {
+			return
+		}
+	}
+
+	if len(query) >= 0xffffff {
+		return nil, errors.New("query is longer than maximum packet")
+	}
+	c.conn.SetDeadline(time.Now().Add(c.config.Timeout))
+	c.seq = 0
+	if err = c.write(append([]byte{proto.MySQLComQuery}, query...)); err != nil {
+		c.Disconnect()
+		return
+	}
+	state := new(mysqlResponseState)
+	for {
+		var header [4]byte
+		if _, err = io.ReadFull(c.reader, header[:]); err != nil {
+			c.Disconnect()
+			return
+		}
+		n := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+		packet := make([]byte, 4+n)
+		copy(packet, header[:])
+		if _, err = io.ReadFull(c.reader, packet[4:]); err != nil {
+			c.Disconnect()
+			return
+		}
+		response = append(response, packet...)
+		if proto.MySQLLength(state, false, response) == len(response) {
+			return
+		}
+	}
+}
+
+func (c *MySQLClient) write(payload []byte) error {
+	data := make([]byte, 4, 4+len(payload))
+	data[0], data[1], data[2], data[3] = byte(len(payload)), byte(len(payload)>>8), byte(len(payload)>>16), c.seq
+	c.seq++
+	_, err := c.conn.Write(append(data, payload...))
+	return err
+}
+
+// read reads a packet of the handshake, and returns its payload
+func (c *MySQLClient) read() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return nil, err
+	}
+	c.seq = header[3] + 1
+	payload := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+	_, err := io.ReadFull(c.reader, payload)
+	return payload, err
+}
+
+// Disconnect closes the connection
+func (c *MySQLClient) Disconnect() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// mysqlResponseState keeps the parsing state of a response, it lets MySQLLength continue from the last packet
+type mysqlResponseState struct {
+	state interface{}
+}
+
+func (s *mysqlResponseState) SetProtocolState(state interface{}) {
+	s.state = state
+}
+
+func (s *mysqlResponseState) ProtocolState() interface{} {
+	return s.state
+}
+
+// mysqlGreeting returns the authentication plugin and its data of the protocol version 10 greeting
+func mysqlGreeting(data []byte) (plugin string, salt []byte, err error) {
+	if len(data) == 0 || data[0] != mysqlHandshakeProtocolNumber {
+		return "", nil, errors.New("unsupported protocol version")
+	}
+	_, data, ok := mysqlNullString(data[1:])
+	// connection id, the first 8 bytes of plugin data, filler, capabilities, collation, status,
+	// capabilities, length of plugin data and reserved bytes
+	if !ok || len(data) < 31 {
+		return "", nil, errors.New("invalid server greeting")
+	}
+	salt = append([]byte(nil), data[4:12]...)
+	capabilities := uint32(binary.LittleEndian.Uint16(data[13:])) | uint32(binary.LittleEndian.Uint16(data[18:]))<<16
+	length := int(data[20]) - 8
+	if length < 13 {
+		length = 13
+	}
+	data = data[31:]
+	if capabilities&mysqlClientSecureConnection != 0 {
+		if len(data) < length {
+			return "", nil, errors.New("invalid server greeting")
+		}
+		// the plugin data ends with 0
+		salt = append(salt, bytes.TrimSuffix(data[:length], []byte{0})...)
+		data = data[length:]
+	}
+	plugin = mysqlNativePassword
+	if capabilities&mysqlClientPluginAuth != 0 {
+		if name, _, ok := mysqlNullString(data); ok {
+			plugin = string(name)
+		} else if len(data) > 0 {
+			plugin = string(data)
+		}
+	}
+	return plugin, salt, nil
+}
+
+// mysqlScramble returns authentication response of the plugin for the password
+func mysqlScramble(plugin, password string, salt []byte) []byte {
+	if password == "" {
+		return nil
+	}
+	switch plugin {
+	case mysqlCachingSHA2Password:
+		// XOR(SHA256(password), SHA256(SHA256(SHA256(password)), salt))
+		hash := sha256.Sum256([]byte(password))
+		double := sha256.Sum256(hash[:])
+		scramble := sha256.Sum256(append(double[:], salt...))
+		for i := range scramble {
+			scramble[i] ^= hash[i]
+		}
+		return scramble[:]
+	case mysqlNativePassword:
+		// XOR(SHA1(password), SHA1(salt, SHA1(SHA1(password))))
+		hash := sha1.Sum([]byte(password))
+		double := sha1.Sum(hash[:])
+		scramble := sha1.Sum(append(append([]byte(nil), salt...), double[:]...))
+		for i := range scramble {
+			scramble[i] ^= hash[i]
+		}
+		return scramble[:]
+	}
+	// the server answers with authentication switch to supported plugin
+	return nil
+}
+
+// mysqlNullString returns the null terminated string, and the data after it
+func mysqlNullString(data []byte) (s []byte, rest []byte, ok bool) {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 {
+		return nil, data, false
+	}
+	return data[:i], data[i+1:], true
+}
+
+// mysqlError returns the message of ERR packet
+func mysqlError(payload []byte) error {
+	// error code, SQL state marker and SQL state
+	if len(payload) < 9 {
+		return errors.New("unknown error")
+	}
+	return fmt.Errorf("error %d: %s", binary.LittleEndian.Uint16(payload[1:]), payload[9:])
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"log"
 	"sync/atomic"
 	"time"
 
@@ -14,6 +16,13 @@ type BinaryOutputConfig struct {
 	BufferSize     size.Size     `json:"output-tcp-response-buffer"`
 	Debug          bool          `json:"output-binary-debug"`
 	TrackResponses bool          `json:"output-binary-track-response"`
+	Secure         bool          `json:"output-binary-secure"`
+	SkipVerify     bool          `json:"output-binary-skip-verify"`
+	TLSCert        string        `json:"output-binary-tls-cert"`
+	TLSKey         string        `json:"output-binary-tls-key"`
+	TLSCACert      string        `json:"output-binary-tls-ca-cert"`
+	TLSServerName  string        `json:"output-binary-tls-server-name"`
+	TLSMinVersion  string        `json:"output-binary-tls-min-version"`
 }
 
 // BinaryOutput plugin manage pool of workers which send request to replayed server
@@ -31,6 +40,7 @@ type BinaryOutput struct {
 	quit          chan struct{}
 	config        *BinaryOutputConfig
 	queueStats    *GorStat
+	tlsConfig     *tls.Config
 }
 
 // NewBinaryOutput constructor for BinaryOutput
@@ -41,6 +51,14 @@ func NewBinaryOutput(address string, config *BinaryOutputConfig) PluginReadWrite
 	o.address = address
 	o.config = config
 
+	if config.Secure {
+		var err error
+		o.tlsConfig, err = newClientTLSConfig(config.TLSCert, config.TLSKey, config.TLSCACert, config.TLSServerName, config.TLSMinVersion, config.SkipVerify)
+		if err != nil {
+			log.Fatal("[OUTPUT-BINARY] error while loading TLS configuration: ", err)
+		}
+	}
+
 	o.queue = make(chan *Message, 1000)
 	o.responses = make(chan response, 1000)
 	o.needWorker = make(chan int, 1)
@@ -77,6 +95,8 @@ func (o *BinaryOutput) startWorker() {
 		Debug:              o.config.Debug,
 		Timeout:            o.config.Timeout,
 		ResponseBufferSize: int(o.config.BufferSize),
+		Secure:             o.config.Secure,
+		TLSConfig:          o.tlsConfig,
 	})
 
 	deathCount := 0
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"compress/gzip"
+	"container/list"
 	"errors"
 	"fmt"
 	"io"
@@ -56,9 +57,24 @@ type FileOutputConfig struct {
 	QueueLimit        int           `json:"output-file-queue-limit"`
 	Append            bool          `json:"output-file-append"`
 	BufferPath        string        `json:"output-file-buffer"`
+	GroupResponses    bool          `json:"output-file-group-responses"`
+	GroupTimeout      time.Duration `json:"output-file-group-timeout"`
+	GroupLimit        int           `json:"output-file-group-limit"`
 	onClose           func(string)
 }
 
+// responseGroup holds request, original response and replayed response
+// sharing the same ID, until all of them are received or the group expires
+type responseGroup struct {
+	id       string
+	messages [3]*Message
+	created  time.Time
+}
+
+func (g *responseGroup) complete() bool {
+	return g.messages[0] != nil && g.messages[1] != nil && g.messages[2] != nil
+}
+
 // FileOutput output plugin
 type FileOutput struct {
 	sync.RWMutex
@@ -74,6 +90,11 @@ type FileOutput struct {
 	currentFileSize int
 	totalFileSize   size.Size
 
+	groupsMu     sync.Mutex
+	groups       map[string]*list.Element // ID -> group, elements are ordered by creation time
+	groupOrder   *list.List
+	groupsClosed bool
+
 	config *FileOutputConfig
 }
 
@@ -92,12 +113,26 @@ func NewFileOutput(pathTemplate string, config *FileOutputConfig) *FileOutput {
 		config.FlushInterval = 100 * time.Millisecond
 	}
 
+	if config.GroupResponses {
+		if config.GroupTimeout <= 0 {
+			config.GroupTimeout = 5 * time.Second
+		}
+		if config.GroupLimit <= 0 {
+			config.GroupLimit = 10000
+		}
+		o.groups = make(map[string]*list.Element)
+		o.groupOrder = list.New()
+	}
+
 	go func() {
 		for {
 			time.Sleep(config.FlushInterval)
 			if o.IsClosed() {
 				break
 			}
+			if o.config.GroupResponses {
+				o.flushGroups(false)
+			}
 			o.updateName()
 			o.flush()
 		}
@@ -215,6 +250,104 @@ func (o *FileOutput) updateName() {
 
 // PluginWrite writes message to this plugin
 func (o *FileOutput) PluginWrite(msg *Message) (n int, err error) {
+	if o.config.GroupResponses {
+		return o.groupWrite(msg)
+	}
+	return o.write(msg)
+}
+
+// groupWrite holds the message until request, original response and replayed response
+// with the same ID are received, and writes them as adjacent records in this order.
+// Incomplete groups are written after GroupTimeout, see flushGroups, or when
+// the number of open groups reaches GroupLimit, starting from the oldest.
+func (o *FileOutput) groupWrite(msg *Message) (n int, err error) {
+	idx := int(msg.Meta[0] - RequestPayload)
+	if idx < 0 || idx > 2 {
+		return o.write(msg)
+	}
+	id := string(payloadID(msg.Meta))
+
+	var ready []*responseGroup
+	o.groupsMu.Lock()
+	if o.groupsClosed {
+		o.groupsMu.Unlock()
+		return o.write(msg)
+	}
+	e, ok := o.groups[id]
+	if ok && e.Value.(*responseGroup).messages[idx] != nil {
+		// same payload type received twice, the previous group can't be completed anymore
+		ready = append(ready, o.removeGroup(e))
+		ok = false
+	}
+	if !ok {
+		if o.groupOrder.Len() >= o.config.GroupLimit {
+			ready = append(ready, o.removeGroup(o.groupOrder.Front()))
+		}
+		e = o.groupOrder.PushBack(&responseGroup{id: id, created: time.Now()})
+		o.groups[id] = e
+	}
+	g := e.Value.(*responseGroup)
+	g.messages[idx] = msg
+	if g.complete() {
+		ready = append(ready, o.removeGroup(e))
+	}
+	o.groupsMu.Unlock()
+
+	for _, g := range ready {
+		if _, err = o.writeGroup(g); err != nil {
+			return
+		}
+	}
+	return len(msg.Data) + len(msg.Meta), nil
+}
+
+// removeGroup must be called with groupsMu held
+func (o *FileOutput) removeGroup(e *list.Element) *responseGroup {
+	g := o.groupOrder.Remove(e).(*responseGroup)
+	delete(o.groups, g.id)
+	return g
+}
+
+func (o *FileOutput) writeGroup(g *responseGroup) (n int, err error) {
+	var nn int
+	for _, msg := range g.messages {
+		if msg == nil {
+			continue
+		}
+		nn, err = o.write(msg)
+		n += nn
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// flushGroups writes expired groups, if closing is set it writes all of them
+// and any group message received after that is written straight away
+func (o *FileOutput) flushGroups(closing bool) {
+	var expired []*responseGroup
+	now := time.Now()
+
+	o.groupsMu.Lock()
+	o.groupsClosed = o.groupsClosed || closing
+	for e := o.groupOrder.Front(); e != nil; e = o.groupOrder.Front() {
+		if !closing && now.Sub(e.Value.(*responseGroup).created) < o.config.GroupTimeout {
+			break
+		}
+		expired = append(expired, o.removeGroup(e))
+	}
+	o.groupsMu.Unlock()
+
+	for _, g := range expired {
+		if _, err := o.writeGroup(g); err != nil {
+			Debug(0, "[OUTPUT-FILE] error while writing response group", err)
+			return
+		}
+	}
+}
+
+func (o *FileOutput) write(msg *Message) (n int, err error) {
 	if o.requestPerFile {
 		o.Lock()
 		meta := payloadMeta(msg.Meta)
@@ -314,6 +447,9 @@ func (o *FileOutput) closeLocked() error {
 
 // Close closes the output file that is being written to.
 func (o *FileOutput) Close() error {
+	if o.config.GroupResponses {
+		o.flushGroups(true)
+	}
 	o.Lock()
 	defer o.Unlock()
 	return o.closeLocked()
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"math/rand"
 	"os"
@@ -331,3 +332,101 @@ func TestFileOutputAppendSizeLimitOverflow(t *testing.T) {
 	os.Remove(name1)
 	os.Remove(name3)
 }
+
+// readFileRecords returns data of all the records written to the file
+func readFileRecords(t *testing.T, name string) (records []string) {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Split(payloadScanner)
+	for scanner.Scan() {
+		_, data := payloadMetaWithBody(scanner.Bytes())
+		records = append(records, string(data))
+	}
+	return
+}
+
+func openGroups(o *FileOutput) int {
+	o.groupsMu.Lock()
+	defer o.groupsMu.Unlock()
+	return len(o.groups)
+}
+
+func TestFileOutputGroupResponses(t *testing.T) {
+	name := fmt.Sprintf("/tmp/%d", rand.Int63())
+	defer os.Remove(name)
+
+	output := NewFileOutput(name, &FileOutputConfig{Append: true, FlushInterval: time.Minute, GroupResponses: true, GroupTimeout: time.Minute})
+
+	output.PluginWrite(&Message{Meta: payloadHeader(ReplayedResponsePayload, []byte("a"), 1, 1), Data: []byte("replayed a")})
+	output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, []byte("b"), 1, 1), Data: []byte("request b")})
+	output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, []byte("a"), 1, 1), Data: []byte("request a")})
+	// not a request or response, written straight away
+	output.PluginWrite(&Message{Meta: []byte("4 c 1 1\n"), Data: []byte("other c")})
+	output.PluginWrite(&Message{Meta: payloadHeader(ResponsePayload, []byte("a"), 1, 1), Data: []byte("response a")})
+	output.PluginWrite(&Message{Meta: payloadHeader(ResponsePayload, []byte("b"), 1, 1), Data: []byte("response b")})
+	// same payload type twice, the previous group is written incomplete
+	output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, []byte("d"), 1, 1), Data: []byte("request d")})
+	output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, []byte("d"), 1, 1), Data: []byte("request d2")})
+
+	if n := openGroups(output); n != 2 {
+		t.Errorf("expected 2 incomplete groups, got %d", n)
+	}
+	output.Close()
+
+	expected := []string{"other c", "request a", "response a", "replayed a", "request d", "request b", "response b", "request d2"}
+	if records := readFileRecords(t, name); !reflect.DeepEqual(records, expected) {
+		t.Errorf("expected %q, got %q", expected, records)
+	}
+}
+
+func TestFileOutputGroupResponsesTimeout(t *testing.T) {
+	name := fmt.Sprintf("/tmp/%d", rand.Int63())
+	defer os.Remove(name)
+
+	output := NewFileOutput(name, &FileOutputConfig{Append: true, FlushInterval: 10 * time.Millisecond, GroupResponses: true, GroupTimeout: 50 * time.Millisecond})
+	defer output.Close()
+
+	output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, []byte("a"), 1, 1), Data: []byte("request a")})
+	output.PluginWrite(&Message{Meta: payloadHeader(ResponsePayload, []byte("a"), 1, 1), Data: []byte("response a")})
+
+	time.Sleep(300 * time.Millisecond)
+	if n := openGroups(output); n != 0 {
+		t.Errorf("expected expired group to be written, %d groups still open", n)
+	}
+
+	expected := []string{"request a", "response a"}
+	if records := readFileRecords(t, name); !reflect.DeepEqual(records, expected) {
+		t.Errorf("expected %q, got %q", expected, records)
+	}
+}
+
+func TestFileOutputGroupResponsesLimit(t *testing.T) {
+	name := fmt.Sprintf("/tmp/%d", rand.Int63())
+	defer os.Remove(name)
+
+	output := NewFileOutput(name, &FileOutputConfig{Append: true, FlushInterval: time.Minute, GroupResponses: true, GroupTimeout: time.Minute, GroupLimit: 2})
+
+	for _, id := range []string{"a", "b", "c"} {
+		output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, []byte(id), 1, 1), Data: []byte("request " + id)})
+	}
+	if n := openGroups(output); n != 2 {
+		t.Errorf("expected 2 open groups, got %d", n)
+	}
+	output.flush()
+
+	expected := []string{"request a"}
+	if records := readFileRecords(t, name); !reflect.DeepEqual(records, expected) {
+		t.Errorf("expected %q, got %q", expected, records)
+	}
+
+	output.Close()
+	expected = []string{"request a", "request b", "request c"}
+	if records := readFileRecords(t, name); !reflect.DeepEqual(records, expected) {
+		t.Errorf("expected %q, got %q", expected, records)
+	}
+}
@@ -3,11 +3,12 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"crypto/tls"
 	"fmt"
 	"log"
 	"math"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httputil"
 	"net/url"
 	"sync/atomic"
@@ -44,8 +45,38 @@ type HTTPOutputConfig struct {
 	WorkerTimeout  time.Duration `json:"output-http-worker-timeout"`
 	BufferSize     size.Size     `json:"output-http-response-buffer"`
 	SkipVerify     bool          `json:"output-http-skip-verify"`
-	rawURL         string
-	url            *url.URL
+
+	MaxIdleConnsPerHost int           `json:"output-http-max-idle-conns-per-host"`
+	MaxConnsPerHost     int           `json:"output-http-max-conns-per-host"`
+	IdleConnTimeout     time.Duration `json:"output-http-idle-conn-timeout"`
+	DisableKeepAlive    bool          `json:"output-http-disable-keepalive"`
+	ForceHTTP2          bool          `json:"output-http-force-http2"`
+	DialTimeout         time.Duration `json:"output-http-dial-timeout"`
+	TLSHandshakeTimeout time.Duration `json:"output-http-tls-handshake-timeout"`
+	Proxy               string        `json:"output-http-proxy"`
+	LocalAddr           string        `json:"output-http-local-addr"`
+	TLSCert             string        `json:"output-http-tls-cert"`
+	TLSKey              string        `json:"output-http-tls-key"`
+	TLSCACert           string        `json:"output-http-tls-ca-cert"`
+	TLSServerName       string        `json:"output-http-tls-server-name"`
+	TLSMinVersion       string        `json:"output-http-tls-min-version"`
+
+	Auth HTTPAuthConfig
+
+	CookieJar      string `json:"output-http-cookie-jar"`
+	CookieJarLimit int    `json:"output-http-cookie-jar-limit"`
+	realIPHeader   string // --input-raw-realip-header, client address of cookie jars
+
+	DiscoveryInterval time.Duration `json:"output-http-discovery-interval"`
+	EjectFailures     int           `json:"output-http-eject-failures"`
+	EjectDuration     time.Duration `json:"output-http-eject-duration"`
+
+	EndpointStats         bool          `json:"output-http-endpoint-stats"`
+	EndpointStatsInterval time.Duration `json:"output-http-endpoint-stats-interval"`
+
+	rawURL   string
+	url      *url.URL
+	backends *backendPool
 }
 
 // HTTPOutput plugin manage pool of workers which send request to replayed server
@@ -55,6 +86,7 @@ type HTTPOutput struct {
 	activeWorkers int32
 	config        *HTTPOutputConfig
 	queueStats    *GorStat
+	endpointStats *HTTPEndpointStats
 	elasticSearch *ESPlugin
 	client        *HTTPClient
 	stopWorker    chan struct{}
@@ -67,6 +99,9 @@ type HTTPOutput struct {
 // Initialize workers
 func NewHTTPOutput(address string, config *HTTPOutputConfig) PluginReadWriter {
 	o := new(HTTPOutput)
+	// every --output-http is given the same config, the address and defaults belong to this output only
+	conf := *config
+	config = &conf
 	var err error
 	config.url, err = url.Parse(address)
 	if err != nil {
@@ -76,6 +111,12 @@ func NewHTTPOutput(address string, config *HTTPOutputConfig) PluginReadWriter {
 		config.url.Scheme = "http"
 	}
 	config.rawURL = config.url.String()
+	if isBackendPoolAddress(config.url) {
+		config.backends, err = newBackendPool(config.url, config)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("[OUTPUT-HTTP] backends discovery error[%q]", err))
+		}
+	}
 	if config.Timeout < time.Millisecond*100 {
 		config.Timeout = time.Second
 	}
@@ -103,11 +144,17 @@ func NewHTTPOutput(address string, config *HTTPOutputConfig) PluginReadWriter {
 	if config.WorkerTimeout <= 0 {
 		config.WorkerTimeout = time.Second * 2
 	}
+	if config.ForceHTTP2 && config.url.Scheme != "https" && config.url.Scheme != "srv+https" {
+		log.Fatal("[OUTPUT-HTTP] --output-http-force-http2 requires https:// address, HTTP/2 over cleartext is not supported")
+	}
 	o.config = config
 	o.stop = make(chan bool)
 	if o.config.Stats {
 		o.queueStats = NewGorStat("output_http", o.config.StatsMs)
 	}
+	if o.config.EndpointStats {
+		o.endpointStats = NewHTTPEndpointStats(o.config.EndpointStatsInterval)
+	}
 
 	o.queue = make(chan *Message, o.config.QueueLen)
 	if o.config.TrackResponses {
@@ -169,6 +216,9 @@ func (o *HTTPOutput) startWorker() {
 
 // PluginWrite writes message to this plugin
 func (o *HTTPOutput) PluginWrite(msg *Message) (n int, err error) {
+	if o.endpointStats != nil {
+		o.endpointStats.Write(msg)
+	}
 	if !isRequestPayload(msg.Meta) {
 		return len(msg.Data), nil
 	}
@@ -218,9 +268,13 @@ func (o *HTTPOutput) sendRequest(client *HTTPClient, msg *Message) {
 
 	uuid := payloadID(msg.Meta)
 	start := time.Now()
-	resp, err := client.Send(msg.Data)
+	resp, status, err := client.send(msg.Data)
 	stop := time.Now()
 
+	if o.endpointStats != nil && (err != nil || status > 0) {
+		o.endpointStats.Replayed(msg.Data, status, stop.Sub(start), err)
+	}
+
 	if err != nil {
 		Debug(1, fmt.Sprintf("[HTTP-OUTPUT] error when sending: %q", err))
 		return
@@ -244,8 +298,14 @@ func (o *HTTPOutput) String() string {
 
 // Close closes the data channel so that data
 func (o *HTTPOutput) Close() error {
+	if o.config.backends != nil {
+		o.config.backends.close()
+	}
 	close(o.stop)
 	close(o.stopWorker)
+	if o.endpointStats != nil {
+		o.endpointStats.Close()
+	}
 	return nil
 }
 
@@ -253,6 +313,8 @@ func (o *HTTPOutput) Close() error {
 type HTTPClient struct {
 	config *HTTPOutputConfig
 	Client *http.Client
+	auth   *authProvider
+	jars   *cookieJars
 }
 
 // NewHTTPClient returns new http client with check redirects policy
@@ -273,41 +335,132 @@ func NewHTTPClient(config *HTTPOutputConfig) *HTTPClient {
 			return nil
 		},
 	}
-	if config.SkipVerify {
-		// clone to avoid modying global default RoundTripper
-		transport = http.DefaultTransport.(*http.Transport).Clone()
-		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-		client.Client.Transport = transport
+	transport, err := newHTTPTransport(config)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("[HTTPCLIENT] %q", err))
+	}
+	client.Client.Transport = transport
+
+	client.auth, err = newAuthProvider(&config.Auth)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("[HTTPCLIENT] %q", err))
+	}
+	client.jars, err = newCookieJars(config.CookieJar, config.realIPHeader, config.CookieJarLimit)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("[HTTPCLIENT] %q", err))
 	}
 
 	return client
 }
 
+// newHTTPTransport returns transport with connection pool, dial and TLS settings from config
+func newHTTPTransport(config *HTTPOutputConfig) (*http.Transport, error) {
+	// clone to avoid modying global default RoundTripper
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if config.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+		if transport.MaxIdleConns < config.MaxIdleConnsPerHost {
+			transport.MaxIdleConns = config.MaxIdleConnsPerHost
+		}
+	}
+	if config.MaxConnsPerHost > 0 {
+		transport.MaxConnsPerHost = config.MaxConnsPerHost
+	}
+	if config.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = config.IdleConnTimeout
+	}
+	if config.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = config.TLSHandshakeTimeout
+	}
+	transport.DisableKeepAlives = config.DisableKeepAlive
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if config.DialTimeout > 0 {
+		dialer.Timeout = config.DialTimeout
+	}
+	if config.LocalAddr != "" {
+		ip := net.ParseIP(config.LocalAddr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid local address %q", config.LocalAddr)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	transport.DialContext = dialer.DialContext
+
+	if config.Proxy != "" {
+		proxy, err := url.Parse(config.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy address %q: %v", config.Proxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	tlsConfig, err := newClientTLSConfig(config.TLSCert, config.TLSKey, config.TLSCACert, config.TLSServerName, config.TLSMinVersion, config.SkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	if config.ForceHTTP2 {
+		tlsConfig.NextProtos = []string{"h2"}
+	}
+	transport.TLSClientConfig = tlsConfig
+	// custom TLS config and dialer disable HTTP/2 unless it is forced
+	transport.ForceAttemptHTTP2 = true
+
+	return transport, nil
+}
+
 // Send sends an http request using client create by NewHTTPClient
 func (c *HTTPClient) Send(data []byte) ([]byte, error) {
+	dump, _, err := c.send(data)
+	return dump, err
+}
+
+// send returns dumped response if responses are tracked, and status code of the response
+func (c *HTTPClient) send(data []byte) (dump []byte, status int, err error) {
 	var req *http.Request
 	var resp *http.Response
-	var err error
 
 	req, err = http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	// we don't send CONNECT or OPTIONS request
 	if req.Method == http.MethodConnect {
-		return nil, nil
+		return nil, 0, nil
+	}
+
+	target := c.config.url
+	var backend *httpBackend
+	if c.config.backends != nil {
+		if backend, err = c.config.backends.pick(); err != nil {
+			return nil, 0, err
+		}
+		target = backend.url
 	}
 
 	if !c.config.OriginalHost {
-		req.Host = c.config.url.Host
+		req.Host = target.Host
 	}
 
 	// fix #862
-	if c.config.url.Path == "" && c.config.url.RawQuery == "" {
-		req.URL.Scheme = c.config.url.Scheme
-		req.URL.Host = c.config.url.Host
+	if target.Path == "" && target.RawQuery == "" {
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
 	} else {
-		req.URL = c.config.url
+		req.URL = target
+	}
+
+	if c.auth != nil {
+		token, err := c.auth.Token()
+		if err != nil {
+			return nil, 0, err
+		}
+		// replaces recorded credentials
+		req.Header.Set(c.config.Auth.Header, token)
 	}
 
 	// force connection to not be closed, which can affect the global client
@@ -315,13 +468,32 @@ func (c *HTTPClient) Send(data []byte) ([]byte, error) {
 	// it's an error if this is not equal to empty string
 	req.RequestURI = ""
 
+	var jar *cookiejar.Jar
+	if c.jars != nil {
+		if key := c.jars.clientKey(data); len(key) > 0 {
+			jar = c.jars.get(key)
+			setCookies(req, jar)
+		}
+	}
+
 	resp, err = c.Client.Do(req)
+	if backend != nil {
+		c.config.backends.report(backend, err)
+	}
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	if jar != nil {
+		jar.SetCookies(req.URL, resp.Cookies())
+	}
+	if c.config.ForceHTTP2 && resp.ProtoMajor != 2 {
+		_ = resp.Body.Close()
+		return nil, 0, fmt.Errorf("server responded with %s, HTTP/2 is forced", resp.Proto)
 	}
 	if c.config.TrackResponses {
-		return httputil.DumpResponse(resp, true)
+		dump, err = httputil.DumpResponse(resp, true)
+		return dump, resp.StatusCode, err
 	}
 	_ = resp.Body.Close()
-	return nil, nil
+	return nil, resp.StatusCode, nil
 }
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	authFetchTimeout = 10 * time.Second
+	// authRetryInterval is the interval of refresh retries while the cached token is valid
+	authRetryInterval = time.Second
+)
+
+// HTTPAuthConfig holds configuration of tokens injected into replayed requests
+type HTTPAuthConfig struct {
+	TokenURL      string        `json:"output-http-auth-token-url"`
+	ClientID      string        `json:"output-http-auth-client-id"`
+	ClientSecret  string        `json:"output-http-auth-client-secret"`
+	Scope         string        `json:"output-http-auth-scope"`
+	TokenFile     string        `json:"output-http-auth-token-file"`
+	TokenCommand  string        `json:"output-http-auth-token-command"`
+	Header        string        `json:"output-http-auth-header"`
+	RefreshBefore time.Duration `json:"output-http-auth-refresh-before"`
+	TokenTTL      time.Duration `json:"output-http-auth-token-ttl"`
+}
+
+// authToken is a token as returned by OAuth2 token endpoint.
+// Token files and commands may return it as well, instead of a plain token.
+type authToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// authProvider fetches tokens and caches them until they are about to expire
+type authProvider struct {
+	config *HTTPAuthConfig
+	client *http.Client
+	fetch  func() (*authToken, error)
+
+	mu         sync.Mutex
+	value      string
+	refreshAt  time.Time
+	expires    time.Time
+	refreshing chan struct{} // closed when the running refresh is done
+	err        error         // error of the last refresh
+}
+
+// newAuthProvider returns nil if no token source is configured
+func newAuthProvider(config *HTTPAuthConfig) (*authProvider, error) {
+	a := &authProvider{config: config}
+
+	sources := 0
+	if config.TokenURL != "" {
+		if config.ClientID == "" {
+			return nil, errors.New("--output-http-auth-client-id is required with --output-http-auth-token-url")
+		}
+		a.client = &http.Client{Timeout: authFetchTimeout}
+		a.fetch = a.fetchClientCredentials
+		sources++
+	}
+	if config.TokenFile != "" {
+		a.fetch = a.readFile
+		sources++
+	}
+	if config.TokenCommand != "" {
+		if _, err := splitCommand(config.TokenCommand); err != nil {
+			return nil, fmt.Errorf("invalid --output-http-auth-token-command: %v", err)
+		}
+		a.fetch = a.runCommand
+		sources++
+	}
+	if sources == 0 {
+		return nil, nil
+	}
+	if sources > 1 {
+		return nil, errors.New("only one of --output-http-auth-token-url, --output-http-auth-token-file and --output-http-auth-token-command can be used")
+	}
+
+	if config.Header == "" {
+		config.Header = "Authorization"
+	}
+	if config.RefreshBefore <= 0 {
+		config.RefreshBefore = time.Minute
+	}
+	if config.TokenTTL <= 0 {
+		config.TokenTTL = 5 * time.Minute
+	}
+	return a, nil
+}
+
+// Token returns cached header value, token is refreshed in background if it expires in less than RefreshBefore,
+// and the cached token is used until it is expired. Requests wait only if there is no valid token.
+func (a *authProvider) Token() (string, error) {
+	a.mu.Lock()
+	now := time.Now()
+	if a.value != "" && now.Before(a.refreshAt) {
+		defer a.mu.Unlock()
+		return a.value, nil
+	}
+	if a.refreshing == nil {
+		a.refreshing = make(chan struct{})
+		go a.refresh(a.refreshing)
+	}
+	refreshing := a.refreshing
+	if a.value != "" && now.Before(a.expires) {
+		defer a.mu.Unlock()
+		return a.value, nil
+	}
+	a.mu.Unlock()
+
+	<-refreshing
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.value != "" && time.Now().Before(a.expires) {
+		return a.value, nil
+	}
+	return "", fmt.Errorf("token fetch error: %v", a.err)
+}
+
+// refresh fetches the token, only one refresh runs at a time
+func (a *authProvider) refresh(done chan struct{}) {
+	token, err := a.fetch()
+	if err == nil && token.AccessToken == "" {
+		err = errors.New("empty token")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	defer close(done)
+	a.refreshing = nil
+
+	now := time.Now()
+	a.err = err
+	if err != nil {
+		if a.value != "" && now.Before(a.expires) {
+			Debug(0, fmt.Sprintf("[OUTPUT-HTTP-AUTH] token refresh error: %q, using cached token", err))
+			// retry later, not on every request
+			if a.refreshAt = now.Add(authRetryInterval); a.refreshAt.After(a.expires) {
+				a.refreshAt = a.expires
+			}
+		}
+		return
+	}
+
+	a.value = token.AccessToken
+	switch {
+	case strings.EqualFold(token.TokenType, "bearer"):
+		a.value = "Bearer " + token.AccessToken
+	case token.TokenType != "":
+		a.value = token.TokenType + " " + token.AccessToken
+	case !strings.Contains(token.AccessToken, " ") && a.config.Header == "Authorization":
+		a.value = "Bearer " + token.AccessToken
+	}
+	ttl := a.config.TokenTTL
+	if token.ExpiresIn > 0 {
+		ttl = time.Duration(token.ExpiresIn) * time.Second
+	}
+	a.expires = now.Add(ttl)
+	// short-lived tokens are refreshed in the middle of their lifetime
+	refreshBefore := a.config.RefreshBefore
+	if refreshBefore > ttl/2 {
+		refreshBefore = ttl / 2
+	}
+	a.refreshAt = a.expires.Add(-refreshBefore)
+	Debug(1, fmt.Sprintf("[OUTPUT-HTTP-AUTH] token refreshed, expires in %s", ttl))
+}
+
+func (a *authProvider) fetchClientCredentials() (*authToken, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if a.config.Scope != "" {
+		form.Set("scope", a.config.Scope)
+	}
+	req, err := http.NewRequest(http.MethodPost, a.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(a.config.ClientID), url.QueryEscape(a.config.ClientSecret))
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint responded with %q: %s", resp.Status, body)
+	}
+
+	token := new(authToken)
+	if err = json.Unmarshal(body, token); err != nil {
+		return nil, fmt.Errorf("can't decode token response: %v", err)
+	}
+	return token, nil
+}
+
+func (a *authProvider) readFile() (*authToken, error) {
+	data, err := ioutil.ReadFile(a.config.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseAuthToken(data), nil
+}
+
+func (a *authProvider) runCommand() (*authToken, error) {
+	args, _ := splitCommand(a.config.TokenCommand)
+	ctx, cancel := context.WithTimeout(context.Background(), authFetchTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("%v: %s", err, e.Stderr)
+		}
+		return nil, err
+	}
+	return parseAuthToken(out), nil
+}
+
+// parseAuthToken accepts either JSON token response or a plain token
+func parseAuthToken(data []byte) *authToken {
+	token := new(authToken)
+	if err := json.Unmarshal(data, token); err == nil && token.AccessToken != "" {
+		return token
+	}
+	return &authToken{AccessToken: strings.TrimSpace(string(data))}
+}
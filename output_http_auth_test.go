@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPOutputAuthClientCredentials(t *testing.T) {
+	var issued int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		r.ParseForm()
+		if user != "gor" || pass != "secret" || r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("scope") != "replay" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		n := atomic.AddInt32(&issued, 1)
+		fmt.Fprintf(w, `{"access_token": "token%d", "token_type": "bearer", "expires_in": 2}`, n)
+	}))
+	defer tokenServer.Close()
+
+	authHeaders := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeaders <- r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	config := &HTTPOutputConfig{Auth: HTTPAuthConfig{TokenURL: tokenServer.URL, ClientID: "gor", ClientSecret: "secret", Scope: "replay"}}
+	config.url, _ = url.Parse(server.URL)
+	client := NewHTTPClient(config)
+
+	request := []byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\nAuthorization: Bearer expired\r\n\r\n")
+	for i := 0; i < 2; i++ {
+		if _, err := client.Send(request); err != nil {
+			t.Fatal(err)
+		}
+		if h := <-authHeaders; h != "Bearer token1" {
+			t.Errorf("expected recorded token to be replaced, got %q", h)
+		}
+	}
+
+	// token expiring in 2s is refreshed after 1s, the request doesn't wait for the refresh
+	time.Sleep(1100 * time.Millisecond)
+	client.Send(request)
+	if h := <-authHeaders; h != "Bearer token1" {
+		t.Errorf("expected cached token to be used during refresh, got %q", h)
+	}
+	for i := 0; ; i++ {
+		if token, _ := client.auth.Token(); token == "Bearer token2" {
+			break
+		}
+		if i == 100 {
+			t.Fatal("token was not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.Send(request)
+	if h := <-authHeaders; h != "Bearer token2" {
+		t.Errorf("expected token to be refreshed, got %q", h)
+	}
+	if n := atomic.LoadInt32(&issued); n != 2 {
+		t.Errorf("expected 2 tokens to be issued, got %d", n)
+	}
+
+	config = &HTTPOutputConfig{Auth: HTTPAuthConfig{TokenURL: tokenServer.URL, ClientID: "gor", ClientSecret: "wrong"}}
+	config.url, _ = url.Parse(server.URL)
+	if _, err := NewHTTPClient(config).Send(request); err == nil {
+		t.Error("request should fail when token can't be fetched")
+	}
+}
+
+func TestHTTPOutputAuthFileAndCommand(t *testing.T) {
+	file, _ := ioutil.TempFile("", "gor-token")
+	file.WriteString("token1\n")
+	file.Close()
+	defer os.Remove(file.Name())
+
+	provider, err := newAuthProvider(&HTTPAuthConfig{TokenFile: file.Name(), TokenTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, _ := provider.Token(); token != "Bearer token1" {
+		t.Errorf("wrong token %q", token)
+	}
+	ioutil.WriteFile(file.Name(), []byte("token2"), 0600)
+	if token, _ := provider.Token(); token != "Bearer token1" {
+		t.Errorf("token should be cached, got %q", token)
+	}
+
+	// refresh failure keeps token which is not expired yet
+	provider.refreshAt = time.Now()
+	os.Remove(file.Name())
+	if token, err := provider.Token(); token != "Bearer token1" || err != nil {
+		t.Errorf("cached token should be used, got %q, %v", token, err)
+	}
+	provider.mu.Lock()
+	refreshing := provider.refreshing
+	provider.mu.Unlock()
+	if refreshing != nil {
+		<-refreshing
+	}
+	if token, err := provider.Token(); token != "Bearer token1" || err != nil {
+		t.Errorf("cached token should be used after refresh error, got %q, %v", token, err)
+	}
+
+	provider, _ = newAuthProvider(&HTTPAuthConfig{TokenCommand: `echo '{"access_token": "abc", "expires_in": 60}'`, Header: "X-Api-Key"})
+	if token, _ := provider.Token(); token != "abc" {
+		t.Errorf("wrong token %q", token)
+	}
+	if d := time.Until(provider.expires); d > time.Minute || d < 59*time.Second {
+		t.Errorf("expires_in is not used: %s", d)
+	}
+
+	provider, _ = newAuthProvider(&HTTPAuthConfig{TokenCommand: "echo Basic Z29yOmdvcg=="})
+	if token, _ := provider.Token(); token != "Basic Z29yOmdvcg==" {
+		t.Errorf("token with scheme should be used as is, got %q", token)
+	}
+
+	if _, err = newAuthProvider(&HTTPAuthConfig{TokenFile: "token", TokenCommand: "cat token"}); err == nil || !strings.Contains(err.Error(), "only one") {
+		t.Errorf("expected error for multiple token sources, got %v", err)
+	}
+	if provider, err = newAuthProvider(&HTTPAuthConfig{}); provider != nil || err != nil {
+		t.Error("provider should not be created without token source")
+	}
+}
+
+func TestHTTPOutputAuthSingleRefresh(t *testing.T) {
+	var fetches int32
+	release := make(chan struct{})
+	provider := &authProvider{config: &HTTPAuthConfig{Header: "Authorization", TokenTTL: time.Minute, RefreshBefore: time.Second}}
+	provider.fetch = func() (*authToken, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return &authToken{AccessToken: "new"}, nil
+	}
+	provider.value = "Bearer old"
+	provider.expires = time.Now().Add(time.Minute)
+	provider.refreshAt = time.Now()
+
+	// valid token is served while the slow refresh is running
+	for i := 0; i < 10; i++ {
+		if token, err := provider.Token(); token != "Bearer old" || err != nil {
+			t.Fatalf("expected cached token, got %q, %v", token, err)
+		}
+	}
+	close(release)
+	for i := 0; ; i++ {
+		if token, _ := provider.Token(); token == "Bearer new" {
+			break
+		}
+		if i == 100 {
+			t.Fatal("token was not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("expected 1 fetch, got %d", n)
+	}
+
+	// without valid token requests wait for the refresh
+	provider.value = ""
+	if token, err := provider.Token(); token != "Bearer new" || err != nil {
+		t.Errorf("expected fetched token, got %q, %v", token, err)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lookupSRV is replaced in tests
+var lookupSRV = net.LookupSRV
+
+var errNoBackends = errors.New("no backends")
+
+type httpBackend struct {
+	url          *url.URL
+	failures     int
+	ejectedUntil time.Time
+}
+
+// backendPool holds backends of --output-http address discovered from DNS SRV records
+// (srv://_http._tcp.staging.local or srv+https://...) or from a file (file:///etc/gor/backends),
+// one address per line. Backends are refreshed every interval and requests are balanced
+// between them using round robin. Backend which failed EjectFailures times in a row is
+// not used for EjectDuration.
+type backendPool struct {
+	source        *url.URL
+	interval      time.Duration
+	ejectFailures int
+	ejectDuration time.Duration
+	next          uint32
+	modTime       time.Time
+	stop          chan struct{}
+	stopOnce      sync.Once
+
+	mu       sync.RWMutex
+	backends []*httpBackend
+}
+
+func isBackendPoolAddress(u *url.URL) bool {
+	return u.Scheme == "srv" || u.Scheme == "srv+https" || u.Scheme == "file"
+}
+
+func newBackendPool(source *url.URL, config *HTTPOutputConfig) (*backendPool, error) {
+	p := &backendPool{source: source, interval: config.DiscoveryInterval, ejectFailures: config.EjectFailures,
+		ejectDuration: config.EjectDuration, stop: make(chan struct{})}
+	if p.interval <= 0 {
+		p.interval = 10 * time.Second
+	}
+	if p.ejectFailures <= 0 {
+		p.ejectFailures = 3
+	}
+	if p.ejectDuration <= 0 {
+		p.ejectDuration = 30 * time.Second
+	}
+
+	if err := p.refresh(); err != nil {
+		return nil, err
+	}
+	go p.watch()
+	return p, nil
+}
+
+func (p *backendPool) watch() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			if err := p.refresh(); err != nil {
+				Debug(0, fmt.Sprintf("[OUTPUT-HTTP] backends discovery error: %q, keeping %d backends", err, p.len()))
+			}
+		}
+	}
+}
+
+// refresh discovers backends, health state of known backends is kept
+func (p *backendPool) refresh() error {
+	var addresses []*url.URL
+	var err error
+	if p.source.Scheme == "file" {
+		addresses, err = p.readFile()
+	} else {
+		addresses, err = p.resolveSRV()
+	}
+	if err != nil || addresses == nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	known := make(map[string]*httpBackend, len(p.backends))
+	for _, b := range p.backends {
+		known[b.url.String()] = b
+	}
+	backends := make([]*httpBackend, 0, len(addresses))
+	changed := len(addresses) != len(p.backends)
+	for _, u := range addresses {
+		b, ok := known[u.String()]
+		if !ok {
+			b = &httpBackend{url: u}
+			changed = true
+		}
+		backends = append(backends, b)
+	}
+	p.backends = backends
+	if changed {
+		Debug(1, fmt.Sprintf("[OUTPUT-HTTP] %s backends: %v", p.source, addresses))
+	}
+	return nil
+}
+
+// readFile returns nil if the file was not changed since last read
+func (p *backendPool) readFile() ([]*url.URL, error) {
+	path := p.source.Host + p.source.Path
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.ModTime().Equal(p.modTime) {
+		return nil, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var addresses []*url.URL
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.Contains(line, "://") {
+			line = "http://" + line
+		}
+		u, err := url.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backend address %q: %v", line, err)
+		}
+		addresses = append(addresses, u)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("%s: %v", path, errNoBackends)
+	}
+	p.modTime = info.ModTime()
+	return addresses, nil
+}
+
+func (p *backendPool) resolveSRV() ([]*url.URL, error) {
+	scheme := "http"
+	if p.source.Scheme == "srv+https" {
+		scheme = "https"
+	}
+	_, records, err := lookupSRV("", "", p.source.Host)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s: %v", p.source.Host, errNoBackends)
+	}
+
+	addresses := make([]*url.URL, 0, len(records))
+	for _, r := range records {
+		host := net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port)))
+		addresses = append(addresses, &url.URL{Scheme: scheme, Host: host, Path: p.source.Path, RawQuery: p.source.RawQuery})
+	}
+	return addresses, nil
+}
+
+// pick returns next healthy backend. If all backends are ejected, the one which is ejected
+// for the longest time is used.
+func (p *backendPool) pick() (*httpBackend, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.backends) == 0 {
+		return nil, errNoBackends
+	}
+	now := time.Now()
+	n := atomic.AddUint32(&p.next, 1)
+	var fallback *httpBackend
+	for i := 0; i < len(p.backends); i++ {
+		b := p.backends[(int(n)+i)%len(p.backends)]
+		if now.After(b.ejectedUntil) {
+			return b, nil
+		}
+		if fallback == nil || b.ejectedUntil.Before(fallback.ejectedUntil) {
+			fallback = b
+		}
+	}
+	return fallback, nil
+}
+
+// report updates health of the backend after a request
+func (p *backendPool) report(b *httpBackend, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= p.ejectFailures {
+		b.failures = 0
+		b.ejectedUntil = time.Now().Add(p.ejectDuration)
+		Debug(0, fmt.Sprintf("[OUTPUT-HTTP] backend %s ejected for %s: %q", b.url.Host, p.ejectDuration, err))
+	}
+}
+
+func (p *backendPool) len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.backends)
+}
+
+func (p *backendPool) close() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
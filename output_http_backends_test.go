@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func backendServer(counter *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(counter, 1)
+	}))
+}
+
+func TestHTTPOutputFileBackends(t *testing.T) {
+	var hits1, hits2 int32
+	server1, server2 := backendServer(&hits1), backendServer(&hits2)
+	defer server1.Close()
+	defer server2.Close()
+
+	file, _ := ioutil.TempFile("", "gor-backends")
+	file.WriteString("# staging\n" + server1.URL + "\n" + strings.TrimPrefix(server2.URL, "http://") + "\n")
+	file.Close()
+	defer os.Remove(file.Name())
+
+	config := &HTTPOutputConfig{}
+	config.url, _ = url.Parse("file://" + file.Name())
+	pool, err := newBackendPool(config.url, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.close()
+	config.backends = pool
+	client := NewHTTPClient(config)
+
+	request := []byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\n\r\n")
+	for i := 0; i < 4; i++ {
+		if _, err := client.Send(request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hits1 != 2 || hits2 != 2 {
+		t.Errorf("requests should be balanced, got %d and %d", hits1, hits2)
+	}
+
+	ioutil.WriteFile(file.Name(), []byte(server2.URL), 0600)
+	os.Chtimes(file.Name(), time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if err = pool.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		client.Send(request)
+	}
+	if hits1 != 2 || hits2 != 6 {
+		t.Errorf("removed backend should not be used, got %d and %d", hits1, hits2)
+	}
+
+	// invalid file keeps last known backends
+	ioutil.WriteFile(file.Name(), []byte("# empty\n"), 0600)
+	os.Chtimes(file.Name(), time.Now().Add(2*time.Minute), time.Now().Add(2*time.Minute))
+	if err = pool.refresh(); err == nil || pool.len() != 1 {
+		t.Errorf("expected error and 1 backend, got %v and %d", err, pool.len())
+	}
+}
+
+func TestHTTPOutputSRVBackends(t *testing.T) {
+	var hits int32
+	server := backendServer(&hits)
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+
+	// closed port, backend is ejected after the first error
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	_, deadPort, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+
+	defer func() { lookupSRV = net.LookupSRV }()
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_http._tcp.staging.local" {
+			t.Errorf("wrong SRV name %q", name)
+		}
+		p1, _ := net.LookupPort("tcp", port)
+		p2, _ := net.LookupPort("tcp", deadPort)
+		return "", []*net.SRV{{Target: host + ".", Port: uint16(p1)}, {Target: host + ".", Port: uint16(p2)}}, nil
+	}
+
+	config := &HTTPOutputConfig{EjectFailures: 1, EjectDuration: time.Minute}
+	config.url, _ = url.Parse("srv://_http._tcp.staging.local")
+	pool, err := newBackendPool(config.url, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.close()
+	config.backends = pool
+	client := NewHTTPClient(config)
+
+	request := []byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\n\r\n")
+	failed := 0
+	for i := 0; i < 6; i++ {
+		if _, err := client.Send(request); err != nil {
+			failed++
+		}
+	}
+	if failed != 1 || hits != 5 {
+		t.Errorf("dead backend should be ejected after the first error, got %d errors and %d hits", failed, hits)
+	}
+
+	// all backends ejected, the one ejected first is still tried
+	for _, b := range pool.backends {
+		b.ejectedUntil = time.Now().Add(time.Minute)
+	}
+	pool.backends[0].ejectedUntil = time.Now().Add(time.Second)
+	if b, _ := pool.pick(); b != pool.backends[0] {
+		t.Error("backend ejected first should be picked when all are ejected")
+	}
+}
+
+func TestHTTPOutputBackendsPerOutput(t *testing.T) {
+	var hits1, hits2 int32
+	server1, server2 := backendServer(&hits1), backendServer(&hits2)
+	defer server1.Close()
+	defer server2.Close()
+
+	file, _ := ioutil.TempFile("", "gor-backends")
+	file.WriteString(server1.URL + "\n")
+	file.Close()
+	defer os.Remove(file.Name())
+
+	// outputs share the config, like --output-http flags do
+	config := &HTTPOutputConfig{}
+	pooled := NewHTTPOutput("file://"+file.Name(), config).(*HTTPOutput)
+	defer pooled.Close()
+	plain := NewHTTPOutput(server2.URL, config).(*HTTPOutput)
+	defer plain.Close()
+
+	if config.url != nil || config.backends != nil || config.DiscoveryInterval != 0 || config.EjectFailures != 0 {
+		t.Errorf("shared config should not be changed: %+v", config)
+	}
+	if plain.client.config.backends != nil {
+		t.Error("plain output should not use backends of the other output")
+	}
+
+	request := []byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\n\r\n")
+	for _, o := range []*HTTPOutput{pooled, plain} {
+		if _, err := o.client.Send(request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hits1 != 1 || hits2 != 1 {
+		t.Errorf("each output should send to its own target, got %d and %d", hits1, hits2)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+	"sync"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// cookieJars keeps a cookie jar per original client, so cookies set by the replayed
+// server are sent back instead of the recorded ones
+type cookieJars struct {
+	source string // ip, header or cookie
+	name   []byte
+	limit  int
+
+	mu    sync.Mutex
+	jars  map[string]*list.Element
+	order *list.List
+}
+
+type clientJar struct {
+	key string
+	jar *cookiejar.Jar
+}
+
+// newCookieJars accepts client key in one of formats: ip, header:<name> or cookie:<name>.
+// ip is the address of the client in realIPHeader, which is added by --input-raw-realip-header.
+// Returns nil if key is empty.
+func newCookieJars(key, realIPHeader string, limit int) (*cookieJars, error) {
+	if key == "" {
+		return nil, nil
+	}
+	j := &cookieJars{source: key, limit: limit, jars: make(map[string]*list.Element), order: list.New()}
+	if i := strings.IndexByte(key, ':'); i != -1 {
+		j.source, j.name = key[:i], []byte(key[i+1:])
+	}
+	switch {
+	case j.source == "ip" && j.name == nil:
+		// without the header all clients would have the same address
+		if realIPHeader == "" {
+			return nil, fmt.Errorf("cookie jar key %q requires --input-raw-realip-header, use header:<name> for other headers", key)
+		}
+		j.name = []byte(realIPHeader)
+	case (j.source == "header" || j.source == "cookie") && len(j.name) > 0:
+	default:
+		return nil, fmt.Errorf("invalid cookie jar key %q, expected one of ip, header:<name>, cookie:<name>", key)
+	}
+	if j.limit <= 0 {
+		j.limit = 10000
+	}
+	return j, nil
+}
+
+// clientKey returns key of the original client which sent the request
+func (j *cookieJars) clientKey(payload []byte) []byte {
+	switch j.source {
+	case "ip":
+		// the first address of a list, like X-Forwarded-For
+		ip := proto.Header(payload, j.name)
+		if i := bytes.IndexByte(ip, ','); i != -1 {
+			ip = ip[:i]
+		}
+		return bytes.TrimSpace(ip)
+	case "header":
+		return proto.Header(payload, j.name)
+	case "cookie":
+		return proto.Cookie(payload, j.name)
+	}
+	return nil
+}
+
+// get returns jar of the client, the least recently used jar is dropped when limit is reached
+func (j *cookieJars) get(key []byte) *cookiejar.Jar {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if el, ok := j.jars[string(key)]; ok {
+		j.order.MoveToBack(el)
+		return el.Value.(*clientJar).jar
+	}
+	if j.order.Len() >= j.limit {
+		oldest := j.order.Remove(j.order.Front()).(*clientJar)
+		delete(j.jars, oldest.key)
+	}
+	jar, _ := cookiejar.New(nil)
+	j.jars[string(key)] = j.order.PushBack(&clientJar{string(key), jar})
+	return jar
+}
+
+// setCookies replaces recorded cookies with ones from the jar, recorded cookies unknown to the jar are kept
+func setCookies(req *http.Request, jar *cookiejar.Jar) {
+	issued := jar.Cookies(req.URL)
+	if len(issued) == 0 {
+		return
+	}
+	recorded := req.Cookies()
+	req.Header.Del("Cookie")
+
+	names := make(map[string]bool, len(issued))
+	for _, c := range issued {
+		names[c.Name] = true
+	}
+	for _, c := range recorded {
+		if !names[c.Name] {
+			req.AddCookie(c)
+		}
+	}
+	for _, c := range issued {
+		req.AddCookie(c)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHTTPOutputCookieJar(t *testing.T) {
+	var sessions int32
+	cookies := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: fmt.Sprint("replayed", atomic.AddInt32(&sessions, 1)), Path: "/"})
+			return
+		}
+		cookies <- r.Header.Get("Cookie")
+	}))
+	defer server.Close()
+
+	config := &HTTPOutputConfig{CookieJar: "ip", realIPHeader: "X-Real-IP"}
+	config.url, _ = url.Parse(server.URL)
+	client := NewHTTPClient(config)
+
+	send := func(ip, path, cookie string) {
+		request := "GET " + path + " HTTP/1.1\r\nHost: www.w3.org\r\nX-Real-IP: " + ip + "\r\n"
+		if cookie != "" {
+			request += "Cookie: " + cookie + "\r\n"
+		}
+		if _, err := client.Send([]byte(request + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send("10.0.0.1", "/profile", "session=recorded1; tracking=1")
+	if c := <-cookies; c != "session=recorded1; tracking=1" {
+		t.Errorf("recorded cookies should be sent before server sets any, got %q", c)
+	}
+
+	send("10.0.0.1", "/login", "")
+	send("10.0.0.2", "/login", "")
+
+	send("10.0.0.1", "/profile", "session=recorded1; tracking=1")
+	if c := <-cookies; c != "tracking=1; session=replayed1" {
+		t.Errorf("expected replayed session of the first client, got %q", c)
+	}
+	send("10.0.0.2", "/profile", "session=recorded2")
+	if c := <-cookies; c != "session=replayed2" {
+		t.Errorf("expected replayed session of the second client, got %q", c)
+	}
+	send("10.0.0.3", "/profile", "session=recorded3")
+	if c := <-cookies; c != "session=recorded3" {
+		t.Errorf("unknown client should keep recorded cookies, got %q", c)
+	}
+}
+
+func TestCookieJarsKey(t *testing.T) {
+	request := []byte("GET / HTTP/1.1\r\nX-Forwarded-For: 10.0.0.1, 10.0.0.2\r\nX-Session: abc\r\nCookie: sid=xyz\r\n\r\n")
+	cases := map[string]string{"ip": "10.0.0.1", "header:X-Session": "abc", "cookie:sid": "xyz"}
+	for key, expected := range cases {
+		jars, err := newCookieJars(key, "X-Forwarded-For", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k := jars.clientKey(request); string(k) != expected {
+			t.Errorf("%s: expected %q, got %q", key, expected, k)
+		}
+	}
+
+	for _, key := range []string{"ip:X", "header:", "session"} {
+		if _, err := newCookieJars(key, "X-Real-IP", 0); err == nil {
+			t.Errorf("key %q should be invalid", key)
+		}
+	}
+	if _, err := newCookieJars("ip", "", 0); err == nil {
+		t.Error("ip key should require real IP header")
+	}
+	jars, _ := newCookieJars("ip", "X-Real-IP", 0)
+	if k := jars.clientKey(request); len(k) != 0 {
+		t.Errorf("request without the header should have no key, got %q", k)
+	}
+
+	jars, _ = newCookieJars("ip", "X-Real-IP", 2)
+	first := jars.get([]byte("1"))
+	jars.get([]byte("2"))
+	jars.get([]byte("1"))
+	jars.get([]byte("3"))
+	if _, ok := jars.jars["2"]; ok || len(jars.jars) != 2 || jars.get([]byte("1")) != first {
+		t.Error("least recently used jar should be dropped")
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/byteutils"
+)
+
+// latencySamples is the number of latencies kept per endpoint to calculate percentiles
+const latencySamples = 10000
+
+// latencyStats keeps a uniform random sample of latencies, so percentiles are
+// estimated in constant memory
+type latencyStats struct {
+	count   int
+	max     time.Duration
+	samples []time.Duration
+}
+
+func (l *latencyStats) add(d time.Duration) {
+	l.count++
+	if d > l.max {
+		l.max = d
+	}
+	if len(l.samples) < latencySamples {
+		l.samples = append(l.samples, d)
+	} else if i := rand.Intn(l.count); i < latencySamples {
+		l.samples[i] = d
+	}
+}
+
+// percentiles returns latencies of given percentiles, samples are sorted in place
+func (l *latencyStats) percentiles(ps ...float64) []time.Duration {
+	result := make([]time.Duration, len(ps))
+	if len(l.samples) == 0 {
+		return result
+	}
+	sort.Slice(l.samples, func(i, j int) bool { return l.samples[i] < l.samples[j] })
+	for i, p := range ps {
+		result[i] = l.samples[int(float64(len(l.samples)-1)*p/100+0.5)]
+	}
+	return result
+}
+
+func (l *latencyStats) String() string {
+	p := l.percentiles(50, 90, 99)
+	return fmt.Sprintf("p50=%s p90=%s p99=%s max=%s", p[0], p[1], p[2], l.max)
+}
+
+type endpointStats struct {
+	endpoint    string
+	requests    int
+	replayed    latencyStats
+	original    latencyStats
+	statuses    map[int]int
+	timeouts    int
+	connErrors  int
+	otherErrors int
+}
+
+type pendingRequest struct {
+	endpoint string
+	start    int64
+}
+
+// HTTPEndpointStats collects latencies, status codes and errors of replayed requests
+// per endpoint, and latencies of original responses from the recorded meta
+type HTTPEndpointStats struct {
+	interval time.Duration
+	stop     chan struct{}
+
+	mu         sync.Mutex
+	endpoints  map[string]*endpointStats
+	pending    map[string]pendingRequest
+	lastCleanT int64
+}
+
+// NewHTTPEndpointStats reports stats every interval, if it is positive
+func NewHTTPEndpointStats(interval time.Duration) *HTTPEndpointStats {
+	s := &HTTPEndpointStats{
+		interval:   interval,
+		stop:       make(chan struct{}),
+		endpoints:  make(map[string]*endpointStats),
+		pending:    make(map[string]pendingRequest),
+		lastCleanT: time.Now().UnixNano(),
+	}
+	if interval > 0 {
+		go s.reportStats()
+	}
+	return s
+}
+
+func (s *HTTPEndpointStats) endpointStats(endpoint string) *endpointStats {
+	e, ok := s.endpoints[endpoint]
+	if !ok {
+		e = &endpointStats{endpoint: endpoint, statuses: make(map[int]int)}
+		s.endpoints[endpoint] = e
+	}
+	return e
+}
+
+// Write records original request and response messages, the latency of the original
+// response is the difference between response and request timestamps
+func (s *HTTPEndpointStats) Write(msg *Message) {
+	meta := payloadMeta(msg.Meta)
+	if len(meta) < 3 {
+		return
+	}
+	ts, _ := strconv.ParseInt(byteutils.SliceToString(meta[2]), 10, 64)
+	id := string(meta[1])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch msg.Meta[0] {
+	case RequestPayload:
+		s.pending[id] = pendingRequest{endpointTemplate(msg.Data), ts}
+	case ResponsePayload:
+		req, ok := s.pending[id]
+		if !ok {
+			return
+		}
+		delete(s.pending, id)
+		if ts > req.start {
+			s.endpointStats(req.endpoint).original.add(time.Duration(ts - req.start))
+		}
+	}
+
+	// Clean up requests for which we didn't get a response
+	now := time.Now().UnixNano()
+	if len(s.pending)%1000 == 0 && now-s.lastCleanT > int64(60*time.Second) {
+		for k, v := range s.pending {
+			if now-v.start > int64(60*time.Second) {
+				delete(s.pending, k)
+			}
+		}
+		s.lastCleanT = now
+	}
+}
+
+// Replayed records result of the replayed request
+func (s *HTTPEndpointStats) Replayed(request []byte, status int, latency time.Duration, err error) {
+	endpoint := endpointTemplate(request)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.endpointStats(endpoint)
+	e.requests++
+	if err != nil {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			e.timeouts++
+		} else if uerr, ok := err.(*url.Error); ok {
+			if _, ok := uerr.Err.(*net.OpError); ok {
+				e.connErrors++
+			} else {
+				e.otherErrors++
+			}
+		} else {
+			e.otherErrors++
+		}
+		return
+	}
+	e.replayed.add(latency)
+	if status > 0 {
+		e.statuses[status]++
+	}
+}
+
+// Report returns stats of all endpoints, the most requested endpoints first
+func (s *HTTPEndpointStats) Report() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	endpoints := make([]*endpointStats, 0, len(s.endpoints))
+	for _, e := range s.endpoints {
+		if e.requests > 0 {
+			endpoints = append(endpoints, e)
+		}
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].requests != endpoints[j].requests {
+			return endpoints[i].requests > endpoints[j].requests
+		}
+		return endpoints[i].endpoint < endpoints[j].endpoint
+	})
+
+	var b strings.Builder
+	b.WriteString("[OUTPUT-HTTP] endpoint stats:\n")
+	for _, e := range endpoints {
+		fmt.Fprintf(&b, "%s: requests=%d replayed: %s", e.endpoint, e.requests, &e.replayed)
+		if e.original.count > 0 {
+			fmt.Fprintf(&b, " original: %s", &e.original)
+		}
+		codes := make([]int, 0, len(e.statuses))
+		for code := range e.statuses {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		b.WriteString(" statuses:")
+		for _, code := range codes {
+			fmt.Fprintf(&b, " %d=%d", code, e.statuses[code])
+		}
+		fmt.Fprintf(&b, " timeouts=%d conn_errors=%d errors=%d\n", e.timeouts, e.connErrors, e.otherErrors)
+	}
+	return b.String()
+}
+
+func (s *HTTPEndpointStats) reportStats() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			Debug(0, s.Report())
+		}
+	}
+}
+
+// Close stops periodic reports and prints the final one
+func (s *HTTPEndpointStats) Close() {
+	close(s.stop)
+	Debug(0, s.Report())
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyStatsPercentiles(t *testing.T) {
+	var l latencyStats
+	for i := 100; i >= 1; i-- {
+		l.add(time.Duration(i) * time.Millisecond)
+	}
+	p := l.percentiles(50, 90, 99)
+	if p[0] != 51*time.Millisecond || p[1] != 90*time.Millisecond || p[2] != 99*time.Millisecond {
+		t.Errorf("wrong percentiles %v", p)
+	}
+	if l.max != 100*time.Millisecond || l.count != 100 {
+		t.Errorf("wrong max %s or count %d", l.max, l.count)
+	}
+
+	for i := 0; i < latencySamples; i++ {
+		l.add(time.Millisecond)
+	}
+	if len(l.samples) != latencySamples {
+		t.Errorf("expected samples to be limited, got %d", len(l.samples))
+	}
+}
+
+func TestHTTPEndpointStats(t *testing.T) {
+	s := NewHTTPEndpointStats(0)
+
+	request := []byte("GET /users/1 HTTP/1.1\r\n\r\n")
+	s.Write(&Message{Meta: payloadHeader(RequestPayload, []byte("a"), 1000000000, 0), Data: request})
+	s.Write(&Message{Meta: payloadHeader(ResponsePayload, []byte("a"), 1020000000, 0), Data: []byte("HTTP/1.1 200 OK\r\n\r\n")})
+
+	s.Replayed(request, 200, 10*time.Millisecond, nil)
+	s.Replayed([]byte("GET /users/2 HTTP/1.1\r\n\r\n"), 500, 30*time.Millisecond, nil)
+	s.Replayed(request, 0, time.Second, &url.Error{Op: "Get", URL: "/", Err: timeoutError{}})
+	s.Replayed(request, 0, 0, &url.Error{Op: "Get", URL: "/", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}})
+	s.Replayed([]byte("POST /users HTTP/1.1\r\n\r\n"), 201, time.Millisecond, nil)
+
+	report := s.Report()
+	expected := []string{
+		"GET /users/:id: requests=4 replayed: p50=30ms p90=30ms p99=30ms max=30ms original: p50=20ms p90=20ms p99=20ms max=20ms statuses: 200=1 500=1 timeouts=1 conn_errors=1 errors=0",
+		"POST /users: requests=1 replayed: p50=1ms p90=1ms p99=1ms max=1ms statuses: 201=1 timeouts=0 conn_errors=0 errors=0",
+	}
+	lines := strings.Split(strings.TrimSpace(report), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("unexpected report:\n%s", report)
+	}
+	for i, line := range expected {
+		if lines[i+1] != line {
+			t.Errorf("expected\n%s\ngot\n%s", line, lines[i+1])
+		}
+	}
+	s.Close()
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestHTTPOutputEndpointStats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{EndpointStats: true}).(*HTTPOutput)
+	output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, []byte("1"), 1, 0), Data: []byte("GET /items/1 HTTP/1.1\r\n\r\n")})
+	output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, []byte("2"), 1, 0), Data: []byte("GET /missing HTTP/1.1\r\n\r\n")})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		report := output.endpointStats.Report()
+		if strings.Contains(report, "GET /items/:id: requests=1") && strings.Contains(report, "statuses: 404=1") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("requests are not reported:\n%s", report)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	output.Close()
+}
@@ -1,12 +1,27 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	_ "net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestHTTPOutput(t *testing.T) {
@@ -179,6 +194,224 @@ func TestHTTPOutputSessions(t *testing.T) {
 	Settings.SplitOutput = false
 }
 
+func TestHTTPOutputSplitWeighted(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	input := NewTestInput()
+
+	var counter1, counter2 int32
+	server1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&counter1, 1)
+		wg.Done()
+	}))
+	defer server1.Close()
+	server2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&counter2, 1)
+		wg.Done()
+	}))
+	defer server2.Close()
+
+	// outputs share the config, like --output-http flags do
+	config := &HTTPOutputConfig{}
+	output1 := NewHTTPOutput(server1.URL, config)
+	output2 := NewHTTPOutput(server2.URL, config)
+
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input},
+		Outputs: []PluginWriter{output1, output2},
+	}
+	plugins.All = append(plugins.All, input, output1, output2)
+
+	Settings.SplitOutput = true
+	Settings.SplitOutputWeights.Set("50,50")
+
+	emitter := NewEmitter()
+	go emitter.Start(plugins, Settings.Middleware)
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		input.EmitGET()
+	}
+
+	wg.Wait()
+	emitter.Close()
+
+	if counter1 < 20 || counter2 < 20 {
+		t.Errorf("Expected requests to reach both hosts: %d vs %d", counter1, counter2)
+	}
+
+	Settings.SplitOutput = false
+	Settings.SplitOutputWeights = nil
+}
+
+// writeTestCertificates writes CA certificate, and certificate with key signed by it,
+// valid for 127.0.0.1 and usable both by servers and clients
+func writeTestCertificates(t *testing.T) (dir, caFile, certFile, keyFile string) {
+	dir, err := ioutil.TempDir("", "gor-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writePEM := func(name, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gor test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ = x509.ParseCertificate(caDER)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	return dir, writePEM("ca.crt", "CERTIFICATE", caDER), writePEM("client.crt", "CERTIFICATE", certDER), writePEM("client.key", "EC PRIVATE KEY", keyDER)
+}
+
+func TestHTTPOutputClientCertificate(t *testing.T) {
+	dir, caFile, certFile, keyFile := writeTestCertificates(t)
+	defer os.RemoveAll(dir)
+
+	serverTLS, err := NewTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM, _ := ioutil.ReadFile(caFile)
+	serverTLS.ClientCAs = x509.NewCertPool()
+	serverTLS.ClientCAs.AppendCertsFromPEM(caPEM)
+	serverTLS.ClientAuth = tls.RequireAndVerifyClientCert
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = serverTLS
+	server.StartTLS()
+	defer server.Close()
+
+	request := []byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\n\r\n")
+
+	config := &HTTPOutputConfig{TrackResponses: true, TLSCert: certFile, TLSKey: keyFile, TLSCACert: caFile}
+	config.url, _ = url.Parse(server.URL)
+	resp, err := NewHTTPClient(config).Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(resp), "127.0.0.1") {
+		t.Errorf("expected client certificate to be sent, got %q", resp)
+	}
+
+	config = &HTTPOutputConfig{TrackResponses: true, TLSCACert: caFile}
+	config.url, _ = url.Parse(server.URL)
+	if _, err = NewHTTPClient(config).Send(request); err == nil {
+		t.Error("request without client certificate should fail")
+	}
+}
+
+func TestHTTPOutputTransport(t *testing.T) {
+	var conns int32
+	var remoteAddr atomic.Value
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddr.Store(r.RemoteAddr)
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	request := []byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\n\r\n")
+	send := func(config *HTTPOutputConfig) {
+		config.url, _ = url.Parse(server.URL)
+		client := NewHTTPClient(config)
+		for i := 0; i < 3; i++ {
+			if _, err := client.Send(request); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	send(&HTTPOutputConfig{LocalAddr: "127.0.0.1", MaxIdleConnsPerHost: 10})
+	if n := atomic.SwapInt32(&conns, 0); n != 1 {
+		t.Errorf("expected connection to be reused, got %d connections", n)
+	}
+	if addr := remoteAddr.Load().(string); !strings.HasPrefix(addr, "127.0.0.1:") {
+		t.Errorf("wrong source address %q", addr)
+	}
+
+	send(&HTTPOutputConfig{DisableKeepAlive: true})
+	if n := atomic.SwapInt32(&conns, 0); n != 3 {
+		t.Errorf("expected new connection per request, got %d connections", n)
+	}
+
+	transport, _ := newHTTPTransport(&HTTPOutputConfig{MaxIdleConnsPerHost: 200, MaxConnsPerHost: 300, IdleConnTimeout: time.Second, DialTimeout: time.Second, TLSHandshakeTimeout: time.Second, Proxy: "http://proxy.local:3128", SkipVerify: true})
+	if transport.MaxIdleConnsPerHost != 200 || transport.MaxIdleConns < 200 || transport.MaxConnsPerHost != 300 ||
+		transport.IdleConnTimeout != time.Second || transport.TLSHandshakeTimeout != time.Second || !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Errorf("transport is not configured: %+v", transport)
+	}
+	req, _ := http.NewRequest("GET", "http://example.org", nil)
+	if proxy, _ := transport.Proxy(req); proxy == nil || proxy.Host != "proxy.local:3128" {
+		t.Errorf("wrong proxy %v", proxy)
+	}
+
+	if _, err := newHTTPTransport(&HTTPOutputConfig{LocalAddr: "not an ip"}); err == nil {
+		t.Error("invalid local address should fail")
+	}
+}
+
+func TestHTTPOutputForceHTTP2(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	request := []byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\n\r\n")
+
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	config := &HTTPOutputConfig{SkipVerify: true, ForceHTTP2: true}
+	config.url, _ = url.Parse(h2.URL)
+	if _, err := NewHTTPClient(config).Send(request); err != nil {
+		t.Error(err)
+	}
+
+	h1 := httptest.NewTLSServer(handler)
+	defer h1.Close()
+
+	config = &HTTPOutputConfig{SkipVerify: true, ForceHTTP2: true}
+	config.url, _ = url.Parse(h1.URL)
+	if _, err := NewHTTPClient(config).Send(request); err == nil {
+		t.Error("HTTP/1.1 server should fail when HTTP/2 is forced")
+	}
+}
+
 func BenchmarkHTTPOutput(b *testing.B) {
 	wg := new(sync.WaitGroup)
 
@@ -87,6 +87,9 @@ func (o *KafkaOutput) PluginWrite(msg *Message) (n int, err error) {
 			ReqBody:    byteutils.SliceToString(proto.Body(req)),
 			ReqHeaders: header,
 		}
+		if isRequestPayload(msg.Meta) {
+			kafkaMessage.ReqEndpoint = Settings.PathTemplates.Normalize(proto.Path(req))
+		}
 		jsonMessage, _ := json.Marshal(&kafkaMessage)
 		message = sarama.StringEncoder(byteutils.SliceToString(jsonMessage))
 	}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readMySQLPacket(r *bufio.Reader) (seq byte, payload []byte, err error) {
+	var header [4]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	payload = make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+	_, err = io.ReadFull(r, payload)
+	return header[3], payload, err
+}
+
+// startMySQL starts a server which makes authentication with the plugin, and sends received queries to the channel
+func startMySQL(t *testing.T, plugin, password string, queries chan<- string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("0123456789abcdefghij")
+	okPacket := "\x00\x00\x00\x02\x00\x00\x00"
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				// protocol 41, secure connection and plugin authentication
+				greeting := "\x0a8.0.33\x00\x01\x00\x00\x00" + string(salt[:8]) + "\x00\x00\x82\x2d\x02\x00\x08\x00\x15" +
+					strings.Repeat("\x00", 10) + string(salt[8:]) + "\x00" + plugin + "\x00"
+				conn.Write([]byte(mysqlTestPacket(0, greeting)))
+
+				_, resp, err := readMySQLPacket(r)
+				if err != nil || !bytes.Contains(resp, []byte("replay\x00")) {
+					t.Errorf("wrong handshake response %q", resp)
+					return
+				}
+				// the authentication response follows the user name
+				auth := resp[bytes.Index(resp, []byte("replay\x00"))+7:]
+				if len(auth) == 0 || !bytes.Equal(auth[1:1+auth[0]], mysqlScramble(plugin, password, salt)) {
+					conn.Write([]byte(mysqlTestPacket(2, "\xff\x15\x04#28000Access denied")))
+					return
+				}
+				seq := byte(2)
+				if plugin == mysqlCachingSHA2Password {
+					conn.Write([]byte(mysqlTestPacket(seq, "\x01\x03")))
+					seq++
+				}
+				conn.Write([]byte(mysqlTestPacket(seq, okPacket)))
+
+				for {
+					_, payload, err := readMySQLPacket(r)
+					if err != nil {
+						return
+					}
+					queries <- string(payload[1:])
+					conn.Write([]byte(mysqlTestPacket(1, okPacket)))
+				}
+			}(conn)
+		}
+	}()
+	return listener
+}
+
+func TestMySQLOutput(t *testing.T) {
+	for _, plugin := range []string{mysqlNativePassword, mysqlCachingSHA2Password} {
+		queries := make(chan string, 10)
+		listener := startMySQL(t, plugin, "secret", queries)
+
+		output := NewMySQLOutput("mysql://replay:secret@"+listener.Addr().String()+"/app", &MySQLOutputConfig{
+			Workers:        1,
+			TrackResponses: true,
+		})
+
+		expected := []string{"SELECT 1", "USE `app`"}
+		for _, query := range expected {
+			output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1), Data: []byte(query)})
+		}
+		for _, query := range expected {
+			select {
+			case received := <-queries:
+				if received != query {
+					t.Errorf("%s: expected query %q, got %q", plugin, query, received)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("%s: query %q is not replayed", plugin, query)
+			}
+		}
+		for range expected {
+			msg, err := output.PluginRead()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Meta[0] != ReplayedResponsePayload || string(msg.Data) != mysqlTestPacket(1, "\x00\x00\x00\x02\x00\x00\x00") {
+				t.Errorf("%s: wrong response %q %q", plugin, msg.Meta, msg.Data)
+			}
+		}
+		output.(*MySQLOutput).Close()
+		listener.Close()
+	}
+}
+
+func TestMySQLClientConfig(t *testing.T) {
+	config, err := mysqlClientConfig("mysql://user:pass@db/app", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Address != "db:3306" || config.User != "user" || config.Password != "pass" || config.Database != "app" {
+		t.Errorf("wrong config %+v", config)
+	}
+	if _, err = mysqlClientConfig("postgres://db", time.Second); err == nil {
+		t.Error("wrong scheme should be an error")
+	}
+}
+
+func TestMySQLGreeting(t *testing.T) {
+	greeting := "\x0a5.7.0\x00\x01\x00\x00\x00abcdefgh\x00\xff\xf7\x21\x02\x00\xff\x81\x15" + strings.Repeat("\x00", 10) +
+		"ijklmnopqrst\x00mysql_native_password\x00"
+	plugin, salt, err := mysqlGreeting([]byte(greeting))
+	if err != nil || plugin != mysqlNativePassword || string(salt) != "abcdefghijklmnopqrst" {
+		t.Errorf("wrong greeting %q %q %v", plugin, salt, err)
+	}
+}
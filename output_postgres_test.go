@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func readPostgresMessage(r *bufio.Reader, untyped bool) (msg proto.PostgresMessage, err error) {
+	if !untyped {
+		if msg.Type, err = r.ReadByte(); err != nil {
+			return
+		}
+	}
+	var length [4]byte
+	if _, err = io.ReadFull(r, length[:]); err != nil {
+		return
+	}
+	msg.Data = make([]byte, binary.BigEndian.Uint32(length[:])-4)
+	_, err = io.ReadFull(r, msg.Data)
+	return
+}
+
+// startPostgres starts a server which makes md5 authentication, and sends received messages to the channel
+func startPostgres(t *testing.T, password string, messages chan<- proto.PostgresMessage) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(conn net.Conn, typ byte, data string) {
+		msg := proto.PostgresMessage{Type: typ, Data: []byte(data)}
+		conn.Write(msg.Encode())
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				startup, err := readPostgresMessage(r, true)
+				if err != nil || !strings.Contains(string(startup.Data), "user\x00replay\x00") {
+					t.Errorf("wrong startup message %q", startup.Data)
+					return
+				}
+				write(conn, 'R', "\x00\x00\x00\x05salt")
+				msg, err := readPostgresMessage(r, false)
+				if err != nil || string(msg.Data) != postgresMD5("replay", password, []byte("salt"))+"\x00" {
+					write(conn, 'E', "SFATAL\x00Mpassword authentication failed\x00\x00")
+					return
+				}
+				write(conn, 'R', "\x00\x00\x00\x00")
+				write(conn, 'Z', "I")
+
+				for {
+					msg, err := readPostgresMessage(r, false)
+					if err != nil {
+						return
+					}
+					messages <- msg
+					switch msg.Type {
+					case proto.PostgresQuery:
+						write(conn, 'C', "SELECT 1\x00")
+						write(conn, 'Z', "I")
+					case proto.PostgresSync:
+						write(conn, 'Z', "I")
+					}
+				}
+			}(conn)
+		}
+	}()
+	return listener
+}
+
+func TestPostgresOutput(t *testing.T) {
+	messages := make(chan proto.PostgresMessage, 20)
+	listener := startPostgres(t, "secret", messages)
+	defer listener.Close()
+
+	output := NewPostgresOutput("postgres://replay:secret@"+listener.Addr().String()+"/app", &PostgresOutputConfig{
+		Workers:        1,
+		ReadOnly:       true,
+		TrackResponses: true,
+	})
+	defer output.(*PostgresOutput).Close()
+
+	message := func(typ byte, data string) string {
+		m := proto.PostgresMessage{Type: typ, Data: []byte(data)}
+		return string(m.Encode())
+	}
+	bind := message('B', "\x00S_1\x00\x00\x00\x00\x00\x00\x00")
+	execute := message('E', "\x00\x00\x00\x00\x00") + message('S', "")
+	requests := []string{
+		message(proto.PostgresUntypedType, "\x00\x03\x00\x00user\x00app\x00\x00"),
+		message('P', "S_1\x00SELECT 1\x00\x00\x00") + bind + execute,
+		// the statement prepared by the previous request
+		bind + execute,
+		message('Q', "DELETE FROM users\x00"),
+		message('Q', "SELECT 2\x00"),
+	}
+	for _, data := range requests {
+		output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1), Data: []byte(data)})
+	}
+
+	expected := []string{"P\x00SELECT 1", "B\x00\x00", "E", "S", "P\x00SELECT 1", "B\x00\x00", "E", "S", "Q" + "SELECT 2"}
+	for _, prefix := range expected {
+		select {
+		case msg := <-messages:
+			if received := string(msg.Type) + string(msg.Data); !strings.HasPrefix(received, prefix) {
+				t.Errorf("expected message %q, got %q", prefix, received)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("message %q is not replayed", prefix)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		msg, err := output.PluginRead()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Meta[0] != ReplayedResponsePayload || !strings.HasSuffix(string(msg.Data), "Z\x00\x00\x00\x05I") {
+			t.Errorf("wrong response %q %q", msg.Meta, msg.Data)
+		}
+	}
+}
+
+func TestPostgresClientConfig(t *testing.T) {
+	config, err := postgresClientConfig("postgres://user:pass@db?sslmode=require", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Address != "db:5432" || config.User != "user" || config.Password != "pass" || config.Database != "user" || !config.TLS {
+		t.Errorf("wrong config %+v", config)
+	}
+	if _, err = postgresClientConfig("mysql://db", time.Second); err == nil {
+		t.Error("wrong scheme should be an error")
+	}
+}
+
+func TestSCRAMClient(t *testing.T) {
+	// example of RFC 7677
+	s := &scramClient{user: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	if first := s.first(); first != "n,,n=user,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Errorf("wrong client-first-message %q", first)
+	}
+	final, err := s.final([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(final) != "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=" {
+		t.Errorf("wrong client-final-message %q", final)
+	}
+	if err = s.verify([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err != nil {
+		t.Error(err)
+	}
+}
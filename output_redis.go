@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// RedisOutputConfig struct for holding redis output configuration
+type RedisOutputConfig struct {
+	Workers        int           `json:"output-redis-workers"`
+	Timeout        time.Duration `json:"output-redis-timeout"`
+	TrackResponses bool          `json:"output-redis-track-response"`
+	AllowCommands  MultiOption   `json:"output-redis-allow-command"`
+	DenyCommands   MultiOption   `json:"output-redis-deny-command"`
+}
+
+// RedisOutput plugin replays captured redis commands, captured with `--input-raw-protocol redis`.
+// Each worker keeps its own connection, and reads the reply of a command before sending the next one.
+type RedisOutput struct {
+	address   string
+	config    *RedisOutputConfig
+	allow     map[string]bool
+	deny      map[string]bool
+	queue     chan *Message
+	responses chan response
+	quit      chan struct{}
+}
+
+// NewRedisOutput constructor for RedisOutput
+func NewRedisOutput(address string, config *RedisOutputConfig) PluginReadWriter {
+	o := new(RedisOutput)
+	o.address = address
+	o.config = config
+	o.allow = redisCommands(config.AllowCommands)
+	o.deny = redisCommands(config.DenyCommands)
+
+	if o.config.Workers <= 0 {
+		o.config.Workers = initialDynamicWorkers
+	}
+	if o.config.Timeout <= 0 {
+		o.config.Timeout = 5 * time.Second
+	}
+
+	o.queue = make(chan *Message, 1000)
+	o.responses = make(chan response, 1000)
+	o.quit = make(chan struct{})
+
+	for i := 0; i < o.config.Workers; i++ {
+		go o.startWorker()
+	}
+
+	return o
+}
+
+// redisCommands returns set of upper case command names
+func redisCommands(names []string) map[string]bool {
+	commands := make(map[string]bool)
+	for _, name := range names {
+		for _, n := range strings.Split(name, ",") {
+			if n = strings.TrimSpace(n); n != "" {
+				commands[strings.ToUpper(n)] = true
+			}
+		}
+	}
+	return commands
+}
+
+// allowed reports whether the command passes allow and deny lists
+func (o *RedisOutput) allowed(command []byte) bool {
+	name := strings.ToUpper(string(command))
+	if o.deny[name] {
+		return false
+	}
+	return len(o.allow) == 0 || o.allow[name]
+}
+
+// PluginWrite writes a message to this plugin
+func (o *RedisOutput) PluginWrite(msg *Message) (n int, err error) {
+	n = len(msg.Data) + len(msg.Meta)
+	if !isRequestPayload(msg.Meta) {
+		return
+	}
+
+	command := proto.RESPCommand(msg.Data)
+	if command == nil {
+		Debug(2, "[OUTPUT-REDIS] not a redis command:", string(msg.Data))
+		return
+	}
+	if !o.allowed(command) {
+		Debug(3, "[OUTPUT-REDIS] command is filtered:", string(command))
+		return
+	}
+
+	select {
+	case o.queue <- msg:
+	case <-o.quit:
+		return 0, ErrorStopped
+	}
+	return
+}
+
+// PluginRead reads a message from this plugin
+func (o *RedisOutput) PluginRead() (*Message, error) {
+	var resp response
+	var msg Message
+	select {
+	case <-o.quit:
+		return nil, ErrorStopped
+	case resp = <-o.responses:
+	}
+	msg.Data = resp.payload
+	msg.Meta = payloadHeader(ReplayedResponsePayload, resp.uuid, resp.startedAt, resp.roundTripTime)
+
+	return &msg, nil
+}
+
+func (o *RedisOutput) startWorker() {
+	conn := &redisConn{address: o.address, timeout: o.config.Timeout}
+	defer conn.close()
+
+	for {
+		select {
+		case <-o.quit:
+			return
+		case msg := <-o.queue:
+			start := time.Now()
+			reply, err := conn.send(msg.Data)
+			stop := time.Now()
+			if err != nil {
+				Debug(1, "[OUTPUT-REDIS] request error:", err)
+				conn.close()
+				continue
+			}
+
+			if o.config.TrackResponses {
+				o.responses <- response{reply, payloadID(msg.Meta), start.UnixNano(), stop.UnixNano() - start.UnixNano()}
+			}
+		}
+	}
+}
+
+func (o *RedisOutput) String() string {
+	return "Redis output: " + o.address
+}
+
+// Close closes this plugin
+func (o *RedisOutput) Close() error {
+	close(o.quit)
+	return nil
+}
+
+// redisConn is a connection which sends commands and reads their replies
+type redisConn struct {
+	address string
+	timeout time.Duration
+	conn    net.Conn
+	buf     []byte // data read after the last reply
+}
+
+// send sends the command and returns its reply
+func (c *redisConn) send(command []byte) (reply []byte, err error) {
+	if c.conn == nil {
+		if c.conn, err = net.DialTimeout("tcp", c.address, c.timeout); err != nil {
+			return
+		}
+	}
+
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err = c.conn.Write(command); err != nil {
+		return
+	}
+
+	var chunk [4096]byte
+	for {
+		if n := proto.RESPLength(c.buf); n > 0 {
+			reply = append([]byte(nil), c.buf[:n]...)
+			c.buf = append(c.buf[:0], c.buf[n:]...)
+			return
+		}
+		if len(c.buf) > 0 && !proto.IsRESPType(c.buf[0]) {
+			return nil, errors.New("invalid reply")
+		}
+		n, err := c.conn.Read(chunk[:])
+		if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, chunk[:n]...)
+	}
+}
+
+func (c *redisConn) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	c.buf = c.buf[:0]
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func startRedis(t *testing.T, commands chan<- string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				var buf []byte
+				chunk := make([]byte, 1024)
+				for {
+					n, err := conn.Read(chunk)
+					if err != nil {
+						return
+					}
+					buf = append(buf, chunk[:n]...)
+					for n = proto.RESPLength(buf); n > 0; n = proto.RESPLength(buf) {
+						commands <- string(proto.RESPCommand(buf[:n]))
+						buf = buf[n:]
+						conn.Write([]byte("+OK\r\n"))
+					}
+				}
+			}(conn)
+		}
+	}()
+	return listener
+}
+
+func TestRedisOutput(t *testing.T) {
+	commands := make(chan string, 10)
+	listener := startRedis(t, commands)
+	defer listener.Close()
+
+	output := NewRedisOutput(listener.Addr().String(), &RedisOutputConfig{
+		Workers:        1,
+		TrackResponses: true,
+		DenyCommands:   MultiOption{"flushall,FLUSHDB"},
+	})
+	defer output.(*RedisOutput).Close()
+
+	for _, data := range []string{
+		"*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n",
+		"*1\r\n$8\r\nFlushAll\r\n",
+		"GET a\r\n",
+	} {
+		output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1), Data: []byte(data)})
+	}
+
+	for _, expected := range []string{"SET", "GET"} {
+		select {
+		case command := <-commands:
+			if command != expected {
+				t.Errorf("expected command %q, got %q", expected, command)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("command %q is not replayed", expected)
+		}
+		msg, err := output.PluginRead()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Meta[0] != ReplayedResponsePayload || string(msg.Data) != "+OK\r\n" {
+			t.Errorf("wrong reply %q %q", msg.Meta, msg.Data)
+		}
+	}
+	select {
+	case command := <-commands:
+		t.Errorf("command %q should be filtered", command)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRedisOutputAllowCommands(t *testing.T) {
+	o := &RedisOutput{allow: redisCommands([]string{"get", "SET"}), deny: redisCommands([]string{"set"})}
+	for command, allowed := range map[string]bool{"GET": true, "get": true, "SET": false, "DEL": false} {
+		if o.allowed([]byte(command)) != allowed {
+			t.Errorf("expected %q to be allowed: %v", command, allowed)
+		}
+	}
+}
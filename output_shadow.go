@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ShadowOutputConfig holds configuration of the shadow comparison output
+type ShadowOutputConfig struct {
+	Baseline       string        `json:"output-http-shadow-baseline"`
+	Candidate      string        `json:"output-http-shadow-candidate"`
+	Control        string        `json:"output-http-shadow-control"`
+	Report         string        `json:"output-http-shadow-report"`
+	ReportInterval time.Duration `json:"output-http-shadow-report-interval"`
+	Threshold      float64       `json:"output-http-shadow-threshold"`
+	Workers        int           `json:"output-http-shadow-workers"`
+}
+
+// ShadowOutput replays every request to a baseline, a candidate and a control target,
+// and compares candidate responses with baseline ones. The control target is a second
+// replay to the baseline, differences between baseline and control responses are
+// considered noise (timestamps, random IDs and etc.) and are not reported.
+type ShadowOutput struct {
+	config    *ShadowOutputConfig
+	baseline  *HTTPClient
+	candidate *HTTPClient
+	control   *HTTPClient
+	queue     chan *Message
+	stop      chan bool // Channel used only to indicate goroutine should shutdown
+	wg        sync.WaitGroup
+
+	mu        sync.Mutex
+	endpoints map[string]*ShadowEndpointStats
+}
+
+// ShadowEndpointStats holds comparison results of a single endpoint
+type ShadowEndpointStats struct {
+	Endpoint  string                       `json:"endpoint"`
+	Requests  int                          `json:"requests"`
+	Errors    int                          `json:"errors"`
+	Divergent int                          `json:"divergent"`
+	Fields    map[string]*ShadowFieldStats `json:"fields"`
+}
+
+// ShadowFieldStats counts how often a response field differed.
+// Differences are counted only if baseline and control agree on the field, otherwise it is noise.
+type ShadowFieldStats struct {
+	Differences int `json:"differences"`
+	Noise       int `json:"noise"`
+}
+
+// NewShadowOutput constructor for ShadowOutput
+func NewShadowOutput(address string, config *ShadowOutputConfig, httpConfig *HTTPOutputConfig) PluginWriter {
+	o := new(ShadowOutput)
+	if config.Control == "" {
+		config.Control = config.Baseline
+	}
+	if config.Workers <= 0 {
+		config.Workers = 10
+	}
+	o.config = config
+	o.baseline = newShadowClient(config.Baseline, *httpConfig)
+	o.candidate = newShadowClient(config.Candidate, *httpConfig)
+	o.control = newShadowClient(config.Control, *httpConfig)
+	o.endpoints = make(map[string]*ShadowEndpointStats)
+	o.queue = make(chan *Message, 1000)
+	o.stop = make(chan bool)
+
+	for i := 0; i < config.Workers; i++ {
+		o.wg.Add(1)
+		go o.worker()
+	}
+	if config.ReportInterval > 0 {
+		go o.reportStats()
+	}
+	return o
+}
+
+// newShadowClient returns client of the target, only options of the connections and requests are taken
+// from --output-http config, the target is the address alone
+func newShadowClient(address string, config HTTPOutputConfig) *HTTPClient {
+	var err error
+	config.backends = nil
+	config.url, err = url.Parse(address)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("[OUTPUT-HTTP-SHADOW] parse URL error[%q]", err))
+	}
+	if config.url.Scheme == "" {
+		config.url.Scheme = "http"
+	}
+	config.rawURL = config.url.String()
+	if config.Timeout < time.Millisecond*100 {
+		config.Timeout = time.Second
+	}
+	config.TrackResponses = true
+	return NewHTTPClient(&config)
+}
+
+// PluginWrite writes message to this plugin
+func (o *ShadowOutput) PluginWrite(msg *Message) (n int, err error) {
+	if !isRequestPayload(msg.Meta) {
+		return len(msg.Data), nil
+	}
+	select {
+	case <-o.stop:
+		return 0, ErrorStopped
+	default:
+	}
+
+	select {
+	case <-o.stop:
+		return 0, ErrorStopped
+	case o.queue <- msg:
+	}
+
+	return len(msg.Data) + len(msg.Meta), nil
+}
+
+func (o *ShadowOutput) worker() {
+	defer o.wg.Done()
+	for {
+		select {
+		case <-o.stop:
+			// requests queued before closing are compared, so they are in the final report
+			for {
+				select {
+				case msg := <-o.queue:
+					o.compare(msg.Data)
+				default:
+					return
+				}
+			}
+		case msg := <-o.queue:
+			o.compare(msg.Data)
+		}
+	}
+}
+
+func (o *ShadowOutput) compare(request []byte) {
+	if _, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(request))); err != nil {
+		return
+	}
+	endpoint := endpointTemplate(request)
+
+	var responses [3][]byte
+	var errs [3]error
+	var wg sync.WaitGroup
+	for i, client := range []*HTTPClient{o.baseline, o.candidate, o.control} {
+		wg.Add(1)
+		go func(i int, client *HTTPClient) {
+			defer wg.Done()
+			responses[i], errs[i] = client.Send(request)
+		}(i, client)
+	}
+	wg.Wait()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	stats, ok := o.endpoints[endpoint]
+	if !ok {
+		stats = &ShadowEndpointStats{Endpoint: endpoint, Fields: make(map[string]*ShadowFieldStats)}
+		o.endpoints[endpoint] = stats
+	}
+	stats.Requests++
+	for i := range responses {
+		if errs[i] != nil || responses[i] == nil {
+			Debug(1, fmt.Sprintf("[OUTPUT-HTTP-SHADOW] error when sending: %v", errs[i]))
+			stats.Errors++
+			return
+		}
+	}
+
+	differences, noise := compareResponses(responses[0], responses[1], responses[2])
+	if len(differences) > 0 {
+		stats.Divergent++
+	}
+	for _, f := range differences {
+		stats.field(f).Differences++
+	}
+	for _, f := range noise {
+		stats.field(f).Noise++
+	}
+}
+
+func (s *ShadowEndpointStats) field(name string) *ShadowFieldStats {
+	f, ok := s.Fields[name]
+	if !ok {
+		f = new(ShadowFieldStats)
+		s.Fields[name] = f
+	}
+	return f
+}
+
+// compareResponses returns fields in which candidate differs from baseline while
+// control agrees with baseline, and fields in which control differs from baseline
+func compareResponses(baseline, candidate, control []byte) (differences, noise []string) {
+	b, c, n := responseFields(baseline), responseFields(candidate), responseFields(control)
+
+	names := make(map[string]struct{})
+	for _, fields := range []map[string]string{b, c, n} {
+		for name := range fields {
+			names[name] = struct{}{}
+		}
+	}
+	for name := range names {
+		bv, bok := b[name]
+		nv, nok := n[name]
+		if bv != nv || bok != nok {
+			noise = append(noise, name)
+			continue
+		}
+		if cv, cok := c[name]; bv != cv || bok != cok {
+			differences = append(differences, name)
+		}
+	}
+	sort.Strings(differences)
+	sort.Strings(noise)
+	return
+}
+
+// responseFields flattens response into comparable fields: status, headers and body.
+// JSON bodies are compared field by field, other bodies as a whole.
+func responseFields(payload []byte) map[string]string {
+	fields := make(map[string]string)
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(payload)), nil)
+	if err != nil {
+		fields["response"] = string(payload)
+		return fields
+	}
+	defer resp.Body.Close()
+
+	fields["status"] = strconv.Itoa(resp.StatusCode)
+	for name, values := range resp.Header {
+		if name == "Content-Length" {
+			continue
+		}
+		fields["header."+name] = strings.Join(values, ", ")
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		if r, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
+			if decoded, err := ioutil.ReadAll(r); err == nil {
+				body = decoded
+			}
+		}
+	}
+
+	var v interface{}
+	if len(body) > 0 && json.Unmarshal(body, &v) == nil {
+		flattenJSON("body", v, fields)
+	} else {
+		fields["body"] = string(body)
+	}
+	return fields
+}
+
+func flattenJSON(prefix string, v interface{}, fields map[string]string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			flattenJSON(prefix+"."+k, val, fields)
+		}
+	case []interface{}:
+		fields[prefix+".length"] = strconv.Itoa(len(v))
+		for i, val := range v {
+			flattenJSON(fmt.Sprintf("%s[%d]", prefix, i), val, fields)
+		}
+	default:
+		b, _ := json.Marshal(v)
+		fields[prefix] = string(b)
+	}
+}
+
+// Report returns endpoints with fields in which candidate diverged for more than Threshold percent of requests
+func (o *ShadowOutput) Report() (report []ShadowEndpointStats) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, stats := range o.endpoints {
+		if stats.Divergent == 0 {
+			continue
+		}
+		endpoint := *stats
+		endpoint.Fields = make(map[string]*ShadowFieldStats)
+		for name, f := range stats.Fields {
+			if f.Differences > 0 && float64(f.Differences)*100/float64(stats.Requests) > o.config.Threshold {
+				field := *f
+				endpoint.Fields[name] = &field
+			}
+		}
+		if len(endpoint.Fields) > 0 {
+			report = append(report, endpoint)
+		}
+	}
+	sort.Slice(report, func(i, j int) bool {
+		ri := float64(report[i].Divergent) / float64(report[i].Requests)
+		rj := float64(report[j].Divergent) / float64(report[j].Requests)
+		if ri != rj {
+			return ri > rj
+		}
+		return report[i].Endpoint < report[j].Endpoint
+	})
+	return
+}
+
+func (o *ShadowOutput) reportStats() {
+	ticker := time.NewTicker(o.config.ReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-o.stop:
+			return
+		case <-ticker.C:
+			Debug(0, o.reportString())
+		}
+	}
+}
+
+func (o *ShadowOutput) reportString() string {
+	var b strings.Builder
+	b.WriteString("[OUTPUT-HTTP-SHADOW] divergence report:\n")
+	for _, e := range o.Report() {
+		fmt.Fprintf(&b, "%s: %d requests, %d divergent (%.1f%%), %d errors\n", e.Endpoint, e.Requests, e.Divergent, float64(e.Divergent)*100/float64(e.Requests), e.Errors)
+		names := make([]string, 0, len(e.Fields))
+		for name := range e.Fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(&b, "\t%s: %d differences, %d noise\n", name, e.Fields[name].Differences, e.Fields[name].Noise)
+		}
+	}
+	return b.String()
+}
+
+func (o *ShadowOutput) writeReport() error {
+	data, err := json.MarshalIndent(o.Report(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(o.config.Report, data, 0644)
+}
+
+func (o *ShadowOutput) String() string {
+	return fmt.Sprintf("HTTP shadow output: baseline %s, candidate %s, control %s", o.config.Baseline, o.config.Candidate, o.config.Control)
+}
+
+// Close compares queued requests, stops the workers and writes the final report
+func (o *ShadowOutput) Close() error {
+	close(o.stop)
+	o.wg.Wait()
+
+	Debug(0, o.reportString())
+	if o.config.Report != "" {
+		if err := o.writeReport(); err != nil {
+			Debug(0, fmt.Sprintf("[OUTPUT-HTTP-SHADOW] error writing report: %q", err))
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func shadowServer(version int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"ts": %d, "version": %d, "path": %q}`, rand.Int63(), version, req.URL.Path)
+	}))
+}
+
+func TestShadowOutput(t *testing.T) {
+	baseline := shadowServer(1)
+	defer baseline.Close()
+	candidate := shadowServer(2)
+	defer candidate.Close()
+
+	report, _ := ioutil.TempFile("", "shadow-report")
+	report.Close()
+	defer os.Remove(report.Name())
+
+	config := &ShadowOutputConfig{Baseline: baseline.URL, Candidate: candidate.URL, Report: report.Name()}
+	output := NewShadowOutput("", config, &HTTPOutputConfig{}).(*ShadowOutput)
+
+	for i := 0; i < 10; i++ {
+		output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1), Data: []byte("GET /users?id=1 HTTP/1.1\r\nHost: example.org\r\n\r\n")})
+		output.PluginWrite(&Message{Meta: payloadHeader(ResponsePayload, uuid(), time.Now().UnixNano(), -1), Data: []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")})
+	}
+
+	for i := 0; ; i++ {
+		output.mu.Lock()
+		stats := output.endpoints["GET /users"]
+		done := stats != nil && stats.Requests == 10
+		output.mu.Unlock()
+		if done {
+			break
+		}
+		if i == 100 {
+			t.Fatal("requests were not compared")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	output.Close()
+
+	data, _ := ioutil.ReadFile(report.Name())
+	var endpoints []ShadowEndpointStats
+	if err := json.Unmarshal(data, &endpoints); err != nil {
+		t.Fatal(err, string(data))
+	}
+	if len(endpoints) != 1 {
+		t.Fatalf("expected 1 divergent endpoint, got %s", data)
+	}
+	e := endpoints[0]
+	if e.Endpoint != "GET /users" || e.Requests != 10 || e.Divergent != 10 || e.Errors != 0 {
+		t.Errorf("wrong endpoint stats: %+v", e)
+	}
+	if f, ok := e.Fields["body.version"]; !ok || f.Differences != 10 {
+		t.Errorf("body.version should diverge: %s", data)
+	}
+	if _, ok := e.Fields["body.ts"]; ok {
+		t.Errorf("noisy body.ts should not be reported: %s", data)
+	}
+	if _, ok := e.Fields["body.path"]; ok {
+		t.Errorf("body.path should not be reported: %s", data)
+	}
+}
+
+func TestShadowOutputCloseDrainsQueue(t *testing.T) {
+	slow := func(version int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			time.Sleep(20 * time.Millisecond)
+			fmt.Fprintf(w, `{"version": %d}`, version)
+		}))
+	}
+	baseline := slow(1)
+	defer baseline.Close()
+	candidate := slow(2)
+	defer candidate.Close()
+
+	config := &ShadowOutputConfig{Baseline: baseline.URL, Candidate: candidate.URL, Workers: 1}
+	output := NewShadowOutput("", config, &HTTPOutputConfig{}).(*ShadowOutput)
+	for i := 0; i < 10; i++ {
+		output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1), Data: []byte("GET /users HTTP/1.1\r\nHost: example.org\r\n\r\n")})
+	}
+	output.Close()
+
+	report := output.Report()
+	if len(report) != 1 || report[0].Requests != 10 || report[0].Divergent != 10 {
+		t.Errorf("requests queued before closing should be reported: %+v", report)
+	}
+	if _, err := output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1)}); err != ErrorStopped {
+		t.Errorf("expected ErrorStopped after closing, got %v", err)
+	}
+}
+
+func TestShadowClientAddress(t *testing.T) {
+	primary := &HTTPOutputConfig{Timeout: 3 * time.Second}
+	primary.url, _ = url.Parse("srv://_http._tcp.primary.local")
+	primary.backends = &backendPool{}
+
+	client := newShadowClient("http://candidate.local:8080", *primary)
+	if client.config.url.Host != "candidate.local:8080" || client.config.backends != nil {
+		t.Errorf("shadow client should use its address only, got %s, backends %v", client.config.url, client.config.backends)
+	}
+	if client.config.Timeout != 3*time.Second {
+		t.Errorf("shadow client should keep --output-http options, got timeout %s", client.config.Timeout)
+	}
+}
+
+func TestShadowCompareResponses(t *testing.T) {
+	baseline := []byte("HTTP/1.1 200 OK\r\nDate: Mon\r\nX-Version: 1\r\nContent-Length: 23\r\n\r\n{\"a\": [1, 2], \"b\": \"x\"}")
+	control := []byte("HTTP/1.1 200 OK\r\nDate: Tue\r\nX-Version: 1\r\nContent-Length: 23\r\n\r\n{\"a\": [1, 2], \"b\": \"x\"}")
+	candidate := []byte("HTTP/1.1 500 Internal Server Error\r\nDate: Wed\r\nX-Version: 2\r\nContent-Length: 20\r\n\r\n{\"a\": [1], \"b\": \"x\"}")
+
+	differences, noise := compareResponses(baseline, candidate, control)
+	expected := []string{"body.a.length", "body.a[1]", "header.X-Version", "status"}
+	if fmt.Sprint(differences) != fmt.Sprint(expected) {
+		t.Errorf("expected differences %v, got %v", expected, differences)
+	}
+	if fmt.Sprint(noise) != "[header.Date]" {
+		t.Errorf("expected Date header to be noise, got %v", noise)
+	}
+
+	differences, _ = compareResponses(baseline, baseline, baseline)
+	if len(differences) != 0 {
+		t.Errorf("equal responses should not differ: %v", differences)
+	}
+}
+
+func TestShadowReportThreshold(t *testing.T) {
+	output := &ShadowOutput{config: &ShadowOutputConfig{Threshold: 10}, endpoints: map[string]*ShadowEndpointStats{
+		"GET /a": {Endpoint: "GET /a", Requests: 100, Divergent: 5, Fields: map[string]*ShadowFieldStats{"status": {Differences: 5}}},
+		"GET /b": {Endpoint: "GET /b", Requests: 10, Divergent: 5, Fields: map[string]*ShadowFieldStats{"status": {Differences: 5}, "body": {Differences: 1}}},
+	}}
+
+	report := output.Report()
+	if len(report) != 1 || report[0].Endpoint != "GET /b" {
+		t.Fatalf("only GET /b should be reported: %+v", report)
+	}
+	if _, ok := report[0].Fields["body"]; ok || len(report[0].Fields) != 1 {
+		t.Errorf("body diverged below threshold: %+v", report[0].Fields)
+	}
+}
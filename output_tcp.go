@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"hash/fnv"
+	"log"
 	"net"
 	"time"
 )
@@ -19,16 +20,22 @@ type TCPOutput struct {
 	bufStats    *GorStat
 	config      *TCPOutputConfig
 	workerIndex uint32
+	tlsConfig   *tls.Config
 
 	close bool
 }
 
 // TCPOutputConfig tcp output configuration
 type TCPOutputConfig struct {
-	Secure     bool `json:"output-tcp-secure"`
-	Sticky     bool `json:"output-tcp-sticky"`
-	SkipVerify bool `json:"output-tcp-skip-verify"`
-	Workers    int  `json:"output-tcp-workers"`
+	Secure        bool   `json:"output-tcp-secure"`
+	Sticky        bool   `json:"output-tcp-sticky"`
+	SkipVerify    bool   `json:"output-tcp-skip-verify"`
+	Workers       int    `json:"output-tcp-workers"`
+	TLSCert       string `json:"output-tcp-tls-cert"`
+	TLSKey        string `json:"output-tcp-tls-key"`
+	TLSCACert     string `json:"output-tcp-tls-ca-cert"`
+	TLSServerName string `json:"output-tcp-tls-server-name"`
+	TLSMinVersion string `json:"output-tcp-tls-min-version"`
 }
 
 // NewTCPOutput constructor for TCPOutput
@@ -39,6 +46,14 @@ func NewTCPOutput(address string, config *TCPOutputConfig) PluginWriter {
 	o.address = address
 	o.config = config
 
+	if config.Secure {
+		var err error
+		o.tlsConfig, err = newClientTLSConfig(config.TLSCert, config.TLSKey, config.TLSCACert, config.TLSServerName, config.TLSMinVersion, config.SkipVerify)
+		if err != nil {
+			log.Fatal("[OUTPUT-TCP] error while loading TLS configuration: ", err)
+		}
+	}
+
 	if Settings.OutputTCPStats {
 		o.bufStats = NewGorStat("output_tcp", 5000)
 	}
@@ -125,7 +140,7 @@ func (o *TCPOutput) PluginWrite(msg *Message) (n int, err error) {
 func (o *TCPOutput) connect(address string) (conn net.Conn, err error) {
 	if o.config.Secure {
 		var d tls.Dialer
-		d.Config = &tls.Config{InsecureSkipVerify: o.config.SkipVerify}
+		d.Config = o.tlsConfig
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		conn, err = d.DialContext(ctx, "tcp", address)
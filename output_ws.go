@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/byteutils"
+	"github.com/buger/goreplay/proto"
+)
+
+// webSocketGUID is appended to the handshake key to compute the accept header, RFC 6455 section 4.2.2
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocketOutputConfig WebSocket output configuration
+type WebSocketOutputConfig struct {
+	Timeout     time.Duration `json:"output-ws-timeout"`
+	IdleTimeout time.Duration `json:"output-ws-idle-timeout"`
+	QueueLen    int           `json:"output-ws-queue-len"`
+	SkipVerify  bool          `json:"output-ws-skip-verify"`
+}
+
+// WebSocketOutput replays captured WebSocket connections. The upgrade request opens a connection
+// to the target, and frames sent by the client are replayed on it in order, with the original timing.
+type WebSocketOutput struct {
+	sync.Mutex
+	address   string
+	url       *url.URL
+	config    *WebSocketOutputConfig
+	tlsConfig *tls.Config
+	conns     map[string]*webSocketReplay // by id of the upgrade request
+	stop      chan struct{}
+	closed    bool
+}
+
+// webSocketReplay is a replayed connection
+type webSocketReplay struct {
+	frames  chan *Message
+	start   int64     // timestamp of the upgrade request
+	started time.Time // time when the replay started
+}
+
+// NewWebSocketOutput constructor for WebSocketOutput, address is ws:// or wss:// URL of the target
+func NewWebSocketOutput(address string, config *WebSocketOutputConfig) PluginWriter {
+	o := new(WebSocketOutput)
+	o.address = address
+	o.config = config
+	o.conns = make(map[string]*webSocketReplay)
+	o.stop = make(chan struct{})
+
+	var err error
+	if o.url, err = url.Parse(address); err != nil || o.url.Host == "" {
+		// address without scheme
+		o.url, err = url.Parse("ws://" + address)
+	}
+	if err != nil {
+		log.Fatal("[OUTPUT-WS] error while parsing address: ", err)
+	}
+	switch o.url.Scheme {
+	case "ws":
+	case "wss":
+		o.tlsConfig = &tls.Config{ServerName: o.url.Hostname(), InsecureSkipVerify: config.SkipVerify}
+	default:
+		log.Fatalf("[OUTPUT-WS] unsupported scheme %q, expected ws or wss", o.url.Scheme)
+	}
+	if o.url.Port() == "" {
+		port := "80"
+		if o.url.Scheme == "wss" {
+			port = "443"
+		}
+		o.url.Host = net.JoinHostPort(o.url.Hostname(), port)
+	}
+	if o.config.Timeout <= 0 {
+		o.config.Timeout = 5 * time.Second
+	}
+	if o.config.IdleTimeout <= 0 {
+		o.config.IdleTimeout = time.Minute
+	}
+	if o.config.QueueLen <= 0 {
+		o.config.QueueLen = 1000
+	}
+
+	return o
+}
+
+// PluginWrite opens a connection for the upgrade request, and queues frames to their connections
+func (o *WebSocketOutput) PluginWrite(msg *Message) (n int, err error) {
+	n = len(msg.Data) + len(msg.Meta)
+	meta := payloadMeta(msg.Meta)
+	if len(meta) < 3 {
+		return
+	}
+	id := string(meta[1])
+
+	switch {
+	case isRequestPayload(msg.Meta) && proto.IsWebSocketUpgrade(msg.Data):
+		r := &webSocketReplay{frames: make(chan *Message, o.config.QueueLen), started: time.Now()}
+		r.start, _ = strconv.ParseInt(byteutils.SliceToString(meta[2]), 10, 64)
+
+		o.Lock()
+		if o.closed {
+			o.Unlock()
+			return
+		}
+		o.conns[id] = r
+		o.Unlock()
+		go o.replay(id, r, append([]byte(nil), msg.Data...))
+	case msg.Meta[0] == WebSocketPayload:
+		o.Lock()
+		r := o.conns[id]
+		o.Unlock()
+		if r == nil {
+			Debug(3, "[OUTPUT-WS] frame of unknown connection", id)
+			return
+		}
+		select {
+		case r.frames <- msg:
+		default:
+			Debug(2, "[OUTPUT-WS] queue is full, frame dropped, increase --output-ws-queue-len")
+		}
+	}
+	return
+}
+
+// replay opens the connection and writes queued frames until the close frame or the idle timeout
+func (o *WebSocketOutput) replay(id string, r *webSocketReplay, request []byte) {
+	defer func() {
+		o.Lock()
+		if o.conns[id] == r {
+			delete(o.conns, id)
+		}
+		o.Unlock()
+	}()
+
+	conn, err := o.connect(request)
+	if err != nil {
+		Debug(1, "[OUTPUT-WS] error while opening connection:", err)
+		return
+	}
+	defer conn.Close()
+
+	idle := time.NewTimer(o.config.IdleTimeout)
+	defer idle.Stop()
+	for {
+		var msg *Message
+		select {
+		case msg = <-r.frames:
+		case <-idle.C:
+			Debug(2, "[OUTPUT-WS] connection closed after idle timeout", id)
+			return
+		case <-o.stop:
+			return
+		}
+		idle.Reset(o.config.IdleTimeout)
+
+		frame, _, ok := proto.ParseWebSocketFrame(msg.Data)
+		// frames sent by the server are not masked, they are not replayed
+		if !ok || !frame.Masked {
+			continue
+		}
+		if !o.wait(r, msg) {
+			return
+		}
+		key := make([]byte, 4)
+		rand.Read(key)
+		if _, err = conn.Write(frame.Encode(key)); err != nil {
+			Debug(1, "[OUTPUT-WS] error while writing frame:", err)
+			return
+		}
+		if frame.Opcode == proto.WebSocketClose {
+			return
+		}
+	}
+}
+
+// wait waits until the frame is due, relatively to the start of the replayed connection.
+// It returns false if the output is closed.
+func (o *WebSocketOutput) wait(r *webSocketReplay, msg *Message) bool {
+	meta := payloadMeta(msg.Meta)
+	ts, _ := strconv.ParseInt(byteutils.SliceToString(meta[2]), 10, 64)
+	delay := time.Until(r.started.Add(time.Duration(ts - r.start)))
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-o.stop:
+		return false
+	}
+}
+
+// connect opens a connection to the target, and makes the handshake with the captured upgrade request
+func (o *WebSocketOutput) connect(request []byte) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: o.config.Timeout}
+	var conn net.Conn
+	var err error
+	if o.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", o.url.Host, o.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", o.url.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	request = proto.SetHeader(request, []byte("Host"), []byte(o.url.Host))
+	request = proto.SetHeader(request, []byte("Sec-WebSocket-Key"), []byte(key))
+
+	conn.SetDeadline(time.Now().Add(o.config.Timeout))
+	if _, err = conn.Write(request); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		conn.Close()
+		return nil, fmt.Errorf("handshake is not accepted: %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// frames sent by the target are read and discarded
+	go io.Copy(ioutil.Discard, reader)
+	return conn, nil
+}
+
+// webSocketAccept returns Sec-WebSocket-Accept value for the handshake key
+func webSocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (o *WebSocketOutput) String() string {
+	return "WebSocket output: " + o.address
+}
+
+// Close closes the output and its connections
+func (o *WebSocketOutput) Close() error {
+	o.Lock()
+	defer o.Unlock()
+	if !o.closed {
+		o.closed = true
+		close(o.stop)
+	}
+	return nil
+}
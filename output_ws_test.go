@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+type receivedFrame struct {
+	proto.WebSocketFrame
+	at time.Time
+}
+
+func startWebSocket(t *testing.T, frames chan<- receivedFrame) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" || r.URL.Path != "/chat" {
+			t.Errorf("wrong upgrade request %v", r)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		rw.WriteString("Sec-WebSocket-Accept: " + webSocketAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+		rw.Flush()
+
+		for {
+			frame, err := readWebSocketFrame(rw.Reader)
+			if err != nil {
+				return
+			}
+			frames <- receivedFrame{frame, time.Now()}
+		}
+	}))
+}
+
+func readWebSocketFrame(r *bufio.Reader) (frame proto.WebSocketFrame, err error) {
+	var data []byte
+	for n := -1; n < 0 || len(data) < n; n = proto.WebSocketFrameLength(data) {
+		var b byte
+		if b, err = r.ReadByte(); err != nil {
+			return
+		}
+		data = append(data, b)
+	}
+	frame, _, _ = proto.ParseWebSocketFrame(data)
+	return
+}
+
+func TestWebSocketOutput(t *testing.T) {
+	frames := make(chan receivedFrame, 10)
+	server := startWebSocket(t, frames)
+	defer server.Close()
+
+	output := NewWebSocketOutput("ws://"+server.Listener.Addr().String(), &WebSocketOutputConfig{})
+	defer output.(*WebSocketOutput).Close()
+
+	id := []byte("7b0a5bfb1ab8e3cd0cd4b2a9d6b3c4e7a1b2c3d4")
+	start := time.Now().UnixNano()
+	key := []byte("abcd")
+	write := func(payloadType byte, delay time.Duration, data []byte) {
+		output.PluginWrite(&Message{Meta: payloadHeader(payloadType, id, start+int64(delay), -1), Data: data})
+	}
+	write(RequestPayload, 0, []byte("GET /chat HTTP/1.1\r\nHost: example.org\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	write(WebSocketPayload, 10*time.Millisecond, (&proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketText, Payload: []byte("first")}).Encode(key))
+	// frames sent by the server are not replayed
+	write(WebSocketPayload, 20*time.Millisecond, (&proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketText, Payload: []byte("reply")}).Encode(nil))
+	write(WebSocketPayload, 200*time.Millisecond, (&proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketText, Payload: []byte("second")}).Encode(key))
+	write(WebSocketPayload, 210*time.Millisecond, (&proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketClose}).Encode(key))
+
+	var received []receivedFrame
+	for i := 0; i < 3; i++ {
+		select {
+		case f := <-frames:
+			if !f.Masked {
+				t.Errorf("replayed frame should be masked")
+			}
+			received = append(received, f)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("frame %d is not replayed", i)
+		}
+	}
+	if string(received[0].Payload) != "first" || string(received[1].Payload) != "second" || received[2].Opcode != proto.WebSocketClose {
+		t.Errorf("wrong frames %+v", received)
+	}
+	if d := received[1].at.Sub(received[0].at); d < 150*time.Millisecond {
+		t.Errorf("frames should be replayed with the original timing, got %s between them", d)
+	}
+}
+
+func TestWebSocketOutputAddress(t *testing.T) {
+	tests := []struct {
+		address, host string
+	}{
+		{"localhost:8080", "localhost:8080"},
+		{"ws://localhost", "localhost:80"},
+		{"wss://example.org/ws", "example.org:443"},
+	}
+	for _, tt := range tests {
+		output := NewWebSocketOutput(tt.address, &WebSocketOutputConfig{}).(*WebSocketOutput)
+		if output.url.Host != tt.host {
+			t.Errorf("expected %q host to be %q, got %q", tt.address, tt.host, output.url.Host)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log"
 	"reflect"
 	"strings"
 )
@@ -121,6 +122,17 @@ func NewPlugins() *InOutPlugins {
 		plugins.registerPlugin(NewFileInput, options, Settings.InputFileLoop, Settings.InputFileReadDepth, Settings.InputFileMaxWait, Settings.InputFileDryRun)
 	}
 
+	if len(Settings.OutputFile) > 0 && Settings.OutputFileConfig.GroupResponses &&
+		!Settings.TrackResponse && !Settings.OutputHTTPConfig.TrackResponses && !Settings.OutputBinaryConfig.TrackResponses &&
+		!Settings.OutputRedisConfig.TrackResponses && !Settings.OutputPostgresConfig.TrackResponses &&
+		!Settings.OutputMySQLConfig.TrackResponses {
+		log.Println("[OUTPUT-FILE] --output-file-group-responses is set without response tracking, requests will be held for --output-file-group-timeout before written")
+	}
+
+	if len(Settings.TemplateConfig.Rules) > 0 && (!Settings.TrackResponse || !Settings.OutputHTTPConfig.TrackResponses) {
+		log.Println("[HTTP-TEMPLATE] --http-template requires both original and replayed responses, set --input-raw-track-response and --output-http-track-response")
+	}
+
 	for _, path := range Settings.OutputFile {
 		if strings.HasPrefix(path, "s3://") {
 			plugins.registerPlugin(NewS3Output, path, &Settings.OutputFileConfig)
@@ -142,14 +154,35 @@ func NewPlugins() *InOutPlugins {
 		}
 	}
 
+	Settings.OutputHTTPConfig.realIPHeader = Settings.RealIPHeader
 	for _, options := range Settings.OutputHTTP {
 		plugins.registerPlugin(NewHTTPOutput, options, &Settings.OutputHTTPConfig)
 	}
 
+	if Settings.OutputHTTPShadowConfig.Baseline != "" && Settings.OutputHTTPShadowConfig.Candidate != "" {
+		plugins.registerPlugin(NewShadowOutput, "", &Settings.OutputHTTPShadowConfig, &Settings.OutputHTTPConfig)
+	}
+
 	for _, options := range Settings.OutputBinary {
 		plugins.registerPlugin(NewBinaryOutput, options, &Settings.OutputBinaryConfig)
 	}
 
+	for _, options := range Settings.OutputWebSocket {
+		plugins.registerPlugin(NewWebSocketOutput, options, &Settings.OutputWebSocketConfig)
+	}
+
+	for _, options := range Settings.OutputRedis {
+		plugins.registerPlugin(NewRedisOutput, options, &Settings.OutputRedisConfig)
+	}
+
+	for _, options := range Settings.OutputPostgres {
+		plugins.registerPlugin(NewPostgresOutput, options, &Settings.OutputPostgresConfig)
+	}
+
+	for _, options := range Settings.OutputMySQL {
+		plugins.registerPlugin(NewMySQLOutput, options, &Settings.OutputMySQLConfig)
+	}
+
 	if Settings.OutputKafkaConfig.Host != "" && Settings.OutputKafkaConfig.Topic != "" {
 		plugins.registerPlugin(NewKafkaOutput, "", &Settings.OutputKafkaConfig, &Settings.KafkaTLSConfig)
 	}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// PostgresClientConfig connection settings of PostgresClient
+type PostgresClientConfig struct {
+	Address  string
+	User     string
+	Password string
+	Database string
+	TLS      bool
+	Timeout  time.Duration
+	// Params are sent in the startup message, they set server settings of the session
+	Params map[string]string
+}
+
+// PostgresClient is a connection to PostgreSQL server, which sends requests in wire format
+type PostgresClient struct {
+	config *PostgresClientConfig
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewPostgresClient returns a client, it connects on the first request
+func NewPostgresClient(config *PostgresClientConfig) *PostgresClient {
+	return &PostgresClient{config: config}
+}
+
+// Connect opens a connection and authenticates the user
+func (c *PostgresClient) Connect() (err error) {
+	c.Disconnect()
+
+	if c.conn, err = net.DialTimeout("tcp", c.config.Address, c.config.Timeout); err != nil {
+		return
+	}
+	c.conn.SetDeadline(time.Now().Add(c.config.Timeout))
+	if c.config.TLS {
+		if err = c.startTLS(); err != nil {
+			c.Disconnect()
+			return
+		}
+	}
+	c.reader = bufio.NewReader(c.conn)
+
+	if err = c.startup(); err != nil {
+		c.Disconnect()
+	}
+	return
+}
+
+// startTLS sends SSL request, server which does not support TLS is an error
+func (c *PostgresClient) startTLS() error {
+	var request [4]byte
+	binary.BigEndian.PutUint32(request[:], proto.PostgresSSLRequest)
+	msg := proto.PostgresMessage{Data: request[:]}
+	if _, err := c.conn.Write(msg.Encode()); err != nil {
+		return err
+	}
+	var resp [1]byte
+	if _, err := io.ReadFull(c.conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != 'S' {
+		return errors.New("server does not support TLS")
+	}
+	host, _, _ := net.SplitHostPort(c.config.Address)
+	// like sslmode=require of libpq, the certificate is not verified
+	c.conn = tls.Client(c.conn, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+	return nil
+}
+
+// startup sends the startup message, and makes authentication until the server is ready for queries
+func (c *PostgresClient) startup() error {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, proto.PostgresProtocolVersion)
+	params := map[string]string{"user": c.config.User, "database": c.config.Database, "application_name": "goreplay"}
+	for k, v := range c.config.Params {
+		params[k] = v
+	}
+	for k, v := range params {
+		data = append(append(append(append(data, k...), 0), v...), 0)
+	}
+	data = append(data, 0)
+	if err := c.write(proto.PostgresMessage{Data: data}); err != nil {
+		return err
+	}
+
+	var scram *scramClient
+	for {
+		msg, err := c.read()
+		if err != nil {
+			return err
+		}
+		switch msg.Type {
+		case proto.PostgresReadyForQuery:
+			return nil
+		case proto.PostgresErrorResponse:
+			return fmt.Errorf("authentication error: %s", postgresError(msg.Data))
+		case proto.PostgresAuthentication:
+			if len(msg.Data) < 4 {
+				return errors.New("invalid authentication request")
+			}
+			var resp []byte
+			switch code := binary.BigEndian.Uint32(msg.Data); code {
+			case proto.PostgresAuthOk:
+				continue
+			case proto.PostgresAuthCleartext:
+				resp = append([]byte(c.config.Password), 0)
+			case proto.PostgresAuthMD5:
+				if len(msg.Data) < 8 {
+					return errors.New("invalid md5 authentication request")
+				}
+				resp = append([]byte(postgresMD5(c.config.User, c.config.Password, msg.Data[4:8])), 0)
+			case proto.PostgresAuthSASL:
+				if !strings.Contains(string(msg.Data[4:]), "SCRAM-SHA-256\x00") {
+					return errors.New("SASL mechanisms are not supported")
+				}
+				scram = newSCRAMClient("", c.config.Password)
+				first := scram.first()
+				resp = append([]byte("SCRAM-SHA-256\x00"), 0, 0, 0, 0)
+				binary.BigEndian.PutUint32(resp[len(resp)-4:], uint32(len(first)))
+				resp = append(resp, first...)
+			case proto.PostgresAuthSASLContinue:
+				if scram == nil {
+					return errors.New("unexpected SASL message")
+				}
+				if resp, err = scram.final(msg.Data[4:]); err != nil {
+					return err
+				}
+			case proto.PostgresAuthSASLFinal:
+				if scram == nil {
+					return errors.New("unexpected SASL message")
+				}
+				if err = scram.verify(msg.Data[4:]); err != nil {
+					return err
+				}
+				continue
+			default:
+				return fmt.Errorf("authentication method %d is not supported", code)
+			}
+			if err = c.write(proto.PostgresMessage{Type: proto.PostgresPassword, Data: resp}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Send sends the request, and returns the response which ends with the given number of ReadyForQuery messages
+func (c *PostgresClient) Send(request []byte, ready int) (response []byte, err error) {
+	if c.conn == nil {
+		if err = c.Connect(); err != nil {
+			return
+		}
+	}
+
+	c.conn.SetDeadline(time.Now().Add(c.config.Timeout))
+	if _, err = c.conn.Write(request); err != nil {
+		c.Disconnect()
+		return
+	}
+	for ready > 0 {
+		var msg proto.PostgresMessage
+		if msg, err = c.read(); err != nil {
+			c.Disconnect()
+			return
+		}
+		if msg.Type == proto.PostgresReadyForQuery {
+			ready--
+		}
+		response = append(response, msg.Encode()...)
+	}
+	return
+}
+
+func (c *PostgresClient) write(msg proto.PostgresMessage) error {
+	_, err := c.conn.Write(msg.Encode())
+	return err
+}
+
+func (c *PostgresClient) read() (msg proto.PostgresMessage, err error) {
+	var header [5]byte
+	if _, err = io.ReadFull(c.reader, header[:]); err != nil {
+		return
+	}
+	length := int(binary.BigEndian.Uint32(header[1:]))
+	if !proto.IsPostgresType(header[0], false) || length < 4 {
+		return msg, fmt.Errorf("invalid message %q", header[0])
+	}
+	msg.Type = header[0]
+	msg.Data = make([]byte, length-4)
+	_, err = io.ReadFull(c.reader, msg.Data)
+	return
+}
+
+// Disconnect closes the connection
+func (c *PostgresClient) Disconnect() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// postgresError returns the message field of ErrorResponse
+func postgresError(data []byte) string {
+	for len(data) > 1 {
+		field := data[0]
+		value, rest, ok := proto.PostgresString(data[1:])
+		if !ok {
+			break
+		}
+		if field == 'M' {
+			return string(value)
+		}
+		data = rest
+	}
+	return "unknown error"
+}
+
+// postgresMD5 returns the password hashed for md5 authentication
+func postgresMD5(user, password string, salt []byte) string {
+	sum := md5.Sum([]byte(password + user))
+	sum = md5.Sum(append([]byte(hex.EncodeToString(sum[:])), salt...))
+	return "md5" + hex.EncodeToString(sum[:])
+}
+
+// scramClient makes SCRAM-SHA-256 authentication, RFC 5802 and RFC 7677
+type scramClient struct {
+	user, password string
+	nonce          string
+	firstBare      string
+	serverSig      []byte
+}
+
+func newSCRAMClient(user, password string) *scramClient {
+	nonce := make([]byte, 18)
+	rand.Read(nonce)
+	return &scramClient{user: user, password: password, nonce: base64.StdEncoding.EncodeToString(nonce)}
+}
+
+// first returns client-first-message, postgres ignores the user name, the one of the startup message is used
+func (s *scramClient) first() string {
+	s.firstBare = "n=" + s.user + ",r=" + s.nonce
+	return "n,," + s.firstBare
+}
+
+// final returns client-final-message for server-first-message
+func (s *scramClient) final(serverFirst []byte) ([]byte, error) {
+	var nonce, salt string
+	iterations := 0
+	for _, attr := range strings.Split(string(serverFirst), ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			continue
+		}
+		switch attr[0] {
+		case 'r':
+			nonce = attr[2:]
+		case 's':
+			salt = attr[2:]
+		case 'i':
+			iterations, _ = strconv.Atoi(attr[2:])
+		}
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil || !strings.HasPrefix(nonce, s.nonce) || iterations < 1 {
+		return nil, errors.New("invalid SCRAM server message")
+	}
+
+	salted := pbkdf2.Key([]byte(s.password), saltBytes, iterations, sha256.Size, sha256.New)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=biws,r=" + nonce
+	authMessage := s.firstBare + "," + string(serverFirst) + "," + withoutProof
+	proof := scramHMAC(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	s.serverSig = scramHMAC(scramHMAC(salted, "Server Key"), authMessage)
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verify checks server signature of server-final-message
+func (s *scramClient) verify(serverFinal []byte) error {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(string(serverFinal), "v="))
+	if err != nil || !hmac.Equal(sig, s.serverSig) {
+		return errors.New("invalid SCRAM server signature")
+	}
+	return nil
+}
+
+func scramHMAC(key []byte, message string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(message))
+	return h.Sum(nil)
+}
@@ -0,0 +1,170 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+)
+
+// magic bytes of memcached binary protocol
+const (
+	MemcachedRequestMagic  = 0x80
+	MemcachedResponseMagic = 0x81
+)
+
+const (
+	// memcachedHeader is the length of binary protocol header
+	memcachedHeader = 24
+	// maxMemcachedLine limits command and response lines of text protocol
+	maxMemcachedLine = 8 << 10
+	// memcachedStat is opcode of binary stat command
+	memcachedStat = 0x10
+)
+
+type memcachedProto struct {
+	pos   int  // position of the first line or packet which is not parsed yet
+	multi bool // response has several lines, which end with END
+}
+
+// MemcachedLength returns the length of the first command or response of the payloads of text or binary protocol,
+// or -1 if it is not complete. Commands which have no response, text commands with noreply and quiet binary
+// commands, are joined with the next command. Quiet binary responses are joined with the next response too.
+// The parsing state is stored in m if it is not nil, so payloads are not parsed again.
+func MemcachedLength(m ProtocolStateSetter, frontend bool, payloads ...[]byte) int {
+	var state *memcachedProto
+	if m != nil {
+		state, _ = m.ProtocolState().(*memcachedProto)
+	}
+	if state == nil {
+		state = new(memcachedProto)
+		if m != nil {
+			m.SetProtocolState(state)
+		}
+	}
+
+	total := 0
+	for _, data := range payloads {
+		total += len(data)
+	}
+	for state.pos < total {
+		magic := payloadsRange(payloads, state.pos, state.pos+1)[0]
+		if magic == MemcachedRequestMagic || magic == MemcachedResponseMagic {
+			header := payloadsRange(payloads, state.pos, state.pos+memcachedHeader)
+			if len(header) < memcachedHeader {
+				return -1
+			}
+			next := state.pos + memcachedHeader + int(binary.BigEndian.Uint32(header[8:]))
+			if next > total {
+				return -1
+			}
+			// stat response is a packet per statistic, it ends with the packet without key
+			stat := magic == MemcachedResponseMagic && header[1] == memcachedStat && binary.BigEndian.Uint16(header[2:]) > 0
+			if !stat && !isMemcachedQuiet(header[1]) {
+				return next
+			}
+			state.pos = next
+			continue
+		}
+
+		line := payloadsRange(payloads, state.pos, state.pos+maxMemcachedLine)
+		end := bytes.Index(line, []byte("\r\n"))
+		if end < 0 {
+			return -1
+		}
+		fields := bytes.Fields(line[:end])
+		next := state.pos + end + 2
+		if len(fields) == 0 {
+			state.pos = next
+			continue
+		}
+		if frontend {
+			// storage commands are followed by the data block
+			if n := memcachedDataField(fields); n >= 0 {
+				size, err := strconv.Atoi(string(fields[n]))
+				if err != nil || size < 0 {
+					return -1
+				}
+				next += size + 2
+			}
+			if next > total {
+				return -1
+			}
+			if !bytes.Equal(fields[len(fields)-1], []byte("noreply")) {
+				return next
+			}
+			state.pos = next
+			continue
+		}
+
+		switch string(fields[0]) {
+		case "VALUE":
+			// VALUE <key> <flags> <bytes> [<cas unique>]
+			if len(fields) < 4 {
+				return -1
+			}
+			size, err := strconv.Atoi(string(fields[3]))
+			if err != nil || size < 0 {
+				return -1
+			}
+			next += size + 2
+			state.multi = true
+		case "VA":
+			// meta command value, VA <size> <flags>*
+			if len(fields) < 2 {
+				return -1
+			}
+			size, err := strconv.Atoi(string(fields[1]))
+			if err != nil || size < 0 {
+				return -1
+			}
+			next += size + 2
+			if next > total {
+				return -1
+			}
+			return next
+		case "STAT", "ITEM":
+			state.multi = true
+		case "END":
+			return next
+		default:
+			if !state.multi {
+				return next
+			}
+		}
+		if next > total {
+			return -1
+		}
+		state.pos = next
+	}
+	return -1
+}
+
+// memcachedDataField returns the index of the field with the size of the data block of storage command, or -1
+func memcachedDataField(fields [][]byte) int {
+	switch string(fields[0]) {
+	case "set", "add", "replace", "append", "prepend", "cas":
+		// <command> <key> <flags> <exptime> <bytes>
+		if len(fields) >= 5 {
+			return 4
+		}
+	case "ms":
+		// ms <key> <datalen> <flags>*
+		if len(fields) >= 3 {
+			return 2
+		}
+	}
+	return -1
+}
+
+// isMemcachedQuiet reports whether the binary opcode is a quiet command, the server does not respond to them
+// on success, or on miss for get commands
+func isMemcachedQuiet(opcode byte) bool {
+	switch opcode {
+	case 0x09, 0x0d, // getq, getkq
+		0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, // setq ... prependq
+		0x1e, 0x24, // gatq, gatkq
+		0x32, 0x34, 0x36, 0x38, 0x3a, 0x3c: // quiet range commands
+		return true
+	}
+	return false
+}
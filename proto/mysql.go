@@ -0,0 +1,588 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"unicode/utf8"
+)
+
+// MySQL commands, https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_command_phase.html
+const (
+	MySQLComQuit             = 0x01
+	MySQLComInitDB           = 0x02
+	MySQLComQuery            = 0x03
+	MySQLComPing             = 0x0e
+	MySQLComStmtPrepare      = 0x16
+	MySQLComStmtExecute      = 0x17
+	MySQLComStmtSendLongData = 0x18
+	MySQLComStmtClose        = 0x19
+	MySQLComStmtReset        = 0x1a
+)
+
+// MySQL capability flags used by the parser
+const (
+	MySQLClientProtocol41      = 1 << 9
+	MySQLClientQueryAttributes = 1 << 27
+)
+
+const (
+	// maxMySQLPacket is the maximum payload length of a packet, longer payloads continue in the next packets
+	maxMySQLPacket = 0xffffff
+	// mysqlPeek is the number of the first payload bytes needed to classify a packet
+	mysqlPeek = 32
+	// mysqlMoreResults is SERVER_MORE_RESULTS_EXISTS status flag
+	mysqlMoreResults = 0x0008
+	// mysqlParameterCountAvailable is PARAMETER_COUNT_AVAILABLE flag of COM_STMT_EXECUTE
+	mysqlParameterCountAvailable = 0x08
+)
+
+// stages of a response
+const (
+	mysqlResult = iota
+	mysqlDefinitions
+	mysqlDefinitionsEnd
+	mysqlRows
+)
+
+type mysqlProto struct {
+	pos     int // position of the first packet which is not parsed yet
+	stage   int
+	count   int  // definitions left to read
+	columns int  // column definitions of prepared statement, which follow parameter definitions
+	prepare bool // response to COM_STMT_PREPARE
+}
+
+// MySQLLength returns the length of the first command or response of the payloads, or -1 if it is not complete.
+// Commands are sent by frontend, COM_STMT_CLOSE and COM_STMT_SEND_LONG_DATA, which have no response, are joined
+// with the next command. Responses are OK and ERR packets, result sets, including multiple results,
+// and responses to COM_STMT_PREPARE. Handshake packets are single messages.
+// The parsing state is stored in m if it is not nil, so payloads are not parsed again.
+func MySQLLength(m ProtocolStateSetter, frontend bool, payloads ...[]byte) int {
+	var state *mysqlProto
+	if m != nil {
+		state, _ = m.ProtocolState().(*mysqlProto)
+	}
+	if state == nil {
+		state = new(mysqlProto)
+		if m != nil {
+			m.SetProtocolState(state)
+		}
+	}
+
+	total := 0
+	for _, data := range payloads {
+		total += len(data)
+	}
+	for state.pos < total {
+		seq, head, length, next := mysqlPacket(payloads, state.pos, total)
+		if next < 0 {
+			return -1
+		}
+		if frontend {
+			if seq == 0 && len(head) > 0 && (head[0] == MySQLComStmtClose || head[0] == MySQLComStmtSendLongData) {
+				state.pos = next
+				continue
+			}
+			return next
+		}
+		if len(head) == 0 {
+			return -1
+		}
+
+		switch state.stage {
+		case mysqlResult:
+			switch {
+			case seq == 0 && head[0] == 0x0a:
+				// server greeting
+				return next
+			case head[0] == 0xff, head[0] == 0xfe, head[0] == 0xfb:
+				// error, authentication switch or LOCAL INFILE request
+				return next
+			case head[0] == 0x00 && length == 12 && head[9] == 0:
+				// COM_STMT_PREPARE response, parameter and column definitions follow
+				params := int(binary.LittleEndian.Uint16(head[7:]))
+				columns := int(binary.LittleEndian.Uint16(head[5:]))
+				if params == 0 {
+					params, columns = columns, 0
+				}
+				if params == 0 {
+					return next
+				}
+				state.stage, state.count, state.columns, state.prepare = mysqlDefinitions, params, columns, true
+			case head[0] == 0x00:
+				if mysqlStatus(head, length)&mysqlMoreResults == 0 {
+					return next
+				}
+			case head[0] == 0x01 && length > 1:
+				// authentication data, fast authentication success is followed by OK
+				if length != 2 || head[1] != 0x03 {
+					return next
+				}
+			default:
+				// result set starts with the number of columns
+				columns, _, ok := MySQLLenEnc(head)
+				if !ok || columns == 0 {
+					return -1
+				}
+				state.stage, state.count, state.prepare = mysqlDefinitions, int(columns), false
+			}
+		case mysqlDefinitions:
+			state.count--
+			if state.count == 0 {
+				state.stage = mysqlDefinitionsEnd
+			}
+		case mysqlDefinitionsEnd:
+			// definitions end with EOF packet, unless CLIENT_DEPRECATE_EOF is set
+			eof := head[0] == 0xfe && length < 9
+			if !eof {
+				next = state.pos
+			}
+			switch {
+			case !state.prepare:
+				state.stage = mysqlRows
+			case state.columns > 0:
+				state.stage, state.count, state.columns = mysqlDefinitions, state.columns, 0
+			default:
+				return next
+			}
+		case mysqlRows:
+			if head[0] == 0xff {
+				return next
+			}
+			if head[0] == 0xfe && length < maxMySQLPacket {
+				if mysqlStatus(head, length)&mysqlMoreResults == 0 {
+					return next
+				}
+				state.stage = mysqlResult
+			}
+		}
+		state.pos = next
+	}
+	// the last definitions of prepared statement are not followed by EOF with CLIENT_DEPRECATE_EOF
+	if !frontend && state.stage == mysqlDefinitionsEnd && state.prepare && state.columns == 0 && state.pos == total {
+		return total
+	}
+	return -1
+}
+
+// mysqlPacket returns the sequence id, the first bytes of the payload and its length of the packet at pos,
+// and the position after it. Payloads longer than maximum packet continue in the next packets.
+// The position is -1 if the packet is not complete.
+func mysqlPacket(payloads [][]byte, pos, total int) (seq byte, head []byte, length, next int) {
+	header := payloadsRange(payloads, pos, pos+4)
+	if len(header) < 4 {
+		return 0, nil, 0, -1
+	}
+	n := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	seq = header[3]
+	peek := n
+	if peek > mysqlPeek {
+		peek = mysqlPeek
+	}
+	head = payloadsRange(payloads, pos+4, pos+4+peek)
+	length, next = n, pos+4+n
+	for n == maxMySQLPacket {
+		header = payloadsRange(payloads, next, next+4)
+		if len(header) < 4 {
+			return 0, nil, 0, -1
+		}
+		n = int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+		length += n
+		next += 4 + n
+	}
+	if next > total || len(head) < peek {
+		return 0, nil, 0, -1
+	}
+	return
+}
+
+// mysqlStatus returns status flags of OK or EOF packet
+func mysqlStatus(head []byte, length int) uint16 {
+	if head[0] == 0xfe && length < 9 {
+		// EOF packet has warnings and status
+		if len(head) < 5 {
+			return 0
+		}
+		return binary.LittleEndian.Uint16(head[3:])
+	}
+	data := head[1:]
+	for i := 0; i < 2; i++ {
+		// affected rows and last insert id
+		_, n, ok := MySQLLenEnc(data)
+		if !ok {
+			return 0
+		}
+		data = data[n:]
+	}
+	if len(data) < 2 {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(data)
+}
+
+// MySQLLenEnc decodes length-encoded integer, it returns the value and its size
+func MySQLLenEnc(data []byte) (v uint64, n int, ok bool) {
+	if len(data) == 0 {
+		return 0, 0, false
+	}
+	switch data[0] {
+	case 0xfc:
+		n = 3
+	case 0xfd:
+		n = 4
+	case 0xfe:
+		n = 9
+	case 0xfb, 0xff:
+		// NULL and error are not integers
+		return 0, 1, false
+	default:
+		return uint64(data[0]), 1, true
+	}
+	if len(data) < n {
+		return 0, 0, false
+	}
+	var buf [8]byte
+	copy(buf[:], data[1:n])
+	return binary.LittleEndian.Uint64(buf[:]), n, true
+}
+
+// MySQLPacket is a packet of MySQL protocol, Payload of the packets which continue it is joined
+type MySQLPacket struct {
+	Seq     byte
+	Payload []byte
+}
+
+// ParseMySQLPackets decodes packets of the data, it returns false if the last packet is not complete
+func ParseMySQLPackets(data []byte) (packets []MySQLPacket, ok bool) {
+	for len(data) > 0 {
+		var packet MySQLPacket
+		for {
+			if len(data) < 4 {
+				return packets, false
+			}
+			n := int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+			if len(data) < 4+n {
+				return packets, false
+			}
+			if packet.Payload == nil {
+				packet.Seq = data[3]
+				packet.Payload = data[4 : 4+n]
+			} else {
+				packet.Payload = append(packet.Payload[:len(packet.Payload):len(packet.Payload)], data[4:4+n]...)
+			}
+			data = data[4+n:]
+			if n < maxMySQLPacket {
+				break
+			}
+		}
+		packets = append(packets, packet)
+	}
+	return packets, true
+}
+
+// MySQLPrepareOK returns the statement id and the number of parameters of COM_STMT_PREPARE response
+func MySQLPrepareOK(payload []byte) (id uint32, params int, ok bool) {
+	if len(payload) != 12 || payload[0] != 0x00 || payload[9] != 0 {
+		return 0, 0, false
+	}
+	return binary.LittleEndian.Uint32(payload[1:]), int(binary.LittleEndian.Uint16(payload[7:])), true
+}
+
+// MySQLQuery returns the query of COM_QUERY payload, query attributes are skipped
+func MySQLQuery(payload []byte, attributes bool) ([]byte, bool) {
+	if len(payload) == 0 || payload[0] != MySQLComQuery {
+		return nil, false
+	}
+	data := payload[1:]
+	if !attributes {
+		return data, true
+	}
+	count, n, ok := MySQLLenEnc(data)
+	if !ok {
+		return nil, false
+	}
+	data = data[n:]
+	// parameter set count is always 1
+	if _, n, ok = MySQLLenEnc(data); !ok {
+		return nil, false
+	}
+	data = data[n:]
+	if count > 0 {
+		params := mysqlParams{count: int(count), names: true}
+		if data, ok = params.decode(data, nil, nil); !ok {
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+// MySQLPlaceholders returns the number of parameter placeholders of the query, quoted strings and comments are skipped
+func MySQLPlaceholders(query []byte) int {
+	return len(mysqlPlaceholders(query))
+}
+
+// mysqlPlaceholders returns positions of parameter placeholders
+func mysqlPlaceholders(query []byte) (positions []int) {
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; c {
+		case '?':
+			positions = append(positions, i)
+		case '\'', '"', '`':
+			for i++; i < len(query) && query[i] != c; i++ {
+				if query[i] == '\\' && c != '`' {
+					i++
+				}
+			}
+		case '#':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case '-':
+			if bytes.HasPrefix(query[i:], []byte("-- ")) {
+				for i < len(query) && query[i] != '\n' {
+					i++
+				}
+			}
+		case '/':
+			if bytes.HasPrefix(query[i:], []byte("/*")) {
+				end := bytes.Index(query[i+2:], []byte("*/"))
+				if end < 0 {
+					return
+				}
+				i += end + 3
+			}
+		}
+	}
+	return
+}
+
+// MySQLExecuteQuery returns the query of prepared statement with parameters of COM_STMT_EXECUTE payload substituted.
+// Parameter types are sent with the first execution only, types of the previous execution are used if the payload
+// does not have them, and the types are returned for the next execution. longData has values of parameters sent by
+// COM_STMT_SEND_LONG_DATA, they are not sent in the payload.
+func MySQLExecuteQuery(query []byte, count int, payload []byte, types []byte, longData map[int][]byte, attributes bool) (sql []byte, usedTypes []byte, ok bool) {
+	if len(payload) < 10 || payload[0] != MySQLComStmtExecute {
+		return nil, nil, false
+	}
+	flags := payload[5]
+	data := payload[10:]
+	if attributes && flags&mysqlParameterCountAvailable != 0 {
+		c, n, ok := MySQLLenEnc(data)
+		if !ok {
+			return nil, nil, false
+		}
+		count, data = int(c), data[n:]
+	}
+	params := mysqlParams{count: count, types: types, names: attributes}
+	values := make([][]byte, count)
+	if count > 0 {
+		if _, ok = params.decode(data, values, longData); !ok {
+			return nil, nil, false
+		}
+	}
+
+	positions := mysqlPlaceholders(query)
+	sql = make([]byte, 0, len(query))
+	last := 0
+	for i, pos := range positions {
+		if i >= len(values) {
+			break
+		}
+		sql = append(sql, query[last:pos]...)
+		sql = append(sql, values[i]...)
+		last = pos + 1
+	}
+	return append(sql, query[last:]...), params.types, true
+}
+
+// mysqlParams decodes binary parameters of COM_STMT_EXECUTE and query attributes of COM_QUERY
+type mysqlParams struct {
+	count int
+	types []byte // type and flags of each parameter
+	names bool   // types are followed by names of query attributes
+}
+
+// decode decodes parameters into SQL literals, it returns the data after them
+func (p *mysqlParams) decode(data []byte, values [][]byte, longData map[int][]byte) ([]byte, bool) {
+	bitmap := (p.count + 7) / 8
+	if len(data) < bitmap+1 {
+		return nil, false
+	}
+	nulls := data[:bitmap]
+	newBound := data[bitmap] == 1
+	data = data[bitmap+1:]
+	if newBound {
+		types := make([]byte, 0, 2*p.count)
+		for i := 0; i < p.count; i++ {
+			if len(data) < 2 {
+				return nil, false
+			}
+			types = append(types, data[:2]...)
+			data = data[2:]
+			if p.names {
+				n, size, ok := MySQLLenEnc(data)
+				if !ok || len(data) < size+int(n) {
+					return nil, false
+				}
+				data = data[size+int(n):]
+			}
+		}
+		p.types = types
+	}
+	if len(p.types) < 2*p.count {
+		return nil, false
+	}
+
+	for i := 0; i < p.count; i++ {
+		var value []byte
+		switch {
+		case nulls[i/8]&(1<<(i%8)) != 0:
+			value = []byte("NULL")
+		case longData[i] != nil:
+			value = mysqlString(longData[i])
+		default:
+			var n int
+			if value, n = mysqlValue(p.types[2*i], p.types[2*i+1]&0x80 != 0, data); n < 0 {
+				return nil, false
+			}
+			data = data[n:]
+		}
+		if values != nil {
+			values[i] = value
+		}
+	}
+	return data, true
+}
+
+// mysqlValue decodes binary value of the type into SQL literal, it returns the size of the value, or -1
+func mysqlValue(typ byte, unsigned bool, data []byte) (value []byte, n int) {
+	integer := func(size int) ([]byte, int) {
+		if len(data) < size {
+			return nil, -1
+		}
+		var buf [8]byte
+		copy(buf[:], data[:size])
+		v := binary.LittleEndian.Uint64(buf[:])
+		if unsigned {
+			return strconv.AppendUint(nil, v, 10), size
+		}
+		// sign extension
+		shift := uint(64 - 8*size)
+		return strconv.AppendInt(nil, int64(v<<shift)>>shift, 10), size
+	}
+
+	switch typ {
+	case 0x06: // NULL
+		return []byte("NULL"), 0
+	case 0x01: // TINY
+		return integer(1)
+	case 0x02, 0x0d: // SHORT, YEAR
+		return integer(2)
+	case 0x03, 0x09: // LONG, INT24
+		return integer(4)
+	case 0x08: // LONGLONG
+		return integer(8)
+	case 0x04: // FLOAT
+		if len(data) < 4 {
+			return nil, -1
+		}
+		f := math.Float32frombits(binary.LittleEndian.Uint32(data))
+		return strconv.AppendFloat(nil, float64(f), 'g', -1, 32), 4
+	case 0x05: // DOUBLE
+		if len(data) < 8 {
+			return nil, -1
+		}
+		f := math.Float64frombits(binary.LittleEndian.Uint64(data))
+		return strconv.AppendFloat(nil, f, 'g', -1, 64), 8
+	case 0x07, 0x0a, 0x0c: // TIMESTAMP, DATE, DATETIME
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return nil, -1
+		}
+		n = 1 + int(data[0])
+		var year, micro int
+		var t [5]int // month, day, hour, minute, second
+		d := data[1:n]
+		if len(d) >= 4 {
+			year, t[0], t[1] = int(binary.LittleEndian.Uint16(d)), int(d[2]), int(d[3])
+		}
+		if len(d) >= 7 {
+			t[2], t[3], t[4] = int(d[4]), int(d[5]), int(d[6])
+		}
+		if len(d) >= 11 {
+			micro = int(binary.LittleEndian.Uint32(d[7:]))
+		}
+		s := fmt.Sprintf("'%04d-%02d-%02d", year, t[0], t[1])
+		if typ != 0x0a {
+			s += fmt.Sprintf(" %02d:%02d:%02d", t[2], t[3], t[4])
+			if micro > 0 {
+				s += fmt.Sprintf(".%06d", micro)
+			}
+		}
+		return []byte(s + "'"), n
+	case 0x0b: // TIME
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return nil, -1
+		}
+		n = 1 + int(data[0])
+		d := data[1:n]
+		s := "'00:00:00'"
+		if len(d) >= 8 {
+			sign := ""
+			if d[0] == 1 {
+				sign = "-"
+			}
+			hours := int(binary.LittleEndian.Uint32(d[1:]))*24 + int(d[5])
+			s = fmt.Sprintf("'%s%02d:%02d:%02d", sign, hours, d[6], d[7])
+			if len(d) >= 12 {
+				if micro := binary.LittleEndian.Uint32(d[8:]); micro > 0 {
+					s += fmt.Sprintf(".%06d", micro)
+				}
+			}
+			s += "'"
+		}
+		return []byte(s), n
+	default:
+		// strings, decimals, blobs, JSON, BIT, ENUM, SET and geometry are length encoded
+		size, sizeLen, ok := MySQLLenEnc(data)
+		if !ok || uint64(len(data)-sizeLen) < size {
+			return nil, -1
+		}
+		v := data[sizeLen : sizeLen+int(size)]
+		if typ == 0xf6 { // NEWDECIMAL
+			return v, sizeLen + int(size)
+		}
+		return mysqlString(v), sizeLen + int(size)
+	}
+}
+
+// mysqlString returns quoted SQL string, binary data is hex literal
+func mysqlString(v []byte) []byte {
+	if !utf8.Valid(v) {
+		out := append([]byte("X'"), make([]byte, hex.EncodedLen(len(v)))...)
+		hex.Encode(out[2:], v)
+		return append(out, '\'')
+	}
+	out := make([]byte, 0, len(v)+2)
+	out = append(out, '\'')
+	for _, c := range v {
+		switch c {
+		case 0:
+			out = append(out, '\\', '0')
+		case '\n':
+			out = append(out, '\\', 'n')
+		case '\r':
+			out = append(out, '\\', 'r')
+		case 0x1a:
+			out = append(out, '\\', 'Z')
+		case '\'', '\\':
+			out = append(out, '\\', c)
+		default:
+			out = append(out, c)
+		}
+	}
+	return append(out, '\'')
+}
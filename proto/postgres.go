@@ -0,0 +1,229 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// PostgreSQL message types, https://www.postgresql.org/docs/current/protocol-message-formats.html
+// Some types have different meaning in frontend (sent by client) and backend (sent by server) messages.
+const (
+	// frontend
+	PostgresBind        = 'B'
+	PostgresClose       = 'C'
+	PostgresDescribe    = 'D'
+	PostgresExecute     = 'E'
+	PostgresFlush       = 'H'
+	PostgresFuncCall    = 'F'
+	PostgresParse       = 'P'
+	PostgresPassword    = 'p'
+	PostgresQuery       = 'Q'
+	PostgresSync        = 'S'
+	PostgresTerminate   = 'X'
+	PostgresCopyData    = 'd'
+	PostgresCopyDone    = 'c'
+	PostgresCopyFail    = 'f'
+	PostgresUntypedType = 0 // startup message, SSL and cancel requests have no type
+
+	// backend
+	PostgresAuthentication = 'R'
+	PostgresErrorResponse  = 'E'
+	PostgresReadyForQuery  = 'Z'
+)
+
+// PostgreSQL request codes of untyped frontend messages
+const (
+	PostgresProtocolVersion = 196608 // 3.0
+	PostgresCancelRequest   = 80877102
+	PostgresSSLRequest      = 80877103
+	PostgresGSSENCRequest   = 80877104
+)
+
+// PostgreSQL authentication request codes
+const (
+	PostgresAuthOk           = 0
+	PostgresAuthCleartext    = 3
+	PostgresAuthMD5          = 5
+	PostgresAuthSASL         = 10
+	PostgresAuthSASLContinue = 11
+	PostgresAuthSASLFinal    = 12
+)
+
+// maxPostgresMessage is the limit of the message length, server rejects longer messages
+const maxPostgresMessage = 1 << 30
+
+// PostgresMessage is a message of PostgreSQL wire protocol
+type PostgresMessage struct {
+	Type byte // PostgresUntypedType for untyped frontend messages
+	// Data is the content of the message after its length
+	Data []byte
+}
+
+type postgresProto struct {
+	pos int // position of the first message which is not parsed yet
+}
+
+// PostgresLength returns the length of the first request or response of the payloads, or -1 if it is not complete.
+// Requests are sent by frontend, they end with Query, Sync, FunctionCall, Terminate, password or untyped message.
+// Responses end with ReadyForQuery, or with authentication request which needs the password.
+// The length of parsed messages is stored in m if it is not nil, so payloads are not parsed again.
+func PostgresLength(m ProtocolStateSetter, frontend bool, payloads ...[]byte) int {
+	var state *postgresProto
+	if m != nil {
+		state, _ = m.ProtocolState().(*postgresProto)
+	}
+	if state == nil {
+		state = new(postgresProto)
+		if m != nil {
+			m.SetProtocolState(state)
+		}
+	}
+
+	total := 0
+	for _, data := range payloads {
+		total += len(data)
+	}
+	// response to SSL request is one byte
+	if !frontend && total == 1 && state.pos == 0 {
+		if b := payloadsRange(payloads, 0, 1)[0]; b == 'S' || b == 'N' {
+			return 1
+		}
+		return -1
+	}
+
+	for pos := state.pos; pos < total; {
+		header := payloadsRange(payloads, pos, pos+9)
+		if len(header) < 5 {
+			return -1
+		}
+		typ, length, ok := postgresHeader(header, frontend)
+		if !ok {
+			return -1
+		}
+		next := pos + length
+		if next > total {
+			return -1
+		}
+		switch {
+		case !frontend && typ == PostgresReadyForQuery:
+			return next
+		case !frontend && typ == PostgresAuthentication:
+			if len(header) < 9 {
+				return -1
+			}
+			// final SASL message is followed by AuthenticationOk
+			if code := binary.BigEndian.Uint32(header[5:]); code != PostgresAuthOk && code != PostgresAuthSASLFinal {
+				return next
+			}
+		case frontend:
+			switch typ {
+			case PostgresUntypedType, PostgresQuery, PostgresSync, PostgresFuncCall, PostgresTerminate, PostgresPassword:
+				return next
+			}
+		}
+		pos = next
+		state.pos = pos
+	}
+	return -1
+}
+
+// postgresHeader returns the type and the full length of the message
+func postgresHeader(header []byte, frontend bool) (typ byte, length int, ok bool) {
+	if frontend && header[0] == PostgresUntypedType {
+		if len(header) < 8 {
+			return 0, 0, false
+		}
+		length = int(binary.BigEndian.Uint32(header))
+		return PostgresUntypedType, length, length >= 8 && length < maxPostgresMessage
+	}
+	typ = header[0]
+	if !IsPostgresType(typ, frontend) {
+		return 0, 0, false
+	}
+	length = int(binary.BigEndian.Uint32(header[1:]))
+	return typ, 1 + length, length >= 4 && length < maxPostgresMessage
+}
+
+// IsPostgresType reports whether the byte is a type of frontend or backend message
+func IsPostgresType(typ byte, frontend bool) bool {
+	if frontend {
+		return bytes.IndexByte([]byte("BCcdDEfFHpPQSX"), typ) >= 0
+	}
+	return bytes.IndexByte([]byte("123AcCdDEGHIKnNRsStTvVWZ"), typ) >= 0
+}
+
+// ParsePostgresMessages decodes messages of the data, frontend reports whether they are sent by client.
+// It returns false if the data does not end with a complete message.
+func ParsePostgresMessages(data []byte, frontend bool) (messages []PostgresMessage, ok bool) {
+	for len(data) > 0 {
+		if len(data) < 5 {
+			return messages, false
+		}
+		typ, length, ok := postgresHeader(data, frontend)
+		if !ok || length > len(data) {
+			return messages, false
+		}
+		start := 5
+		if typ == PostgresUntypedType {
+			start = 4
+		}
+		messages = append(messages, PostgresMessage{Type: typ, Data: data[start:length]})
+		data = data[length:]
+	}
+	return messages, true
+}
+
+// Encode returns the message in wire format
+func (m *PostgresMessage) Encode() []byte {
+	data := make([]byte, 0, 5+len(m.Data))
+	if m.Type != PostgresUntypedType {
+		data = append(data, m.Type)
+	}
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(4+len(m.Data)))
+	data = append(data, length[:]...)
+	return append(data, m.Data...)
+}
+
+// PostgresString returns null terminated string at the beginning of the data, and the rest of the data.
+// It returns false if the string is not terminated.
+func PostgresString(data []byte) (s, rest []byte, ok bool) {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 {
+		return nil, data, false
+	}
+	return data[:i], data[i+1:], true
+}
+
+// IsReadOnlyQuery reports whether the SQL query only reads data, judging by its first keyword.
+// Comments and parentheses before the keyword are skipped.
+func IsReadOnlyQuery(query []byte) bool {
+	for {
+		query = bytes.TrimLeft(query, " \t\r\n(")
+		switch {
+		case bytes.HasPrefix(query, []byte("--")):
+			if i := bytes.IndexByte(query, '\n'); i >= 0 {
+				query = query[i+1:]
+				continue
+			}
+			return false
+		case bytes.HasPrefix(query, []byte("/*")):
+			if i := bytes.Index(query, []byte("*/")); i >= 0 {
+				query = query[i+2:]
+				continue
+			}
+			return false
+		}
+		break
+	}
+
+	end := 0
+	for end < len(query) && (query[end] >= 'a' && query[end] <= 'z' || query[end] >= 'A' && query[end] <= 'Z') {
+		end++
+	}
+	switch string(bytes.ToUpper(query[:end])) {
+	case "SELECT", "WITH", "SHOW", "VALUES", "TABLE", "EXPLAIN":
+		return true
+	}
+	return false
+}
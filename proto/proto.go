@@ -190,6 +190,25 @@ func DeleteHeader(payload, name []byte) []byte {
 	return payload
 }
 
+// Cookie returns value of the cookie with given name from the Cookie header,
+// if cookie not found, value will be blank
+func Cookie(payload, name []byte) []byte {
+	cookies := Header(payload, []byte("Cookie"))
+	for len(cookies) > 0 {
+		var pair []byte
+		if i := bytes.IndexByte(cookies, ';'); i != -1 {
+			pair, cookies = cookies[:i], cookies[i+1:]
+		} else {
+			pair, cookies = cookies, nil
+		}
+		pair = bytes.TrimSpace(pair)
+		if i := bytes.IndexByte(pair, '='); i != -1 && bytes.Equal(pair[:i], name) {
+			return pair[i+1:]
+		}
+	}
+	return nil
+}
+
 // Body returns request/response body
 func Body(payload []byte) []byte {
 	pos := MIMEHeadersEndPos(payload)
@@ -456,6 +475,9 @@ type httpProto struct {
 	isChunked    bool // Transfer-Encoding: chunked
 	bodyLen      int  // Content-Length's value
 	hasTrailer   bool // Trailer header?
+
+	headersEnd int // end of the headers, see MessageLength
+	chunkPos   int // position of the first chunk which is not scanned yet
 }
 
 // HasFullPayload checks if this message has full or valid payloads and returns true.
@@ -553,6 +575,126 @@ func HasFullPayload(m ProtocolStateSetter, payloads ...[]byte) bool {
 	return state.bodyLen == bodyLen
 }
 
+// maximum sizes of the sections which are searched for their end when a message is split
+const (
+	maxHeadersSize   = 64 << 10
+	maxChunkLineSize = 1 << 10
+)
+
+// MessageLength returns the length of the first HTTP message of the payloads, or -1 if it is
+// not complete or its end is not known. It is used to split pipelined messages.
+// Message body is delimited by Content-Length or chunked encoding, requests without them have no body,
+// and responses without them end with the connection, unless their status does not allow a body.
+// Message param is optional, like in HasFullPayload, it keeps the state of scanned chunks.
+func MessageLength(m ProtocolStateSetter, payloads ...[]byte) int {
+	var state *httpProto
+	if m != nil {
+		state, _ = m.ProtocolState().(*httpProto)
+	}
+	if state == nil {
+		state = new(httpProto)
+		if m != nil {
+			m.SetProtocolState(state)
+		}
+	}
+
+	total := 0
+	for _, data := range payloads {
+		total += len(data)
+	}
+	if state.headersEnd < 1 {
+		end := MIMEHeadersEndPos(payloadsRange(payloads, 0, maxHeadersSize))
+		if end < 0 {
+			return -1
+		}
+		state.headersEnd = end
+		state.chunkPos = end
+	}
+	headers := payloadsRange(payloads, 0, state.headersEnd)
+
+	if bytes.Contains(Header(headers, []byte("Transfer-Encoding")), []byte("chunked")) {
+		return chunkedLength(state, payloads, total)
+	}
+	if contentLen := Header(headers, []byte("Content-Length")); len(contentLen) > 0 {
+		n, ok := atoI(contentLen, 10)
+		if !ok || state.headersEnd+n > total {
+			return -1
+		}
+		return state.headersEnd + n
+	}
+	if HasRequestTitle(headers) {
+		return state.headersEnd
+	}
+	switch status := Status(headers); {
+	case status == nil:
+		return -1
+	case status[0] == '1', string(status) == "204", string(status) == "304":
+		return state.headersEnd
+	}
+	return -1
+}
+
+// chunkedLength scans chunks of the body and returns the end of the message after the last chunk and trailers
+func chunkedLength(state *httpProto, payloads [][]byte, total int) int {
+	for pos := state.chunkPos; pos < total; {
+		line := payloadsRange(payloads, pos, pos+maxChunkLineSize)
+		i := bytes.Index(line, CRLF)
+		if i < 1 {
+			return -1
+		}
+		size := line[:i]
+		if ext := bytes.IndexByte(size, ';'); ext > 0 {
+			size = size[:ext]
+		}
+		n, ok := atoI(bytes.TrimSpace(size), 16)
+		if !ok {
+			return -1
+		}
+		if n == 0 {
+			// the last chunk is followed by optional trailers and the empty line
+			trailers := payloadsRange(payloads, pos+i, pos+i+maxHeadersSize)
+			if end := bytes.Index(trailers, EmptyLine); end >= 0 {
+				return pos + i + end + len(EmptyLine)
+			}
+			return -1
+		}
+		next := pos + i + len(CRLF) + n + len(CRLF)
+		if next > total {
+			return -1
+		}
+		pos = next
+		state.chunkPos = pos
+	}
+	return -1
+}
+
+// payloadsRange returns bytes of the payloads from start to end as one slice, end is limited by the data.
+// The slice of the payload is returned if the range does not cross payloads.
+func payloadsRange(payloads [][]byte, start, end int) (out []byte) {
+	pos := 0
+	for _, data := range payloads {
+		from, to := start-pos, end-pos
+		pos += len(data)
+		if to <= 0 {
+			break
+		}
+		if from >= len(data) {
+			continue
+		}
+		if from < 0 {
+			from = 0
+		}
+		if to > len(data) {
+			to = len(data)
+		}
+		if out == nil && (to < len(data) || pos >= end) {
+			return data[from:to]
+		}
+		out = append(out, data[from:to]...)
+	}
+	return
+}
+
 // this works with positive integers
 func atoI(s []byte, base int) (num int, ok bool) {
 	var v int
@@ -268,6 +268,22 @@ func TestSetPath(t *testing.T) {
 
 }
 
+func TestCookie(t *testing.T) {
+	payload := []byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\nCookie: a=1; session=abc;b=2\r\n\r\n")
+
+	if val := Cookie(payload, []byte("session")); !bytes.Equal(val, []byte("abc")) {
+		t.Error("Should detect cookie", string(val))
+	}
+
+	if val := Cookie(payload, []byte("b")); !bytes.Equal(val, []byte("2")) {
+		t.Error("Should detect cookie", string(val))
+	}
+
+	if val := Cookie(payload, []byte("sess")); val != nil {
+		t.Error("Should not detect cookie", string(val))
+	}
+}
+
 func TestPathParam(t *testing.T) {
 	var payload []byte
 
@@ -481,6 +497,340 @@ func TestHasFullPayload(t *testing.T) {
 	}
 }
 
+func TestMessageLength(t *testing.T) {
+	next := "GET /next HTTP/1.1\r\n\r\n"
+	tests := []struct {
+		payloads []string
+		length   int
+	}{
+		{[]string{"GET / HTTP/1.1\r\nHost: a\r\n\r\n" + next}, 27},
+		{[]string{"GET / HTTP/1.1\r\nHo", "st: a\r\n\r\n", next}, 27},
+		{[]string{"GET / HTTP/1.1\r\nHost: a\r\n"}, -1},
+		{[]string{"POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello" + next}, 43},
+		{[]string{"POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhel", "lo"}, 43},
+		{[]string{"POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhel"}, -1},
+		{[]string{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n", "4\r\nWiki\r\n5\r\npedia\r\n0\r\n\r\n" + next}, 71},
+		{[]string{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nWiki\r\n5\r", "\npedia\r\n0\r\nExpires: now\r\n\r\n"}, 85},
+		{[]string{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nWiki\r\n5\r\npedia"}, -1},
+		{[]string{"HTTP/1.1 304 Not Modified\r\n\r\n" + next}, 29},
+		{[]string{"HTTP/1.1 200 OK\r\n\r\nuntil the connection is closed"}, -1},
+	}
+	for i, tt := range tests {
+		var payloads [][]byte
+		for _, p := range tt.payloads {
+			payloads = append(payloads, []byte(p))
+		}
+		if length := MessageLength(nil, payloads...); length != tt.length {
+			t.Errorf("%d: expected length %d, got %d", i, tt.length, length)
+		}
+	}
+}
+
+func TestWebSocketFrame(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 0xffff, 0x10000} {
+		frame := WebSocketFrame{Fin: true, Opcode: WebSocketBinary, Payload: bytes.Repeat([]byte{'a'}, size)}
+		for _, key := range [][]byte{nil, []byte("abcd")} {
+			data := frame.Encode(key)
+			// the header is split between payloads
+			if n := WebSocketFrameLength(data[:1], data[1:]); n != len(data) {
+				t.Errorf("%d: expected length %d, got %d", size, len(data), n)
+			}
+			decoded, n, ok := ParseWebSocketFrame(append(data, 0x81))
+			if !ok || n != len(data) || decoded.Masked != (key != nil) || !decoded.Fin || decoded.Opcode != WebSocketBinary {
+				t.Errorf("%d: wrong frame %v %d %+v", size, ok, n, decoded)
+			}
+			if !bytes.Equal(decoded.Payload, frame.Payload) {
+				t.Errorf("%d: wrong payload", size)
+			}
+			if _, _, ok = ParseWebSocketFrame(data[:len(data)-1]); ok && size > 0 {
+				t.Errorf("%d: incomplete frame should not be parsed", size)
+			}
+		}
+	}
+	if n := WebSocketFrameLength([]byte{0x81, 0xfe, 0x01}); n != -1 {
+		t.Errorf("incomplete header should have unknown length, got %d", n)
+	}
+
+	request := []byte("GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: WebSocket\r\nConnection: Upgrade\r\n\r\n")
+	response := []byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	if !IsWebSocketUpgrade(request) || !IsWebSocketUpgrade(response) {
+		t.Error("expected upgrade request and response")
+	}
+	if IsWebSocketUpgrade([]byte("HTTP/1.1 400 Bad Request\r\nUpgrade: websocket\r\n\r\n")) {
+		t.Error("rejected upgrade should not upgrade the connection")
+	}
+}
+
+func TestRESPLength(t *testing.T) {
+	tests := []struct {
+		data     string
+		expected int
+	}{
+		{"*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n*1\r\n$4\r\nPING\r\n", 22},
+		{"*2\r\n$3\r\nGET\r\n$3\r\nke", -1},
+		{"+OK\r\n:1\r\n", 5},
+		{"-ERR unknown command\r\n", 22},
+		{"$-1\r\n+OK\r\n", 5},
+		{"$5\r\nhel\r\n\r\n", 11},
+		{"*-1\r\n", 5},
+		{"*2\r\n*1\r\n:1\r\n$0\r\n\r\n", 18},
+		{"*3\r\n:1\r\n", -1},
+		// RESP3 map with an attribute
+		{"%1\r\n+a\r\n|1\r\n+ttl\r\n:3600\r\n#t\r\n", 29},
+		{">2\r\n+message\r\n_\r\n", 17},
+		{"PING\r\nPING\r\n", 6},
+		{"PING", -1},
+		{"$x\r\n", -1},
+	}
+	for _, tt := range tests {
+		if n := RESPLength([]byte(tt.data)); n != tt.expected {
+			t.Errorf("expected length of %q to be %d, got %d", tt.data, tt.expected, n)
+		}
+		// lines are split between payloads
+		if len(tt.data) > 3 {
+			if n := RESPLength([]byte(tt.data[:3]), []byte(tt.data[3:])); n != tt.expected {
+				t.Errorf("expected length of split %q to be %d, got %d", tt.data, tt.expected, n)
+			}
+		}
+	}
+}
+
+func TestRESPCommand(t *testing.T) {
+	tests := []struct {
+		data, command string
+	}{
+		{"*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n", "GET"},
+		{"*1\r\n$8\r\nflushall\r\n", "flushall"},
+		{"ping\r\n", "ping"},
+		{"  SET a 1\r\n", "SET"},
+		{"*1\r\n:1\r\n", ""},
+		{"*1\r\n$8\r\nflu", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if command := RESPCommand([]byte(tt.data)); string(command) != tt.command {
+			t.Errorf("expected command of %q to be %q, got %q", tt.data, tt.command, command)
+		}
+	}
+}
+
+func postgresMessage(typ byte, data string) string {
+	m := PostgresMessage{Type: typ, Data: []byte(data)}
+	return string(m.Encode())
+}
+
+func TestPostgresLength(t *testing.T) {
+	startup := postgresMessage(PostgresUntypedType, "\x00\x03\x00\x00user\x00app\x00\x00")
+	query := postgresMessage('Q', "SELECT 1\x00")
+	extended := postgresMessage('P', "s1\x00SELECT $1\x00\x00\x00") + postgresMessage('B', "\x00s1\x00\x00\x00\x00\x01\x00\x00\x00\x011\x00\x00") +
+		postgresMessage('E', "\x00\x00\x00\x00\x00") + postgresMessage('S', "")
+	md5 := postgresMessage('R', "\x00\x00\x00\x05salt")
+	ready := postgresMessage('R', "\x00\x00\x00\x00") + postgresMessage('S', "TimeZone\x00UTC\x00") + postgresMessage('Z', "I")
+	result := postgresMessage('T', "\x00\x00") + postgresMessage('D', "\x00\x00") + postgresMessage('C', "SELECT 1\x00") + postgresMessage('Z', "I")
+
+	tests := []struct {
+		data     string
+		frontend bool
+		expected int
+	}{
+		{startup + query, true, len(startup)},
+		{query + extended, true, len(query)},
+		{extended + query, true, len(extended)},
+		{extended[:len(extended)-1], true, -1},
+		{md5 + ready, false, len(md5)},
+		{ready + result, false, len(ready)},
+		{result, false, len(result)},
+		{result[:len(result)-6], false, -1},
+		{"N", false, 1},
+		{"Q\x00\x00\x00\x03", true, -1},
+		{"x\x00\x00\x00\x04", false, -1},
+	}
+	for i, tt := range tests {
+		if n := PostgresLength(nil, tt.frontend, []byte(tt.data)); n != tt.expected {
+			t.Errorf("%d: expected length %d, got %d", i, tt.expected, n)
+		}
+		if len(tt.data) > 7 {
+			if n := PostgresLength(nil, tt.frontend, []byte(tt.data[:7]), []byte(tt.data[7:])); n != tt.expected {
+				t.Errorf("%d: expected length of split payloads %d, got %d", i, tt.expected, n)
+			}
+		}
+	}
+
+	messages, ok := ParsePostgresMessages([]byte(startup+extended), true)
+	if !ok || len(messages) != 5 || messages[0].Type != PostgresUntypedType || messages[4].Type != PostgresSync {
+		t.Errorf("wrong messages %q", messages)
+	}
+	if _, ok = ParsePostgresMessages([]byte(result[:len(result)-1]), false); ok {
+		t.Error("incomplete message should not be parsed")
+	}
+}
+
+func TestIsReadOnlyQuery(t *testing.T) {
+	tests := map[string]bool{
+		"SELECT * FROM users":                      true,
+		"  (select 1) union (select 2)":            true,
+		"-- comment\nWITH t AS (SELECT 1) TABLE t": true,
+		"/* hint */ show search_path":              true,
+		"DELETE FROM users":                        false,
+		"insert into t values (1)":                 false,
+		"/* not closed SELECT":                     false,
+		"selected":                                 false,
+	}
+	for query, expected := range tests {
+		if IsReadOnlyQuery([]byte(query)) != expected {
+			t.Errorf("expected %q to be read-only: %v", query, expected)
+		}
+	}
+}
+
+func mysqlTestPacket(seq byte, payload string) string {
+	n := len(payload)
+	return string([]byte{byte(n), byte(n >> 8), byte(n >> 16), seq}) + payload
+}
+
+func TestMySQLLength(t *testing.T) {
+	query := mysqlTestPacket(0, "\x03SELECT 1")
+	closeQuery := mysqlTestPacket(0, "\x19\x01\x00\x00\x00") + query
+	greeting := mysqlTestPacket(0, "\x0a8.0.33\x00\x01\x00\x00\x00")
+	ok := mysqlTestPacket(1, "\x00\x00\x00\x02\x00\x00\x00")
+	moreResults := mysqlTestPacket(1, "\x00\x00\x00\x0a\x00\x00\x00") + mysqlTestPacket(2, "\x00\x00\x00\x02\x00\x00\x00")
+	err := mysqlTestPacket(1, "\xff\x48\x04#42000syntax error")
+	eof := "\xfe\x00\x00\x02\x00"
+	result := mysqlTestPacket(1, "\x01") + mysqlTestPacket(2, "\x03def\x00\x00\x00\x011\x00\x0c") + mysqlTestPacket(3, eof) +
+		mysqlTestPacket(4, "\x011") + mysqlTestPacket(5, eof)
+	// CLIENT_DEPRECATE_EOF, rows end with OK packet of 0xfe header
+	deprecateEOF := mysqlTestPacket(1, "\x01") + mysqlTestPacket(2, "\x03def\x00\x00\x00\x011\x00\x0c") +
+		mysqlTestPacket(3, "\x011") + mysqlTestPacket(4, "\xfe\x00\x00\x02\x00\x00\x00")
+	// statement 1 with one parameter and one column
+	prepare := mysqlTestPacket(1, "\x00\x01\x00\x00\x00\x01\x00\x01\x00\x00\x00\x00") + mysqlTestPacket(2, "\x03def\x00\x00\x00\x01?\x00\x0c") +
+		mysqlTestPacket(3, eof) + mysqlTestPacket(4, "\x03def\x00\x00\x00\x01a\x00\x0c") + mysqlTestPacket(5, eof)
+
+	tests := []struct {
+		data     string
+		frontend bool
+		expected int
+	}{
+		{query + query, true, len(query)},
+		{closeQuery + query, true, len(closeQuery)},
+		{closeQuery[:len(closeQuery)-1], true, -1},
+		{greeting, false, len(greeting)},
+		{ok + ok, false, len(ok)},
+		{moreResults, false, len(moreResults)},
+		{err, false, len(err)},
+		{result + ok, false, len(result)},
+		{result[:len(result)-1], false, -1},
+		{deprecateEOF, false, len(deprecateEOF)},
+		{prepare, false, len(prepare)},
+		{prepare[:len(prepare)-2], false, -1},
+	}
+	for i, tt := range tests {
+		if n := MySQLLength(nil, tt.frontend, []byte(tt.data)); n != tt.expected {
+			t.Errorf("%d: expected length %d, got %d", i, tt.expected, n)
+		}
+		if len(tt.data) > 7 {
+			if n := MySQLLength(nil, tt.frontend, []byte(tt.data[:7]), []byte(tt.data[7:])); n != tt.expected {
+				t.Errorf("%d: expected length of split payloads %d, got %d", i, tt.expected, n)
+			}
+		}
+	}
+
+	packets, complete := ParseMySQLPackets([]byte(closeQuery))
+	if !complete || len(packets) != 2 || packets[1].Payload[0] != MySQLComQuery {
+		t.Errorf("wrong packets %q", packets)
+	}
+	packets, _ = ParseMySQLPackets([]byte(prepare))
+	if id, params, ok := MySQLPrepareOK(packets[0].Payload); !ok || id != 1 || params != 1 {
+		t.Errorf("wrong prepare response %d %d", id, params)
+	}
+}
+
+func TestMemcachedLength(t *testing.T) {
+	binary := func(magic, opcode byte, key, value string) string {
+		header := make([]byte, 24)
+		header[0], header[1], header[3] = magic, opcode, byte(len(key))
+		header[11] = byte(len(key) + len(value))
+		return string(header) + key + value
+	}
+	get := binary(MemcachedRequestMagic, 0x00, "a", "")
+	getq := binary(MemcachedRequestMagic, 0x09, "b", "")
+	hit := binary(MemcachedResponseMagic, 0x09, "", "value")
+	miss := binary(MemcachedResponseMagic, 0x00, "", "Not found")
+	stat := binary(MemcachedResponseMagic, 0x10, "pid", "1") + binary(MemcachedResponseMagic, 0x10, "", "")
+
+	tests := []struct {
+		data     string
+		frontend bool
+		expected int
+	}{
+		{"get a\r\nget b\r\n", true, 7},
+		{"set a 0 0 5\r\nhello\r\nget a\r\n", true, 20},
+		{"set a 0 0 5\r\nhel", true, -1},
+		{"set a 0 0 5 noreply\r\nhello\r\nmn\r\n", true, 32},
+		{"ms a 2 T0\r\nhi\r\n", true, 15},
+		{"VALUE a 0 5\r\nhello\r\nEND\r\nEND\r\n", false, 25},
+		{"VALUE a 0 5\r\nhello\r\n", false, -1},
+		{"STAT pid 1\r\nSTAT uptime 2\r\nEND\r\n", false, 32},
+		{"STORED\r\nEND\r\n", false, 8},
+		{"VA 2 f0\r\nhi\r\nHD\r\n", false, 13},
+		{get + get, true, 25},
+		{getq + get, true, 50},
+		{hit + miss, false, 62},
+		{stat + hit, false, len(stat)},
+		{get[:20], true, -1},
+	}
+	for i, tt := range tests {
+		if n := MemcachedLength(nil, tt.frontend, []byte(tt.data)); n != tt.expected {
+			t.Errorf("%d: expected length %d, got %d", i, tt.expected, n)
+		}
+		if len(tt.data) > 7 {
+			if n := MemcachedLength(nil, tt.frontend, []byte(tt.data[:7]), []byte(tt.data[7:])); n != tt.expected {
+				t.Errorf("%d: expected length of split payloads %d, got %d", i, tt.expected, n)
+			}
+		}
+	}
+}
+
+func TestMySQLQuery(t *testing.T) {
+	if q, ok := MySQLQuery([]byte("\x03SELECT 1"), false); !ok || string(q) != "SELECT 1" {
+		t.Errorf("wrong query %q", q)
+	}
+	// one query attribute of string type named id
+	if q, ok := MySQLQuery([]byte("\x03\x01\x01\x00\x01\xfd\x00\x02id\x011SELECT 1"), true); !ok || string(q) != "SELECT 1" {
+		t.Errorf("wrong query with attributes %q", q)
+	}
+	if n := MySQLPlaceholders([]byte("SELECT ? FROM t WHERE a = '?' AND b = ? -- ?")); n != 2 {
+		t.Errorf("expected 2 placeholders, got %d", n)
+	}
+}
+
+func TestMySQLExecuteQuery(t *testing.T) {
+	query := []byte("SELECT * FROM t WHERE id = ? AND name = ? AND deleted = ? AND note = '?'")
+	header := "\x17\x01\x00\x00\x00\x00\x01\x00\x00\x00"
+	// LONGLONG, VAR_STRING and NULL parameters, types are sent with the first execution
+	first := header + "\x04\x01\x08\x00\xfd\x00\x06\x00" + "\x2a\x00\x00\x00\x00\x00\x00\x00" + "\x04it's"
+	sql, types, ok := MySQLExecuteQuery(query, 3, []byte(first), nil, nil, false)
+	if expected := "SELECT * FROM t WHERE id = 42 AND name = 'it\\'s' AND deleted = NULL AND note = '?'"; !ok || string(sql) != expected {
+		t.Errorf("expected %q, got %q", expected, sql)
+	}
+
+	next := header + "\x00\x00" + "\xf9\xff\xff\xff\xff\xff\xff\xff" + "\x02ab"
+	sql, _, ok = MySQLExecuteQuery(query, 3, []byte(next), types, nil, false)
+	if expected := "SELECT * FROM t WHERE id = -7 AND name = 'ab' AND deleted = NULL AND note = '?'"; !ok || string(sql) != expected {
+		t.Errorf("expected %q, got %q", expected, sql)
+	}
+
+	// the second parameter is sent by COM_STMT_SEND_LONG_DATA
+	long := header + "\x00\x00" + "\x01\x00\x00\x00\x00\x00\x00\x00"
+	sql, _, ok = MySQLExecuteQuery(query, 3, []byte(long), types, map[int][]byte{1: []byte("\xff\x00")}, false)
+	if expected := "SELECT * FROM t WHERE id = 1 AND name = X'ff00' AND deleted = NULL AND note = '?'"; !ok || string(sql) != expected {
+		t.Errorf("expected %q, got %q", expected, sql)
+	}
+
+	if _, _, ok = MySQLExecuteQuery(query, 3, []byte(next), nil, nil, false); ok {
+		t.Error("execution without known types should fail")
+	}
+}
+
 func BenchmarkHasFullPayload(b *testing.B) {
 	data := []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n1e\r\n111111111111111111111111111111\r\n0\r\n\r\n")
 	for i := 0; i < b.N; i++ {
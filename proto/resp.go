@@ -0,0 +1,164 @@
+package proto
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// RESP (REdis Serialization Protocol) type prefixes, RESP3 types are included
+const (
+	RESPSimpleString = '+'
+	RESPError        = '-'
+	RESPInteger      = ':'
+	RESPBulkString   = '$'
+	RESPArray        = '*'
+	RESPNull         = '_'
+	RESPDouble       = ','
+	RESPBoolean      = '#'
+	RESPBigNumber    = '('
+	RESPBulkError    = '!'
+	RESPVerbatim     = '='
+	RESPMap          = '%'
+	RESPSet          = '~'
+	RESPAttribute    = '|'
+	RESPPush         = '>'
+)
+
+const (
+	// maxRESPHeader is enough for the type and the length of bulk strings and aggregates
+	maxRESPHeader = 32
+	// maxRESPLine limits simple strings and inline commands, redis limits inline commands to 64KB
+	maxRESPLine = 64 << 10
+)
+
+// IsRESPType reports whether the byte is a type prefix of RESP value
+func IsRESPType(b byte) bool {
+	switch b {
+	case RESPSimpleString, RESPError, RESPInteger, RESPBulkString, RESPArray,
+		RESPNull, RESPDouble, RESPBoolean, RESPBigNumber, RESPBulkError, RESPVerbatim,
+		RESPMap, RESPSet, RESPAttribute, RESPPush:
+		return true
+	}
+	return false
+}
+
+// RESPLength returns the length of the first RESP value of the payloads, or -1 if it is not complete or not valid.
+// Inline commands, which are sent by clients as a plain line, are supported too.
+func RESPLength(payloads ...[]byte) int {
+	total := 0
+	for _, data := range payloads {
+		total += len(data)
+	}
+	if total == 0 {
+		return -1
+	}
+	if !IsRESPType(payloadsRange(payloads, 0, 1)[0]) {
+		// inline command ends with the new line
+		line := payloadsRange(payloads, 0, maxRESPLine)
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			return i + 1
+		}
+		return -1
+	}
+
+	pos := 0
+	// values are nested in aggregates, remaining is the number of values left to read
+	for remaining := 1; remaining > 0; remaining-- {
+		if pos >= total {
+			return -1
+		}
+		typ, line, next := respLine(payloads, pos)
+		if next < 0 {
+			return -1
+		}
+		pos = next
+		switch typ {
+		case RESPSimpleString, RESPError, RESPInteger, RESPNull, RESPDouble, RESPBoolean, RESPBigNumber:
+		case RESPBulkString, RESPBulkError, RESPVerbatim:
+			n, err := strconv.Atoi(string(line))
+			if err != nil || n < -1 {
+				return -1
+			}
+			// null bulk string has no data
+			if n >= 0 {
+				pos += n + len(CRLF)
+			}
+		case RESPArray, RESPSet, RESPPush, RESPMap, RESPAttribute:
+			n, err := strconv.Atoi(string(line))
+			if err != nil || n < -1 {
+				return -1
+			}
+			if n < 0 {
+				break
+			}
+			if typ == RESPMap || typ == RESPAttribute {
+				n *= 2
+			}
+			remaining += n
+			// attributes are followed by the value they describe
+			if typ == RESPAttribute {
+				remaining++
+			}
+		default:
+			return -1
+		}
+	}
+	if pos > total {
+		return -1
+	}
+	return pos
+}
+
+// respLine returns the type and the rest of the line at pos, and the position after the line,
+// or -1 if the line is not complete
+func respLine(payloads [][]byte, pos int) (typ byte, line []byte, next int) {
+	line = payloadsRange(payloads, pos, pos+maxRESPHeader)
+	i := bytes.Index(line, CRLF)
+	if i < 0 {
+		switch line[0] {
+		case RESPSimpleString, RESPError, RESPDouble, RESPBigNumber:
+			// only simple strings can be long
+			line = payloadsRange(payloads, pos, pos+maxRESPLine)
+			i = bytes.Index(line, CRLF)
+		}
+		if i < 0 {
+			return 0, nil, -1
+		}
+	}
+	return line[0], line[1:i], pos + i + len(CRLF)
+}
+
+// RESPCommand returns the name of the command sent by redis client, as it is sent.
+// Commands are arrays of bulk strings, or inline commands.
+func RESPCommand(data []byte) []byte {
+	if len(data) == 0 {
+		return nil
+	}
+	if data[0] != RESPArray {
+		line := data
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i]
+		}
+		fields := bytes.Fields(line)
+		if len(fields) == 0 {
+			return nil
+		}
+		return fields[0]
+	}
+
+	// skip the array header, the first element is the name
+	i := bytes.Index(data, CRLF)
+	if i < 0 || i+2 >= len(data) || data[i+2] != RESPBulkString {
+		return nil
+	}
+	data = data[i+len(CRLF):]
+	if i = bytes.Index(data, CRLF); i < 0 {
+		return nil
+	}
+	n, err := strconv.Atoi(string(data[1:i]))
+	data = data[i+len(CRLF):]
+	if err != nil || n < 0 || n > len(data) {
+		return nil
+	}
+	return data[:n]
+}
@@ -0,0 +1,138 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// WebSocket frame opcodes, RFC 6455 section 5.2
+const (
+	WebSocketContinuation = 0x0
+	WebSocketText         = 0x1
+	WebSocketBinary       = 0x2
+	WebSocketClose        = 0x8
+	WebSocketPing         = 0x9
+	WebSocketPong         = 0xa
+)
+
+// maxWebSocketHeader is the size of frame header with 64 bit length and masking key
+const maxWebSocketHeader = 14
+
+// WebSocketFrame is a decoded WebSocket frame
+type WebSocketFrame struct {
+	Fin    bool
+	RSV    byte // reserved bits, used by extensions like compression
+	Opcode byte
+	Masked bool // frames sent by clients are masked
+	// Payload is unmasked payload of the frame
+	Payload []byte
+}
+
+// IsWebSocketUpgrade reports whether the payload is a request which asks to upgrade its connection
+// to WebSocket, or a response which accepts it
+func IsWebSocketUpgrade(payload []byte) bool {
+	if !bytes.EqualFold(Header(payload, []byte("Upgrade")), []byte("websocket")) {
+		return false
+	}
+	return HasRequestTitle(payload) || bytes.Equal(Status(payload), []byte("101"))
+}
+
+// WebSocketFrameLength returns the length of the first frame of the payloads, including its header,
+// or -1 if the header is not complete
+func WebSocketFrameLength(payloads ...[]byte) int {
+	header := payloadsRange(payloads, 0, maxWebSocketHeader)
+	n, length := webSocketHeader(header)
+	if n < 0 {
+		return -1
+	}
+	return n + length
+}
+
+// webSocketHeader returns the size of frame header and the length of its payload, or -1 if the header is not complete
+func webSocketHeader(data []byte) (n, length int) {
+	if len(data) < 2 {
+		return -1, 0
+	}
+	n = 2
+	switch length = int(data[1] & 0x7f); length {
+	case 126:
+		n += 2
+		if len(data) < n {
+			return -1, 0
+		}
+		length = int(binary.BigEndian.Uint16(data[2:]))
+	case 127:
+		n += 8
+		if len(data) < n {
+			return -1, 0
+		}
+		l := binary.BigEndian.Uint64(data[2:])
+		if l > 1<<62 {
+			return -1, 0
+		}
+		length = int(l)
+	}
+	if data[1]&0x80 != 0 {
+		n += 4
+	}
+	if len(data) < n {
+		return -1, 0
+	}
+	return
+}
+
+// ParseWebSocketFrame decodes the frame at the beginning of the data, and returns it with its length.
+// It returns false if the frame is not complete.
+func ParseWebSocketFrame(data []byte) (frame WebSocketFrame, n int, ok bool) {
+	n, length := webSocketHeader(data)
+	if n < 0 || len(data) < n+length {
+		return frame, 0, false
+	}
+	frame.Fin = data[0]&0x80 != 0
+	frame.RSV = data[0] >> 4 & 0x7
+	frame.Opcode = data[0] & 0xf
+	frame.Masked = data[1]&0x80 != 0
+	frame.Payload = append([]byte(nil), data[n:n+length]...)
+	if frame.Masked {
+		maskWebSocketPayload(frame.Payload, data[n-4:n])
+	}
+	return frame, n + length, true
+}
+
+// Encode returns the frame in wire format, the payload is masked if the key is given
+func (f *WebSocketFrame) Encode(key []byte) []byte {
+	data := make([]byte, 2, maxWebSocketHeader+len(f.Payload))
+	data[0] = f.Opcode & 0xf
+	data[0] |= (f.RSV & 0x7) << 4
+	if f.Fin {
+		data[0] |= 0x80
+	}
+	switch length := len(f.Payload); {
+	case length < 126:
+		data[1] = byte(length)
+	case length <= 0xffff:
+		data[1] = 126
+		data = append(data, byte(length>>8), byte(length))
+	default:
+		data[1] = 127
+		var l [8]byte
+		binary.BigEndian.PutUint64(l[:], uint64(length))
+		data = append(data, l[:]...)
+	}
+	if key == nil {
+		return append(data, f.Payload...)
+	}
+	data[1] |= 0x80
+	data = append(data, key[:4]...)
+	payload := len(data)
+	data = append(data, f.Payload...)
+	maskWebSocketPayload(data[payload:], key)
+	return data
+}
+
+// maskWebSocketPayload masks or unmasks the payload in place
+func maskWebSocketPayload(payload, key []byte) {
+	for i := range payload {
+		payload[i] ^= key[i&3]
+	}
+}
@@ -12,6 +12,7 @@ const (
 	RequestPayload          = '1'
 	ResponsePayload         = '2'
 	ReplayedResponsePayload = '3'
+	WebSocketPayload        = '4' // WebSocket frame, with the id of the request which upgraded the connection
 )
 
 func randByte(len int) []byte {
@@ -86,7 +87,7 @@ func payloadID(payload []byte) (id []byte) {
 }
 
 func isOriginPayload(payload []byte) bool {
-	return payload[0] == RequestPayload || payload[0] == ResponsePayload
+	return payload[0] == RequestPayload || payload[0] == ResponsePayload || payload[0] == WebSocketPayload
 }
 
 func isRequestPayload(payload []byte) bool {
@@ -20,6 +20,12 @@ const (
 	ProtocolHTTP TCPProtocol = iota
 	// ProtocolBinary ...
 	ProtocolBinary
+	// ProtocolRedis ...
+	ProtocolRedis
+	// ProtocolPostgres ...
+	ProtocolPostgres
+	// ProtocolMySQL ...
+	ProtocolMySQL
 )
 
 // Set is here so that TCPProtocol can implement flag.Var
@@ -29,6 +35,12 @@ func (protocol *TCPProtocol) Set(v string) error {
 		*protocol = ProtocolHTTP
 	case "binary":
 		*protocol = ProtocolBinary
+	case "redis":
+		*protocol = ProtocolRedis
+	case "postgres":
+		*protocol = ProtocolPostgres
+	case "mysql":
+		*protocol = ProtocolMySQL
 	default:
 		return fmt.Errorf("unsupported protocol %s", v)
 	}
@@ -41,6 +53,12 @@ func (protocol *TCPProtocol) String() string {
 		return "binary"
 	case ProtocolHTTP:
 		return "http"
+	case ProtocolRedis:
+		return "redis"
+	case ProtocolPostgres:
+		return "postgres"
+	case ProtocolMySQL:
+		return "mysql"
 	default:
 		return ""
 	}
@@ -57,6 +75,7 @@ type Stats struct {
 	Direction Dir
 	TimedOut  bool // timeout before getting the whole message
 	Truncated bool // last packet truncated due to max message size
+	Upgraded  bool // message is a frame of the connection upgraded to another protocol, see MessageParser.Upgrade
 	IPversion byte
 }
 
@@ -66,11 +85,24 @@ type Message struct {
 	parser   *MessageParser
 	feedback interface{}
 	Idx      uint16
+	uuid     []byte   // id which pairs the message, when it differs from the one of its first packet
+	next     *Message // message which continues the stream after this one is split
 	Stats
 }
 
 // UUID returns the UUID of a TCP request and its response.
 func (m *Message) UUID() []byte {
+	if m.uuid != nil {
+		return m.uuid
+	}
+	if m.Direction == DirIncoming {
+		return m.uuidWith(m.packets[0].Ack)
+	}
+	return m.uuidWith(m.packets[0].Seq)
+}
+
+// uuidWith returns the id of the message connection combined with the number
+func (m *Message) uuidWith(n uint32) []byte {
 	var streamID uint64
 	pckt := m.packets[0]
 
@@ -85,12 +117,7 @@ func (m *Message) UUID() []byte {
 
 	id := make([]byte, 12)
 	binary.BigEndian.PutUint64(id, streamID)
-
-	if m.Direction == DirIncoming {
-		binary.BigEndian.PutUint32(id[8:], pckt.Ack)
-	} else {
-		binary.BigEndian.PutUint32(id[8:], pckt.Seq)
-	}
+	binary.BigEndian.PutUint32(id[8:], n)
 
 	uuidHex := make([]byte, 24)
 	hex.Encode(uuidHex[:], id[:])
@@ -107,13 +134,13 @@ func (m *Message) add(packet *Packet) bool {
 	}
 
 	// Packets not always captured in same Seq order, and sometimes we need to prepend
-	if len(m.packets) == 0 || packet.Seq > m.packets[len(m.packets)-1].Seq {
+	if len(m.packets) == 0 || seqLess(m.packets[len(m.packets)-1].Seq, packet.Seq) {
 		m.packets = append(m.packets, packet)
-	} else if packet.Seq < m.packets[0].Seq {
+	} else if seqLess(packet.Seq, m.packets[0].Seq) {
 		m.packets = append([]*Packet{packet}, m.packets...)
 	} else { // insert somewhere in the middle...
 		for i, p := range m.packets {
-			if packet.Seq < p.Seq {
+			if seqLess(packet.Seq, p.Seq) {
 				m.packets = append(m.packets[:i], append([]*Packet{packet}, m.packets[i:]...)...)
 				break
 			}
@@ -130,6 +157,39 @@ func (m *Message) add(packet *Packet) bool {
 	return true
 }
 
+// cut splits the message after n bytes of data, the message keeps the data before,
+// and the returned message gets the rest
+func (m *Message) cut(n int) *Message {
+	rest := &Message{parser: m.parser, Idx: m.Idx}
+	rest.Direction, rest.IPversion, rest.Upgraded = m.Direction, m.IPversion, m.Upgraded
+	rest.SrcAddr, rest.DstAddr = m.SrcAddr, m.DstAddr
+
+	var packets []*Packet
+	for _, p := range m.packets {
+		switch {
+		case n <= 0:
+			rest.add(p)
+		case len(p.Payload) <= n:
+			packets = append(packets, p)
+		default:
+			// the packet carries the end of one message and the beginning of the next one
+			head, tail := *p, *p
+			head.Payload = p.Payload[:n]
+			tail.Payload = p.Payload[n:]
+			tail.Seq += uint32(n)
+			packets = append(packets, &head)
+			rest.add(&tail)
+		}
+		n -= len(p.Payload)
+	}
+	m.packets = packets
+	m.Length -= rest.Length
+	m.LostData -= rest.LostData
+	rest.Start = rest.packets[0].Timestamp
+	m.next = rest
+	return rest
+}
+
 // Packets returns packets of the message
 func (m *Message) Packets() []*Packet {
 	return m.packets
@@ -183,7 +243,12 @@ func (m *Message) ProtocolState() interface{} {
 
 // Sort a helper to sort packets
 func (m *Message) Sort() {
-	sort.SliceStable(m.packets, func(i, j int) bool { return m.packets[i].Seq < m.packets[j].Seq })
+	sort.SliceStable(m.packets, func(i, j int) bool { return seqLess(m.packets[i].Seq, m.packets[j].Seq) })
+}
+
+// seqLess compares sequence numbers which can wrap around
+func seqLess(a, b uint32) bool {
+	return int32(a-b) < 0
 }
 
 // Emitter message handler
@@ -193,10 +258,26 @@ type Emitter func(*Message)
 // when set, it will be executed before checking FIN or RST flag
 type HintEnd func(*Message) bool
 
+// HintSplit hints the parser where the first of pipelined messages ends, see MessageParser.Split
+// it returns the length of the first message, or -1 if it is not known yet
+type HintSplit func(*Message) int
+
+// HintUpgrade hints the parser that the message switches its connection to another protocol, see MessageParser.Upgrade
+type HintUpgrade func(*Message) bool
+
 // HintStart hints the parser to start the reassembling the message, see MessageParser.Start
 // when set, it will be called after checking SYN flag
 type HintStart func(*Packet) (IsRequest, IsOutgoing bool)
 
+// Hints are hints of a protocol, see the fields of MessageParser with the same names
+type Hints struct {
+	Start   HintStart
+	End     HintEnd
+	Split   HintSplit
+	Upgrade HintUpgrade
+	Frame   HintSplit
+}
+
 // MessageParser holds data of all tcp messages in progress(still receiving/sending packets).
 // message is identified by its source port and dst port, and last 4bytes of src IP.
 type MessageParser struct {
@@ -213,6 +294,24 @@ type MessageParser struct {
 	close          chan struct{} // to signal that we are able to close
 	ports          []uint16
 	ips            []net.IP
+
+	// Split splits pipelined messages of a connection when set, responses are paired with requests in their order
+	Split HintSplit
+	// Upgrade is called with emitted messages when set, after the message which upgrades the connection
+	// its messages are delimited by Frame hint, and they have the id of the upgraded connection
+	Upgrade HintUpgrade
+	Frame   HintSplit
+	// TLS decrypts TLS connections when set, it must be set before the first packet
+	TLS *TLSDecryptor
+	// ConnectionClosed is called with stats of closed connections
+	ConnectionClosed ConnectionHandler
+	// PortHints are hints of connections by the port of the server, they are used instead of the hints of the parser,
+	// so one parser captures different protocols. They must be set before the first packet
+	PortHints map[uint16]*Hints
+
+	conns     map[connID]*connection
+	connsL    sync.Mutex
+	lastSweep time.Time
 }
 
 // NewMessageParser returns a new instance of message parser
@@ -237,6 +336,7 @@ func NewMessageParser(messages chan *Message, ports []uint16, ips []net.IP, mess
 
 	parser.ports = ports
 	parser.ips = ips
+	parser.conns = make(map[connID]*connection)
 
 	for i := 0; i < 10; i++ {
 		parser.m = append(parser.m, make(map[uint64]*Message))
@@ -255,9 +355,25 @@ var packetLen int
 // Packet returns packet handler
 func (parser *MessageParser) PacketHandler(packet *PcapPacket) {
 	packetLen++
+	if parser.TLS != nil {
+		parser.decrypt(packet)
+		return
+	}
 	parser.packets <- packet
 }
 
+// decrypt parses and decrypts packets in the order of capture, before they are processed concurrently
+func (parser *MessageParser) decrypt(packet *PcapPacket) {
+	pckt, err := ParsePacket(packet.Data, packet.LType, packet.LTypeLen, packet.Ci, true)
+	if err != nil {
+		stats.Add("packet_error", 1)
+		return
+	}
+	for _, decrypted := range parser.TLS.Decrypt(pckt) {
+		parser.packets <- &PcapPacket{parsed: decrypted}
+	}
+}
+
 func (parser *MessageParser) wait(index int) {
 	var (
 		now time.Time
@@ -279,10 +395,15 @@ func (parser *MessageParser) wait(index int) {
 }
 
 func (parser *MessageParser) parsePacket(pcapPkt *PcapPacket) *Packet {
-	pckt, err := ParsePacket(pcapPkt.Data, pcapPkt.LType, pcapPkt.LTypeLen, pcapPkt.Ci, false)
-	if err != nil {
-		stats.Add("packet_error", 1)
-		return nil
+	pckt := pcapPkt.parsed
+	if pckt == nil {
+		var err error
+		// empty packets are parsed too, they control the connection state
+		pckt, err = ParsePacket(pcapPkt.Data, pcapPkt.LType, pcapPkt.LTypeLen, pcapPkt.Ci, true)
+		if err != nil {
+			stats.Add("packet_error", 1)
+			return nil
+		}
 	}
 
 	for _, p := range parser.ports {
@@ -305,6 +426,36 @@ func (parser *MessageParser) processPacket(pckt *Packet) {
 		return
 	}
 
+	c, dir := parser.connection(pckt)
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return
+	}
+	s := &c.streams[dir]
+	for _, seg := range c.reassemble(pckt, dir) {
+		parser.addSegment(c, s, seg)
+	}
+
+	// finished stream has complete message, after reset messages are not completed
+	if pckt.RST {
+		c.Reset, c.closed = true, true
+		parser.closeStream(&c.streams[0], true)
+		parser.closeStream(&c.streams[1], true)
+	} else {
+		parser.closeStream(s, false)
+		c.closed = c.streams[0].fin && c.streams[1].fin
+	}
+	closed := c.closed
+	c.Unlock()
+
+	if closed {
+		parser.closeConnection(c)
+	}
+}
+
+// addToMessage adds the packet to the message it belongs to, or to a new message
+func (parser *MessageParser) addToMessage(pckt *Packet, upgraded bool) *Message {
 	// Trying to build unique hash, but there is small chance of collision
 	// No matter if it is request or response, all packets in the same message have same
 	mID := pckt.MessageID()
@@ -329,9 +480,9 @@ func (parser *MessageParser) processPacket(pckt *Packet) {
 		parser.addPacket(m, pckt)
 
 		parser.mL[mIDX].Unlock()
-		return
-	case pckt.Direction == DirUnknown && parser.Start != nil:
-		if in, out := parser.Start(pckt); in || out {
+		return m
+	case pckt.Direction == DirUnknown && parser.hints(pckt).Start != nil && !upgraded:
+		if in, out := parser.hints(pckt).Start(pckt); in || out {
 			if in {
 				pckt.Direction = DirIncoming
 			} else {
@@ -350,6 +501,7 @@ func (parser *MessageParser) processPacket(pckt *Packet) {
 
 	m = new(Message)
 	m.Direction = pckt.Direction
+	m.Upgraded = upgraded
 
 	parser.m[mIDX][mID] = m
 
@@ -359,6 +511,7 @@ func (parser *MessageParser) processPacket(pckt *Packet) {
 	parser.addPacket(m, pckt)
 
 	parser.mL[mIDX].Unlock()
+	return m
 }
 
 func (parser *MessageParser) addPacket(m *Message, pckt *Packet) bool {
@@ -368,15 +521,55 @@ func (parser *MessageParser) addPacket(m *Message, pckt *Packet) bool {
 
 	// If we are using protocol parsing, like HTTP, depend on its parsing func.
 	// For the binary procols wait for message to expire
-	if parser.End != nil {
-		if parser.End(m) {
+	hints := parser.hints(m.packets[0])
+	for {
+		split, end := hints.Split, hints.End
+		if m.Upgraded {
+			split, end = hints.Frame, parser.frameEnd
+		}
+		if end == nil {
+			break
+		}
+		// pipelined messages are emitted one by one, the rest is kept as a new message
+		if split != nil && !m.MissingChunk() {
+			if n := split(m); n > 0 && n < m.Length {
+				rest := m.cut(n)
+				parser.Emit(m)
+				// frames can follow the message which upgrades the connection in the same packet
+				rest.Upgraded = rest.Upgraded || hints.Upgrade != nil && hints.Upgrade(m)
+				parser.m[rest.Idx][rest.packets[0].MessageID()] = rest
+				m = rest
+				continue
+			}
+		}
+		if end(m) {
 			parser.Emit(m)
 		}
+		break
 	}
 
 	return true
 }
 
+// hints returns the hints of the connection of the packet, PortHints of its server port or the hints of the parser
+func (parser *MessageParser) hints(pckt *Packet) Hints {
+	if parser.PortHints != nil {
+		// the server port is the destination of requests, and the source of responses
+		if h, ok := parser.PortHints[pckt.DstPort]; ok {
+			return *h
+		}
+		if h, ok := parser.PortHints[pckt.SrcPort]; ok {
+			return *h
+		}
+	}
+	return Hints{Start: parser.Start, End: parser.End, Split: parser.Split, Upgrade: parser.Upgrade, Frame: parser.Frame}
+}
+
+// frameEnd reports if the message is a complete frame of upgraded connection
+func (parser *MessageParser) frameEnd(m *Message) bool {
+	return !m.MissingChunk() && parser.hints(m.packets[0]).Frame(m) == m.Length
+}
+
 func (parser *MessageParser) Read() *Message {
 	m := <-parser.messages
 	return m
@@ -386,6 +579,9 @@ func (parser *MessageParser) Emit(m *Message) {
 	stats.Add("message_count", 1)
 
 	delete(parser.m[m.Idx], m.packets[0].MessageID())
+	if hints := parser.hints(m.packets[0]); hints.Split != nil || hints.Upgrade != nil {
+		parser.pair(m)
+	}
 
 	parser.messages <- m
 }
@@ -408,7 +604,7 @@ func (parser *MessageParser) timer(now time.Time, index int) {
 			m.TimedOut = true
 			stats.Add("message_timeout_count", 1)
 			failMsg++
-			if parser.End == nil || parser.allowIncompete {
+			if parser.hints(m.packets[0]).End == nil || parser.allowIncompete {
 				parser.Emit(m)
 			}
 
@@ -417,6 +613,11 @@ func (parser *MessageParser) timer(now time.Time, index int) {
 	}
 
 	parser.mL[index].Unlock()
+
+	if index == 0 && now.Sub(parser.lastSweep) > time.Second {
+		parser.lastSweep = now
+		parser.expireConnections(now)
+	}
 }
 
 func (parser *MessageParser) Close() error {
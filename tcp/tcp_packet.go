@@ -17,9 +17,11 @@ func copySlice(to []byte, skip int, from ...[]byte) ([]byte, int) {
 	}
 	totalLen += skip
 
-	if cap(to) < totalLen {
-		diff := totalLen - cap(to)
-		to = append(to, make([]byte, diff)...)
+	// the slice can share its array with other payloads, it is never extended in place
+	if len(to) < totalLen {
+		buf := make([]byte, totalLen)
+		copy(buf, to)
+		to = buf
 	}
 
 	for _, s := range from {
@@ -64,6 +66,9 @@ type Packet struct {
 	SrcPort, DstPort   uint16
 	Ack, Seq           uint32
 	ACK, SYN, FIN, RST bool
+	Window             uint16
+	WindowScale        uint8 // window scale option of SYN packet
+	HasWindowScale     bool
 	Lost               uint32
 	Retry              int
 	CaptureLength      int
@@ -80,6 +85,8 @@ type PcapPacket struct {
 	LType    int
 	LTypeLen int
 	Ci       *gopacket.CaptureInfo
+
+	parsed *Packet // packet which is already parsed, e.g decrypted TLS packet
 }
 
 // ParsePacket parse raw packets
@@ -196,6 +203,12 @@ func (pckt *Packet) parse(data []byte, lType, lTypeLen int, cp *gopacket.Capture
 	pckt.SYN = transLayer[13]&0x02 != 0
 	pckt.RST = transLayer[13]&0x04 != 0
 	pckt.ACK = transLayer[13]&0x10 != 0
+	pckt.Window = binary.BigEndian.Uint16(transLayer[14:16])
+	pckt.WindowScale, pckt.HasWindowScale = 0, false
+	if pckt.SYN {
+		// options are between the fixed header and the data offset, which is validated above
+		pckt.parseOptions(transLayer[20:dOf])
+	}
 	pckt.Lost = uint32(cp.Length - cp.CaptureLength)
 
 	pckt.Payload = ndata[dOf:]
@@ -203,6 +216,29 @@ func (pckt *Packet) parse(data []byte, lType, lTypeLen int, cp *gopacket.Capture
 	return nil
 }
 
+// parseOptions parses TCP options of SYN packet, only window scale option is used
+func (pckt *Packet) parseOptions(opts []byte) {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case 0: // end of options
+			return
+		case 1: // no-operation
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || len(opts) < int(opts[1]) {
+			return
+		}
+		if opts[0] == 3 && opts[1] == 3 {
+			pckt.WindowScale, pckt.HasWindowScale = opts[2], true
+			if pckt.WindowScale > 14 {
+				pckt.WindowScale = 14
+			}
+		}
+		opts = opts[opts[1]:]
+	}
+}
+
 func (pckt *Packet) MessageID() uint64 {
 	if pckt.messageID == 0 {
 		// All packets in the same message will share the same ID
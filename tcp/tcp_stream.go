@@ -0,0 +1,466 @@
+package tcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxStreamRanges  = 256             // gaps kept per direction, older gaps are considered lost
+	maxSeqJump       = 1 << 30         // segments further from the stream are not part of it
+	connectionExpire = 2 * time.Minute // state of idle connection is removed after this time
+	maxPipelined     = 100             // requests waiting for responses, older requests are not paired
+)
+
+// ConnectionStats reports data and loss of TCP connection
+type ConnectionStats struct {
+	SrcAddr            string // endpoint which sent the first captured packet
+	DstAddr            string
+	Start              time.Time
+	End                time.Time
+	Packets            int
+	Bytes              int  // payload bytes without retransmissions
+	Retransmitted      int  // segments which carry already captured data
+	RetransmittedBytes int  // bytes which are captured more than once
+	OutOfOrder         int  // segments received ahead of the stream, or filling a gap
+	OutOfWindow        int  // segments beyond the window advertised by the receiver
+	LostBytes          int  // bytes missing in the captured stream
+	Reset              bool // connection is closed by RST
+}
+
+func (s *ConnectionStats) String() string {
+	return fmt.Sprintf("%s -> %s: packets=%d bytes=%d retransmitted=%d/%dB out_of_order=%d out_of_window=%d lost=%dB",
+		s.SrcAddr, s.DstAddr, s.Packets, s.Bytes, s.Retransmitted, s.RetransmittedBytes, s.OutOfOrder, s.OutOfWindow, s.LostBytes)
+}
+
+// ConnectionHandler is called with the stats of closed or expired connection
+type ConnectionHandler func(ConnectionStats)
+
+// connID identifies the connection regardless of the direction of the packet
+type connID [36]byte
+
+// newConnID returns connection id, and if the packet is sent by the first endpoint of the id
+func newConnID(pckt *Packet) (id connID, fromFirst bool) {
+	var src, dst [18]byte
+	copy(src[:], pckt.SrcIP.To16())
+	binary.BigEndian.PutUint16(src[16:], pckt.SrcPort)
+	copy(dst[:], pckt.DstIP.To16())
+	binary.BigEndian.PutUint16(dst[16:], pckt.DstPort)
+
+	fromFirst = bytes.Compare(src[:], dst[:]) <= 0
+	if fromFirst {
+		copy(id[:], src[:])
+		copy(id[18:], dst[:])
+	} else {
+		copy(id[:], dst[:])
+		copy(id[18:], src[:])
+	}
+	return
+}
+
+// connection reassembles both directions of TCP connection
+type connection struct {
+	sync.Mutex
+	id      connID
+	streams [2]stream // data sent by the first and by the second endpoint of the id
+	last    int64     // unix nano timestamp of the last packet, accessed atomically
+	closed  bool
+	pending [][]byte // ids of requests waiting for responses, guarded by the parser connections lock
+
+	upgraded  int32  // connection is switched to another protocol, accessed atomically
+	upgradeID []byte // id of the message which upgraded the connection, guarded by the parser connections lock
+	ConnectionStats
+}
+
+// seqRange is a range of stream offsets, end is exclusive
+type seqRange struct {
+	start, end int64
+}
+
+// stream is one direction of the connection. Sequence numbers are converted to
+// 64 bit offsets relative to the first byte of the stream, so they do not wrap around.
+type stream struct {
+	started bool
+	synced  bool       // SYN is captured, offset 0 is the first byte of the stream
+	base    uint32     // sequence number of offset 0
+	ref     int64      // offset of the furthest data, the reference for converting sequence numbers
+	ranges  []seqRange // captured data, sorted and merged
+	lost    int        // bytes of gaps which are given up
+
+	fin       bool
+	finOffset int64
+
+	ack       uint32 // the last acknowledgment of the peer data
+	ackKnown  bool
+	window    uint32 // the last window advertised for the peer data, scaled
+	wscale    uint8
+	hasWScale bool
+
+	message      *Message // the message which receives data of the stream
+	messageStart int64
+	messageEnd   int64
+}
+
+// offset converts sequence number to the stream offset, closest to the furthest data
+func (s *stream) offset(seq uint32) int64 {
+	return s.ref + int64(int32(seq-(s.base+uint32(s.ref))))
+}
+
+// segment is a part of packet data which is not captured before
+type segment struct {
+	packet *Packet
+	offset int64
+}
+
+// reassemble updates the state of the connection with the packet, and returns parts of its payload
+// which are not captured before. The direction is 0 if the packet is sent by the first endpoint.
+func (c *connection) reassemble(pckt *Packet, dir int) (segments []segment) {
+	s, peer := &c.streams[dir], &c.streams[1-dir]
+	c.Packets++
+	if c.Start.IsZero() {
+		c.SrcAddr, c.DstAddr, c.Start = pckt.Src(), pckt.Dst(), pckt.Timestamp
+	}
+	if pckt.Timestamp.After(c.End) {
+		c.End = pckt.Timestamp
+	}
+
+	seq := pckt.Seq
+	if pckt.SYN && !(s.synced && s.base == pckt.Seq+1) {
+		s.started, s.synced = true, true
+		s.base, s.ref, s.ranges = pckt.Seq+1, 0, nil
+		s.wscale, s.hasWScale = pckt.WindowScale, pckt.HasWindowScale
+	}
+	if pckt.SYN {
+		seq++
+	}
+	if pckt.ACK {
+		s.ack, s.ackKnown = pckt.Ack, true
+		s.window = uint32(pckt.Window)
+		// scaling is used only if both sides sent the option, and never in SYN packets
+		if !pckt.SYN && s.hasWScale && peer.hasWScale {
+			s.window <<= s.wscale
+		}
+	}
+	if !s.started {
+		s.started, s.base = true, seq
+	}
+
+	offset := s.offset(seq)
+	end := offset + int64(len(pckt.Payload))
+	if pckt.FIN {
+		s.fin, s.finOffset = true, end
+	}
+	if len(pckt.Payload) == 0 {
+		return
+	}
+	if offset-s.ref > maxSeqJump || s.ref-end > maxSeqJump {
+		// most likely a segment of the previous connection with the same ports
+		c.OutOfWindow++
+		stats.Add("out_of_window_segments", 1)
+		return
+	}
+	if peer.ackKnown && peer.window > 0 && end > s.offset(peer.ack)+int64(peer.window) {
+		// the receiver acknowledgment could be captured later, segment is kept
+		c.OutOfWindow++
+		stats.Add("out_of_window_segments", 1)
+	}
+
+	// segment is out of order if it leaves or fills a gap
+	outOfOrder := false
+	if n := len(s.ranges); n > 0 {
+		last := s.ranges[n-1].end
+		outOfOrder = offset > last
+		for _, r := range s.missing(offset, end) {
+			outOfOrder = outOfOrder || r.start < last
+		}
+	}
+	if outOfOrder {
+		c.OutOfOrder++
+		stats.Add("out_of_order_segments", 1)
+	}
+
+	captured := 0
+	for _, r := range s.missing(offset, end) {
+		part := *pckt
+		part.messageID = 0
+		part.Seq = seq + uint32(r.start-offset)
+		part.Payload = pckt.Payload[r.start-offset : r.end-offset]
+		segments = append(segments, segment{&part, r.start})
+		s.add(r)
+		captured += len(part.Payload)
+	}
+	if retransmitted := len(pckt.Payload) - captured; retransmitted > 0 {
+		c.Retransmitted++
+		c.RetransmittedBytes += retransmitted
+		stats.Add("retransmitted_segments", 1)
+		stats.Add("retransmitted_bytes", int64(retransmitted))
+	}
+	c.Bytes += captured
+	if end > s.ref {
+		s.ref = end
+	}
+	return
+}
+
+// missing returns parts of the range which are not captured
+func (s *stream) missing(start, end int64) (parts []seqRange) {
+	for _, r := range s.ranges {
+		if r.end <= start {
+			continue
+		}
+		if r.start >= end {
+			break
+		}
+		if r.start > start {
+			parts = append(parts, seqRange{start, r.start})
+		}
+		start = r.end
+		if start >= end {
+			return
+		}
+	}
+	return append(parts, seqRange{start, end})
+}
+
+// add marks the range as captured
+func (s *stream) add(r seqRange) {
+	i := 0
+	for i < len(s.ranges) && s.ranges[i].end < r.start {
+		i++
+	}
+	j := i
+	for j < len(s.ranges) && s.ranges[j].start <= r.end {
+		if s.ranges[j].start < r.start {
+			r.start = s.ranges[j].start
+		}
+		if s.ranges[j].end > r.end {
+			r.end = s.ranges[j].end
+		}
+		j++
+	}
+	s.ranges = append(s.ranges[:i], append([]seqRange{r}, s.ranges[j:]...)...)
+
+	// give up the oldest gap
+	if len(s.ranges) > maxStreamRanges {
+		s.lost += int(s.ranges[1].start - s.ranges[0].end)
+		s.ranges[1].start = s.ranges[0].start
+		s.ranges = s.ranges[1:]
+	}
+}
+
+// complete reports if all data before the offset is captured
+func (s *stream) complete(offset int64) bool {
+	if len(s.ranges) == 0 {
+		return offset <= 0 || !s.synced
+	}
+	first := s.ranges[0]
+	return first.end >= offset && (!s.synced || first.start <= 0)
+}
+
+// lostBytes returns the size of gaps in the captured data
+func (s *stream) lostBytes() int {
+	lost := s.lost
+	if len(s.ranges) == 0 {
+		return lost
+	}
+	if s.synced && s.ranges[0].start > 0 {
+		lost += int(s.ranges[0].start)
+	}
+	for i := 1; i < len(s.ranges); i++ {
+		lost += int(s.ranges[i].start - s.ranges[i-1].end)
+	}
+	if last := s.ranges[len(s.ranges)-1].end; s.fin && s.finOffset > last {
+		lost += int(s.finOffset - last)
+	}
+	return lost
+}
+
+// stats returns stats of the connection
+func (c *connection) stats() ConnectionStats {
+	cs := c.ConnectionStats
+	cs.LostBytes = c.streams[0].lostBytes() + c.streams[1].lostBytes()
+	return cs
+}
+
+// connection returns the state of packet connection, and the direction of the packet
+func (parser *MessageParser) connection(pckt *Packet) (*connection, int) {
+	id, fromFirst := newConnID(pckt)
+	dir := 0
+	if !fromFirst {
+		dir = 1
+	}
+
+	parser.connsL.Lock()
+	defer parser.connsL.Unlock()
+	c, ok := parser.conns[id]
+	if !ok {
+		c = &connection{id: id}
+		parser.conns[id] = c
+	}
+	atomic.StoreInt64(&c.last, time.Now().UnixNano())
+	return c, dir
+}
+
+// addSegment adds the segment of the stream to a message. Data which fills a gap of the message
+// is added to it, otherwise the message is found by the packet.
+func (parser *MessageParser) addSegment(c *connection, s *stream, seg segment) {
+	pckt := seg.packet
+	end := seg.offset + int64(len(pckt.Payload))
+	if m := s.message; m != nil && seg.offset >= s.messageStart && seg.offset < s.messageEnd {
+		parser.mL[m.Idx].Lock()
+		if parser.m[m.Idx][m.packets[0].MessageID()] == m {
+			parser.addPacket(m, pckt)
+		}
+		parser.mL[m.Idx].Unlock()
+		s.follow()
+		return
+	}
+
+	m := parser.addToMessage(pckt, atomic.LoadInt32(&c.upgraded) == 1)
+	if m != s.message {
+		s.message, s.messageStart, s.messageEnd = m, seg.offset, end
+	} else {
+		if seg.offset < s.messageStart {
+			s.messageStart = seg.offset
+		}
+		if end > s.messageEnd {
+			s.messageEnd = end
+		}
+	}
+	s.follow()
+}
+
+// follow moves the stream to the last message, when its message is split into pipelined messages
+func (s *stream) follow() {
+	if s.message == nil || s.message.next == nil {
+		return
+	}
+	m := s.message
+	for m.next != nil {
+		m = m.next
+	}
+	s.message, s.messageStart = m, s.offset(m.packets[0].Seq)
+	if s.messageEnd < s.messageStart {
+		s.messageEnd = s.messageStart
+	}
+}
+
+// closeStream emits the message of the stream when the stream is finished
+func (parser *MessageParser) closeStream(s *stream, force bool) {
+	m := s.message
+	if m == nil || !force && (!s.fin || !s.complete(s.finOffset)) {
+		return
+	}
+	parser.mL[m.Idx].Lock()
+	if parser.m[m.Idx][m.packets[0].MessageID()] == m {
+		if !force || parser.hints(m.packets[0]).End == nil || parser.allowIncompete {
+			parser.Emit(m)
+		} else {
+			delete(parser.m[m.Idx], m.packets[0].MessageID())
+		}
+	}
+	parser.mL[m.Idx].Unlock()
+	s.message = nil
+}
+
+// closeConnection removes the state of the connection and reports its stats
+func (parser *MessageParser) closeConnection(c *connection) {
+	parser.connsL.Lock()
+	if parser.conns[c.id] == c {
+		delete(parser.conns, c.id)
+	}
+	parser.connsL.Unlock()
+
+	cs := c.stats()
+	stats.Add("lost_bytes", int64(cs.LostBytes))
+	stats.Add("connections_closed", 1)
+	if parser.ConnectionClosed != nil {
+		parser.ConnectionClosed(cs)
+	}
+}
+
+// pair gives pipelined requests unique ids, and responses ids of the requests in their order.
+// A response which has the id of a waiting request is paired with it, and older requests are skipped.
+// Frames of upgraded connection get the id of the message which upgraded it.
+func (parser *MessageParser) pair(m *Message) {
+	id, _ := newConnID(m.packets[0])
+	parser.connsL.Lock()
+	defer parser.connsL.Unlock()
+	c, ok := parser.conns[id]
+	if !ok {
+		return
+	}
+
+	if m.Upgraded {
+		m.uuid = c.upgradeID
+		return
+	}
+	hints := parser.hints(m.packets[0])
+	if hints.Split != nil {
+		c.pair(m)
+	}
+	if hints.Upgrade != nil && hints.Upgrade(m) {
+		c.upgradeID = m.UUID()
+		atomic.StoreInt32(&c.upgraded, 1)
+	}
+}
+
+// pair pairs the request or response with the requests waiting for responses, see MessageParser.pair
+func (c *connection) pair(m *Message) {
+	if m.Direction != DirIncoming && m.Direction != DirOutcoming {
+		return
+	}
+	uuid := m.UUID()
+	if m.Direction == DirIncoming {
+		// pipelined requests are sent before any response, and have the same acknowledgment
+		for _, pending := range c.pending {
+			if bytes.Equal(pending, uuid) {
+				m.uuid = m.uuidWith(m.packets[0].Seq)
+				uuid = m.uuid
+				break
+			}
+		}
+		c.pending = append(c.pending, uuid)
+		if len(c.pending) > maxPipelined {
+			c.pending = c.pending[1:]
+		}
+		return
+	}
+	for i, pending := range c.pending {
+		if bytes.Equal(pending, uuid) {
+			c.pending = c.pending[i+1:]
+			return
+		}
+	}
+	if len(c.pending) > 0 {
+		m.uuid = c.pending[0]
+		c.pending = c.pending[1:]
+	}
+}
+
+// expireConnections closes connections without packets for a long time
+func (parser *MessageParser) expireConnections(now time.Time) {
+	var expired []*connection
+	parser.connsL.Lock()
+	for id, c := range parser.conns {
+		if now.UnixNano()-atomic.LoadInt64(&c.last) > int64(connectionExpire) {
+			delete(parser.conns, id)
+			expired = append(expired, c)
+		}
+	}
+	parser.connsL.Unlock()
+
+	for _, c := range expired {
+		c.Lock()
+		closed := c.closed
+		c.closed = true
+		c.Unlock()
+		if !closed {
+			parser.closeConnection(c)
+		}
+	}
+}
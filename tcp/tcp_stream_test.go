@@ -0,0 +1,188 @@
+package tcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func streamPacket(request bool, seq, ack uint32, payload string) *Packet {
+	pckt := &Packet{SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}, SrcPort: 60000, DstPort: 80,
+		Seq: seq, Ack: ack, ACK: true, Timestamp: time.Now(), Payload: []byte(payload), Direction: DirIncoming}
+	if !request {
+		pckt.SrcIP, pckt.DstIP, pckt.SrcPort, pckt.DstPort = pckt.DstIP, pckt.SrcIP, pckt.DstPort, pckt.SrcPort
+		pckt.Direction = DirOutcoming
+	}
+	return pckt
+}
+
+func newHTTPParser(expire time.Duration, allowIncomplete bool) *MessageParser {
+	parser := NewMessageParser(nil, nil, nil, expire, allowIncomplete)
+	parser.Start = func(pckt *Packet) (bool, bool) {
+		return proto.HasRequestTitle(pckt.Payload), proto.HasResponseTitle(pckt.Payload)
+	}
+	parser.End = func(m *Message) bool {
+		return !m.MissingChunk() && proto.HasFullPayload(m, m.PacketData()...)
+	}
+	return parser
+}
+
+func readMessage(t *testing.T, parser *MessageParser) *Message {
+	select {
+	case m := <-parser.messages:
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("message is not emitted")
+	}
+	return nil
+}
+
+func TestStreamOverlappingRetransmission(t *testing.T) {
+	parser := newHTTPParser(time.Minute, false)
+	closed := make(chan ConnectionStats, 1)
+	parser.ConnectionClosed = func(stats ConnectionStats) { closed <- stats }
+
+	request := "POST /a HTTP/1.1\r\nContent-Length: 30\r\n\r\n012345678901234567890123456789"
+	packets := []*Packet{
+		streamPacket(true, 1, 100, request[:45]),
+		streamPacket(true, 61, 100, request[60:]),
+		// retransmission with different segmentation and the updated acknowledgment
+		streamPacket(true, 41, 150, request[40:65]),
+		streamPacket(true, 1, 150, request[:10]),
+	}
+	for _, p := range packets {
+		parser.processPacket(p)
+	}
+	m := readMessage(t, parser)
+	if string(m.Data()) != request {
+		t.Errorf("wrong message %q", m.Data())
+	}
+
+	fin := streamPacket(true, 71, 100, "")
+	fin.FIN = true
+	parser.processPacket(fin)
+	fin = streamPacket(false, 100, 71, "")
+	fin.FIN = true
+	parser.processPacket(fin)
+
+	stats := <-closed
+	if stats.Packets != 6 || stats.Bytes != len(request) || stats.Retransmitted != 2 || stats.RetransmittedBytes != 20 {
+		t.Errorf("wrong stats %+v", stats)
+	}
+	if stats.OutOfOrder != 2 || stats.LostBytes != 0 {
+		t.Errorf("wrong stats %+v", stats)
+	}
+}
+
+func TestStreamSeqWraparound(t *testing.T) {
+	parser := newHTTPParser(time.Minute, false)
+	request := "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	start := uint32(0xffffffe8)
+	// the middle part crosses the wrap around and is captured the last
+	parser.processPacket(streamPacket(true, start, 1, request[:20]))
+	parser.processPacket(streamPacket(true, start+28, 1, request[28:]))
+	parser.processPacket(streamPacket(true, start+20, 1, request[20:28]))
+
+	m := readMessage(t, parser)
+	if string(m.Data()) != request {
+		t.Errorf("wrong message %q", m.Data())
+	}
+}
+
+func TestStreamFinEmitsMessage(t *testing.T) {
+	parser := newHTTPParser(time.Minute, false)
+	closed := make(chan ConnectionStats, 1)
+	parser.ConnectionClosed = func(stats ConnectionStats) { closed <- stats }
+
+	syn := streamPacket(false, 999, 0, "")
+	syn.SYN, syn.ACK = true, false
+	parser.processPacket(syn)
+
+	// HTTP/1.0 response without Content-Length ends with the connection
+	response := "HTTP/1.0 200 OK\r\n\r\nbody"
+	parser.processPacket(streamPacket(false, 1000, 1, response[:10]))
+	parser.processPacket(streamPacket(false, 1010, 1, response[10:]))
+	select {
+	case m := <-parser.messages:
+		t.Fatalf("message should not be complete before FIN %q", m.Data())
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	fin := streamPacket(false, 1000+uint32(len(response)), 1, "")
+	fin.FIN = true
+	parser.processPacket(fin)
+	if m := readMessage(t, parser); string(m.Data()) != response {
+		t.Errorf("wrong message %q", m.Data())
+	}
+
+	rst := streamPacket(true, 1, 0, "")
+	rst.RST = true
+	parser.processPacket(rst)
+	if stats := <-closed; !stats.Reset || stats.LostBytes != 0 {
+		t.Errorf("wrong stats %+v", stats)
+	}
+}
+
+func TestStreamLossStats(t *testing.T) {
+	parser := newHTTPParser(time.Minute, true)
+	closed := make(chan ConnectionStats, 1)
+	parser.ConnectionClosed = func(stats ConnectionStats) { closed <- stats }
+
+	syn := streamPacket(true, 0, 0, "")
+	syn.SYN, syn.ACK = true, false
+	parser.processPacket(syn)
+
+	// the receiver advertises 20 bytes window
+	ack := streamPacket(false, 1000, 1, "")
+	ack.Window = 20
+	parser.processPacket(ack)
+
+	request := "POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\n0123456789"
+	parser.processPacket(streamPacket(true, 1, 1000, request[:10]))
+	parser.processPacket(streamPacket(true, 21, 1000, request[20:30]))
+	parser.processPacket(streamPacket(true, 41, 1000, request[40:]))
+
+	rst := streamPacket(true, 51, 1000, "")
+	rst.RST = true
+	parser.processPacket(rst)
+
+	if m := readMessage(t, parser); !bytes.HasPrefix(m.Data(), []byte("POST / ")) || !m.MissingChunk() {
+		t.Errorf("incomplete message should be emitted on reset %q", m.Data())
+	}
+	stats := <-closed
+	if stats.LostBytes != 20 || stats.OutOfOrder != 2 || stats.OutOfWindow != 2 || !stats.Reset {
+		t.Errorf("wrong stats %+v", stats)
+	}
+}
+
+func TestPacketWindowScale(t *testing.T) {
+	data := append(generateHeader(true, 1, 0), []byte{}...)
+	tcp := data[4+24:]
+	tcp[13] = 0x02 // SYN
+	binary.BigEndian.PutUint16(tcp[14:], 1024)
+	copy(tcp[20:], []byte{1, 3, 3, 7})
+
+	pckt, err := ParsePacket(data, int(layers.LinkTypeLoop), 4, &gopacket.CaptureInfo{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pckt.SYN || pckt.Window != 1024 || !pckt.HasWindowScale || pckt.WindowScale != 7 {
+		t.Errorf("wrong packet %+v", pckt)
+	}
+
+	// without options the same bytes are payload
+	tcp[12] = 5 << 4
+	pckt, err = ParsePacket(data, int(layers.LinkTypeLoop), 4, &gopacket.CaptureInfo{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pckt.HasWindowScale || !bytes.Equal(pckt.Payload, []byte{1, 3, 3, 7}) {
+		t.Errorf("payload should not be parsed as options %+v", pckt)
+	}
+}
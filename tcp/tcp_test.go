@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 
 	// "runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -44,15 +45,17 @@ func generateHeader(request bool, seq uint32, length uint16) []byte {
 func GetPackets(request bool, start uint32, _len int, payload []byte) []*Packet {
 	var packets = make([]*Packet, _len)
 	var err error
-	for i := start; i < start+uint32(_len); i++ {
-		d := append(generateHeader(request, i, uint16(len(payload))), payload...)
+	for i := 0; i < _len; i++ {
+		// sequence number is advanced by the payload size
+		seq := start + uint32(i*len(payload))
+		d := append(generateHeader(request, seq, uint16(len(payload))), payload...)
 		ci := &gopacket.CaptureInfo{Length: len(d), CaptureLength: len(d), Timestamp: time.Now()}
 
-		packets[i-start], err = ParsePacket(d, int(layers.LinkTypeLoop), 4, ci, true)
+		packets[i], err = ParsePacket(d, int(layers.LinkTypeLoop), 4, ci, true)
 		if request {
-			packets[i-start].Direction = DirIncoming
+			packets[i].Direction = DirIncoming
 		} else {
-			packets[i-start].Direction = DirOutcoming
+			packets[i].Direction = DirOutcoming
 		}
 		if err != nil {
 			panic(err)
@@ -120,14 +123,14 @@ func TestMessageParserWithHint(t *testing.T) {
 	packets := []*Packet{
 		// Seq of first response packet match Ack of first request packet
 		{SrcPort: 80, DstPort: 60000, Ack: 1, Seq: 1, Direction: DirOutcoming, Timestamp: time.Unix(1, 0), Payload: []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n7\r\n")},
-		{SrcPort: 80, DstPort: 60000, Ack: 1, Seq: 18, Direction: DirOutcoming, Timestamp: time.Unix(2, 0), Payload: []byte("\r\nMozilla\r\n9\r\nDeveloper\r")},
-		{SrcPort: 80, DstPort: 60000, Ack: 1, Seq: 42, Direction: DirOutcoming, Timestamp: time.Unix(3, 0), Payload: []byte("\n7\r\nNetwork\r\n0\r\n\r\n")},
+		{SrcPort: 80, DstPort: 60000, Ack: 1, Seq: 77, Direction: DirOutcoming, Timestamp: time.Unix(2, 0), Payload: []byte("\r\nMozilla\r\n9\r\nDeveloper\r")},
+		{SrcPort: 80, DstPort: 60000, Ack: 1, Seq: 101, Direction: DirOutcoming, Timestamp: time.Unix(3, 0), Payload: []byte("\n7\r\nNetwork\r\n0\r\n\r\n")},
 
-		{SrcPort: 60000, DstPort: 80, Ack: 60, Seq: 1, Direction: DirIncoming, Timestamp: time.Unix(4, 0), Payload: []byte("POST / HTTP/1.1\r\nContent-Type: text/plain\r\nContent-Length: 23\r\n\r\n")},
-		{SrcPort: 60000, DstPort: 80, Ack: 60, Seq: 66, Direction: DirIncoming, Timestamp: time.Unix(5, 0), Payload: []byte("MozillaDeveloper")},
-		{SrcPort: 60000, DstPort: 80, Ack: 60, Seq: 82, Direction: DirIncoming, Timestamp: time.Unix(6, 0), Payload: []byte("Network")},
+		{SrcPort: 60000, DstPort: 80, Ack: 119, Seq: 1, Direction: DirIncoming, Timestamp: time.Unix(4, 0), Payload: []byte("POST / HTTP/1.1\r\nContent-Type: text/plain\r\nContent-Length: 23\r\n\r\n")},
+		{SrcPort: 60000, DstPort: 80, Ack: 119, Seq: 66, Direction: DirIncoming, Timestamp: time.Unix(5, 0), Payload: []byte("MozillaDeveloper")},
+		{SrcPort: 60000, DstPort: 80, Ack: 119, Seq: 82, Direction: DirIncoming, Timestamp: time.Unix(6, 0), Payload: []byte("Network")},
 
-		{SrcPort: 80, DstPort: 60000, Ack: 89, Seq: 1, Direction: DirOutcoming, Timestamp: time.Unix(7, 0), Payload: []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 0\r\n\r\n")},
+		{SrcPort: 80, DstPort: 60000, Ack: 89, Seq: 119, Direction: DirOutcoming, Timestamp: time.Unix(7, 0), Payload: []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 0\r\n\r\n")},
 	}
 
 	for _, p := range packets {
@@ -163,15 +166,15 @@ func TestMessageParserWrongOrder(t *testing.T) {
 	}
 	packets := []*Packet{
 		// Seq of first response packet match Ack of first request packet
-		{SrcPort: 60000, DstPort: 80, Ack: 60, Seq: 66, Direction: DirIncoming, Timestamp: time.Unix(5, 0), Payload: []byte("MozillaDeveloper")},
+		{SrcPort: 60000, DstPort: 80, Ack: 119, Seq: 66, Direction: DirIncoming, Timestamp: time.Unix(5, 0), Payload: []byte("MozillaDeveloper")},
 		{SrcPort: 80, DstPort: 60000, Ack: 1, Seq: 1, Direction: DirOutcoming, Timestamp: time.Unix(1, 0), Payload: []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n7\r\n")},
-		{SrcPort: 80, DstPort: 60000, Ack: 1, Seq: 42, Direction: DirOutcoming, Timestamp: time.Unix(3, 0), Payload: []byte("\n7\r\nNetwork\r\n0\r\n\r\n")},
+		{SrcPort: 80, DstPort: 60000, Ack: 1, Seq: 101, Direction: DirOutcoming, Timestamp: time.Unix(3, 0), Payload: []byte("\n7\r\nNetwork\r\n0\r\n\r\n")},
 
-		{SrcPort: 60000, DstPort: 80, Ack: 60, Seq: 1, Direction: DirIncoming, Timestamp: time.Unix(4, 0), Payload: []byte("POST / HTTP/1.1\r\nContent-Type: text/plain\r\nContent-Length: 23\r\n\r\n")},
-		{SrcPort: 80, DstPort: 60000, Ack: 1, Seq: 18, Direction: DirOutcoming, Timestamp: time.Unix(2, 0), Payload: []byte("\r\nMozilla\r\n9\r\nDeveloper\r")},
+		{SrcPort: 60000, DstPort: 80, Ack: 119, Seq: 1, Direction: DirIncoming, Timestamp: time.Unix(4, 0), Payload: []byte("POST / HTTP/1.1\r\nContent-Type: text/plain\r\nContent-Length: 23\r\n\r\n")},
+		{SrcPort: 80, DstPort: 60000, Ack: 1, Seq: 77, Direction: DirOutcoming, Timestamp: time.Unix(2, 0), Payload: []byte("\r\nMozilla\r\n9\r\nDeveloper\r")},
 
-		{SrcPort: 80, DstPort: 60000, Ack: 89, Seq: 1, Direction: DirOutcoming, Timestamp: time.Unix(7, 0), Payload: []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 0\r\n\r\n")},
-		{SrcPort: 60000, DstPort: 80, Ack: 60, Seq: 82, Direction: DirIncoming, Timestamp: time.Unix(6, 0), Payload: []byte("Network")},
+		{SrcPort: 80, DstPort: 60000, Ack: 89, Seq: 119, Direction: DirOutcoming, Timestamp: time.Unix(7, 0), Payload: []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 0\r\n\r\n")},
+		{SrcPort: 60000, DstPort: 80, Ack: 119, Seq: 82, Direction: DirIncoming, Timestamp: time.Unix(6, 0), Payload: []byte("Network")},
 	}
 
 	for _, p := range packets {
@@ -197,6 +200,143 @@ func TestMessageParserWrongOrder(t *testing.T) {
 	}
 }
 
+func TestMessageParserPipelining(t *testing.T) {
+	parser := NewMessageParser(nil, nil, nil, time.Second, false)
+	parser.Start = func(pckt *Packet) (bool, bool) {
+		return proto.HasRequestTitle(pckt.Payload), proto.HasResponseTitle(pckt.Payload)
+	}
+	parser.End = func(m *Message) bool {
+		return proto.HasFullPayload(m, m.PacketData()...)
+	}
+	parser.Split = func(m *Message) int {
+		return proto.MessageLength(m, m.PacketData()...)
+	}
+
+	requests := []string{
+		"GET /1 HTTP/1.1\r\n\r\n",
+		"POST /2 HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello",
+		"GET /3 HTTP/1.1\r\n\r\n",
+	}
+	responses := []string{
+		"HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\n1",
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n1\r\n2\r\n0\r\n\r\n",
+		"HTTP/1.1 204 No Content\r\n\r\n",
+	}
+	request := strings.Join(requests, "")
+	response := strings.Join(responses, "")
+	ack := 1 + uint32(len(request))
+	packets := []*Packet{
+		// the second request is split between packets
+		{SrcPort: 60000, DstPort: 80, Ack: 100, Seq: 1, Timestamp: time.Unix(1, 0), Payload: []byte(request[:30])},
+		{SrcPort: 60000, DstPort: 80, Ack: 100, Seq: 31, Timestamp: time.Unix(2, 0), Payload: []byte(request[30:])},
+		{SrcPort: 80, DstPort: 60000, Ack: ack, Seq: 100, Timestamp: time.Unix(3, 0), Payload: []byte(response)},
+	}
+	for _, p := range packets {
+		parser.processPacket(p)
+	}
+
+	var ids [][]byte
+	for i, expected := range append(requests, responses...) {
+		m := parser.Read()
+		if string(m.Data()) != expected {
+			t.Errorf("expected %q to equal %q", m.Data(), expected)
+		}
+		if i < len(requests) {
+			for _, id := range ids {
+				if bytes.Equal(id, m.UUID()) {
+					t.Errorf("pipelined requests should have different ids %s", id)
+				}
+			}
+			ids = append(ids, m.UUID())
+		} else if id := ids[i-len(requests)]; !bytes.Equal(id, m.UUID()) {
+			t.Errorf("response %d should have id of the request %s, got %s", i-len(requests), id, m.UUID())
+		}
+	}
+}
+
+func TestMessageParserUpgrade(t *testing.T) {
+	parser := newHTTPParser(time.Second, false)
+	parser.Split = func(m *Message) int {
+		return proto.MessageLength(m, m.PacketData()...)
+	}
+	parser.Upgrade = func(m *Message) bool {
+		return m.Direction == DirOutcoming && proto.IsWebSocketUpgrade(m.Data())
+	}
+	parser.Frame = func(m *Message) int {
+		return proto.WebSocketFrameLength(m.PacketData()...)
+	}
+
+	key := []byte("abcd")
+	request := "GET /ws HTTP/1.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"
+	response := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"
+	hello := (&proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketText, Payload: []byte("hello")}).Encode(nil)
+	ping := (&proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketText, Payload: []byte("ping")}).Encode(key)
+	pong := (&proto.WebSocketFrame{Fin: true, Opcode: proto.WebSocketBinary, Payload: []byte("pong")}).Encode(key)
+
+	ack := 1 + uint32(len(request))
+	seq := 100 + uint32(len(response)+len(hello))
+	// the server sends the first frame with the response, and the client sends two frames in one packet
+	parser.processPacket(streamPacket(true, 1, 100, request))
+	parser.processPacket(streamPacket(false, 100, ack, response+string(hello)))
+	parser.processPacket(streamPacket(true, ack, seq, string(ping)+string(pong)))
+
+	expected := []string{request, response, string(hello), string(ping), string(pong)}
+	var id []byte
+	for i, data := range expected {
+		m := readMessage(t, parser)
+		if string(m.Data()) != data {
+			t.Errorf("expected %q to equal %q", m.Data(), data)
+		}
+		if m.Upgraded != (i > 1) {
+			t.Errorf("message %d upgraded: %v", i, m.Upgraded)
+		}
+		if i == 0 {
+			id = m.UUID()
+		} else if !bytes.Equal(id, m.UUID()) {
+			t.Errorf("message %d should have id of the upgrade request %s, got %s", i, id, m.UUID())
+		}
+	}
+}
+
+func TestMessageParserPortHints(t *testing.T) {
+	packets := []*Packet{
+		{SrcPort: 60000, DstPort: 9000, Ack: 1, Seq: 1, Timestamp: time.Now(), Payload: []byte("binary")},
+		{SrcPort: 60001, DstPort: 80, Ack: 1, Seq: 1, Timestamp: time.Now(), Payload: []byte("GET / HTTP/1.1\r\n\r\n")},
+		{SrcPort: 60002, DstPort: 6379, Ack: 1, Seq: 1, Timestamp: time.Now(), Payload: []byte("PING\r\nPING\r\n")},
+	}
+
+	parser := NewMessageParser(nil, nil, nil, 100*time.Millisecond, false)
+	parser.Start = func(pckt *Packet) (bool, bool) {
+		return proto.HasRequestTitle(pckt.Payload), proto.HasResponseTitle(pckt.Payload)
+	}
+	parser.End = func(m *Message) bool {
+		return proto.HasFullPayload(m, m.PacketData()...)
+	}
+	// messages of 9000 port have no hints, they are emitted when they expire
+	parser.PortHints = map[uint16]*Hints{
+		9000: {},
+		6379: {
+			Start: func(pckt *Packet) (bool, bool) { return pckt.DstPort == 6379, pckt.SrcPort == 6379 },
+			End:   func(m *Message) bool { return proto.RESPLength(m.PacketData()...) == m.Length },
+			Split: func(m *Message) int { return proto.RESPLength(m.PacketData()...) },
+		},
+	}
+	for _, packet := range packets {
+		parser.processPacket(packet)
+	}
+
+	for _, expected := range []string{"GET / HTTP/1.1\r\n\r\n", "PING\r\n", "PING\r\n", "binary"} {
+		m := parser.Read()
+		if string(m.Data()) != expected {
+			t.Errorf("expected %q to equal %q", m.Data(), expected)
+		}
+		// without Start hint, the direction is known by the ports of the parser
+		if m.Direction != DirIncoming && expected != "binary" {
+			t.Errorf("message %q should be a request", m.Data())
+		}
+	}
+}
+
 func TestMessageParserWithoutHint(t *testing.T) {
 	var data [63 << 10]byte
 	packets := GetPackets(true, 1, 10, data[:])
@@ -228,8 +368,20 @@ func TestMessageTimeoutReached(t *testing.T) {
 	}
 }
 
+// nextSeq moves packets forward in the stream, so they are not dropped as retransmissions
+func nextSeq(packets []*Packet) {
+	var n uint32
+	for _, p := range packets {
+		n += uint32(len(p.Payload))
+	}
+	for _, p := range packets {
+		p.Seq += n
+		p.messageID = 0
+	}
+}
+
 func BenchmarkMessageUUID(b *testing.B) {
-	packets := GetPackets(true, 1, 5, nil)
+	packets := GetPackets(true, 1, 5, []byte("1111"))
 
 	var uuid []byte
 	parser := NewMessageParser(nil, nil, nil, 10*time.Millisecond, true)
@@ -269,6 +421,7 @@ func BenchmarkMessageParserWithoutHint(b *testing.B) {
 			p.processPacket(v)
 		}
 		p.Read()
+		nextSeq(packets)
 	}
 }
 
@@ -281,8 +434,10 @@ func BenchmarkMessageParserWithHint(b *testing.B) {
 	}
 	buf[1001] = []byte("0\r\n\r\n")
 	packets := make([]*Packet, len(buf))
+	seq := uint32(1)
 	for i := 0; i < len(buf); i++ {
-		packets[i] = GetPackets(false, 1, 1, buf[i])[0]
+		packets[i] = GetPackets(false, seq, 1, buf[i])[0]
+		seq += uint32(len(buf[i]))
 	}
 
 	parser := NewMessageParser(nil, nil, nil, 2*time.Second, false)
@@ -300,6 +455,7 @@ func BenchmarkMessageParserWithHint(b *testing.B) {
 			parser.processPacket(packets[j])
 		}
 		parser.Read()
+		nextSeq(packets)
 	}
 }
 
@@ -0,0 +1,430 @@
+package tcp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// TLS record content types
+const (
+	tlsChangeCipherSpec = 20
+	tlsHandshake        = 22
+	tlsApplicationData  = 23
+)
+
+// TLS handshake message types
+const (
+	tlsClientHello = 1
+	tlsServerHello = 2
+	tlsKeyUpdate   = 24
+)
+
+const (
+	tlsRecordHeaderLen = 5
+	tlsMaxRecordLen    = 16384 + 2048 // maximum length of record payload
+	tlsMaxQueued       = 64           // encrypted records kept per direction while waiting for the keys
+	tlsMaxFuture       = 1 << 20      // out of order data kept per direction
+	tlsConnExpire      = 5 * time.Minute
+)
+
+// random of ServerHello which is HelloRetryRequest, RFC 8446 section 4.1.3
+var tlsHelloRetryRequest = sha256.Sum256([]byte("HelloRetryRequest"))
+
+// TLSDecryptor decrypts TLS 1.2 and TLS 1.3 connections using secrets from the key log.
+// Decrypted application data is returned in packets with the headers of the original packets,
+// sequence and acknowledgment numbers are rewritten to count plaintext bytes, so
+// the decrypted stream can be parsed by MessageParser as the plaintext traffic.
+// Packets of connections which do not start with TLS handshake are returned as is.
+type TLSDecryptor struct {
+	sync.Mutex
+	keyLog    *TLSKeyLog
+	conns     map[connID]*tlsConn
+	lastSweep time.Time
+}
+
+// NewTLSDecryptor returns TLS decryptor which uses secrets from the key log
+func NewTLSDecryptor(keyLog *TLSKeyLog) *TLSDecryptor {
+	return &TLSDecryptor{keyLog: keyLog, conns: make(map[connID]*tlsConn)}
+}
+
+type tlsConn struct {
+	clientFirst  bool // client has the first endpoint of the connection id
+	version      uint16
+	suite        *tlsCipherSuite
+	etm          bool
+	clientRandom []byte
+	serverRandom []byte
+	streams      [2]tlsStream // client and server streams
+	fin          [2]bool
+	last         time.Time
+}
+
+// tlsStream is one direction of the connection
+type tlsStream struct {
+	seq    uint32            // next expected TCP sequence number
+	future map[uint32][]byte // data received ahead of the expected sequence number
+	buf    []byte            // data of incomplete record
+
+	encrypted bool
+	cipher    *tlsRecordCipher
+	secret    []byte // TLS 1.3 traffic secret of the cipher
+	handshake bool   // TLS 1.3 cipher uses handshake traffic secret
+	queued    [][]byte
+
+	plaintext []byte // decrypted application data which is not returned yet
+	plainSeq  uint32 // sequence number of decrypted data, counts decrypted bytes
+	template  Packet // the last packet, decrypted packets have its headers
+}
+
+// Decrypt returns packets with decrypted application data of the packet. Packet of TLS connection
+// can produce no decrypted packets, for example when it has only a part of the record.
+func (d *TLSDecryptor) Decrypt(pckt *Packet) []*Packet {
+	d.Lock()
+	defer d.Unlock()
+
+	d.sweep(pckt.Timestamp)
+
+	id, fromFirst := newConnID(pckt)
+	c, ok := d.conns[id]
+	if !ok {
+		if !isClientHello(pckt.Payload) {
+			// handshake of the connection is not captured
+			if isTLSRecord(pckt.Payload) {
+				stats.Add("tls_unknown_connection", 1)
+				return nil
+			}
+			return []*Packet{pckt}
+		}
+		c = &tlsConn{clientFirst: fromFirst}
+		// the first server byte is acknowledged by the client
+		c.streams[0].seq, c.streams[1].seq = pckt.Seq, pckt.Ack
+		c.streams[0].plainSeq, c.streams[1].plainSeq = pckt.Seq, pckt.Ack
+		d.conns[id] = c
+		stats.Add("tls_connections", 1)
+	}
+	c.last = pckt.Timestamp
+
+	dir := 0
+	if fromFirst != c.clientFirst {
+		dir = 1
+	}
+	s, peer := &c.streams[dir], &c.streams[1-dir]
+	s.template = *pckt
+	s.template.Payload = nil
+
+	for _, data := range s.reassemble(pckt.Seq, pckt.Payload) {
+		s.buf = append(s.buf, data...)
+		d.records(c, dir)
+	}
+	// records of the peer could wait for the keys which are logged now
+	if len(peer.queued) > 0 && d.setCipher(c, 1-dir) {
+		d.flush(c, 1-dir)
+	}
+
+	if pckt.RST {
+		delete(d.conns, id)
+	} else if pckt.FIN {
+		c.fin[dir] = true
+		if c.fin[1-dir] {
+			delete(d.conns, id)
+		}
+	}
+
+	var decrypted []*Packet
+	for _, i := range []int{1 - dir, dir} {
+		if p := c.decrypted(i); p != nil {
+			decrypted = append(decrypted, p)
+		}
+	}
+	// control packets are passed with the sequence numbers of decrypted streams
+	if len(pckt.Payload) == 0 || pckt.FIN || pckt.RST {
+		control := *pckt
+		control.messageID = 0
+		control.Payload = nil
+		control.Seq, control.Ack = s.plainSeq, peer.plainSeq
+		decrypted = append(decrypted, &control)
+	}
+	return decrypted
+}
+
+// decrypted returns packet with the decrypted data of the stream, or nil if there is no data
+func (c *tlsConn) decrypted(dir int) *Packet {
+	s, peer := &c.streams[dir], &c.streams[1-dir]
+	if len(s.plaintext) == 0 {
+		return nil
+	}
+	pckt := s.template
+	pckt.SYN, pckt.FIN, pckt.RST = false, false, false
+	pckt.Payload = s.plaintext
+	pckt.Seq = s.plainSeq
+	pckt.Ack = peer.plainSeq
+	s.plainSeq += uint32(len(s.plaintext))
+	s.plaintext = nil
+	return &pckt
+}
+
+// sweep removes connections which have not seen packets for a long time
+func (d *TLSDecryptor) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < time.Minute {
+		return
+	}
+	d.lastSweep = now
+	for id, c := range d.conns {
+		if now.Sub(c.last) > tlsConnExpire {
+			delete(d.conns, id)
+		}
+	}
+}
+
+func isTLSRecord(payload []byte) bool {
+	return len(payload) >= tlsRecordHeaderLen && payload[0] >= tlsChangeCipherSpec && payload[0] <= tlsApplicationData &&
+		payload[1] == 3 && payload[2] <= 4
+}
+
+func isClientHello(payload []byte) bool {
+	return len(payload) > tlsRecordHeaderLen && payload[0] == tlsHandshake && payload[1] == 3 &&
+		payload[tlsRecordHeaderLen] == tlsClientHello
+}
+
+// reassemble returns in order data of the segment, including buffered segments which follow it
+func (s *tlsStream) reassemble(seq uint32, payload []byte) (data [][]byte) {
+	if len(payload) == 0 {
+		return
+	}
+	// retransmission, or overlapping segment
+	if diff := int32(s.seq - seq); diff > 0 {
+		if int(diff) >= len(payload) {
+			return
+		}
+		payload, seq = payload[diff:], s.seq
+	}
+	if seq != s.seq {
+		if s.future == nil {
+			s.future = make(map[uint32][]byte)
+		}
+		size := 0
+		for _, p := range s.future {
+			size += len(p)
+		}
+		if size+len(payload) <= tlsMaxFuture {
+			s.future[seq] = append([]byte(nil), payload...)
+		}
+		return
+	}
+	for {
+		data = append(data, payload)
+		s.seq += uint32(len(payload))
+		next, ok := s.future[s.seq]
+		if !ok {
+			return
+		}
+		delete(s.future, s.seq)
+		payload = next
+	}
+}
+
+// records processes complete records of the stream buffer
+func (d *TLSDecryptor) records(c *tlsConn, dir int) {
+	s := &c.streams[dir]
+	for len(s.buf) >= tlsRecordHeaderLen {
+		length := int(binary.BigEndian.Uint16(s.buf[3:5]))
+		if s.buf[1] != 3 || length > tlsMaxRecordLen {
+			// lost synchronization with the record layer
+			stats.Add("tls_record_error", 1)
+			s.buf = nil
+			return
+		}
+		if len(s.buf) < tlsRecordHeaderLen+length {
+			break
+		}
+		record := s.buf[:tlsRecordHeaderLen+length]
+		s.buf = s.buf[tlsRecordHeaderLen+length:]
+		d.record(c, dir, record)
+	}
+	// do not keep a reference to the processed data
+	s.buf = append([]byte(nil), s.buf...)
+}
+
+func (d *TLSDecryptor) record(c *tlsConn, dir int, record []byte) {
+	s := &c.streams[dir]
+	contentType := record[0]
+
+	if !s.encrypted {
+		switch contentType {
+		case tlsHandshake:
+			c.handshake(record[tlsRecordHeaderLen:])
+		case tlsChangeCipherSpec:
+			// TLS 1.3 sends it only for compatibility
+			if c.version != 0 && c.version < 0x0304 {
+				s.encrypted = true
+			}
+		}
+		return
+	}
+	if contentType == tlsChangeCipherSpec {
+		return
+	}
+
+	if s.cipher == nil && !d.setCipher(c, dir) {
+		if len(s.queued) < tlsMaxQueued {
+			s.queued = append(s.queued, append([]byte(nil), record...))
+		} else {
+			stats.Add("tls_no_keys", 1)
+		}
+		return
+	}
+	d.flush(c, dir)
+	d.decryptRecord(c, dir, record)
+}
+
+// flush decrypts records which waited for the keys
+func (d *TLSDecryptor) flush(c *tlsConn, dir int) {
+	s := &c.streams[dir]
+	for _, record := range s.queued {
+		d.decryptRecord(c, dir, record)
+	}
+	s.queued = nil
+}
+
+func (d *TLSDecryptor) decryptRecord(c *tlsConn, dir int, record []byte) {
+	s := &c.streams[dir]
+	contentType, data, err := s.cipher.decrypt(record[:tlsRecordHeaderLen], record[tlsRecordHeaderLen:])
+	// TLS 1.3 switches from handshake to application traffic keys after Finished message
+	if err != nil && s.handshake {
+		label := keyLogClientApplicationSecret0
+		if dir == 1 {
+			label = keyLogServerApplicationSecret0
+		}
+		if secret := d.keyLog.Secret(label, c.clientRandom); secret != nil {
+			if next, e := newTLS13Cipher(c.suite, secret); e == nil {
+				if contentType, data, err = next.decrypt(record[:tlsRecordHeaderLen], record[tlsRecordHeaderLen:]); err == nil {
+					s.cipher, s.secret, s.handshake = next, secret, false
+				}
+			}
+		}
+	}
+	if err != nil {
+		stats.Add("tls_decrypt_error", 1)
+		return
+	}
+
+	switch contentType {
+	case tlsApplicationData:
+		s.plaintext = append(s.plaintext, data...)
+	case tlsHandshake:
+		if s.cipher.tls13 && len(data) > 0 && data[0] == tlsKeyUpdate {
+			s.secret = nextTLS13Secret(c.suite, s.secret)
+			if next, e := newTLS13Cipher(c.suite, s.secret); e == nil {
+				s.cipher = next
+			}
+		}
+	}
+}
+
+// setCipher sets the cipher of the stream using secrets from the key log
+func (d *TLSDecryptor) setCipher(c *tlsConn, dir int) bool {
+	s := &c.streams[dir]
+	if c.suite == nil || !s.encrypted {
+		return false
+	}
+	if c.version == 0x0304 {
+		label := keyLogClientHandshakeSecret
+		if dir == 1 {
+			label = keyLogServerHandshakeSecret
+		}
+		secret := d.keyLog.Secret(label, c.clientRandom)
+		if secret == nil {
+			return false
+		}
+		cipher, err := newTLS13Cipher(c.suite, secret)
+		if err != nil {
+			return false
+		}
+		s.cipher, s.secret, s.handshake = cipher, secret, true
+		return true
+	}
+
+	masterSecret := d.keyLog.Secret(keyLogClientRandom, c.clientRandom)
+	if masterSecret == nil {
+		return false
+	}
+	client, server, err := newTLS12Ciphers(c.suite, masterSecret, c.clientRandom, c.serverRandom, c.etm)
+	if err != nil {
+		return false
+	}
+	s.cipher = client
+	if dir == 1 {
+		s.cipher = server
+	}
+	return true
+}
+
+// handshake parses plaintext handshake messages of the record
+func (c *tlsConn) handshake(data []byte) {
+	for len(data) >= 4 {
+		length := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+		if len(data) < 4+length {
+			return
+		}
+		body := data[4 : 4+length]
+		switch data[0] {
+		case tlsClientHello:
+			if len(body) >= 34 {
+				c.clientRandom = append([]byte(nil), body[2:34]...)
+			}
+		case tlsServerHello:
+			c.serverHello(body)
+		}
+		data = data[4+length:]
+	}
+}
+
+// serverHello sets the negotiated version and cipher suite
+func (c *tlsConn) serverHello(body []byte) {
+	// version, random, session id
+	if len(body) < 35 || len(body) < 35+int(body[34])+3 {
+		return
+	}
+	random := body[2:34]
+	if bytes.Equal(random, tlsHelloRetryRequest[:]) {
+		return
+	}
+	c.serverRandom = append([]byte(nil), random...)
+	c.version = binary.BigEndian.Uint16(body[:2])
+	body = body[35+int(body[34]):]
+	c.suite = tlsCipherSuites[binary.BigEndian.Uint16(body[:2])]
+	if c.suite == nil {
+		stats.Add("tls_unsupported_cipher", 1)
+	}
+
+	// compression method and extensions
+	body = body[3:]
+	if len(body) < 2 {
+		return
+	}
+	body = body[2:]
+	for len(body) >= 4 {
+		typ := binary.BigEndian.Uint16(body[:2])
+		length := int(binary.BigEndian.Uint16(body[2:4]))
+		if len(body) < 4+length {
+			return
+		}
+		ext := body[4 : 4+length]
+		switch {
+		case typ == 43 && length == 2: // supported_versions
+			c.version = binary.BigEndian.Uint16(ext)
+		case typ == 22: // encrypt_then_mac
+			c.etm = true
+		}
+		body = body[4+length:]
+	}
+
+	if c.version == 0x0304 {
+		// all records after ServerHello are encrypted
+		c.streams[0].encrypted = true
+		c.streams[1].encrypted = true
+	}
+}
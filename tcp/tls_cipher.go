@@ -0,0 +1,252 @@
+package tcp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"hash"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+var errTLSDecrypt = errors.New("tls: record decryption failed")
+
+// tlsCipherSuite describes how records of a cipher suite are protected
+type tlsCipherSuite struct {
+	keyLen int
+	ivLen  int              // length of the implicit part of the nonce
+	macLen int              // length of HMAC in CBC suites
+	hash   func() hash.Hash // hash of PRF in TLS 1.2 or HKDF in TLS 1.3
+	mac    func() hash.Hash // HMAC of CBC suites
+	aead   func(key []byte) (cipher.AEAD, error)
+}
+
+func aesGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// tlsCipherSuites lists supported suites: AEAD and AES-CBC suites of TLS 1.2, and all suites of TLS 1.3
+var tlsCipherSuites = map[uint16]*tlsCipherSuite{
+	// TLS 1.2 AES-GCM
+	0x009c: {keyLen: 16, ivLen: 4, hash: sha256.New, aead: aesGCM},
+	0x009d: {keyLen: 32, ivLen: 4, hash: sha512.New384, aead: aesGCM},
+	0x009e: {keyLen: 16, ivLen: 4, hash: sha256.New, aead: aesGCM},
+	0x009f: {keyLen: 32, ivLen: 4, hash: sha512.New384, aead: aesGCM},
+	0xc02b: {keyLen: 16, ivLen: 4, hash: sha256.New, aead: aesGCM},
+	0xc02c: {keyLen: 32, ivLen: 4, hash: sha512.New384, aead: aesGCM},
+	0xc02f: {keyLen: 16, ivLen: 4, hash: sha256.New, aead: aesGCM},
+	0xc030: {keyLen: 32, ivLen: 4, hash: sha512.New384, aead: aesGCM},
+	// TLS 1.2 ChaCha20-Poly1305
+	0xcca8: {keyLen: 32, ivLen: 12, hash: sha256.New, aead: chacha20poly1305.New},
+	0xcca9: {keyLen: 32, ivLen: 12, hash: sha256.New, aead: chacha20poly1305.New},
+	0xccaa: {keyLen: 32, ivLen: 12, hash: sha256.New, aead: chacha20poly1305.New},
+	// TLS 1.2 AES-CBC
+	0x002f: {keyLen: 16, macLen: 20, hash: sha256.New, mac: sha1.New},
+	0x0035: {keyLen: 32, macLen: 20, hash: sha256.New, mac: sha1.New},
+	0x003c: {keyLen: 16, macLen: 32, hash: sha256.New, mac: sha256.New},
+	0x003d: {keyLen: 32, macLen: 32, hash: sha256.New, mac: sha256.New},
+	0xc009: {keyLen: 16, macLen: 20, hash: sha256.New, mac: sha1.New},
+	0xc00a: {keyLen: 32, macLen: 20, hash: sha256.New, mac: sha1.New},
+	0xc013: {keyLen: 16, macLen: 20, hash: sha256.New, mac: sha1.New},
+	0xc014: {keyLen: 32, macLen: 20, hash: sha256.New, mac: sha1.New},
+	0xc023: {keyLen: 16, macLen: 32, hash: sha256.New, mac: sha256.New},
+	0xc024: {keyLen: 32, macLen: 48, hash: sha512.New384, mac: sha512.New384},
+	0xc027: {keyLen: 16, macLen: 32, hash: sha256.New, mac: sha256.New},
+	0xc028: {keyLen: 32, macLen: 48, hash: sha512.New384, mac: sha512.New384},
+	// TLS 1.3
+	0x1301: {keyLen: 16, ivLen: 12, hash: sha256.New, aead: aesGCM},
+	0x1302: {keyLen: 32, ivLen: 12, hash: sha512.New384, aead: aesGCM},
+	0x1303: {keyLen: 32, ivLen: 12, hash: sha256.New, aead: chacha20poly1305.New},
+}
+
+// tlsRecordCipher decrypts records of one direction of a connection
+type tlsRecordCipher struct {
+	tls13 bool
+	seq   uint64
+
+	aead cipher.AEAD
+	iv   []byte
+
+	block  cipher.Block // CBC suites
+	macLen int
+	etm    bool // encrypt-then-mac extension is negotiated
+}
+
+// prf12 is TLS 1.2 pseudorandom function, RFC 5246 section 5
+func prf12(h func() hash.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	seed = append([]byte(label), seed...)
+	mac := hmac.New(h, secret)
+	mac.Write(seed)
+	a := mac.Sum(nil)
+
+	var out []byte
+	for len(out) < length {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+	return out[:length]
+}
+
+// newTLS12Ciphers derives client and server record ciphers from the master secret
+func newTLS12Ciphers(suite *tlsCipherSuite, masterSecret, clientRandom, serverRandom []byte, etm bool) (client, server *tlsRecordCipher, err error) {
+	seed := append(append([]byte(nil), serverRandom...), clientRandom...)
+	n := 2*suite.macLen + 2*suite.keyLen + 2*suite.ivLen
+	keyBlock := prf12(suite.hash, masterSecret, "key expansion", seed, n)
+
+	// client and server MAC keys are not needed, HMAC is not verified
+	keyBlock = keyBlock[2*suite.macLen:]
+	clientKey, serverKey := keyBlock[:suite.keyLen], keyBlock[suite.keyLen:2*suite.keyLen]
+	keyBlock = keyBlock[2*suite.keyLen:]
+	clientIV, serverIV := keyBlock[:suite.ivLen], keyBlock[suite.ivLen:]
+
+	if client, err = newTLS12Cipher(suite, clientKey, clientIV, etm); err != nil {
+		return
+	}
+	server, err = newTLS12Cipher(suite, serverKey, serverIV, etm)
+	return
+}
+
+func newTLS12Cipher(suite *tlsCipherSuite, key, iv []byte, etm bool) (c *tlsRecordCipher, err error) {
+	c = &tlsRecordCipher{iv: iv, macLen: suite.macLen, etm: etm}
+	if suite.aead != nil {
+		c.aead, err = suite.aead(key)
+	} else {
+		c.block, err = aes.NewCipher(key)
+	}
+	return
+}
+
+// hkdfExpandLabel is TLS 1.3 HKDF-Expand-Label function with empty context, RFC 8446 section 7.1
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = append(info, byte(length>>8), byte(length), byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+
+	out := make([]byte, length)
+	hkdf.Expand(h, secret, info).Read(out)
+	return out
+}
+
+// newTLS13Cipher derives record cipher from the traffic secret
+func newTLS13Cipher(suite *tlsCipherSuite, secret []byte) (*tlsRecordCipher, error) {
+	aead, err := suite.aead(hkdfExpandLabel(suite.hash, secret, "key", suite.keyLen))
+	if err != nil {
+		return nil, err
+	}
+	return &tlsRecordCipher{tls13: true, aead: aead, iv: hkdfExpandLabel(suite.hash, secret, "iv", suite.ivLen)}, nil
+}
+
+// nextTLS13Secret derives the traffic secret which is used after KeyUpdate message
+func nextTLS13Secret(suite *tlsCipherSuite, secret []byte) []byte {
+	return hkdfExpandLabel(suite.hash, secret, "traffic upd", suite.hash().Size())
+}
+
+// decrypt returns content type and plaintext of the record, header is 5 bytes record header.
+// Sequence number is incremented only when the record is decrypted.
+func (c *tlsRecordCipher) decrypt(header, payload []byte) (contentType byte, plaintext []byte, err error) {
+	contentType = header[0]
+	switch {
+	case c.tls13:
+		plaintext, err = c.aead.Open(nil, c.nonce(nil), payload, header)
+		if err != nil {
+			return 0, nil, errTLSDecrypt
+		}
+		// TLSInnerPlaintext is content, content type and zero padding
+		i := len(plaintext) - 1
+		for i >= 0 && plaintext[i] == 0 {
+			i--
+		}
+		if i < 0 {
+			return 0, nil, errTLSDecrypt
+		}
+		contentType, plaintext = plaintext[i], plaintext[:i]
+	case c.aead != nil:
+		var nonce []byte
+		if len(c.iv) == 12 {
+			nonce = c.nonce(nil)
+		} else {
+			explicit := 8
+			if len(payload) < explicit {
+				return 0, nil, errTLSDecrypt
+			}
+			nonce = append(append([]byte(nil), c.iv...), payload[:explicit]...)
+			payload = payload[explicit:]
+		}
+		if len(payload) < c.aead.Overhead() {
+			return 0, nil, errTLSDecrypt
+		}
+		plaintext, err = c.aead.Open(nil, nonce, payload, c.additionalData(header, len(payload)-c.aead.Overhead()))
+		if err != nil {
+			return 0, nil, errTLSDecrypt
+		}
+	default:
+		if plaintext, err = c.decryptCBC(payload); err != nil {
+			return 0, nil, err
+		}
+	}
+	c.seq++
+	return
+}
+
+// nonce is the IV xor-ed with the sequence number, as in TLS 1.3 and ChaCha20-Poly1305 suites of TLS 1.2
+func (c *tlsRecordCipher) nonce(dst []byte) []byte {
+	dst = append(dst, c.iv...)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], c.seq)
+	for i, b := range seq {
+		dst[len(dst)-8+i] ^= b
+	}
+	return dst
+}
+
+// additionalData is TLS 1.2 AEAD additional data of the record with plaintext length n
+func (c *tlsRecordCipher) additionalData(header []byte, n int) []byte {
+	ad := make([]byte, 13)
+	binary.BigEndian.PutUint64(ad, c.seq)
+	copy(ad[8:11], header[:3])
+	binary.BigEndian.PutUint16(ad[11:], uint16(n))
+	return ad
+}
+
+// decryptCBC decrypts TLS 1.2 CBC record, record begins with explicit IV
+func (c *tlsRecordCipher) decryptCBC(payload []byte) ([]byte, error) {
+	if c.etm {
+		if len(payload) < c.macLen {
+			return nil, errTLSDecrypt
+		}
+		payload = payload[:len(payload)-c.macLen]
+	}
+	size := c.block.BlockSize()
+	if len(payload) < 2*size || len(payload)%size != 0 {
+		return nil, errTLSDecrypt
+	}
+	plaintext := make([]byte, len(payload)-size)
+	cipher.NewCBCDecrypter(c.block, payload[:size]).CryptBlocks(plaintext, payload[size:])
+
+	padding := int(plaintext[len(plaintext)-1]) + 1
+	if !c.etm {
+		padding += c.macLen
+	}
+	if padding > len(plaintext) {
+		return nil, errTLSDecrypt
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
@@ -0,0 +1,114 @@
+package tcp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// key log labels, see https://developer.mozilla.org/en-US/docs/Mozilla/Projects/NSS/Key_Log_Format
+const (
+	keyLogClientRandom             = "CLIENT_RANDOM"
+	keyLogClientHandshakeSecret    = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogServerHandshakeSecret    = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogClientApplicationSecret0 = "CLIENT_TRAFFIC_SECRET_0"
+	keyLogServerApplicationSecret0 = "SERVER_TRAFFIC_SECRET_0"
+)
+
+// the key log file is checked for new lines at most this often
+const keyLogReloadInterval = 10 * time.Millisecond
+
+// TLSKeyLog holds TLS secrets from NSS key log file, the file written by clients and servers
+// when SSLKEYLOGFILE environment variable is set. When a secret is missing, lines appended
+// to the file since the last read are loaded, so the file can be written while capturing.
+type TLSKeyLog struct {
+	sync.Mutex
+	path    string
+	offset  int64
+	partial []byte    // last line which is not terminated yet
+	checked time.Time // last time the file was read
+	secrets map[string][]byte
+}
+
+// NewTLSKeyLog reads key log file at the path
+func NewTLSKeyLog(path string) (*TLSKeyLog, error) {
+	k := &TLSKeyLog{path: path, secrets: make(map[string][]byte)}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Secret returns the secret with the label for the session with the client random,
+// or nil if the key log has no such secret
+func (k *TLSKeyLog) Secret(label string, clientRandom []byte) []byte {
+	k.Lock()
+	defer k.Unlock()
+	key := label + string(clientRandom)
+	if secret, ok := k.secrets[key]; ok {
+		return secret
+	}
+	if time.Since(k.checked) < keyLogReloadInterval {
+		return nil
+	}
+	k.load()
+	return k.secrets[key]
+}
+
+// load reads lines appended since the last read, the file is read from the start if it was truncated
+func (k *TLSKeyLog) load() error {
+	k.checked = time.Now()
+	f, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < k.offset {
+		k.offset, k.partial = 0, nil
+	}
+	if info.Size() == k.offset {
+		return nil
+	}
+	if _, err = f.Seek(k.offset, io.SeekStart); err != nil {
+		return err
+	}
+	data := make([]byte, info.Size()-k.offset)
+	n, err := io.ReadFull(f, data)
+	k.offset += int64(n)
+	data = append(k.partial, data[:n]...)
+
+	end := bytes.LastIndexByte(data, '\n')
+	k.partial = append([]byte(nil), data[end+1:]...)
+	for _, line := range bytes.Split(data[:end+1], []byte("\n")) {
+		k.parseLine(line)
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return err
+}
+
+// parseLine parses "<label> <client random> <secret>" line, comments and unknown labels are skipped
+func (k *TLSKeyLog) parseLine(line []byte) {
+	fields := bytes.Fields(line)
+	if len(fields) != 3 || fields[0][0] == '#' {
+		return
+	}
+	clientRandom := make([]byte, hex.DecodedLen(len(fields[1])))
+	if _, err := hex.Decode(clientRandom, fields[1]); err != nil || len(clientRandom) != 32 {
+		return
+	}
+	secret := make([]byte, hex.DecodedLen(len(fields[2])))
+	if _, err := hex.Decode(secret, fields[2]); err != nil {
+		return
+	}
+	k.secrets[string(fields[0])+string(clientRandom)] = secret
+}
@@ -0,0 +1,240 @@
+package tcp
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// recordedConn records data written to the connection
+type recordedConn struct {
+	net.Conn
+	client  bool
+	mu      *sync.Mutex
+	records *[]tlsTestSegment
+}
+
+type tlsTestSegment struct {
+	client bool
+	data   []byte
+}
+
+func (c *recordedConn) Write(data []byte) (int, error) {
+	c.mu.Lock()
+	*c.records = append(*c.records, tlsTestSegment{c.client, append([]byte(nil), data...)})
+	c.mu.Unlock()
+	return c.Conn.Write(data)
+}
+
+func tlsTestCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// tlsSession runs HTTP exchanges over TLS and returns recorded segments and the key log
+func tlsSession(t *testing.T, config *tls.Config, requests int) ([]tlsTestSegment, []byte) {
+	var mu sync.Mutex
+	var segments []tlsTestSegment
+	var keyLog bytes.Buffer
+
+	c, s := net.Pipe()
+	config.Certificates = []tls.Certificate{tlsTestCertificate(t)}
+	config.InsecureSkipVerify = true
+	config.KeyLogWriter = &keyLog
+	server := tls.Server(&recordedConn{s, false, &mu, &segments}, config)
+	client := tls.Client(&recordedConn{c, true, &mu, &segments}, config)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 1024)
+		for i := 0; i < requests; i++ {
+			if _, err := server.Read(buf); err != nil {
+				return
+			}
+			server.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+		}
+	}()
+	response := make([]byte, 40)
+	for i := 0; i < requests; i++ {
+		if _, err := client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(client, response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	// closing the pipe instead of TLS connections does not wait for close_notify alerts
+	c.Close()
+	s.Close()
+	return segments, keyLog.Bytes()
+}
+
+// tlsTestPackets splits segments into packets of at most 500 bytes
+func tlsTestPackets(segments []tlsTestSegment) (packets []*Packet) {
+	clientSeq, serverSeq := uint32(1000), uint32(5000)
+	for _, segment := range segments {
+		for data := segment.data; len(data) > 0; {
+			n := len(data)
+			if n > 500 {
+				n = 500
+			}
+			pckt := &Packet{Timestamp: time.Now(), Payload: data[:n]}
+			if segment.client {
+				pckt.SrcIP, pckt.DstIP, pckt.SrcPort, pckt.DstPort = net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}, 60000, 443
+				pckt.Seq, pckt.Ack = clientSeq, serverSeq
+				clientSeq += uint32(n)
+			} else {
+				pckt.SrcIP, pckt.DstIP, pckt.SrcPort, pckt.DstPort = net.IP{10, 0, 0, 2}, net.IP{10, 0, 0, 1}, 443, 60000
+				pckt.Seq, pckt.Ack = serverSeq, clientSeq
+				serverSeq += uint32(n)
+			}
+			packets = append(packets, pckt)
+			data = data[n:]
+		}
+	}
+	return
+}
+
+func tlsTestKeyLog(t *testing.T, data []byte) (*TLSKeyLog, string) {
+	f, err := ioutil.TempFile("", "keylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(data)
+	f.Close()
+	keyLog, err := NewTLSKeyLog(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyLog, f.Name()
+}
+
+func TestTLSDecryptor(t *testing.T) {
+	configs := map[string]*tls.Config{
+		"TLS 1.3":                {MinVersion: tls.VersionTLS13},
+		"TLS 1.2 AES-128-GCM":    {MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}},
+		"TLS 1.2 AES-256-GCM":    {MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}},
+		"TLS 1.2 ChaCha20":       {MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305}},
+		"TLS 1.2 AES-128-CBC":    {MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA}},
+		"TLS 1.2 AES-128-SHA256": {MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256}},
+	}
+	for name, config := range configs {
+		segments, keys := tlsSession(t, config, 2)
+		keyLog, path := tlsTestKeyLog(t, keys)
+		defer os.Remove(path)
+
+		d := NewTLSDecryptor(keyLog)
+		var client, server []byte
+		var lastAck uint32
+		for _, pckt := range tlsTestPackets(segments) {
+			for _, decrypted := range d.Decrypt(pckt) {
+				if decrypted.SrcPort == 60000 {
+					client = append(client, decrypted.Payload...)
+					lastAck = decrypted.Ack
+				} else {
+					if len(server) == 0 && decrypted.Seq != lastAck {
+						t.Errorf("%s: response seq %d does not match request ack %d", name, decrypted.Seq, lastAck)
+					}
+					server = append(server, decrypted.Payload...)
+				}
+			}
+		}
+		if string(client) != "GET / HTTP/1.1\r\nHost: localhost\r\n\r\nGET / HTTP/1.1\r\nHost: localhost\r\n\r\n" {
+			t.Errorf("%s: wrong decrypted requests %q", name, client)
+		}
+		if string(server) != "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nokHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok" {
+			t.Errorf("%s: wrong decrypted responses %q", name, server)
+		}
+	}
+}
+
+func TestTLSDecryptorKeyLogAppended(t *testing.T) {
+	segments, keys := tlsSession(t, &tls.Config{}, 1)
+	keyLog, path := tlsTestKeyLog(t, nil)
+	defer os.Remove(path)
+
+	packets := tlsTestPackets(segments)
+	// the last packet is the response
+	d := NewTLSDecryptor(keyLog)
+	for _, pckt := range packets[:len(packets)-1] {
+		if decrypted := d.Decrypt(pckt); len(decrypted) != 0 {
+			t.Fatalf("nothing should be decrypted without keys: %q", decrypted[0].Payload)
+		}
+	}
+
+	ioutil.WriteFile(path, keys, 0600)
+	time.Sleep(2 * keyLogReloadInterval)
+	decrypted := d.Decrypt(packets[len(packets)-1])
+	if len(decrypted) != 2 {
+		t.Fatalf("expected request and response, got %d packets", len(decrypted))
+	}
+	if !proto.HasRequestTitle(decrypted[0].Payload) || !proto.HasResponseTitle(decrypted[1].Payload) {
+		t.Errorf("wrong decrypted packets %q %q", decrypted[0].Payload, decrypted[1].Payload)
+	}
+}
+
+func TestTLSDecryptorMessageParser(t *testing.T) {
+	segments, keys := tlsSession(t, &tls.Config{}, 1)
+	keyLog, path := tlsTestKeyLog(t, keys)
+	defer os.Remove(path)
+
+	parser := NewMessageParser(nil, nil, nil, time.Second, false)
+	parser.Start = func(pckt *Packet) (bool, bool) {
+		return proto.HasRequestTitle(pckt.Payload), proto.HasResponseTitle(pckt.Payload)
+	}
+	parser.End = func(m *Message) bool {
+		return proto.HasFullPayload(m, m.PacketData()...)
+	}
+	d := NewTLSDecryptor(keyLog)
+
+	plaintext := &Packet{SrcIP: net.IP{10, 0, 0, 3}, DstIP: net.IP{10, 0, 0, 2}, SrcPort: 60001, DstPort: 80, Seq: 1, Ack: 1,
+		Timestamp: time.Now(), Payload: []byte("GET /plain HTTP/1.1\r\n\r\n")}
+	for _, pckt := range append([]*Packet{plaintext}, tlsTestPackets(segments)...) {
+		for _, decrypted := range d.Decrypt(pckt) {
+			parser.processPacket(decrypted)
+		}
+	}
+
+	plain, request, response := parser.Read(), parser.Read(), parser.Read()
+	if !bytes.HasPrefix(plain.Data(), []byte("GET /plain")) {
+		t.Errorf("plaintext connection should be passed as is: %q", plain.Data())
+	}
+	if !bytes.HasPrefix(request.Data(), []byte("GET / HTTP/1.1")) || request.Direction != DirIncoming {
+		t.Errorf("wrong request %q", request.Data())
+	}
+	if !bytes.HasSuffix(response.Data(), []byte("\r\n\r\nok")) {
+		t.Errorf("wrong response %q", response.Data())
+	}
+	if !bytes.Equal(request.UUID(), response.UUID()) {
+		t.Errorf("request and response should have the same id: %s %s", request.UUID(), response.UUID())
+	}
+}
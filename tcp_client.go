@@ -16,6 +16,8 @@ type TCPClientConfig struct {
 	Timeout            time.Duration
 	ResponseBufferSize int
 	Secure             bool
+	// TLSConfig is used when Secure is set, by default server certificate is not verified
+	TLSConfig *tls.Config
 }
 
 // TCPClient client connection properties
@@ -51,11 +53,22 @@ func (c *TCPClient) Connect() (err error) {
 	c.Disconnect()
 
 	c.conn, err = net.DialTimeout("tcp", c.addr, c.config.ConnectionTimeout)
+	if err != nil {
+		return
+	}
 
 	if c.config.Secure {
-		tlsConn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+		config := c.config.TLSConfig
+		if config == nil {
+			config = &tls.Config{InsecureSkipVerify: true}
+		} else if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName, _, _ = net.SplitHostPort(c.addr)
+		}
+		tlsConn := tls.Client(c.conn, config)
 
 		if err = tlsConn.Handshake(); err != nil {
+			c.Disconnect()
 			return
 		}
 
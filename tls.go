@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// NewTLSConfig loads TLS certificates
+func NewTLSConfig(clientCertFile, clientKeyFile, caCertFile string) (*tls.Config, error) {
+	tlsConfig := tls.Config{}
+
+	if clientCertFile != "" && clientKeyFile == "" {
+		return &tlsConfig, errors.New("missing key of TLS client certificate")
+	}
+	if clientCertFile == "" && clientKeyFile != "" {
+		return &tlsConfig, errors.New("missing TLS client certificate")
+	}
+	// Load client cert
+	if (clientCertFile != "") && (clientKeyFile != "") {
+		cert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+		if err != nil {
+			return &tlsConfig, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	// Load CA cert
+	if caCertFile != "" {
+		caCertPool, err := loadCertPool(caCertFile)
+		if err != nil {
+			return &tlsConfig, err
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+	return &tlsConfig, nil
+}
+
+// newClientTLSConfig returns TLS config used by outputs to connect to servers,
+// minVersion is one of "1.0", "1.1", "1.2" or "1.3"
+func newClientTLSConfig(clientCertFile, clientKeyFile, caCertFile, serverName, minVersion string, skipVerify bool) (*tls.Config, error) {
+	tlsConfig, err := NewTLSConfig(clientCertFile, clientKeyFile, caCertFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.MinVersion, err = parseTLSVersion(minVersion)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ServerName = serverName
+	tlsConfig.InsecureSkipVerify = skipVerify
+	return tlsConfig, nil
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q, expected one of 1.0, 1.1, 1.2, 1.3", version)
+}
+
+func loadCertPool(caCertFile string) (*x509.CertPool, error) {
+	caCert, err := ioutil.ReadFile(caCertFile)
+	if err != nil {
+		return nil, err
+	}
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no PEM encoded certificates found in %q", caCertFile)
+	}
+	return caCertPool, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestNewClientTLSConfig(t *testing.T) {
+	dir, caFile, certFile, keyFile := writeTestCertificates(t)
+	defer os.RemoveAll(dir)
+
+	config, err := newClientTLSConfig(certFile, keyFile, caFile, "staging.local", "1.2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Certificates) != 1 || config.RootCAs == nil || config.ServerName != "staging.local" || config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("wrong TLS config: %+v", config)
+	}
+
+	if _, err = newClientTLSConfig(certFile, "", "", "", "", false); err == nil {
+		t.Error("certificate without key should fail")
+	}
+	if _, err = newClientTLSConfig("", "", "", "", "1.4", false); err == nil {
+		t.Error("unknown TLS version should fail")
+	}
+	if _, err = newClientTLSConfig("", "", keyFile, "", "", false); err == nil {
+		t.Error("CA file without certificates should fail")
+	}
+}
+
+func TestTCPClientClientCertificate(t *testing.T) {
+	dir, caFile, certFile, keyFile := writeTestCertificates(t)
+	defer os.RemoveAll(dir)
+
+	serverConfig, _ := NewTLSConfig(certFile, keyFile, "")
+	serverConfig.ClientCAs, _ = loadCertPool(caFile)
+	serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				n, _ := conn.Read(buf)
+				conn.Write(buf[:n])
+			}(conn)
+		}
+	}()
+
+	clientConfig, _ := newClientTLSConfig(certFile, keyFile, caFile, "", "1.2", false)
+	client := NewTCPClient(listener.Addr().String(), &TCPClientConfig{Secure: true, TLSConfig: clientConfig})
+	resp, err := client.Send([]byte("ping"))
+	if err != nil || string(resp) != "ping" {
+		t.Errorf("expected echo, got %q, %v", resp, err)
+	}
+	client.Disconnect()
+
+	clientConfig, _ = newClientTLSConfig("", "", "", "", "", false)
+	client = NewTCPClient(listener.Addr().String(), &TCPClientConfig{Secure: true, TLSConfig: clientConfig})
+	if err = client.Connect(); err == nil {
+		t.Error("server certificate signed by unknown CA should fail")
+	}
+}